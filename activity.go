@@ -0,0 +1,90 @@
+package boringproxy
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// How often in-memory activity times are written to the database.
+const activitySaveInterval = time.Minute
+
+// lastActivity returns the later of the in-memory and saved activity times
+// for the tunnel stored under key.
+func (m *TunnelManager) lastActivity(key string, tun Tunnel) time.Time {
+	last := m.conns.LastActivity(key)
+	if tun.LastActivity.After(last) {
+		return tun.LastActivity
+	}
+	return last
+}
+
+// LastActivity returns when the tunnel stored under key last proxied a
+// request or connection.
+func (m *TunnelManager) LastActivity(key string) (time.Time, error) {
+	tun, exists := m.db.GetTunnel(key)
+	if !exists {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	return m.lastActivity(key, tun), nil
+}
+
+// IdleTunnels returns the keys of tunnels with no activity for longer than
+// olderThan as of now, sorted. Tunnels created before activity was tracked
+// count from when this server started. Redirect tunnels are left out, since
+// they belong to their primary tunnel, as are tunnels with connections
+// open, ie WebSockets.
+func (m *TunnelManager) IdleTunnels(olderThan time.Duration, now time.Time) []string {
+	cutoff := now.Add(-olderThan)
+
+	idle := []string{}
+	for key, tun := range m.db.GetTunnels() {
+		if tun.RedirectTo != "" || m.conns.Stats(key).ActiveConnections > 0 {
+			continue
+		}
+
+		last := m.lastActivity(key, tun)
+		if last.IsZero() {
+			last = m.started
+		}
+
+		if last.Before(cutoff) {
+			idle = append(idle, key)
+		}
+	}
+
+	sort.Strings(idle)
+
+	return idle
+}
+
+// saveActivity writes activity times to the database every interval, and
+// once more when ctx is done, so a restart doesn't reset them.
+func (m *TunnelManager) saveActivity(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			m.flushActivity()
+			return
+		case <-time.After(interval):
+			m.flushActivity()
+		}
+	}
+}
+
+func (m *TunnelManager) flushActivity() {
+	activity := make(map[string]time.Time)
+
+	for key, tun := range m.db.GetTunnels() {
+		last := m.conns.LastActivity(key)
+		if last.After(tun.LastActivity) {
+			activity[key] = last
+		}
+	}
+
+	if len(activity) > 0 {
+		m.db.SetTunnelActivity(activity)
+	}
+}
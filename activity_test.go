@@ -0,0 +1,130 @@
+package boringproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// startTlsEchoBackend starts a TLS server for domain that echoes whatever it
+// reads, and returns its port.
+func startTlsEchoBackend(t *testing.T, domain string) int {
+	t.Helper()
+
+	certPem, keyPem, err := makeSelfSignedCert(domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestTrafficUpdatesLastActivity(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	backendPort := startTlsEchoBackend(t, "app.example.com")
+
+	longAgo := time.Now().Add(-24 * time.Hour).Truncate(time.Second)
+	m.db.SetTunnel("app.example.com", Tunnel{
+		Domain:         "app.example.com",
+		TunnelPort:     backendPort,
+		TlsTermination: "passthrough",
+		LastActivity:   longAgo,
+	})
+
+	p := &Server{db: m.db, tunMan: m}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go p.handleConnection(conn)
+		}
+	}()
+
+	last, err := m.LastActivity("app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !last.Equal(longAgo) {
+		t.Fatalf("Expected the saved activity time before any traffic, got %v", last)
+	}
+
+	before := time.Now()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		ServerName:         "app.example.com",
+		InsecureSkipVerify: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = conn.Write([]byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("Expected the backend to echo, got %q", buf)
+	}
+	conn.Close()
+
+	last, err = m.LastActivity("app.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last.Before(before) {
+		t.Errorf("Expected activity at or after %v, got %v", before, last)
+	}
+
+	m.flushActivity()
+
+	tun, _ := m.db.GetTunnel("app.example.com")
+	if tun.LastActivity.Before(before) {
+		t.Errorf("Expected the activity time to be saved, got %v", tun.LastActivity)
+	}
+
+	if idle := m.IdleTunnels(time.Hour, time.Now()); len(idle) != 0 {
+		t.Errorf("Expected no idle tunnels after traffic, got %v", idle)
+	}
+}
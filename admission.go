@@ -0,0 +1,106 @@
+package boringproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How long to wait for the admission webhook to answer.
+const admissionTimeout = 10 * time.Second
+
+// AdmissionRequest is POSTed as JSON to config.AdmissionWebhook before a
+// tunnel is created.
+type AdmissionRequest struct {
+	Domain     string `json:"domain"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	Owner      string `json:"owner"`
+}
+
+// AdmissionResponse is the webhook's answer. The tunnel is only created if
+// the status code is 200 and Allow is true. Message is passed on to the
+// user when the tunnel is denied.
+type AdmissionResponse struct {
+	Allow   bool   `json:"allow"`
+	Message string `json:"message,omitempty"`
+}
+
+// admitTunnel asks the admission webhook, if there is one, whether tunReq may
+// be created. If the webhook can't be reached or answers with a server error,
+// creation is denied unless config.AdmissionFailOpen is set.
+func (m *TunnelManager) admitTunnel(ctx context.Context, tunReq Tunnel) error {
+	if m.config.AdmissionWebhook == "" {
+		return nil
+	}
+
+	admission, err := postAdmissionRequest(ctx, m.config.AdmissionWebhook, AdmissionRequest{
+		Domain:     tunReq.Domain,
+		PathPrefix: tunReq.PathPrefix,
+		Owner:      tunReq.Owner,
+	})
+	if err != nil {
+		if m.config.AdmissionFailOpen {
+			log.Printf("Admission webhook failed for %s, allowing: %v", tunReq.Domain, err)
+			return nil
+		}
+
+		log.Printf("Admission webhook failed for %s, denying: %v", tunReq.Domain, err)
+		return fmt.Errorf("%w: admission webhook failed", ErrAdmissionDenied)
+	}
+
+	if !admission.Allow {
+		if admission.Message != "" {
+			return fmt.Errorf("%w: %s", ErrAdmissionDenied, admission.Message)
+		}
+		return ErrAdmissionDenied
+	}
+
+	return nil
+}
+
+// postAdmissionRequest sends admissionReq to url. An error is only returned
+// if no decision could be made. Client errors (4xx) count as a denial.
+func postAdmissionRequest(ctx context.Context, url string, admissionReq AdmissionRequest) (AdmissionResponse, error) {
+	body, err := json.Marshal(admissionReq)
+	if err != nil {
+		return AdmissionResponse{}, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, admissionTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return AdmissionResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return AdmissionResponse{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 500 {
+		return AdmissionResponse{}, fmt.Errorf("HTTP status code %d", resp.StatusCode)
+	}
+
+	var admission AdmissionResponse
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&admission)
+
+	if resp.StatusCode != 200 {
+		// Only the message is used from a non-200 answer
+		return AdmissionResponse{Message: admission.Message}, nil
+	}
+
+	if err != nil {
+		return AdmissionResponse{}, fmt.Errorf("Invalid response: %v", err)
+	}
+
+	return admission, nil
+}
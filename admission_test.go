@@ -0,0 +1,109 @@
+package boringproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAdmissionWebhook(t *testing.T) {
+	requests := make(chan AdmissionRequest, 10)
+
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var admissionReq AdmissionRequest
+		json.NewDecoder(r.Body).Decode(&admissionReq)
+		requests <- admissionReq
+
+		switch admissionReq.Domain {
+		case "allowed.example.com":
+			json.NewEncoder(w).Encode(AdmissionResponse{Allow: true})
+		case "denied.example.com":
+			json.NewEncoder(w).Encode(AdmissionResponse{Allow: false, Message: "Not your domain"})
+		case "forbidden.example.com":
+			w.WriteHeader(403)
+			json.NewEncoder(w).Encode(AdmissionResponse{Message: "Quota exceeded"})
+		default:
+			w.WriteHeader(500)
+		}
+	}))
+	defer webhook.Close()
+
+	m := newTestTunnelManager(t)
+	m.config.AdmissionWebhook = webhook.URL
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(domain string) error {
+		_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+			Domain:         domain,
+			Owner:          "admin",
+			TlsTermination: "client",
+		})
+		return err
+	}
+
+	err = create("allowed.example.com")
+	if err != nil {
+		t.Fatalf("Expected the tunnel to be admitted: %v", err)
+	}
+	if req := <-requests; req.Domain != "allowed.example.com" || req.Owner != "admin" {
+		t.Errorf("Unexpected admission request %+v", req)
+	}
+	if _, exists := m.db.GetTunnel("allowed.example.com"); !exists {
+		t.Error("Expected the admitted tunnel to be created")
+	}
+
+	cases := []struct {
+		domain  string
+		message string
+	}{
+		{"denied.example.com", "Not your domain"},
+		{"forbidden.example.com", "Quota exceeded"},
+		{"broken.example.com", "admission webhook failed"},
+	}
+
+	for _, c := range cases {
+		err := create(c.domain)
+		<-requests
+
+		if !errors.Is(err, ErrAdmissionDenied) || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: Expected a denial with %q, got %v", c.domain, c.message, err)
+		}
+		if _, exists := m.db.GetTunnel(c.domain); exists {
+			t.Errorf("%s: Expected the tunnel not to be created", c.domain)
+		}
+	}
+
+	// Webhook errors let tunnels through with -admission-fail-open, but
+	// denials still apply
+	m.config.AdmissionFailOpen = true
+
+	err = create("broken.example.com")
+	<-requests
+	if err != nil {
+		t.Errorf("Expected fail open to allow the tunnel, got %v", err)
+	}
+
+	err = create("denied.example.com")
+	<-requests
+	if !errors.Is(err, ErrAdmissionDenied) {
+		t.Errorf("Expected an explicit denial to apply with fail open, got %v", err)
+	}
+
+	m.config.AdmissionFailOpen = false
+	webhook.Close()
+
+	err = create("unreachable.example.com")
+	if !errors.Is(err, ErrAdmissionDenied) {
+		t.Errorf("Expected an unreachable webhook to deny, got %v", err)
+	}
+}
@@ -1,14 +1,22 @@
 package boringproxy
 
 import (
+	"context"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/json"
+	"encoding/pem"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
+	"log"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type Api struct {
@@ -26,9 +34,20 @@ func NewApi(config *Config, db *Database, auth *Auth, tunMan *TunnelManager) *Ap
 	api := &Api{config, db, auth, tunMan, mux}
 
 	mux.Handle("/tunnels", http.StripPrefix("/tunnels", http.HandlerFunc(api.handleTunnels)))
+	mux.Handle("/tunnels/", http.StripPrefix("/tunnels/", http.HandlerFunc(api.handleTunnel)))
 	mux.Handle("/users/", http.StripPrefix("/users", http.HandlerFunc(api.handleUsers)))
 	mux.Handle("/tokens/", http.StripPrefix("/tokens", http.HandlerFunc(api.handleTokens)))
 	mux.Handle("/clients/", http.StripPrefix("/clients", http.HandlerFunc(api.handleClients)))
+	mux.Handle("/join-tokens", http.HandlerFunc(api.handleJoinTokens))
+	mux.Handle("/join", http.HandlerFunc(api.handleJoin))
+	mux.Handle("/enrollment-codes", http.HandlerFunc(api.handleEnrollmentCodes))
+	mux.Handle("/enroll", http.HandlerFunc(api.handleEnroll))
+	mux.Handle("/connection", http.HandlerFunc(api.handleConnectionDescriptor))
+	mux.Handle("/reload", http.HandlerFunc(api.handleReload))
+	mux.Handle("/prewarm-cert", http.HandlerFunc(api.handlePrewarmCert))
+	mux.Handle("/rotate-key", http.HandlerFunc(api.handleRotateKey))
+	mux.Handle("/verify-domain", http.HandlerFunc(api.handleVerifyDomain))
+	mux.Handle("/status", http.HandlerFunc(api.handleStatus))
 
 	return api
 }
@@ -109,10 +128,21 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 		}
 
 		r.ParseForm()
-		_, err := a.CreateTunnel(tokenData, r.Form)
+
+		var tunnel *Tunnel
+		if r.Form.Get("label") != "" {
+			tunnel, err = a.CreateTunnelForClient(r.Context(), tokenData, r.Form)
+		} else {
+			tunnel, err = a.CreateTunnel(r.Context(), tokenData, r.Form)
+		}
+
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(tunnelErrorStatus(err))
 			w.Write([]byte(err.Error()))
+		} else {
+			// Label requests need to be told which domain they got,
+			// and the CLI prints what was created
+			json.NewEncoder(w).Encode(tunnel)
 		}
 	case "DELETE":
 		if tokenData.Client != "" {
@@ -122,17 +152,99 @@ func (a *Api) handleTunnels(w http.ResponseWriter, r *http.Request) {
 		}
 
 		r.ParseForm()
-		err := a.DeleteTunnel(tokenData, r.Form)
+		err := a.DeleteTunnel(r.Context(), tokenData, r.Form)
 		if err != nil {
-			w.WriteHeader(500)
+			w.WriteHeader(tunnelErrorStatus(err))
 			w.Write([]byte(err.Error()))
 		}
+	case "PATCH":
+		r.ParseForm()
+		a.patchTunnel(w, r, tokenData)
 	default:
 		w.WriteHeader(405)
 		w.Write([]byte("Invalid method for /tunnels"))
 	}
 }
 
+// handleTunnel handles /tunnels/{domain}, where the domain can include the
+// tunnel's path prefix.
+func (a *Api) handleTunnel(w http.ResponseWriter, r *http.Request) {
+
+	token, err := extractToken("access_token", r)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "No token provided")
+		return
+	}
+
+	tokenData, exists := a.db.GetTokenData(token)
+	if !exists {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return
+	}
+
+	key := r.URL.Path
+	if key == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid domain")
+		return
+	}
+
+	switch r.Method {
+	case "PATCH":
+		r.ParseForm()
+		r.Form.Set("domain", key)
+		r.Form.Del("path-prefix")
+		a.patchTunnel(w, r, tokenData)
+	default:
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /tunnels/{domain}")
+	}
+}
+
+// patchTunnel updates the tunnel identified by the already parsed form and
+// writes it back as JSON. The changes are either form parameters or, if the
+// content type is application/json, a partial tunnel object in the body.
+func (a *Api) patchTunnel(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
+	if tokenData.Client != "" {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token cannot be used to modify tunnels")
+		return
+	}
+
+	params := r.Form
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		var err error
+		params, err = tunnelPatchParams(r.Body)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		params.Set("domain", r.Form.Get("domain"))
+		params.Set("path-prefix", r.Form.Get("path-prefix"))
+	} else {
+		err := checkTunnelPatchForm(params)
+		if err != nil {
+			w.WriteHeader(400)
+			io.WriteString(w, err.Error())
+			return
+		}
+	}
+
+	tunnel, err := a.UpdateTunnel(tokenData, params)
+	if err != nil {
+		w.WriteHeader(tunnelErrorStatus(err))
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(tunnel)
+}
+
 func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
 	token, err := extractToken("access_token", r)
 	if err != nil {
@@ -150,12 +262,18 @@ func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
 
 	r.ParseForm()
 
-	if tokenData.Client != "" {
+	if tokenData.Client != "" || len(tokenData.Domains) > 0 {
 		w.WriteHeader(403)
 		io.WriteString(w, "Token cannot be used to manage users")
 		return
 	}
 
+	if r.Method != "GET" && !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, ErrReadOnly.Error())
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		users := a.GetUsers(tokenData, r.Form)
@@ -167,6 +285,13 @@ func (a *Api) handleUsers(w http.ResponseWriter, r *http.Request) {
 			io.WriteString(w, err.Error())
 			return
 		}
+	case "PUT":
+		err := a.UpdateUser(tokenData, r.Form)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
 	default:
 		w.WriteHeader(405)
 		io.WriteString(w, "Invalid method for /users")
@@ -189,12 +314,19 @@ func (a *Api) handleTokens(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if tokenData.Client != "" {
+	if tokenData.Client != "" || len(tokenData.Domains) > 0 {
 		w.WriteHeader(403)
 		io.WriteString(w, "Token cannot be used to manage tokens")
 		return
 	}
 
+	// Tokens are credentials, so observers can't list them either.
+	if !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, ErrReadOnly.Error())
+		return
+	}
+
 	switch r.Method {
 	case "GET":
 		tokens := a.GetTokens(tokenData, r.Form)
@@ -225,230 +357,1484 @@ func (a *Api) handleClients(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenData, exists := a.db.GetTokenData(token)
-	if !exists {
-		w.WriteHeader(403)
-		w.Write([]byte("Not authorized"))
-		return
+	tokenData, exists := a.db.GetTokenData(token)
+	if !exists {
+		w.WriteHeader(403)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+
+	clientName := r.Form.Get("client-name")
+	if clientName == "" {
+		if tokenData.Client == "" {
+			w.WriteHeader(400)
+			w.Write([]byte("Missing client-name parameter"))
+			return
+		} else {
+			clientName = tokenData.Client
+		}
+	}
+
+	if (tokenData.Client != "" && tokenData.Client != clientName) || len(tokenData.Domains) > 0 || !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token does not have proper permissions")
+		return
+	}
+
+	user := r.Form.Get("user")
+	if user == "" {
+		user = tokenData.Owner
+	}
+
+	switch r.Method {
+	case "POST":
+		err := a.SetClient(tokenData, r.Form, user, clientName)
+		if err != nil {
+			w.WriteHeader(500)
+			w.Write([]byte(err.Error()))
+		}
+	case "DELETE":
+		err := a.DeleteClient(tokenData, user, clientName)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+	default:
+		w.WriteHeader(405)
+		fmt.Fprintf(w, "Invalid method for /api/clients")
+	}
+}
+
+func (a *Api) handleJoinTokens(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	token, err := extractToken("access_token", r)
+	if err != nil {
+		w.WriteHeader(401)
+		w.Write([]byte("No token provided"))
+		return
+	}
+
+	tokenData, exists := a.db.GetTokenData(token)
+	if !exists {
+		w.WriteHeader(403)
+		w.Write([]byte("Not authorized"))
+		return
+	}
+
+	if tokenData.Client != "" || !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token cannot be used to create join tokens")
+		return
+	}
+
+	switch r.Method {
+	case "POST":
+		joinToken, err := a.CreateClientJoinToken(tokenData, r.Form)
+		if err != nil {
+			w.WriteHeader(500)
+			io.WriteString(w, err.Error())
+			return
+		}
+
+		io.WriteString(w, joinToken)
+	default:
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/join-tokens")
+	}
+}
+
+// handleReload reloads the tunnels from the database on disk, same as
+// sending SIGUSR1. Only admin tokens are accepted.
+func (a *Api) handleReload(w http.ResponseWriter, r *http.Request) {
+
+	_, ok := a.requireAdminToken(w, r, true)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/reload")
+		return
+	}
+
+	err := a.tunMan.ReloadTunnels()
+	if errors.Is(err, ErrPendingWrites) {
+		w.WriteHeader(409)
+		io.WriteString(w, err.Error())
+		return
+	} else if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+// handlePrewarmCert obtains a cert for the domain parameter without creating
+// a tunnel. Only admin tokens are accepted, since it costs an ACME order.
+func (a *Api) handlePrewarmCert(w http.ResponseWriter, r *http.Request) {
+
+	tokenData, ok := a.requireAdminToken(w, r, true)
+	if !ok {
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/prewarm-cert")
+		return
+	}
+
+	r.ParseForm()
+
+	domain := r.Form.Get("domain")
+	if domain == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid domain parameter")
+		return
+	}
+
+	owner := r.Form.Get("owner")
+	if owner == "" {
+		owner = tokenData.Owner
+	}
+
+	err := a.tunMan.PrewarmCert(r.Context(), domain, owner)
+	if err != nil {
+		w.WriteHeader(tunnelErrorStatus(err))
+		io.WriteString(w, err.Error())
+		return
+	}
+}
+
+// handleRotateKey replaces the private key of the tunnel given by the domain
+// and path-prefix parameters, and returns the updated tunnel.
+func (a *Api) handleRotateKey(w http.ResponseWriter, r *http.Request) {
+
+	tokenData, ok := a.requireToken(w, r)
+	if !ok {
+		return
+	}
+
+	if tokenData.Client != "" {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token cannot be used to modify tunnels")
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/rotate-key")
+		return
+	}
+
+	r.ParseForm()
+
+	tunnel, err := a.RotateTunnelKey(tokenData, r.Form)
+	if err != nil {
+		w.WriteHeader(tunnelErrorStatus(err))
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	json.NewEncoder(w).Encode(tunnel)
+}
+
+// handleVerifyDomain checks that the domain parameter points at this server
+// using an HTTP verification token, ie before adding DNS records for a
+// tunnel is considered done.
+func (a *Api) handleVerifyDomain(w http.ResponseWriter, r *http.Request) {
+
+	tokenData, ok := a.requireToken(w, r)
+	if !ok {
+		return
+	}
+
+	if !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/verify-domain")
+		return
+	}
+
+	r.ParseForm()
+
+	domain := r.Form.Get("domain")
+	if domain == "" || strings.ContainsAny(domain, "/:@?#") {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid domain parameter")
+		return
+	}
+
+	if !tokenData.AllowsDomain(domain) {
+		w.WriteHeader(403)
+		io.WriteString(w, ErrTokenScope.Error())
+		return
+	}
+
+	err := a.tunMan.VerifyDomain(r.Context(), domain)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, fmt.Sprintf("Failed to verify %s: %v", domain, err))
+		return
+	}
+
+	io.WriteString(w, "Verified")
+}
+
+// handleJoin serves /api/join, where a join token is exchanged for the
+// ConnectionDescriptor of its tunnel, same as a POST to /api/connection.
+func (a *Api) handleJoin(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/join")
+		return
+	}
+
+	a.handleConnectionDescriptor(w, r)
+}
+
+func (a *Api) CreateClientJoinToken(tokenData TokenData, params url.Values) (string, error) {
+
+	if !tokenData.CanModify() {
+		return "", ErrReadOnly
+	}
+
+	tun, err := a.GetTunnel(tokenData, params)
+	if err != nil {
+		return "", err
+	}
+
+	ttl := 15 * time.Minute
+	ttlParam := params.Get("ttl")
+	if ttlParam != "" {
+		ttl, err = time.ParseDuration(ttlParam)
+		if err != nil {
+			return "", errors.New("Invalid ttl parameter")
+		}
+	}
+
+	maxTtl := 24 * time.Hour
+	if ttl > maxTtl {
+		return "", fmt.Errorf("ttl can't be more than %s", maxTtl)
+	}
+
+	return a.tunMan.CreateClientJoinToken(tunnelKey(tun), ttl)
+}
+
+// requireToken returns the data for the request's access token. If there's
+// no valid token, it writes an error response and returns false.
+func (a *Api) requireToken(w http.ResponseWriter, r *http.Request) (TokenData, bool) {
+	token, err := extractToken("access_token", r)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "No token provided")
+		return TokenData{}, false
+	}
+
+	tokenData, exists := a.db.GetTokenData(token)
+	if !exists {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return TokenData{}, false
+	}
+
+	return tokenData, true
+}
+
+// requireAdminToken is like requireToken, but also requires the token to
+// belong to an admin and not be limited to a client or specific domains, as
+// needed for server-wide endpoints. If write is set, read-only tokens are
+// refused too.
+func (a *Api) requireAdminToken(w http.ResponseWriter, r *http.Request, write bool) (TokenData, bool) {
+	tokenData, ok := a.requireToken(w, r)
+	if !ok {
+		return TokenData{}, false
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if !user.IsAdmin || tokenData.Client != "" || len(tokenData.Domains) > 0 || (write && !tokenData.CanModify()) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return TokenData{}, false
+	}
+
+	return tokenData, true
+}
+
+// tunnelKeyParam returns the key of the tunnel identified by the domain and
+// path-prefix parameters. The domain parameter can also be the full key.
+func tunnelKeyParam(params url.Values) string {
+	return params.Get("domain") + strings.TrimSuffix(params.Get("path-prefix"), "/")
+}
+
+func (a *Api) GetTunnel(tokenData TokenData, params url.Values) (Tunnel, error) {
+	if params.Get("domain") == "" {
+		return Tunnel{}, errors.New("Invalid domain parameter")
+	}
+
+	tun, exists := a.tunMan.GetTunnelDetails(tunnelKeyParam(params))
+	if !exists {
+		return Tunnel{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, tunnelKeyParam(params))
+	}
+
+	if !tokenData.AllowsDomain(tun.Domain) {
+		return Tunnel{}, fmt.Errorf("%w: %s", ErrTokenScope, tun.Domain)
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if user.IsAdmin || tun.Owner == tokenData.Owner {
+		if !tokenData.CanModify() {
+			tun = redactTunnel(tun)
+		}
+		return tun, nil
+	} else {
+		return Tunnel{}, errors.New("Unauthorized")
+	}
+}
+
+func (a *Api) GetTunnels(tokenData TokenData) map[string]Tunnel {
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+
+	var tunnels map[string]Tunnel
+
+	if user.IsAdmin {
+		tunnels = a.tunMan.GetTunnels()
+	} else {
+		tunnels = make(map[string]Tunnel)
+
+		for domain, tun := range a.tunMan.GetTunnels() {
+			if tokenData.Owner == tun.Owner {
+				tunnels[domain] = tun
+			}
+		}
+	}
+
+	if len(tokenData.Domains) > 0 {
+		scoped := make(map[string]Tunnel)
+		for key, tun := range tunnels {
+			if tokenData.AllowsDomain(tun.Domain) {
+				scoped[key] = tun
+			}
+		}
+		tunnels = scoped
+	}
+
+	if !tokenData.CanModify() {
+		for key, tun := range tunnels {
+			tunnels[key] = redactTunnel(tun)
+		}
+	}
+
+	return tunnels
+}
+
+// redactTunnel returns tun without its secrets, for tokens that can only
+// look at tunnels.
+func redactTunnel(tun Tunnel) Tunnel {
+	tun.TunnelPrivateKey = ""
+	tun.AcmeAccountKey = ""
+	tun.AuthUsername = ""
+	tun.AuthPassword = ""
+	return tun
+}
+
+// Tunnel creation parameters that users can have defaults for. Anything
+// identifying a specific tunnel (domain, ports, credentials) is left out.
+var tunnelDefaultParams = []string{
+	"client-addr",
+	"client-use-tls",
+	"client-tls-skip-verify",
+	"client-ca-file",
+	"tls-termination",
+	"tls-min-version",
+	"tls-cipher-suites",
+	"hsts-max-age",
+	"hsts-include-subdomains",
+	"hsts-preload",
+	"host-header-policy",
+	"host-header",
+	"retry-on-dial-failure",
+	"max-channels",
+	"unreachable-policy",
+	"unreachable-wait",
+	"allow-external-tcp",
+	"listen-ip",
+	"error-page-502",
+	"error-page-503",
+	"error-page-504",
+}
+
+// withTunnelDefaults returns a copy of params with the owner's tunnel
+// defaults added for any parameters that weren't given. A parameter given
+// with any value, including "off" for a checkbox, overrides the default.
+// Precedence is explicit parameters, then the preset (see withTunnelPreset),
+// then owner defaults, then the server-wide defaults applied later.
+func withTunnelDefaults(params url.Values, defaults map[string]string) url.Values {
+	merged := url.Values{}
+	for k, v := range params {
+		merged[k] = v
+	}
+
+	for name, value := range defaults {
+		if _, given := merged[name]; !given {
+			merged.Set(name, value)
+		}
+	}
+
+	return merged
+}
+
+// validateSubdomainLabel makes sure label can be used as a single DNS label,
+// ie "myfeature" or "pr-123".
+func validateSubdomainLabel(label string) error {
+	if len(label) == 0 || len(label) > 63 {
+		return errors.New("Label must be 1 to 63 characters")
+	}
+
+	for _, c := range label {
+		if !(c >= 'a' && c <= 'z') && !(c >= '0' && c <= '9') && c != '-' {
+			return fmt.Errorf("Invalid label %s. Only lowercase letters, digits and hyphens are allowed", label)
+		}
+	}
+
+	if strings.HasPrefix(label, "-") || strings.HasSuffix(label, "-") {
+		return fmt.Errorf("Invalid label %s. It can't start or end with a hyphen", label)
+	}
+
+	return nil
+}
+
+// subdomainFor returns the full domain for label under baseDomain.
+func subdomainFor(label, baseDomain string) string {
+	return label + "." + baseDomain
+}
+
+// CreateTunnelForClient creates a tunnel under the server's base domain from
+// the label parameter, ie "myfeature" becomes myfeature.apps.example.com.
+// Everything else is the same as CreateTunnel.
+func (a *Api) CreateTunnelForClient(ctx context.Context, tokenData TokenData, params url.Values) (*Tunnel, error) {
+
+	if a.config.BaseDomain == "" {
+		return nil, errors.New("Server has no base domain for labels")
+	}
+
+	label := strings.ToLower(params.Get("label"))
+
+	err := validateSubdomainLabel(label)
+	if err != nil {
+		return nil, err
+	}
+
+	domain := subdomainFor(label, a.config.BaseDomain)
+
+	if a.db.HasExactDomain(domain) {
+		return nil, fmt.Errorf("%w: %s", ErrSubdomainTaken, domain)
+	}
+
+	labelParams := url.Values{}
+	for k, v := range params {
+		labelParams[k] = v
+	}
+	labelParams.Set("domain", domain)
+	labelParams.Del("path-prefix")
+
+	tunnel, err := a.CreateTunnel(ctx, tokenData, labelParams)
+	if errors.Is(err, ErrTunnelExists) {
+		// Lost a race with another request for the same label
+		return nil, fmt.Errorf("%w: %s", ErrSubdomainTaken, domain)
+	}
+
+	return tunnel, err
+}
+
+func (a *Api) CreateTunnel(ctx context.Context, tokenData TokenData, params url.Values) (*Tunnel, error) {
+
+	if !tokenData.CanModify() {
+		return nil, ErrReadOnly
+	}
+
+	domain := params.Get("domain")
+	if domain == "" {
+		return nil, errors.New("Invalid domain parameter")
+	}
+
+	if !tokenData.AllowsDomain(domain) {
+		return nil, fmt.Errorf("%w: %s", ErrTokenScope, domain)
+	}
+
+	owner := params.Get("owner")
+	if owner == "" {
+		return nil, errors.New("Invalid owner parameter")
+	}
+
+	// Only admins can create tunnels for other users
+	if tokenData.Owner != owner {
+		user, _ := a.db.GetUser(tokenData.Owner)
+		if !user.IsAdmin {
+			return nil, errors.New("Unauthorized")
+		}
+	}
+
+	params, err := a.withTunnelPreset(params)
+	if err != nil {
+		return nil, err
+	}
+
+	ownerUser, _ := a.db.GetUser(owner)
+	params = withTunnelDefaults(params, ownerUser.TunnelDefaults)
+
+	clientName := params.Get("client-name")
+
+	clientPort := 0
+	clientPortParam := params.Get("client-port")
+	if clientPortParam != "" {
+		var err error
+		clientPort, err = strconv.Atoi(clientPortParam)
+		if err != nil {
+			return nil, errors.New("Invalid client-port parameter")
+		}
+	}
+
+	clientAddr := params.Get("client-addr")
+	if clientAddr == "" {
+		clientAddr = "127.0.0.1"
+	}
+
+	clientUseTls := params.Get("client-use-tls") == "on"
+	clientTlsSkipVerify := params.Get("client-tls-skip-verify") == "on"
+	clientCaFile := params.Get("client-ca-file")
+	if !clientUseTls && (clientTlsSkipVerify || clientCaFile != "") {
+		return nil, errors.New("client-tls-skip-verify and client-ca-file require client-use-tls")
+	}
+
+	tunnelPort := 0
+	tunnelPortParam := params.Get("tunnel-port")
+	if tunnelPortParam != "" && tunnelPortParam != "Random" {
+		var err error
+		tunnelPort, err = strconv.Atoi(tunnelPortParam)
+		if err != nil {
+			return nil, errors.New("Invalid tunnel-port parameter")
+		}
+	}
+
+	allowExternalTcp := params.Get("allow-external-tcp") == "on"
+
+	listenIp := params.Get("listen-ip")
+	if listenIp == "" {
+		listenIp = a.config.ListenIp
+	} else {
+		err := checkLocalIp(listenIp)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	passwordProtect := params.Get("password-protect") == "on"
+
+	var username string
+	var password string
+	if passwordProtect {
+		username = params.Get("username")
+		if username == "" {
+			return nil, errors.New("Username required")
+		}
+
+		password = params.Get("password")
+		if password == "" {
+			return nil, errors.New("Password required")
+		}
+	}
+
+	// Redirect tunnels are served by the server itself, so none of the
+	// client settings apply.
+	redirectTo := params.Get("redirect-to")
+	redirectCode := 0
+	if redirectTo != "" {
+		if params.Get("redirect-code") != "" {
+			redirectCode, err = strconv.Atoi(params.Get("redirect-code"))
+			if err != nil {
+				return nil, errors.New("Invalid redirect-code parameter")
+			}
+		}
+
+		err := validateRedirect(redirectTo, redirectCode)
+		if err != nil {
+			return nil, err
+		}
+
+		clientName = ""
+		if params.Get("tls-termination") == "" {
+			params.Set("tls-termination", "server")
+		}
+	}
+
+	tlsTerm := params.Get("tls-termination")
+	if tlsTerm != "server" && tlsTerm != "client" && tlsTerm != "passthrough" && tlsTerm != "client-tls" && tlsTerm != "server-tls" {
+		return nil, errors.New("Invalid tls-termination parameter")
+	}
+
+	forwardProxy := params.Get("forward-proxy") == "on"
+	var forwardProxyAllowlist []string
+	if forwardProxy {
+		if tlsTerm != "client" {
+			return nil, errors.New("forward-proxy requires client TLS termination")
+		}
+
+		for _, entry := range strings.Split(params.Get("forward-proxy-allowlist"), ",") {
+			entry = strings.TrimSpace(entry)
+			if entry != "" {
+				forwardProxyAllowlist = append(forwardProxyAllowlist, entry)
+			}
+		}
+
+		if len(forwardProxyAllowlist) == 0 {
+			return nil, errors.New("forward-proxy requires a forward-proxy-allowlist")
+		}
+	}
+
+	var routes []Route
+	if params.Get("routes") != "" {
+		if tlsTerm != "server" && tlsTerm != "client" {
+			return nil, errors.New("routes require server or client TLS termination")
+		}
+
+		if forwardProxy {
+			return nil, errors.New("routes can't be used with forward-proxy")
+		}
+
+		routes, err = parseRoutes(params.Get("routes"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	description, err := parseDescription(params.Get("description"))
+	if err != nil {
+		return nil, err
+	}
+
+	pathPrefix := strings.TrimSuffix(params.Get("path-prefix"), "/")
+	if pathPrefix != "" {
+		if !strings.HasPrefix(pathPrefix, "/") || strings.ContainsAny(pathPrefix, "?#") {
+			return nil, errors.New("Invalid path-prefix parameter")
+		}
+
+		if tlsTerm != "server" {
+			return nil, errors.New("path-prefix requires server TLS termination")
+		}
+	}
+
+	var companion string
+	if params.Get("redirect-companion") == "on" {
+		if pathPrefix != "" {
+			return nil, errors.New("redirect-companion can't be used with path-prefix")
+		}
+		companion = companionDomain(domain)
+
+		if !tokenData.AllowsDomain(companion) {
+			return nil, fmt.Errorf("%w: %s", ErrTokenScope, companion)
+		}
+	}
+
+	tlsMinVersion := params.Get("tls-min-version")
+	if tlsMinVersion != "" {
+		version, err := parseTlsVersion(tlsMinVersion)
+		if err != nil || version < tls.VersionTLS12 {
+			return nil, errors.New("Invalid tls-min-version parameter. Must be 1.2 or 1.3")
+		}
+	}
+
+	// The CA file is read from the server's filesystem, so like ssh-user
+	// only admins can set it.
+	requireClientCert := params.Get("require-client-cert") == "on"
+	clientCertCaPath := params.Get("client-cert-ca-path")
+	if requireClientCert || clientCertCaPath != "" {
+		tokenUser, _ := a.db.GetUser(tokenData.Owner)
+		if !tokenUser.IsAdmin {
+			return nil, errors.New("Only admins can require client certs")
+		}
+
+		if !requireClientCert || clientCertCaPath == "" {
+			return nil, errors.New("require-client-cert and client-cert-ca-path must be used together")
+		}
+
+		if tlsTerm != "server" && tlsTerm != "server-tls" {
+			return nil, errors.New("require-client-cert requires server TLS termination")
+		}
+
+		// The handshake happens before the path is known, so the TLS
+		// policy can only be per domain.
+		if pathPrefix != "" {
+			return nil, errors.New("require-client-cert can't be used with path-prefix")
+		}
+
+		_, err := loadCertPool(clientCertCaPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var tlsCipherSuites []string
+	tlsCipherSuitesParam := params.Get("tls-cipher-suites")
+	if tlsCipherSuitesParam != "" {
+		tlsCipherSuites = strings.Split(tlsCipherSuitesParam, ",")
+		_, err := parseCipherSuites(tlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hstsMaxAge := 0
+	hstsMaxAgeParam := params.Get("hsts-max-age")
+	if hstsMaxAgeParam != "" {
+		var err error
+		hstsMaxAge, err = strconv.Atoi(hstsMaxAgeParam)
+		if err != nil {
+			return nil, errors.New("Invalid hsts-max-age parameter")
+		}
+	}
+
+	hostHeaderPolicy := params.Get("host-header-policy")
+	hostHeader := params.Get("host-header")
+	err = validateHostHeaderPolicy(hostHeaderPolicy, hostHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	retryOnDialFailure := 0
+	retryParam := params.Get("retry-on-dial-failure")
+	if retryParam != "" {
+		var err error
+		retryOnDialFailure, err = strconv.Atoi(retryParam)
+		if err != nil || retryOnDialFailure < 0 || retryOnDialFailure > maxDialRetries {
+			return nil, fmt.Errorf("Invalid retry-on-dial-failure parameter. Must be between 0 and %d", maxDialRetries)
+		}
+	}
+
+	maxChannels := 0
+	if params.Get("max-channels") != "" {
+		var err error
+		maxChannels, err = parseMaxChannels(params.Get("max-channels"))
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	unreachablePolicy, unreachableWait, err := parseUnreachablePolicy(params.Get("unreachable-policy"), params.Get("unreachable-wait"))
+	if err != nil {
+		return nil, err
+	}
+
+	bodyRewrites, err := parseBodyRewrites(params["body-rewrite"])
+	if err != nil {
+		return nil, err
+	}
+
+	bodyRewriteTypes, err := parseBodyRewriteTypes(params.Get("body-rewrite-types"))
+	if err != nil {
+		return nil, err
+	}
+
+	schedule := strings.TrimSpace(params.Get("schedule"))
+	scheduleTimezone := params.Get("schedule-timezone")
+	if schedule != "" {
+		_, err := parseSchedule(schedule, scheduleTimezone)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sshServerAddr := a.db.GetAdminDomain()
+	sshServerAddrParam := params.Get("ssh-server-addr")
+	if sshServerAddrParam != "" {
+		sshServerAddr = sshServerAddrParam
+	}
+
+	sshServerPort := a.config.SshServerPort
+	sshServerPortParam := params.Get("ssh-server-port")
+	if sshServerPortParam != "" {
+		var err error
+		sshServerPort, err = strconv.Atoi(sshServerPortParam)
+		if err != nil {
+			return nil, errors.New("Invalid ssh-server-port parameter")
+		}
+	}
+
+	// The SSH user whose authorized_keys gets the tunnel key. Since this
+	// writes to another user's home directory, only admins can set it.
+	sshUser := params.Get("ssh-user")
+	if sshUser != "" {
+		tokenUser, _ := a.db.GetUser(tokenData.Owner)
+		if !tokenUser.IsAdmin {
+			return nil, errors.New("Only admins can set ssh-user")
+		}
+	}
+
+	// A separate ACME account for the tunnel's cert. Like the per-user
+	// ACME settings, only admins can set these.
+	acmeEmail := params.Get("acme-email")
+	acmeCa := params.Get("acme-ca")
+	acmeAccountKey := params.Get("acme-account-key")
+	if acmeEmail != "" || acmeCa != "" || acmeAccountKey != "" {
+		tokenUser, _ := a.db.GetUser(tokenData.Owner)
+		if !tokenUser.IsAdmin {
+			return nil, errors.New("Only admins can set a tunnel ACME account")
+		}
+
+		if acmeAccountKey != "" {
+			err := validateAcmeAccountKey(acmeAccountKey)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	errorPages := make(map[string]string)
+	for _, code := range errorPageCodes {
+		page := params.Get(fmt.Sprintf("error-page-%d", code))
+		if page != "" {
+			_, err := template.New("error").Parse(page)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid error-page-%d parameter: %v", code, err)
+			}
+			errorPages[strconv.Itoa(code)] = page
+		}
+	}
+
+	request := Tunnel{
+		Domain:                domain,
+		Owner:                 owner,
+		ClientName:            clientName,
+		ClientPort:            clientPort,
+		ClientAddress:         clientAddr,
+		ClientUseTls:          clientUseTls,
+		ClientTlsSkipVerify:   clientTlsSkipVerify,
+		ClientCaFile:          clientCaFile,
+		TunnelPort:            tunnelPort,
+		AllowExternalTcp:      allowExternalTcp,
+		ListenIp:              listenIp,
+		LoopbackIp:            a.config.LoopbackIp,
+		PathPrefix:            pathPrefix,
+		ForwardProxy:          forwardProxy,
+		ForwardProxyAllowlist: forwardProxyAllowlist,
+		StripPrefix:           params.Get("strip-prefix") == "on",
+		AuthUsername:          username,
+		AuthPassword:          password,
+		TlsTermination:        tlsTerm,
+		ServerAddress:         sshServerAddr,
+		ServerPort:            sshServerPort,
+		Username:              sshUser,
+		ErrorPages:            errorPages,
+		TlsMinVersion:         tlsMinVersion,
+		TlsCipherSuites:       tlsCipherSuites,
+		RequireClientCert:     requireClientCert,
+		ClientCertCaPath:      clientCertCaPath,
+		HstsMaxAge:            hstsMaxAge,
+		HstsIncludeSubdomains: params.Get("hsts-include-subdomains") == "on",
+		HstsPreload:           params.Get("hsts-preload") == "on",
+		HostHeaderPolicy:      hostHeaderPolicy,
+		HostHeader:            hostHeader,
+		RetryOnDialFailure:    retryOnDialFailure,
+		MaxChannels:           maxChannels,
+		UnreachablePolicy:     unreachablePolicy,
+		UnreachableWait:       unreachableWait,
+		Schedule:              schedule,
+		ScheduleTimezone:      scheduleTimezone,
+		BodyRewrites:          bodyRewrites,
+		BodyRewriteTypes:      bodyRewriteTypes,
+		Description:           description,
+		AcmeEmail:             acmeEmail,
+		AcmeCa:                acmeCa,
+		AcmeAccountKey:        acmeAccountKey,
+		Companion:             companion,
+		RedirectTo:            redirectTo,
+		RedirectCode:          redirectCode,
+		Routes:                routes,
+		Pinned:                params.Get("pinned") == "on",
+		NoIdleTimeout:         params.Get("no-idle-timeout") == "on",
+	}
+
+	companionReq := Tunnel{
+		Domain:         companion,
+		Owner:          owner,
+		TlsTermination: "server",
+		RedirectTo:     domain,
+	}
+
+	// Only check whether the tunnel could be created
+	if params.Get("dry-run") == "true" {
+		tunnel, err := a.tunMan.PreflightTunnel(ctx, request)
+		if err != nil {
+			return nil, err
+		}
+
+		if companion != "" {
+			_, err := a.tunMan.PreflightTunnel(ctx, companionReq)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return &tunnel, nil
+	}
+
+	tunnel, err := a.tunMan.RequestCreateTunnel(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	if companion != "" {
+		_, err := a.tunMan.RequestCreateCompanion(ctx, companionReq)
+		if err != nil {
+			// Don't leave the primary pointing at a companion that
+			// doesn't exist.
+			delErr := a.tunMan.DeleteTunnel(context.Background(), tunnelKey(tunnel))
+			if delErr != nil {
+				log.Printf("Failed to clean up %s after companion error: %v", tunnel.Domain, delErr)
+			}
+			return nil, err
+		}
+	}
+
+	return &tunnel, nil
+}
+
+// validateAcmeAccountKey checks that key is a PEM encoded private key of a
+// type ACME accounts can use.
+func validateAcmeAccountKey(key string) error {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		return errors.New("Invalid acme-account-key parameter: not PEM encoded")
+	}
+
+	if _, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	if _, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return nil
+	}
+
+	return errors.New("Invalid acme-account-key parameter: unsupported private key")
+}
+
+// companionDomain returns the www or apex variant of domain, whichever
+// domain isn't.
+func companionDomain(domain string) string {
+	if strings.HasPrefix(domain, "www.") {
+		return strings.TrimPrefix(domain, "www.")
+	}
+	return "www." + domain
+}
+
+func (a *Api) DeleteTunnel(ctx context.Context, tokenData TokenData, params url.Values) error {
+
+	key, tun, err := a.tunnelToChange(tokenData, params)
+	if err != nil {
+		return err
+	}
+
+	deleteCompanion := tun.Companion != "" && params.Get("delete-companion") == "true"
+	if deleteCompanion && !tokenData.AllowsDomain(tun.Companion) {
+		return fmt.Errorf("%w: %s", ErrTokenScope, tun.Companion)
+	}
+
+	err = a.tunMan.DeleteTunnel(ctx, key)
+	if err != nil {
+		return err
+	}
+
+	if deleteCompanion {
+		err := a.tunMan.DeleteTunnel(ctx, tun.Companion)
+		if err != nil && !errors.Is(err, ErrTunnelNotFound) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RotateTunnelKey replaces the private key of the tunnel identified by the
+// domain and path-prefix parameters.
+func (a *Api) RotateTunnelKey(tokenData TokenData, params url.Values) (Tunnel, error) {
+
+	key, _, err := a.tunnelToChange(tokenData, params)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	return a.tunMan.RotateTunnelKey(key)
+}
+
+// SetTunnelPinned pins or unpins a tunnel, depending on the pinned
+// parameter ("true" or "false").
+func (a *Api) SetTunnelPinned(tokenData TokenData, params url.Values) error {
+
+	key, _, err := a.tunnelToChange(tokenData, params)
+	if err != nil {
+		return err
+	}
+
+	pinned, err := strconv.ParseBool(params.Get("pinned"))
+	if err != nil {
+		return errors.New("Invalid pinned parameter")
+	}
+
+	return a.tunMan.SetPinned(key, pinned)
+}
+
+func validateHostHeaderPolicy(policy, header string) error {
+	switch policy {
+	case "", "preserve-original", "set-to-backend":
+	case "custom-value":
+		if header == "" {
+			return errors.New("host-header required for custom-value host-header-policy")
+		}
+	default:
+		return errors.New("Invalid host-header-policy parameter")
+	}
+	return nil
+}
+
+// parseUnreachablePolicy validates the unreachable-policy and
+// unreachable-wait parameters. The wait is in seconds.
+func parseUnreachablePolicy(policy, waitParam string) (string, int, error) {
+	switch policy {
+	case "", "fail", "wait", "maintenance":
+	default:
+		return "", 0, errors.New("Invalid unreachable-policy parameter. Must be fail, wait, or maintenance")
+	}
+
+	wait := 0
+	if waitParam != "" {
+		var err error
+		wait, err = strconv.Atoi(waitParam)
+		if err != nil || wait < 0 || wait > maxUnreachableWait {
+			return "", 0, fmt.Errorf("Invalid unreachable-wait parameter. Must be between 0 and %d", maxUnreachableWait)
+		}
+	}
+
+	return policy, wait, nil
+}
+
+// parseMaxChannels validates the max-channels parameter. 0 means the
+// server default.
+func parseMaxChannels(value string) (int, error) {
+	maxChannels, err := strconv.Atoi(value)
+	if err != nil || maxChannels < 0 {
+		return 0, errors.New("Invalid max-channels parameter. Must be 0 or more")
+	}
+	return maxChannels, nil
+}
+
+// Longest description accepted for a tunnel, in bytes
+const maxDescriptionLength = 1000
+
+func parseDescription(description string) (string, error) {
+	description = strings.TrimSpace(description)
+	if len(description) > maxDescriptionLength {
+		return "", fmt.Errorf("Description is longer than %d bytes", maxDescriptionLength)
+	}
+	return description, nil
+}
+
+// tunnelToChange returns the key and tunnel identified by the domain and
+// path-prefix parameters, if tokenData is allowed to change it.
+func (a *Api) tunnelToChange(tokenData TokenData, params url.Values) (string, Tunnel, error) {
+	if !tokenData.CanModify() {
+		return "", Tunnel{}, ErrReadOnly
 	}
 
-	clientName := r.Form.Get("client-name")
-	if clientName == "" {
-		if tokenData.Client == "" {
-			w.WriteHeader(400)
-			w.Write([]byte("Missing client-name parameter"))
-			return
-		} else {
-			clientName = tokenData.Client
-		}
+	if params.Get("domain") == "" {
+		return "", Tunnel{}, errors.New("Invalid domain parameter")
 	}
 
-	if tokenData.Client != "" && tokenData.Client != clientName {
-		w.WriteHeader(403)
-		io.WriteString(w, "Token does not have proper permissions")
-		return
+	key := tunnelKeyParam(params)
+
+	tun, exists := a.db.GetTunnel(key)
+	if !exists {
+		return "", Tunnel{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
 	}
 
-	user := r.Form.Get("user")
-	if user == "" {
-		user = tokenData.Owner
+	if !tokenData.AllowsDomain(tun.Domain) {
+		return "", Tunnel{}, fmt.Errorf("%w: %s", ErrTokenScope, tun.Domain)
 	}
 
-	switch r.Method {
-	case "POST":
-		err := a.SetClient(tokenData, r.Form, user, clientName)
-		if err != nil {
-			w.WriteHeader(500)
-			w.Write([]byte(err.Error()))
-		}
-	case "DELETE":
-		err := a.DeleteClient(tokenData, user, clientName)
-		if err != nil {
-			w.WriteHeader(500)
-			io.WriteString(w, err.Error())
-			return
+	if tokenData.Owner != tun.Owner {
+		user, _ := a.db.GetUser(tokenData.Owner)
+		if !user.IsAdmin {
+			return "", Tunnel{}, errors.New("Unauthorized")
 		}
-	default:
-		w.WriteHeader(405)
-		fmt.Fprintf(w, "Invalid method for /api/clients")
 	}
+
+	return key, tun, nil
 }
 
-func (a *Api) GetTunnel(tokenData TokenData, params url.Values) (Tunnel, error) {
-	domain := params.Get("domain")
-	if domain == "" {
-		return Tunnel{}, errors.New("Invalid domain parameter")
-	}
+// UpdateTunnel changes settings of an existing tunnel in place, keeping its
+// key, port, and cert. Only the parameters that are present are updated.
+// See tunnelPatchFields for the parameters that can be changed. Connected
+// clients pick up changes to their settings on their next poll.
+func (a *Api) UpdateTunnel(tokenData TokenData, params url.Values) (Tunnel, error) {
 
-	tun, exists := a.db.GetTunnel(domain)
-	if !exists {
-		return Tunnel{}, errors.New("Tunnel doesn't exist for domain")
+	key, _, err := a.tunnelToChange(tokenData, params)
+	if err != nil {
+		return Tunnel{}, err
 	}
 
-	user, _ := a.db.GetUser(tokenData.Owner)
-	if user.IsAdmin || tun.Owner == tokenData.Owner {
-		return tun, nil
-	} else {
-		return Tunnel{}, errors.New("Unauthorized")
-	}
-}
+	update := func(tun *Tunnel) error {
+		if _, exists := params["description"]; exists {
+			description, err := parseDescription(params.Get("description"))
+			if err != nil {
+				return err
+			}
+			tun.Description = description
+		}
 
-func (a *Api) GetTunnels(tokenData TokenData) map[string]Tunnel {
+		if _, exists := params["pinned"]; exists {
+			pinned, err := strconv.ParseBool(params.Get("pinned"))
+			if err != nil {
+				return errors.New("Invalid pinned parameter")
+			}
+			tun.Pinned = pinned
+		}
 
-	user, _ := a.db.GetUser(tokenData.Owner)
+		if _, exists := params["no-idle-timeout"]; exists {
+			noIdleTimeout, err := strconv.ParseBool(params.Get("no-idle-timeout"))
+			if err != nil {
+				return errors.New("Invalid no-idle-timeout parameter")
+			}
+			tun.NoIdleTimeout = noIdleTimeout
+		}
 
-	var tunnels map[string]Tunnel
+		if _, exists := params["client-name"]; exists {
+			clientName := params.Get("client-name")
+			if clientName != "" && clientName != "none" {
+				owner, _ := a.db.GetUser(tun.Owner)
+				if _, exists := owner.Clients[clientName]; !exists {
+					return fmt.Errorf("%w %s for %s", ErrUnknownClient, clientName, tun.Owner)
+				}
+			}
+			tun.ClientName = clientName
+		}
 
-	if user.IsAdmin {
-		tunnels = a.db.GetTunnels()
-	} else {
-		tunnels = make(map[string]Tunnel)
+		if _, exists := params["client-port"]; exists {
+			clientPort, err := strconv.Atoi(params.Get("client-port"))
+			if err != nil || clientPort < 1 || clientPort > 65535 {
+				return errors.New("Invalid client-port parameter")
+			}
+			tun.ClientPort = clientPort
+		}
 
-		for domain, tun := range a.db.GetTunnels() {
-			if tokenData.Owner == tun.Owner {
-				tunnels[domain] = tun
+		if _, exists := params["client-addr"]; exists {
+			if params.Get("client-addr") == "" {
+				return errors.New("Invalid client-addr parameter")
 			}
+			tun.ClientAddress = params.Get("client-addr")
 		}
-	}
 
-	return tunnels
-}
+		if _, exists := params["strip-prefix"]; exists {
+			stripPrefix, err := strconv.ParseBool(params.Get("strip-prefix"))
+			if err != nil {
+				return errors.New("Invalid strip-prefix parameter")
+			}
+			tun.StripPrefix = stripPrefix
+		}
 
-func (a *Api) CreateTunnel(tokenData TokenData, params url.Values) (*Tunnel, error) {
+		if _, exists := params["tls-min-version"]; exists {
+			tlsMinVersion := params.Get("tls-min-version")
+			if tlsMinVersion != "" {
+				version, err := parseTlsVersion(tlsMinVersion)
+				if err != nil || version < tls.VersionTLS12 {
+					return errors.New("Invalid tls-min-version parameter. Must be 1.2 or 1.3")
+				}
+			}
+			tun.TlsMinVersion = tlsMinVersion
+		}
 
-	domain := params.Get("domain")
-	if domain == "" {
-		return nil, errors.New("Invalid domain parameter")
-	}
+		if _, exists := params["tls-cipher-suites"]; exists {
+			var suites []string
+			if params.Get("tls-cipher-suites") != "" {
+				suites = strings.Split(params.Get("tls-cipher-suites"), ",")
+				_, err := parseCipherSuites(suites)
+				if err != nil {
+					return err
+				}
+			}
+			tun.TlsCipherSuites = suites
+		}
 
-	owner := params.Get("owner")
-	if owner == "" {
-		return nil, errors.New("Invalid owner parameter")
-	}
+		if _, exists := params["hsts-max-age"]; exists {
+			hstsMaxAge, err := strconv.Atoi(params.Get("hsts-max-age"))
+			if err != nil {
+				return errors.New("Invalid hsts-max-age parameter")
+			}
+			tun.HstsMaxAge = hstsMaxAge
+		}
 
-	// Only admins can create tunnels for other users
-	if tokenData.Owner != owner {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return nil, errors.New("Unauthorized")
+		if _, exists := params["hsts-include-subdomains"]; exists {
+			include, err := strconv.ParseBool(params.Get("hsts-include-subdomains"))
+			if err != nil {
+				return errors.New("Invalid hsts-include-subdomains parameter")
+			}
+			tun.HstsIncludeSubdomains = include
 		}
-	}
 
-	clientName := params.Get("client-name")
+		if _, exists := params["hsts-preload"]; exists {
+			preload, err := strconv.ParseBool(params.Get("hsts-preload"))
+			if err != nil {
+				return errors.New("Invalid hsts-preload parameter")
+			}
+			tun.HstsPreload = preload
+		}
 
-	clientPort := 0
-	clientPortParam := params.Get("client-port")
-	if clientPortParam != "" {
-		var err error
-		clientPort, err = strconv.Atoi(clientPortParam)
-		if err != nil {
-			return nil, errors.New("Invalid client-port parameter")
+		if _, exists := params["host-header-policy"]; exists {
+			tun.HostHeaderPolicy = params.Get("host-header-policy")
 		}
-	}
 
-	clientAddr := params.Get("client-addr")
-	if clientAddr == "" {
-		clientAddr = "127.0.0.1"
-	}
+		if _, exists := params["host-header"]; exists {
+			tun.HostHeader = params.Get("host-header")
+		}
 
-	tunnelPort := 0
-	tunnelPortParam := params.Get("tunnel-port")
-	if tunnelPortParam != "" && tunnelPortParam != "Random" {
-		var err error
-		tunnelPort, err = strconv.Atoi(tunnelPortParam)
+		err := validateHostHeaderPolicy(tun.HostHeaderPolicy, tun.HostHeader)
 		if err != nil {
-			return nil, errors.New("Invalid tunnel-port parameter")
+			return err
 		}
-	}
 
-	allowExternalTcp := params.Get("allow-external-tcp") == "on"
+		if _, exists := params["retry-on-dial-failure"]; exists {
+			retries, err := strconv.Atoi(params.Get("retry-on-dial-failure"))
+			if err != nil || retries < 0 || retries > maxDialRetries {
+				return fmt.Errorf("Invalid retry-on-dial-failure parameter. Must be between 0 and %d", maxDialRetries)
+			}
+			tun.RetryOnDialFailure = retries
+		}
 
-	passwordProtect := params.Get("password-protect") == "on"
+		if _, exists := params["max-channels"]; exists {
+			tun.MaxChannels, err = parseMaxChannels(params.Get("max-channels"))
+			if err != nil {
+				return err
+			}
+		}
 
-	var username string
-	var password string
-	if passwordProtect {
-		username = params.Get("username")
-		if username == "" {
-			return nil, errors.New("Username required")
+		policy := tun.UnreachablePolicy
+		if _, exists := params["unreachable-policy"]; exists {
+			policy = params.Get("unreachable-policy")
 		}
 
-		password = params.Get("password")
-		if password == "" {
-			return nil, errors.New("Password required")
+		wait := strconv.Itoa(tun.UnreachableWait)
+		if _, exists := params["unreachable-wait"]; exists {
+			wait = params.Get("unreachable-wait")
 		}
-	}
 
-	tlsTerm := params.Get("tls-termination")
-	if tlsTerm != "server" && tlsTerm != "client" && tlsTerm != "passthrough" && tlsTerm != "client-tls" && tlsTerm != "server-tls" {
-		return nil, errors.New("Invalid tls-termination parameter")
-	}
+		tun.UnreachablePolicy, tun.UnreachableWait, err = parseUnreachablePolicy(policy, wait)
+		if err != nil {
+			return err
+		}
 
-	sshServerAddr := a.db.GetAdminDomain()
-	sshServerAddrParam := params.Get("ssh-server-addr")
-	if sshServerAddrParam != "" {
-		sshServerAddr = sshServerAddrParam
+		if values, exists := params["body-rewrite"]; exists {
+			tun.BodyRewrites, err = parseBodyRewrites(values)
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, exists := params["body-rewrite-types"]; exists {
+			tun.BodyRewriteTypes, err = parseBodyRewriteTypes(params.Get("body-rewrite-types"))
+			if err != nil {
+				return err
+			}
+		}
+
+		if _, exists := params["schedule"]; exists {
+			tun.Schedule = strings.TrimSpace(params.Get("schedule"))
+		}
+		if _, exists := params["schedule-timezone"]; exists {
+			tun.ScheduleTimezone = params.Get("schedule-timezone")
+		}
+		if tun.Schedule != "" {
+			_, err := parseSchedule(tun.Schedule, tun.ScheduleTimezone)
+			if err != nil {
+				return err
+			}
+		}
+
+		_, hasTarget := params["redirect-to"]
+		_, hasCode := params["redirect-code"]
+		if hasTarget || hasCode {
+			target := tun.RedirectTo
+			if hasTarget {
+				target = params.Get("redirect-to")
+			}
+
+			code := tun.RedirectCode
+			if hasCode {
+				code = 0
+				if params.Get("redirect-code") != "" {
+					code, err = strconv.Atoi(params.Get("redirect-code"))
+					if err != nil {
+						return errors.New("Invalid redirect-code parameter")
+					}
+				}
+			}
+
+			err := setRedirect(tun, target, code)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
 	}
 
-	sshServerPort := a.config.SshServerPort
-	sshServerPortParam := params.Get("ssh-server-port")
-	if sshServerPortParam != "" {
-		var err error
-		sshServerPort, err = strconv.Atoi(sshServerPortParam)
+	return a.tunMan.UpdateTunnel(key, func(tun *Tunnel) error {
+		err := update(tun)
 		if err != nil {
-			return nil, errors.New("Invalid ssh-server-port parameter")
+			return &ParameterError{Err: err}
 		}
+		return nil
+	})
+}
+
+// Tunnel JSON fields that can be changed with a PATCH, and the UpdateTunnel
+// parameters they map to. Anything else, including the domain, ports, keys,
+// and owner, is rejected.
+var tunnelPatchFields = map[string]string{
+	"description":             "description",
+	"pinned":                  "pinned",
+	"no_idle_timeout":         "no-idle-timeout",
+	"client_name":             "client-name",
+	"client_address":          "client-addr",
+	"client_port":             "client-port",
+	"strip_prefix":            "strip-prefix",
+	"tls_min_version":         "tls-min-version",
+	"tls_cipher_suites":       "tls-cipher-suites",
+	"hsts_max_age":            "hsts-max-age",
+	"hsts_include_subdomains": "hsts-include-subdomains",
+	"hsts_preload":            "hsts-preload",
+	"host_header_policy":      "host-header-policy",
+	"host_header":             "host-header",
+	"retry_on_dial_failure":   "retry-on-dial-failure",
+	"max_channels":            "max-channels",
+	"unreachable_policy":      "unreachable-policy",
+	"unreachable_wait":        "unreachable-wait",
+	"redirect_to":             "redirect-to",
+	"redirect_code":           "redirect-code",
+	"schedule":                "schedule",
+	"schedule_timezone":       "schedule-timezone",
+}
+
+// UpdateTunnel parameters that can only be given as form parameters, and
+// the ones identifying the tunnel and the request's token.
+var tunnelPatchFormParams = []string{"body-rewrite", "body-rewrite-types", "domain", "path-prefix", "access_token"}
+
+// checkTunnelPatchForm rejects form parameters that UpdateTunnel would
+// otherwise silently ignore, so a PATCH of an unknown or immutable field
+// fails like it does with JSON.
+func checkTunnelPatchForm(params url.Values) error {
+	allowed := make(map[string]bool)
+	for _, param := range tunnelPatchFields {
+		allowed[param] = true
+	}
+	for _, param := range tunnelPatchFormParams {
+		allowed[param] = true
 	}
 
-	request := Tunnel{
-		Domain:           domain,
-		Owner:            owner,
-		ClientName:       clientName,
-		ClientPort:       clientPort,
-		ClientAddress:    clientAddr,
-		TunnelPort:       tunnelPort,
-		AllowExternalTcp: allowExternalTcp,
-		AuthUsername:     username,
-		AuthPassword:     password,
-		TlsTermination:   tlsTerm,
-		ServerAddress:    sshServerAddr,
-		ServerPort:       sshServerPort,
-	}
-
-	tunnel, err := a.tunMan.RequestCreateTunnel(request)
-	if err != nil {
-		return nil, err
+	for param := range params {
+		if !allowed[param] {
+			return fmt.Errorf("%w: %s", ErrInvalidField, param)
+		}
 	}
 
-	return &tunnel, nil
+	return nil
 }
 
-func (a *Api) DeleteTunnel(tokenData TokenData, params url.Values) error {
+// tunnelPatchParams converts a partial tunnel JSON object to UpdateTunnel
+// parameters.
+func tunnelPatchParams(body io.Reader) (url.Values, error) {
+	var fields map[string]interface{}
 
-	domain := params.Get("domain")
-	if domain == "" {
-		return errors.New("Invalid domain parameter")
+	decoder := json.NewDecoder(body)
+	decoder.UseNumber()
+	err := decoder.Decode(&fields)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid JSON: %v", err)
 	}
 
-	tun, exists := a.db.GetTunnel(domain)
-	if !exists {
-		return errors.New("Tunnel doesn't exist")
-	}
+	params := url.Values{}
 
-	if tokenData.Owner != tun.Owner {
-		user, _ := a.db.GetUser(tokenData.Owner)
-		if !user.IsAdmin {
-			return errors.New("Unauthorized")
+	for field, value := range fields {
+		param, ok := tunnelPatchFields[field]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidField, field)
+		}
+
+		switch v := value.(type) {
+		case string:
+			params.Set(param, v)
+		case bool:
+			params.Set(param, strconv.FormatBool(v))
+		case json.Number:
+			params.Set(param, v.String())
+		case nil:
+			params.Set(param, "")
+		case []interface{}:
+			items := []string{}
+			for _, item := range v {
+				str, ok := item.(string)
+				if !ok {
+					return nil, fmt.Errorf("Invalid value for %s", field)
+				}
+				items = append(items, str)
+			}
+			params.Set(param, strings.Join(items, ","))
+		default:
+			return nil, fmt.Errorf("Invalid value for %s", field)
 		}
 	}
 
-	a.tunMan.DeleteTunnel(domain)
+	return params, nil
+}
 
-	return nil
+// tunnelErrorStatus maps errors from tunnel operations to HTTP status codes.
+func tunnelErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTunnelNotFound):
+		return 404
+	case errors.Is(err, ErrTunnelExists), errors.Is(err, ErrPortInUse), errors.Is(err, ErrSubdomainTaken):
+		return 409
+	case errors.Is(err, ErrRateLimited):
+		return 429
+	case errors.Is(err, ErrMaxTunnels):
+		return 503
+	case errors.Is(err, ErrTokenScope), errors.Is(err, ErrReadOnly), errors.Is(err, ErrAdmissionDenied):
+		return 403
+	case errors.Is(err, ErrCertFailed):
+		return 502
+	case errors.Is(err, ErrInvalidField), errors.Is(err, ErrInvalidParameter), errors.Is(err, ErrUnknownClient), errors.Is(err, ErrDnsMismatch):
+		return 400
+	default:
+		return 500
+	}
 }
 
 func (a *Api) CreateToken(tokenData TokenData, params url.Values) (string, error) {
 
+	if !tokenData.CanModify() {
+		return "", ErrReadOnly
+	}
+
 	ownerId := params.Get("owner")
 	if ownerId == "" {
 		return "", errors.New("Invalid owner paramater")
@@ -478,7 +1864,17 @@ func (a *Api) CreateToken(tokenData TokenData, params url.Values) (string, error
 		client = ""
 	}
 
-	token, err := a.db.AddToken(ownerId, client)
+	var domains []string
+	if params.Get("domains") != "" {
+		domains = splitList(params.Get("domains"))
+	}
+
+	role := params.Get("role")
+	if role != "" && role != TokenRoleObserver {
+		return "", errors.New("Invalid role parameter")
+	}
+
+	token, err := a.db.AddToken(ownerId, client, domains, role)
 	if err != nil {
 		return "", errors.New("Failed to create token")
 	}
@@ -487,6 +1883,10 @@ func (a *Api) CreateToken(tokenData TokenData, params url.Values) (string, error
 }
 
 func (a *Api) DeleteToken(tokenData TokenData, params url.Values) error {
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
 	token := params.Get("token")
 	if token == "" {
 		return errors.New("Invalid token parameter")
@@ -512,6 +1912,10 @@ func (a *Api) DeleteToken(tokenData TokenData, params url.Values) error {
 
 func (a *Api) GetTokens(tokenData TokenData, params url.Values) map[string]TokenData {
 
+	if !tokenData.CanModify() {
+		return map[string]TokenData{}
+	}
+
 	tokens := a.db.GetTokens()
 
 	user, _ := a.db.GetUser(tokenData.Owner)
@@ -541,6 +1945,10 @@ func (a *Api) GetUsers(tokenData TokenData, params url.Values) map[string]User {
 
 func (a *Api) CreateUser(tokenData TokenData, params url.Values) error {
 
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
 	user, _ := a.db.GetUser(tokenData.Owner)
 	if !user.IsAdmin {
 		return errors.New("Unauthorized")
@@ -563,8 +1971,65 @@ func (a *Api) CreateUser(tokenData TokenData, params url.Values) error {
 	return nil
 }
 
+// UpdateUser changes the settings of an existing user. Only the parameters
+// that are present are updated.
+func (a *Api) UpdateUser(tokenData TokenData, params url.Values) error {
+
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if !user.IsAdmin {
+		return errors.New("Unauthorized")
+	}
+
+	username := params.Get("username")
+	if username == "" {
+		return errors.New("Invalid username parameter")
+	}
+
+	updateUser, exists := a.db.GetUser(username)
+	if !exists {
+		return errors.New("User doesn't exist")
+	}
+
+	if _, exists := params["acme-email"]; exists {
+		updateUser.AcmeEmail = params.Get("acme-email")
+	}
+
+	if _, exists := params["acme-ca"]; exists {
+		updateUser.AcmeCa = params.Get("acme-ca")
+	}
+
+	// Tunnel defaults are passed as "default-<param>". An empty value
+	// removes the default.
+	for _, name := range tunnelDefaultParams {
+		if _, exists := params["default-"+name]; !exists {
+			continue
+		}
+
+		if updateUser.TunnelDefaults == nil {
+			updateUser.TunnelDefaults = make(map[string]string)
+		}
+
+		value := params.Get("default-" + name)
+		if value == "" {
+			delete(updateUser.TunnelDefaults, name)
+		} else {
+			updateUser.TunnelDefaults[name] = value
+		}
+	}
+
+	return a.db.SetUser(username, updateUser)
+}
+
 func (a *Api) DeleteUser(tokenData TokenData, params url.Values) error {
 
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
 	user, _ := a.db.GetUser(tokenData.Owner)
 	if !user.IsAdmin {
 		return errors.New("Unauthorized")
@@ -593,6 +2058,10 @@ func (a *Api) DeleteUser(tokenData TokenData, params url.Values) error {
 
 func (a *Api) SetClient(tokenData TokenData, params url.Values, ownerId, clientId string) error {
 
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
 	if tokenData.Owner != ownerId {
 		user, _ := a.db.GetUser(tokenData.Owner)
 		if !user.IsAdmin {
@@ -610,6 +2079,10 @@ func (a *Api) SetClient(tokenData TokenData, params url.Values, ownerId, clientI
 
 func (a *Api) DeleteClient(tokenData TokenData, ownerId, clientId string) error {
 
+	if !tokenData.CanModify() {
+		return ErrReadOnly
+	}
+
 	if tokenData.Owner != ownerId {
 		user, _ := a.db.GetUser(tokenData.Owner)
 		if !user.IsAdmin {
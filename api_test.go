@@ -0,0 +1,587 @@
+package boringproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObserverCanListButNotChangeTunnels(t *testing.T) {
+	a := newTestApi(t)
+
+	a.db.SetTunnel("app.example.com", Tunnel{
+		Domain:           "app.example.com",
+		Owner:            "admin",
+		TunnelPort:       20001,
+		TunnelPrivateKey: "secret key",
+		AcmeAccountKey:   "secret account key",
+		AuthUsername:     "user",
+		AuthPassword:     "password",
+	})
+
+	observer := TokenData{Owner: "admin", Role: TokenRoleObserver}
+
+	tunnels := a.GetTunnels(observer)
+	tun, exists := tunnels["app.example.com"]
+	if !exists {
+		t.Fatal("Observer can't list tunnels")
+	}
+
+	single, err := a.GetTunnel(observer, url.Values{"domain": {"app.example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tun := range []Tunnel{tun, single} {
+		if tun.TunnelPrivateKey != "" || tun.AcmeAccountKey != "" || tun.AuthUsername != "" || tun.AuthPassword != "" {
+			t.Errorf("Secrets not redacted for observer: %+v", tun)
+		}
+	}
+
+	params := url.Values{"domain": {"app.example.com"}}
+
+	_, err = a.CreateTunnel(context.Background(), observer, url.Values{"domain": {"new.example.com"}})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("CreateTunnel: expected ErrReadOnly, got %v", err)
+	}
+
+	_, err = a.UpdateTunnel(observer, url.Values{"domain": {"app.example.com"}, "description": {"changed"}})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("UpdateTunnel: expected ErrReadOnly, got %v", err)
+	}
+
+	err = a.SetTunnelPinned(observer, url.Values{"domain": {"app.example.com"}, "pinned": {"true"}})
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("SetTunnelPinned: expected ErrReadOnly, got %v", err)
+	}
+
+	err = a.DeleteTunnel(context.Background(), observer, params)
+	if !errors.Is(err, ErrReadOnly) {
+		t.Errorf("DeleteTunnel: expected ErrReadOnly, got %v", err)
+	}
+
+	if _, exists := a.db.GetTunnel("app.example.com"); !exists {
+		t.Error("Observer deleted the tunnel")
+	}
+
+	admin := TokenData{Owner: "admin"}
+	if tun := a.GetTunnels(admin)["app.example.com"]; tun.AuthPassword != "password" {
+		t.Error("Full access tokens should see the tunnel's credentials")
+	}
+}
+
+func TestTunnelDefaultsCanBeTurnedOff(t *testing.T) {
+	defaults := map[string]string{
+		"allow-external-tcp": "on",
+		"client-addr":        "10.0.0.2",
+	}
+
+	// As sent by the web UI with the checkbox unchecked and the address
+	// left blank
+	form := url.Values{
+		"allow-external-tcp": {"off"},
+		"client-addr":        {""},
+	}
+
+	params := withTunnelDefaults(nonEmptyParams(form), defaults)
+
+	if params.Get("allow-external-tcp") != "off" {
+		t.Errorf("Unchecked checkbox was overridden by the default")
+	}
+
+	if params.Get("client-addr") != "10.0.0.2" {
+		t.Errorf("Blank field didn't get the default, got %q", params.Get("client-addr"))
+	}
+
+	// Checked: the checkbox is sent before its hidden "off" value
+	form["allow-external-tcp"] = []string{"on", "off"}
+	if withTunnelDefaults(form, map[string]string{}).Get("allow-external-tcp") != "on" {
+		t.Errorf("Checked checkbox read as off")
+	}
+
+	api := newTestApi(t)
+	api.config.TunnelPresets = map[string]map[string]string{
+		"tcp": {"allow-external-tcp": "on"},
+	}
+
+	params, err := api.withTunnelPreset(url.Values{"preset": {"tcp"}, "allow-external-tcp": {"off"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("allow-external-tcp") != "off" {
+		t.Errorf("Explicit off was overridden by the preset")
+	}
+}
+
+func TestTunnelPresetIsApplied(t *testing.T) {
+	a := newTestApi(t)
+	a.config.TunnelPresets = map[string]map[string]string{
+		"internal": {
+			"tls-termination":    "client",
+			"client-addr":        "10.0.0.5",
+			"host-header-policy": "custom-value",
+			"host-header":        "internal.example.com",
+			"password-protect":   "on",
+			"username":           "team",
+			"password":           "hunter2",
+			"strip-prefix":       "on",
+			"pinned":             "on",
+		},
+	}
+
+	adminUser, _ := a.db.GetUser("admin")
+	adminUser.TunnelDefaults = map[string]string{"client-addr": "10.0.0.9"}
+	err := a.db.SetUser("admin", adminUser)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := TokenData{Owner: "admin"}
+
+	tun, err := a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain":   {"app.example.com"},
+		"owner":    {"admin"},
+		"preset":   {"internal"},
+		"username": {"me"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The preset beats the owner's defaults, and explicit parameters beat
+	// the preset
+	if tun.TlsTermination != "client" {
+		t.Errorf("Expected tls-termination from the preset, got %q", tun.TlsTermination)
+	}
+	if tun.ClientAddress != "10.0.0.5" {
+		t.Errorf("Expected client-addr from the preset, got %q", tun.ClientAddress)
+	}
+	if tun.HostHeaderPolicy != "custom-value" || tun.HostHeader != "internal.example.com" {
+		t.Errorf("Expected the preset's host header, got %q %q", tun.HostHeaderPolicy, tun.HostHeader)
+	}
+	if tun.AuthUsername != "me" || tun.AuthPassword != "hunter2" {
+		t.Errorf("Expected the explicit username and the preset's password, got %q %q", tun.AuthUsername, tun.AuthPassword)
+	}
+	if !tun.StripPrefix || !tun.Pinned {
+		t.Errorf("Expected strip-prefix and pinned from the preset, got %v %v", tun.StripPrefix, tun.Pinned)
+	}
+
+	_, err = a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain": {"other.example.com"},
+		"owner":  {"admin"},
+		"preset": {"missing"},
+	})
+	if err == nil {
+		t.Error("Expected an unknown preset to be refused")
+	}
+}
+
+func TestInlineEditKeepsKey(t *testing.T) {
+	a := newTestApi(t)
+
+	err := os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.db.SetTokenData("admin-token", TokenData{Owner: "admin"})
+
+	user, _ := a.db.GetUser("admin")
+	user.Clients = map[string]DbClient{"laptop": {}, "desktop": {}}
+	a.db.SetUser("admin", user)
+
+	created, err := a.CreateTunnel(context.Background(), TokenData{Owner: "admin"}, url.Values{
+		"domain":          {"app.example.com"},
+		"owner":           {"admin"},
+		"client-name":     {"laptop"},
+		"client-port":     {"3000"},
+		"tls-termination": {"client"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	akPath := filepath.Join(a.tunMan.user.HomeDir, ".ssh", "authorized_keys")
+	akBefore, err := ioutil.ReadFile(akPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := http.StripPrefix("/tunnels/", http.HandlerFunc(a.handleTunnel))
+
+	req := httptest.NewRequest("PATCH", "/tunnels/app.example.com?client-name=desktop&client-port=8080", nil)
+	req.Header.Set("access_token", "admin-token")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected the edit to succeed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	tun, _ := a.tunMan.GetTunnelDetails("app.example.com")
+	if tun.ClientName != "desktop" || tun.ClientPort != 8080 {
+		t.Errorf("Expected the new client name and port, got %s:%d", tun.ClientName, tun.ClientPort)
+	}
+	if tun.TunnelPrivateKey != created.TunnelPrivateKey {
+		t.Error("Expected the tunnel's private key to be kept")
+	}
+	if tun.TunnelPort != created.TunnelPort {
+		t.Errorf("Expected tunnel port %d to be kept, got %d", created.TunnelPort, tun.TunnelPort)
+	}
+
+	akAfter, err := ioutil.ReadFile(akPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(akBefore, akAfter) {
+		t.Errorf("Expected authorized_keys to be left alone, got %q", akAfter)
+	}
+}
+
+func TestFormPatchRejectsUnknownFieldsAndClients(t *testing.T) {
+	a := newTestApi(t)
+
+	a.db.SetTokenData("admin-token", TokenData{Owner: "admin"})
+	a.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Owner: "admin", TunnelPort: 20001})
+
+	user, _ := a.db.GetUser("admin")
+	user.Clients = map[string]DbClient{"laptop": {}}
+	a.db.SetUser("admin", user)
+
+	patch := func(params url.Values) (int, string) {
+		req := httptest.NewRequest("PATCH", "/tunnels?"+params.Encode(), nil)
+		req.Header.Set("access_token", "admin-token")
+		rec := httptest.NewRecorder()
+		a.handleTunnels(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	for _, field := range []string{"owner", "tunnel-port", "no-such-field"} {
+		code, body := patch(url.Values{"domain": {"app.example.com"}, field: {"x"}})
+		if code != 400 || !strings.Contains(body, field) {
+			t.Errorf("Expected %s to be rejected, got %d: %s", field, code, body)
+		}
+	}
+
+	code, body := patch(url.Values{"domain": {"app.example.com"}, "client-name": {"desktop"}})
+	if code != 400 {
+		t.Errorf("Expected unknown client to be rejected, got %d: %s", code, body)
+	}
+
+	code, body = patch(url.Values{"domain": {"app.example.com"}, "client-name": {"laptop"}, "client-port": {"8080"}})
+	if code != 200 {
+		t.Fatalf("Expected update to succeed, got %d: %s", code, body)
+	}
+
+	tun, _ := a.db.GetTunnel("app.example.com")
+	if tun.ClientName != "laptop" || tun.ClientPort != 8080 || tun.Owner != "admin" {
+		t.Errorf("Unexpected tunnel after update: %+v", tun)
+	}
+}
+
+func TestRedirectCompanion(t *testing.T) {
+	a := newTestApi(t)
+	a.config.MaxTunnels = 1
+	a.tunMan.createLimiter = newRateLimiter(0.001, 1)
+
+	err := os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := TokenData{Owner: "admin"}
+
+	// The companion comes with the tunnel, so it's neither rate limited
+	// nor counted towards the cap
+	_, err = a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain":             {"example.com"},
+		"owner":              {"admin"},
+		"tls-termination":    {"client"},
+		"redirect-companion": {"on"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	companion, exists := a.db.GetTunnel("www.example.com")
+	if !exists {
+		t.Fatal("Companion wasn't created")
+	}
+
+	_, err = a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain":          {"other.example.com"},
+		"owner":           {"admin"},
+		"tls-termination": {"client"},
+	})
+	if !errors.Is(err, ErrMaxTunnels) {
+		t.Errorf("Expected ErrMaxTunnels, got %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "https://www.example.com/page?q=1", nil)
+	location, code := redirectLocation(companion, req, false)
+	if code != http.StatusMovedPermanently || location != "https://example.com/page?q=1" {
+		t.Errorf("Unexpected redirect %d %s", code, location)
+	}
+
+	// With -allow-http, plain requests stay plain
+	req = httptest.NewRequest("GET", "http://www.example.com/page", nil)
+	location, _ = redirectLocation(companion, req, false)
+	if location != "http://example.com/page" {
+		t.Errorf("Unexpected redirect for plain HTTP %s", location)
+	}
+}
+
+func TestRedirectOnlyTunnel(t *testing.T) {
+	a := newTestApi(t)
+
+	err := os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := TokenData{Owner: "admin"}
+
+	tun, err := a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain":        {"old.example.com"},
+		"owner":         {"admin"},
+		"redirect-to":   {"https://new.example.com/landing"},
+		"redirect-code": {"302"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if tun.TunnelPrivateKey != "" || tun.TunnelPort != 0 {
+		t.Errorf("Expected no key or port for a redirect, got port %d", tun.TunnelPort)
+	}
+
+	akBytes, err := ioutil.ReadFile(filepath.Join(a.tunMan.user.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	if len(akBytes) != 0 {
+		t.Errorf("Expected no authorized_keys line for a redirect, got %q", akBytes)
+	}
+
+	routed, exists := a.tunMan.routeRequest("old.example.com", "/some/page")
+	if !exists {
+		t.Fatal("Expected the redirect to be routed")
+	}
+
+	req := httptest.NewRequest("GET", "https://old.example.com/some/page", nil)
+	location, code := redirectLocation(routed, req, false)
+	if code != http.StatusFound || location != "https://new.example.com/landing" {
+		t.Errorf("Expected a 302 to the target URL, got %d %s", code, location)
+	}
+
+	_, err = a.CreateTunnel(context.Background(), admin, url.Values{
+		"domain":        {"other.example.com"},
+		"owner":         {"admin"},
+		"redirect-to":   {"new.example.com"},
+		"redirect-code": {"200"},
+	})
+	if err == nil {
+		t.Error("Expected a non-redirect status code to be refused")
+	}
+}
+
+func TestValidateSubdomainLabel(t *testing.T) {
+	valid := []string{"myfeature", "pr-123", "a", "0day", strings.Repeat("x", 63)}
+	for _, label := range valid {
+		if err := validateSubdomainLabel(label); err != nil {
+			t.Errorf("%q: %v", label, err)
+		}
+	}
+
+	invalid := []string{"", strings.Repeat("x", 64), "-start", "end-", "two.labels", "under_score", "Upper", "sp ace", "ümlaut"}
+	for _, label := range invalid {
+		if err := validateSubdomainLabel(label); err == nil {
+			t.Errorf("Expected %q to be rejected", label)
+		}
+	}
+}
+
+func TestCreateTunnelForClient(t *testing.T) {
+	a := newTestApi(t)
+
+	err := os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	admin := TokenData{Owner: "admin"}
+	params := url.Values{
+		"label":           {"MyFeature"},
+		"owner":           {"admin"},
+		"tls-termination": {"client"},
+		// Ignored, since the label is the whole tunnel
+		"domain":      {"elsewhere.example.org"},
+		"path-prefix": {"/api"},
+	}
+
+	_, err = a.CreateTunnelForClient(context.Background(), admin, params)
+	if err == nil {
+		t.Error("Expected labels to be refused without a base domain")
+	}
+
+	a.config.BaseDomain = "apps.example.com"
+
+	tun, err := a.CreateTunnelForClient(context.Background(), admin, params)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tun.Domain != "myfeature.apps.example.com" || tun.PathPrefix != "" {
+		t.Errorf("Expected myfeature.apps.example.com without a path prefix, got %s%s", tun.Domain, tun.PathPrefix)
+	}
+	if _, exists := a.db.GetTunnel("myfeature.apps.example.com"); !exists {
+		t.Error("Expected the tunnel to be stored under its full domain")
+	}
+
+	_, err = a.CreateTunnelForClient(context.Background(), admin, params)
+	if !errors.Is(err, ErrSubdomainTaken) {
+		t.Errorf("Expected ErrSubdomainTaken for a taken label, got %v", err)
+	}
+
+	params.Set("label", "bad_label")
+	_, err = a.CreateTunnelForClient(context.Background(), admin, params)
+	if err == nil {
+		t.Error("Expected an invalid label to be refused")
+	}
+}
+
+func TestJoinTokens(t *testing.T) {
+	a := newTestApi(t)
+
+	a.db.SetTunnel("app.example.com", Tunnel{
+		Domain:           "app.example.com",
+		Owner:            "admin",
+		TunnelPort:       20001,
+		TunnelPrivateKey: "private key",
+		TlsTermination:   "server",
+		AuthUsername:     "user",
+		AuthPassword:     "secret",
+		AcmeEmail:        "owner@example.com",
+		AcmeAccountKey:   "account key",
+	})
+
+	join := func(token string) (int, string) {
+		form := url.Values{"token": {token}}
+		req := httptest.NewRequest("POST", "https://example.com/api/join", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		a.handleJoin(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	token, err := a.tunMan.CreateClientJoinToken("app.example.com", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := join(token)
+	if code != 200 {
+		t.Fatalf("Expected the token to be redeemed, got %d: %s", code, body)
+	}
+
+	var descriptor ConnectionDescriptor
+	err = json.Unmarshal([]byte(body), &descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if descriptor.TunnelPrivateKey != "private key" || descriptor.TunnelPort != 20001 {
+		t.Errorf("Unexpected descriptor %+v", descriptor)
+	}
+
+	// The server checks the credentials, and the ACME account is the
+	// owner's business
+	tun := descriptor.Tunnel
+	if tun.AuthUsername != "" || tun.AuthPassword != "" || tun.AcmeEmail != "" || tun.AcmeAccountKey != "" {
+		t.Errorf("Owner-only fields were returned: %+v", tun)
+	}
+
+	if code, _ := join(token); code != 403 {
+		t.Errorf("Expected a used token to be rejected, got %d", code)
+	}
+
+	expiring, err := a.tunMan.CreateClientJoinToken("app.example.com", time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	if code, body := join(expiring); code != 403 || !strings.Contains(body, "expired") {
+		t.Errorf("Expected an expired token to be rejected, got %d: %s", code, body)
+	}
+
+	_, err = a.tunMan.CreateClientJoinToken("missing.example.com", time.Minute)
+	if !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("Expected ErrTunnelNotFound, got %v", err)
+	}
+}
+
+func TestDomainScopedToken(t *testing.T) {
+	a := newTestApi(t)
+
+	err := os.MkdirAll(filepath.Join(a.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := a.CreateToken(TokenData{Owner: "admin"}, url.Values{
+		"owner":   {"admin"},
+		"client":  {"any"},
+		"domains": {"app.example.com"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.db.SetTunnel("other.example.com", Tunnel{Domain: "other.example.com", Owner: "admin", TunnelPort: 20050})
+
+	request := func(method, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/?"+query, nil)
+		req.Header.Set("access_token", token)
+		rec := httptest.NewRecorder()
+		a.handleTunnels(rec, req)
+		return rec
+	}
+
+	rec := request("POST", "domain=app.example.com&owner=admin&tls-termination=client")
+	if rec.Code != 200 {
+		t.Fatalf("Expected the scoped domain to be allowed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec = request("POST", "domain=new.example.com&owner=admin&tls-termination=client")
+	if rec.Code != 403 {
+		t.Errorf("Expected 403 creating another domain, got %d", rec.Code)
+	}
+
+	rec = request("DELETE", "domain=other.example.com")
+	if rec.Code != 403 {
+		t.Errorf("Expected 403 deleting another domain, got %d", rec.Code)
+	}
+
+	var tunnels map[string]Tunnel
+	err = json.Unmarshal(request("GET", "").Body.Bytes(), &tunnels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists := tunnels["app.example.com"]; !exists || len(tunnels) != 1 {
+		t.Errorf("Expected only the scoped domain to be listed, got %v", tunnels)
+	}
+}
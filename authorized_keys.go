@@ -0,0 +1,494 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// authorizedKeysPath returns the authorized_keys file for the SSH user
+// username. An empty username means the user we're running as.
+func (m *TunnelManager) authorizedKeysPath(username string) (string, error) {
+	if username == "" || username == m.user.Username {
+		return filepath.Join(m.user.HomeDir, ".ssh", "authorized_keys"), nil
+	}
+
+	sshUser, err := m.lookupUser(username)
+	if err != nil {
+		return "", fmt.Errorf("Unknown SSH user %s: %w", username, err)
+	}
+
+	return filepath.Join(sshUser.HomeDir, ".ssh", "authorized_keys"), nil
+}
+
+// authorizedKeysError explains permission errors, since editing another
+// user's authorized_keys needs root.
+func authorizedKeysError(username, path string, err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return fmt.Errorf("No permission to edit %s for SSH user %s. boringproxy needs to run as root or as that user: %w", path, username, err)
+	}
+	return err
+}
+
+// chownToUser gives a newly created authorized_keys file to the SSH user,
+// since sshd ignores files owned by anyone else.
+func (m *TunnelManager) chownToUser(username, path string) {
+	if username == "" || username == m.user.Username {
+		return
+	}
+
+	sshUser, err := m.lookupUser(username)
+	if err != nil {
+		return
+	}
+
+	uid, uidErr := strconv.Atoi(sshUser.Uid)
+	gid, gidErr := strconv.Atoi(sshUser.Gid)
+	if uidErr != nil || gidErr != nil {
+		return
+	}
+
+	err = os.Chown(path, uid, gid)
+	if err != nil {
+		log.Printf("Failed to change owner of %s to %s: %v", path, username, err)
+	}
+}
+
+const defaultForcedCommand = "echo This key permits tunnels only"
+
+// validateForcedCommand makes sure command can be put in the quoted command
+// option of an authorized_keys line without breaking it.
+func validateForcedCommand(command string) error {
+	if command == "" {
+		return errors.New("Forced command can't be empty")
+	}
+
+	if strings.ContainsAny(command, "\r\n") {
+		return errors.New("Forced command can't contain newlines")
+	}
+
+	escaped := false
+	for _, c := range command {
+		switch {
+		case escaped:
+			escaped = false
+		case c == '\\':
+			escaped = true
+		case c == '"':
+			return errors.New(`Forced command can't contain unescaped quotes. Use \"`)
+		}
+	}
+
+	if escaped {
+		return errors.New("Forced command can't end with a backslash")
+	}
+
+	return nil
+}
+
+func tunnelKeyId(domain string, port int) string {
+	return fmt.Sprintf("boringproxy-%s-%d", domain, port)
+}
+
+// permitListenHost returns the host of the permitlisten option in an
+// authorized_keys line, or "" if there isn't one.
+func permitListenHost(line string) string {
+	const option = `permitlisten="`
+
+	start := strings.Index(line, option)
+	if start == -1 {
+		return ""
+	}
+
+	value := line[start+len(option):]
+	end := strings.Index(value, `"`)
+	if end == -1 {
+		return ""
+	}
+
+	host, _, err := net.SplitHostPort(value[:end])
+	if err != nil {
+		return ""
+	}
+
+	return host
+}
+
+// addToAuthorizedKeys generates a new key pair for the tunnel, adds the
+// public key to the SSH user's authorized_keys and returns the private key.
+func (m *TunnelManager) addToAuthorizedKeys(username, domain string, port int, bindAddr string) (string, error) {
+
+	pubKey, privKey, err := MakeSSHKeyPair(m.config.KeyType, m.config.RsaBits, m.config.KeyFormat)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.writeAuthorizedKey(username, domain, port, bindAddr, pubKey)
+	if err != nil {
+		return "", err
+	}
+
+	return privKey, nil
+}
+
+// authorizedKeysOp runs op, which accesses authorized_keys, giving up after
+// config.AuthorizedKeysTimeout. On a networked home directory a stuck file
+// operation would otherwise hold the manager's mutex forever.
+//
+// Ops are serialized by akMutex. A timed out op that hasn't started yet is
+// skipped. One that's already running can't be interrupted, so if it
+// succeeds after the caller has given up, undo is run (if not nil) to revert
+// the change the caller was told failed.
+func (m *TunnelManager) authorizedKeysOp(op, undo func() error) error {
+	timeout := m.config.AuthorizedKeysTimeout
+	if timeout <= 0 {
+		m.akMutex.Lock()
+		defer m.akMutex.Unlock()
+		return op()
+	}
+
+	done := make(chan error, 1)
+
+	var stateMutex sync.Mutex
+	abandoned := false
+	finished := false
+
+	go func() {
+		m.akMutex.Lock()
+		defer m.akMutex.Unlock()
+
+		stateMutex.Lock()
+		skip := abandoned
+		stateMutex.Unlock()
+		if skip {
+			return
+		}
+
+		err := op()
+
+		stateMutex.Lock()
+		finished = true
+		gaveUp := abandoned
+		stateMutex.Unlock()
+
+		if !gaveUp {
+			done <- err
+			return
+		}
+
+		if err == nil && undo != nil {
+			log.Printf("Reverting authorized_keys change that finished after timing out")
+			err = undo()
+			if err != nil {
+				log.Printf("Failed to revert authorized_keys change: %v", err)
+			}
+		}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+
+	if finished {
+		// The op finished just as the timer fired
+		return <-done
+	}
+
+	abandoned = true
+
+	return fmt.Errorf("%w after %s", ErrAuthorizedKeysTimeout, timeout)
+}
+
+// How many times authorized_keys updates are retried after a transient
+// error, and the delay before the first retry, which doubles each time.
+const authorizedKeysRetries = 3
+const authorizedKeysRetryDelay = 100 * time.Millisecond
+
+// retryAuthorizedKeysOp runs op with authorizedKeysOp, retrying with backoff
+// if it fails with an error that might go away, as happens on network
+// filesystems. Timeouts aren't retried, since the timed out op may still be
+// holding akMutex.
+func (m *TunnelManager) retryAuthorizedKeysOp(op, undo func() error) error {
+	delay := authorizedKeysRetryDelay
+
+	for attempt := 0; ; attempt++ {
+		err := m.authorizedKeysOp(op, undo)
+		if err == nil || attempt == authorizedKeysRetries || errors.Is(err, ErrAuthorizedKeysTimeout) || !isTransientFileError(err) {
+			return err
+		}
+
+		log.Printf("Retrying authorized_keys update in %s: %v", delay, err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func isTransientFileError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EAGAIN, syscall.EINTR, syscall.EBUSY, syscall.ETIMEDOUT, syscall.ESTALE} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// writeAuthorizedKey appends an authorized_keys line for the tunnel, unless
+// one already exists. With the embedded SSH server, keys are checked against
+// the database instead, so there's nothing to do.
+func (m *TunnelManager) writeAuthorizedKey(username, domain string, port int, bindAddr string, pubKey string) error {
+	if m.config.EmbeddedSsh {
+		return nil
+	}
+
+	authKeysPath, err := m.authorizedKeysPath(username)
+	if err != nil {
+		return err
+	}
+
+	err = m.retryAuthorizedKeysOp(func() error {
+		start := time.Now()
+		defer func() {
+			m.akMetrics.recordOp("add", time.Since(start))
+		}()
+		return m.writeAuthorizedKeyFile(username, authKeysPath, domain, port, bindAddr, pubKey)
+	}, func() error {
+		return m.removeAuthorizedKeyFile(authKeysPath, domain, port)
+	})
+
+	return authorizedKeysError(username, authKeysPath, err)
+}
+
+func (m *TunnelManager) writeAuthorizedKeyFile(username, authKeysPath, domain string, port int, bindAddr string, pubKey string) error {
+
+	_, statErr := os.Stat(authKeysPath)
+
+	akFile, err := os.OpenFile(authKeysPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer akFile.Close()
+
+	if os.IsNotExist(statErr) {
+		m.chownToUser(username, authKeysPath)
+	}
+
+	akBytes, err := ioutil.ReadAll(akFile)
+	if err != nil {
+		return err
+	}
+
+	akStr := string(akBytes)
+
+	tunnelId := tunnelKeyId(domain, port)
+
+	for _, line := range strings.Split(akStr, "\n") {
+		if strings.HasSuffix(line, " "+tunnelId) {
+			m.akMetrics.recordFile(authKeysPath, akStr)
+			return nil
+		}
+	}
+
+	pubKey = strings.TrimSpace(pubKey)
+
+	forcedCommand := m.config.ForcedCommand
+	if forcedCommand == "" {
+		forcedCommand = defaultForcedCommand
+	}
+
+	options := fmt.Sprintf(`command="%s",permitopen="fakehost:1",permitlisten="%s"`, forcedCommand, net.JoinHostPort(bindAddr, strconv.Itoa(port)))
+
+	newAk := fmt.Sprintf("%s%s %s %s\n", akStr, options, pubKey, tunnelId)
+
+	// Clear the file
+	err = akFile.Truncate(0)
+	if err != nil {
+		return err
+	}
+	_, err = akFile.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+
+	_, err = akFile.Write([]byte(newAk))
+	if err != nil {
+		return err
+	}
+
+	m.akMetrics.recordFile(authKeysPath, newAk)
+
+	return nil
+}
+
+// loadAuthorizedKeysMetrics records the size of the authorized_keys files of
+// the SSH users tunnels use, so they're reported before the first change.
+func (m *TunnelManager) loadAuthorizedKeysMetrics() {
+	usernames := map[string]bool{m.user.Username: true}
+	for _, tun := range m.db.GetTunnels() {
+		if tun.Username != "" {
+			usernames[tun.Username] = true
+		}
+	}
+
+	for username := range usernames {
+		authKeysPath, err := m.authorizedKeysPath(username)
+		if err != nil {
+			continue
+		}
+
+		m.authorizedKeysOp(func() error {
+			akBytes, err := ioutil.ReadFile(authKeysPath)
+			if err == nil {
+				m.akMetrics.recordFile(authKeysPath, string(akBytes))
+			}
+			return err
+		}, nil)
+	}
+}
+
+// removeFromAuthorizedKeys deletes the authorized_keys line for the tunnel
+// from the SSH user's file.
+func (m *TunnelManager) removeFromAuthorizedKeys(username, domain string, port int) error {
+	if m.config.EmbeddedSsh {
+		return nil
+	}
+
+	authKeysPath, err := m.authorizedKeysPath(username)
+	if err != nil {
+		return err
+	}
+
+	err = m.retryAuthorizedKeysOp(func() error {
+		start := time.Now()
+		defer func() {
+			m.akMetrics.recordOp("delete", time.Since(start))
+		}()
+		return m.removeAuthorizedKeyFile(authKeysPath, domain, port)
+	}, nil)
+
+	return authorizedKeysError(username, authKeysPath, err)
+}
+
+func (m *TunnelManager) removeAuthorizedKeyFile(authKeysPath, domain string, port int) error {
+
+	akBytes, err := ioutil.ReadFile(authKeysPath)
+	if err != nil {
+		return err
+	}
+
+	akStr := string(akBytes)
+
+	lines := strings.Split(akStr, "\n")
+
+	tunnelId := tunnelKeyId(domain, port)
+
+	outLines := []string{}
+
+	for _, line := range lines {
+		if strings.Contains(line, tunnelId) {
+			continue
+		}
+
+		outLines = append(outLines, line)
+	}
+
+	outStr := strings.Join(outLines, "\n")
+
+	err = ioutil.WriteFile(authKeysPath, []byte(outStr), 0600)
+	if err != nil {
+		return err
+	}
+
+	m.akMetrics.recordFile(authKeysPath, outStr)
+
+	return nil
+}
+
+// PruneAuthorizedKeys removes the boringproxy lines from the authorized_keys
+// file at path that don't belong to any tunnel in the database in dbDir, ie
+// ones left behind when a tunnel was deleted while the file couldn't be
+// written. It returns the removed lines. If dryRun is set, the file isn't
+// changed. Unlike NewDatabase, a missing database is an error, so a wrong
+// dbDir doesn't remove every tunnel's key.
+func PruneAuthorizedKeys(dbDir, path string, dryRun bool) ([]string, error) {
+
+	dbJson, err := ioutil.ReadFile(dbDir + "boringproxy_db.json")
+	if err != nil {
+		return nil, err
+	}
+
+	var db struct {
+		Tunnels map[string]Tunnel `json:"tunnels"`
+	}
+	err = json.Unmarshal(dbJson, &db)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid database: %w", err)
+	}
+
+	keep := make(map[string]bool)
+	for _, tun := range db.Tunnels {
+		keep[tunnelKeyId(tun.Domain, tun.TunnelPort)] = true
+	}
+
+	akBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	removed := []string{}
+	outLines := []string{}
+
+	for _, line := range strings.Split(string(akBytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 {
+			tunnelId := fields[len(fields)-1]
+			if strings.HasPrefix(tunnelId, "boringproxy-") && !keep[tunnelId] {
+				removed = append(removed, line)
+				continue
+			}
+		}
+
+		outLines = append(outLines, line)
+	}
+
+	if dryRun || len(removed) == 0 {
+		return removed, nil
+	}
+
+	err = ioutil.WriteFile(path, []byte(strings.Join(outLines, "\n")), 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return removed, nil
+}
+
+// publicKeyFromPrivate derives the authorized_keys formatted public key for
+// a PEM encoded private key.
+func publicKeyFromPrivate(privKey string) (string, error) {
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		return "", err
+	}
+
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
@@ -0,0 +1,81 @@
+package boringproxy
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const defaultBackendMaxIdleConns = 16
+const defaultBackendIdleConnTimeout = 90 * time.Second
+
+// BackendPool keeps a separate HTTP client for each backend address, so
+// keep-alive connections to a backend can be reused across requests and
+// dropped when the tunnel goes away.
+type BackendPool struct {
+	maxIdleConns    int
+	idleConnTimeout time.Duration
+	clients         map[string]*http.Client
+	mutex           *sync.Mutex
+}
+
+func NewBackendPool(maxIdleConns int, idleConnTimeout time.Duration) *BackendPool {
+	return &BackendPool{
+		maxIdleConns:    maxIdleConns,
+		idleConnTimeout: idleConnTimeout,
+		clients:         make(map[string]*http.Client),
+		mutex:           &sync.Mutex{},
+	}
+}
+
+// Client returns the client for the backend at addr (host:port).
+func (p *BackendPool) Client(addr string) *http.Client {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	client, exists := p.clients[addr]
+	if !exists {
+		client = newBackendClient(p.maxIdleConns, p.idleConnTimeout)
+		p.clients[addr] = client
+	}
+
+	return client
+}
+
+// Invalidate closes any idle connections to addr. Requests in progress are
+// unaffected.
+func (p *BackendPool) Invalidate(addr string) {
+	p.mutex.Lock()
+	client, exists := p.clients[addr]
+	delete(p.clients, addr)
+	p.mutex.Unlock()
+
+	if exists {
+		client.CloseIdleConnections()
+	}
+}
+
+func newBackendClient(maxIdleConns int, idleConnTimeout time.Duration) *http.Client {
+
+	// A maxIdleConns of 0 means unlimited to http.Transport, but here it
+	// means don't keep connections around at all.
+	disableKeepAlives := maxIdleConns <= 0
+
+	return &http.Client{
+		Transport: &http.Transport{
+			DialContext: (&net.Dialer{
+				Timeout:   30 * time.Second,
+				KeepAlive: 30 * time.Second,
+			}).DialContext,
+			MaxIdleConns:        maxIdleConns,
+			MaxIdleConnsPerHost: maxIdleConns,
+			IdleConnTimeout:     idleConnTimeout,
+			DisableKeepAlives:   disableKeepAlives,
+		},
+		// Don't follow redirects
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
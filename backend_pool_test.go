@@ -0,0 +1,79 @@
+package boringproxy
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// startCountingBackend starts a backend that answers "ok" and counts the
+// connections made to it.
+func startCountingBackend(t *testing.T) (string, int, *int32) {
+	t.Helper()
+
+	var conns int32
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	backend.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	backend.Start()
+	t.Cleanup(backend.Close)
+
+	host, portStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return host, port, &conns
+}
+
+func TestBackendConnectionsAreReused(t *testing.T) {
+	cases := []struct {
+		maxIdleConns int
+		conns        int32
+	}{
+		{defaultBackendMaxIdleConns, 1},
+		// Keep-alives disabled
+		{0, 2},
+	}
+
+	for _, c := range cases {
+		host, port, conns := startCountingBackend(t)
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+		pool := NewBackendPool(c.maxIdleConns, time.Minute)
+		tunnel := Tunnel{Domain: "app.example.com"}
+
+		for i := 0; i < 2; i++ {
+			req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+			rec := httptest.NewRecorder()
+
+			proxyRequest(rec, req, tunnel, pool.Client(addr), host, port, false, nil)
+
+			if rec.Code != 200 {
+				t.Fatalf("Expected 200, got %d", rec.Code)
+			}
+		}
+
+		if n := atomic.LoadInt32(conns); n != c.conns {
+			t.Errorf("With %d idle conns, expected %d backend connections, got %d", c.maxIdleConns, c.conns, n)
+		}
+
+		// Deleting the tunnel drops the connection
+		pool.Invalidate(addr)
+
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		proxyRequest(httptest.NewRecorder(), req, tunnel, pool.Client(addr), host, port, false, nil)
+
+		if n := atomic.LoadInt32(conns); n != c.conns+1 {
+			t.Errorf("Expected a new connection after invalidating, got %d in total", n)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package boringproxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Responses bigger than this are passed through unmodified, rather than
+// buffering them whole.
+const maxRewriteBodySize = 10 * 1024 * 1024
+
+// Content types rewritten if a tunnel doesn't list its own
+var defaultBodyRewriteTypes = []string{"text/html"}
+
+// BodyRewrite replaces Find with Replace in response bodies, ie
+// "http://app.example.com" with "https://app.example.com".
+type BodyRewrite struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+}
+
+// parseBodyRewrites parses body-rewrite parameters, each like
+// "find=>replace".
+func parseBodyRewrites(values []string) ([]BodyRewrite, error) {
+	rewrites := []BodyRewrite{}
+
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+
+		parts := strings.SplitN(value, "=>", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("Invalid body-rewrite %s. Must be find=>replace", value)
+		}
+
+		rewrites = append(rewrites, BodyRewrite{Find: parts[0], Replace: parts[1]})
+	}
+
+	return rewrites, nil
+}
+
+// parseBodyRewriteTypes parses the comma separated body-rewrite-types
+// parameter. Only textual types are allowed, so binary responses are never
+// touched.
+func parseBodyRewriteTypes(value string) ([]string, error) {
+	types := []string{}
+
+	for _, t := range splitList(value) {
+		t = strings.ToLower(t)
+		if !isTextualType(t) {
+			return nil, fmt.Errorf("Invalid body-rewrite-types entry %s. Only text types can be rewritten", t)
+		}
+		types = append(types, t)
+	}
+
+	return types, nil
+}
+
+func isTextualType(mediaType string) bool {
+	if strings.HasPrefix(mediaType, "text/") {
+		return true
+	}
+
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "application/xhtml+xml", "image/svg+xml":
+		return true
+	}
+
+	return strings.HasSuffix(mediaType, "+json") || strings.HasSuffix(mediaType, "+xml")
+}
+
+// shouldRewriteBody reports whether res is a complete, uncompressed
+// response of one of the tunnel's rewrite types.
+func shouldRewriteBody(tunnel Tunnel, res *http.Response) bool {
+	if len(tunnel.BodyRewrites) == 0 || res.StatusCode == http.StatusPartialContent {
+		return false
+	}
+
+	encoding := res.Header.Get("Content-Encoding")
+	if encoding != "" && encoding != "identity" {
+		return false
+	}
+
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+
+	types := tunnel.BodyRewriteTypes
+	if len(types) == 0 {
+		types = defaultBodyRewriteTypes
+	}
+
+	return stringInArray(mediaType, types) && isTextualType(mediaType)
+}
+
+// rewriteBody applies rewrites to body, updating the Content-Length in
+// header. Bodies over maxRewriteBodySize are returned unchanged.
+func rewriteBody(header http.Header, body io.Reader, rewrites []BodyRewrite) (io.Reader, error) {
+	buf, err := io.ReadAll(io.LimitReader(body, maxRewriteBodySize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(buf) > maxRewriteBodySize {
+		return io.MultiReader(bytes.NewReader(buf), body), nil
+	}
+
+	pairs := []string{}
+	for _, rewrite := range rewrites {
+		pairs = append(pairs, rewrite.Find, rewrite.Replace)
+	}
+
+	rewritten := strings.NewReplacer(pairs...).Replace(string(buf))
+
+	header.Set("Content-Length", strconv.Itoa(len(rewritten)))
+	// The backend's validators no longer match what's sent
+	header.Del("ETag")
+	header.Del("Content-MD5")
+
+	return strings.NewReader(rewritten), nil
+}
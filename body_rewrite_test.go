@@ -0,0 +1,73 @@
+package boringproxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestBodyRewriteWithCompressingBackend(t *testing.T) {
+	png := []byte("\x89PNG http://app.example.com")
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := []byte(`<a href="http://app.example.com/">home</a>`)
+		if r.URL.Path == "/logo.png" {
+			w.Header().Set("Content-Type", "image/png")
+			w.Write(png)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+		if strings.Contains(r.Header.Get("Accept-Encoding"), "gzip") {
+			var buf bytes.Buffer
+			gz := gzip.NewWriter(&buf)
+			gz.Write(body)
+			gz.Close()
+			w.Header().Set("Content-Encoding", "gzip")
+			body = buf.Bytes()
+		}
+
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	tunnel := Tunnel{
+		Domain:       "app.example.com",
+		BodyRewrites: []BodyRewrite{{Find: "http://app.example.com", Replace: "https://app.example.com"}},
+	}
+
+	pool := NewBackendPool(defaultBackendMaxIdleConns, defaultBackendIdleConnTimeout)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "https://app.example.com"+path, nil)
+		req.Header.Set("Accept-Encoding", "gzip, br")
+		rec := httptest.NewRecorder()
+		proxyRequest(rec, req, tunnel, pool.Client(backend.Listener.Addr().String()), host, port, false, nil)
+		return rec
+	}
+
+	rec := get("/")
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("HTML response is still compressed")
+	}
+	if string(body) != `<a href="https://app.example.com/">home</a>` {
+		t.Errorf("HTML wasn't rewritten: %q", body)
+	}
+
+	rec = get("/logo.png")
+	body, _ = io.ReadAll(rec.Body)
+	if !bytes.Equal(body, png) {
+		t.Errorf("Image was modified: %q", body)
+	}
+}
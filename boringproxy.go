@@ -11,21 +11,89 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/caddyserver/certmagic"
 	"github.com/mdp/qrterminal/v3"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"github.com/takingnames/namedrop-go"
 )
 
 type Config struct {
-	SshServerPort  int    `json:"ssh_server_port"`
-	PublicIp       string `json:"public_ip"`
-	namedropClient *namedrop.Client
-	autoCerts      bool
+	SshServerPort           int           `json:"ssh_server_port"`
+	PublicIp                string        `json:"public_ip"`
+	RecoverAuthorizedKeys   bool          `json:"recover_authorized_keys"`
+	HstsMaxAge              int           `json:"hsts_max_age"`
+	HstsIncludeSubdomains   bool          `json:"hsts_include_subdomains"`
+	HstsPreload             bool          `json:"hsts_preload"`
+	CertConcurrency         int           `json:"cert_concurrency"`
+	StartupCertTimeout      time.Duration `json:"startup_cert_timeout"`
+	LazyCerts               bool          `json:"lazy_certs"`
+	ListenIp                string        `json:"listen_ip"`
+	LoopbackIp              string        `json:"loopback_ip"`
+	KeyType                 string        `json:"key_type"`
+	RsaBits                 int           `json:"rsa_bits"`
+	KeyFormat               string        `json:"key_format"`
+	AutoRotateWeakKeys      bool          `json:"auto_rotate_weak_keys"`
+	BackendMaxIdleConns     int           `json:"backend_max_idle_conns"`
+	BackendIdleTimeout      time.Duration `json:"backend_idle_timeout"`
+	TunnelCreateRate        float64       `json:"tunnel_create_rate"`
+	TunnelCreateBurst       int           `json:"tunnel_create_burst"`
+	MaxTunnels              int           `json:"max_tunnels"`
+	TunnelPortMin           int           `json:"tunnel_port_min"`
+	TunnelPortMax           int           `json:"tunnel_port_max"`
+	PortReuseGrace          time.Duration `json:"port_reuse_grace"`
+	DefaultTunnel           string        `json:"default_tunnel"`
+	UnmatchedSni            string        `json:"unmatched_sni"`
+	AuthorizedKeysTimeout   time.Duration `json:"authorized_keys_timeout"`
+	IdleTimeout             time.Duration `json:"idle_timeout"`
+	IdleGracePeriod         time.Duration `json:"idle_grace_period"`
+	IdleDryRun              bool          `json:"idle_dry_run"`
+	IdleWebhook             string        `json:"idle_webhook"`
+	IdleSkipConnected       bool          `json:"idle_skip_connected"`
+	PreflightDnsCheck       bool          `json:"preflight_dns_check"`
+	PreflightDnsStrict      bool          `json:"preflight_dns_strict"`
+	AdmissionWebhook        string        `json:"admission_webhook"`
+	AdmissionFailOpen       bool          `json:"admission_fail_open"`
+	BaseDomain              string        `json:"base_domain"`
+	DbSaveInterval          time.Duration `json:"db_save_interval"`
+	DbSaveBatch             int           `json:"db_save_batch"`
+	RouteCacheTtl           time.Duration `json:"route_cache_ttl"`
+	SshMaxChannels          int           `json:"ssh_max_channels"`
+	SshKeepaliveInterval    time.Duration `json:"ssh_keepalive_interval"`
+	SshKeepaliveMaxMissed   int           `json:"ssh_keepalive_max_missed"`
+	Http3                   bool          `json:"http3"`
+	AllowSelfSignedFallback bool          `json:"allow_self_signed_fallback"`
+	EmbeddedSsh             bool          `json:"embedded_ssh"`
+	ForcedCommand           string        `json:"forced_command"`
+	SshHostKeyPath          string        `json:"ssh_host_key_path"`
+	namedropClient          *namedrop.Client
+	secretStore             SecretStore
+	autoCerts               bool
+
+	// Tunnel creation parameters keyed by preset name
+	TunnelPresets map[string]map[string]string `json:"tunnel_presets"`
+
+	// Other domains the admin UI and API are served on
+	AdminDomainAliases []string `json:"admin_domain_aliases"`
+
+	// Only hand out connection details in exchange for a join token
+	ConnectionRequiresJoinToken bool `json:"connection_requires_join_token"`
+
+	// How long a replaced embedded SSH host key is still advertised
+	SshHostKeyGrace time.Duration `json:"ssh_host_key_grace"`
+
+	// Running behind another reverse proxy, so its X-Forwarded-* headers
+	// can be trusted
+	BehindProxy bool `json:"behind_proxy"`
 }
 
 type SmtpConfig struct {
@@ -38,26 +106,82 @@ type SmtpConfig struct {
 type Server struct {
 	db           *Database
 	tunMan       *TunnelManager
-	httpClient   *http.Client
 	httpListener *PassthroughListener
+	tlsConfig    *tls.Config
 }
 
 func Listen() {
 	flagSet := flag.NewFlagSet(os.Args[0], flag.ExitOnError)
 	newAdminDomain := flagSet.String("admin-domain", "", "Admin Domain")
+	adminDomainAliases := flagSet.String("admin-domain-aliases", "", "Comma separated list of other domains to serve the admin UI and API on")
 	sshServerPort := flagSet.Int("ssh-server-port", 22, "SSH Server Port")
 	dbDir := flagSet.String("db-dir", "", "Database file directory")
+	secretsDir := flagSet.String("secrets-dir", "", "Directory for tunnel private keys. Defaults to boringproxy_secrets in -db-dir")
+	secretsKeyFile := flagSet.String("secrets-key-file", "", "File containing a hex encoded AES key used to encrypt tunnel private keys at rest")
 	certDir := flagSet.String("cert-dir", "", "TLS cert directory")
 	printLogin := flagSet.Bool("print-login", false, "Prints admin login information")
 	httpPort := flagSet.Int("http-port", 80, "HTTP (insecure) port")
 	httpsPort := flagSet.Int("https-port", 443, "HTTPS (secure) port")
+	tunnelPortMin := flagSet.Int("tunnel-port-min", 20000, "Lowest port assigned to tunnels that don't request one")
+	tunnelPortMax := flagSet.Int("tunnel-port-max", 29999, "Highest port assigned to tunnels that don't request one")
+	portReuseGrace := flagSet.Duration("port-reuse-grace", 2*time.Minute, "How long a deleted tunnel's port is held back before it's assigned to another tunnel, so lingering sockets don't make binding it fail. 0 reuses ports immediately")
 	allowHttp := flagSet.Bool("allow-http", false, "Allow unencrypted (HTTP) requests")
 	publicIp := flagSet.String("public-ip", "", "Public IP")
+	listenIp := flagSet.String("listen-ip", "", "Local IP to listen on for HTTP/HTTPS and external TCP tunnels. Defaults to all interfaces")
+	loopbackIp := flagSet.String("loopback-ip", "127.0.0.1", "Loopback IP new tunnel ports are bound to on the server, ie ::1 on IPv6-only hosts. With an IPv6 address, external TCP tunnels listen on both stacks")
 	behindProxy := flagSet.Bool("behind-proxy", false, "Whether we're running behind another reverse proxy")
+	tunnelPresetsFile := flagSet.String("tunnel-presets-file", "", "JSON file of named tunnel presets, which bundle tunnel creation parameters")
+	errorPagesDir := flagSet.String("error-pages-dir", "", "Directory containing custom 502.html, 503.html and 504.html error pages")
+	landingPageDir := flagSet.String("landing-page-dir", "", "Directory of static files to serve for domains without a tunnel")
+	defaultTunnel := flagSet.String("default-tunnel", "", "Domain of a server-terminated tunnel to serve for domains without a tunnel, instead of the landing page")
+	unmatchedSni := flagSet.String("unmatched-sni", "", "How to handle TLS connections for unknown domains: \"reject\" closes them, \"admin-cert\" serves the admin domain's cert. By default the handshake fails for lack of a cert")
 	acmeEmail := flagSet.String("acme-email", "", "Email for ACME (ie Let's Encrypt)")
+	acmeChallenges := flagSet.String("acme-challenges", "http-01,tls-alpn-01", "Comma separated ACME challenge types to enable (http-01, tls-alpn-01). When both are enabled, certmagic prefers whichever has been succeeding, so the order isn't guaranteed; use tls-alpn-01 alone if port 80 is blocked")
 	acmeUseStaging := flagSet.Bool("acme-use-staging", false, "Use ACME (ie Let's Encrypt) staging servers")
 	acceptCATerms := flagSet.Bool("accept-ca-terms", false, "Automatically accept CA terms")
 	acmeCa := flagSet.String("acme-certificate-authority", "", "URI for ACME Certificate Authority")
+	otlpEndpoint := flagSet.String("otlp-endpoint", "", "OTLP/HTTP collector (host:port) to send traces to")
+	otlpInsecure := flagSet.Bool("otlp-insecure", false, "Send traces to the OTLP collector without TLS")
+	hstsMaxAge := flagSet.Int("hsts-max-age", 0, "Default Strict-Transport-Security max-age in seconds for HTTPS tunnels. 0 disables")
+	hstsIncludeSubdomains := flagSet.Bool("hsts-include-subdomains", false, "Add includeSubDomains to the default Strict-Transport-Security header")
+	hstsPreload := flagSet.Bool("hsts-preload", false, "Add preload to the default Strict-Transport-Security header")
+	backendMaxIdleConns := flagSet.Int("backend-max-idle-conns", defaultBackendMaxIdleConns, "Idle keep-alive connections to keep open to each tunnel backend. 0 disables keep-alive")
+	backendIdleTimeout := flagSet.Duration("backend-idle-timeout", defaultBackendIdleConnTimeout, "How long idle keep-alive connections to tunnel backends stay open")
+	keyType := flagSet.String("key-type", "rsa", "Type of SSH key generated for new tunnels (rsa, ed25519, ecdsa, ecdsa-p384)")
+	allowSelfSignedFallback := flagSet.Bool("allow-self-signed-fallback", false, "Use a self-signed cert for tunnels when one can't be obtained from the CA")
+	idleTimeout := flagSet.Duration("idle-timeout", 0, "Delete tunnels that haven't been used for this long (ie 720h). 0 disables the idle reaper")
+	idleGracePeriod := flagSet.Duration("idle-grace-period", 24*time.Hour, "How long a tunnel must stay idle after the reaper warns about it before it's deleted")
+	idleDryRun := flagSet.Bool("idle-dry-run", false, "Only log and notify about idle tunnels instead of deleting them")
+	preflightDnsCheck := flagSet.Bool("preflight-dns-check", false, "Check that a new tunnel's domain resolves to -public-ip before getting its cert, and log a warning if not")
+	preflightDnsStrict := flagSet.Bool("preflight-dns-strict", false, "With -preflight-dns-check, refuse to create the tunnel instead of warning")
+	idleSkipConnected := flagSet.Bool("idle-skip-connected", false, "Don't delete idle tunnels while their client is connected")
+	idleWebhook := flagSet.String("idle-webhook", "", "URL to POST a JSON event to for each tunnel deleted by the idle reaper")
+	admissionWebhook := flagSet.String("admission-webhook", "", "URL to POST each new tunnel's domain and owner to. Tunnels are only created if it answers 200 with {\"allow\": true}")
+	admissionFailOpen := flagSet.Bool("admission-fail-open", false, "Create tunnels anyway if the admission webhook can't be reached")
+	dbSaveInterval := flagSet.Duration("db-save-interval", 0, "Batch database writes and save them this often (ie 5s). 0 saves on every change")
+	dbSaveBatch := flagSet.Int("db-save-batch", 0, "With -db-save-interval, also save once this many changes are pending. 0 for no limit")
+	routeCacheTtl := flagSet.Duration("route-cache-ttl", defaultRouteCacheTtl, "How long the copy of the tunnels used for routing requests is kept before reloading it from the database. If reloading fails, requests are routed from the old copy. Changes made through this server apply immediately")
+	connectionRequiresJoinToken := flagSet.Bool("connection-requires-join-token", false, "Only return tunnel connection details from /api/connection in exchange for a join token, not an access token")
+	http3 := flagSet.Bool("http3", false, "Also serve tunnels the server terminates TLS for over HTTP/3 (QUIC), on the UDP port matching -https-port")
+	baseDomain := flagSet.String("base-domain", "", "Domain that tunnels created with just a label are put under, ie apps.example.com gives myfeature.apps.example.com. Needs a wildcard DNS record pointing at this server")
+	authorizedKeysTimeout := flagSet.Duration("authorized-keys-timeout", 10*time.Second, "Give up on reading or writing ~/.ssh/authorized_keys after this long. 0 to wait forever")
+	maxTunnels := flagSet.Int("max-tunnels", 0, "Maximum number of tunnels on the server, across all users. 0 for no limit")
+	lazyCerts := flagSet.Bool("lazy-certs", true, "Obtain tunnel certs on the first TLS handshake rather than when the tunnel is created or at startup. Set to false to get them all up front")
+	keyFormat := flagSet.String("key-format", "pem", "Format of the private keys generated for new tunnels (pem, openssh)")
+	rsaBits := flagSet.Int("rsa-bits", 2048, "Size of RSA keys generated for new tunnels")
+	autoRotateWeakKeys := flagSet.Bool("auto-rotate-weak-keys", false, fmt.Sprintf("Replace RSA tunnel keys smaller than %d bits at startup. Clients pick up the new key on their next poll", minRsaBits))
+	certConcurrency := flagSet.Int("cert-concurrency", 4, "Number of tunnel certificates to obtain in parallel at startup. Higher values start faster but are more likely to hit the CA's rate limits")
+	startupCertTimeout := flagSet.Duration("startup-cert-timeout", 5*time.Minute, "How long /readyz waits for startup certificates before reporting ready anyway")
+	tunnelCreateRate := flagSet.Float64("tunnel-create-rate", 10, "Tunnels each user can create per minute. 0 disables the limit")
+	tunnelCreateBurst := flagSet.Int("tunnel-create-burst", 20, "Tunnels each user can create at once before -tunnel-create-rate applies")
+	forcedCommand := flagSet.String("forced-command", defaultForcedCommand, "Command forced for tunnel keys in authorized_keys, ie a logging wrapper. Quotes must be escaped")
+	embeddedSsh := flagSet.Bool("embedded-ssh", false, "Run a built-in SSH server on -ssh-server-port instead of using the system sshd and authorized_keys")
+	sshHostKey := flagSet.String("ssh-host-key", "", "Host key file for -embedded-ssh, generated if missing. Defaults to boringproxy_ssh_host_key in -db-dir. To replace it with a key of the same type, put the new key at <file>.next first, so clients learn it before it's used")
+	sshMaxChannels := flagSet.Int("ssh-max-channels", 0, "With -embedded-ssh, the most connections forwarded to each tunnel's client at once, unless the tunnel sets max-channels. 0 for no limit")
+	sshKeepaliveInterval := flagSet.Duration("ssh-keepalive-interval", defaultKeepaliveInterval, "With -embedded-ssh, how often to check that each client is still there. 0 disables the checks. For the system sshd, set ClientAliveInterval instead")
+	sshKeepaliveMaxMissed := flagSet.Int("ssh-keepalive-max-missed", defaultKeepaliveMaxMissed, "How many keepalive checks in a row a client can leave unanswered before it's disconnected and its tunnel port freed")
+	sshHostKeyGrace := flagSet.Duration("ssh-host-key-grace", 7*24*time.Hour, "How long the previous -ssh-host-key is still advertised to clients, and presented to clients asking for its key type, after it's replaced")
+	recoverAuthorizedKeys := flagSet.Bool("recover-authorized-keys", false, "Add tunnels found in authorized_keys but missing from the database")
 	err := flagSet.Parse(os.Args[2:])
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "%s: parsing flags: %s\n", os.Args[0], err)
@@ -65,11 +189,123 @@ func Listen() {
 
 	log.Println("Starting up")
 
+	// Canceled on SIGINT/SIGTERM, which aborts any slow operations (ie
+	// waiting on the ACME server) so we can exit promptly.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	shutdownTracing, err := InitTracing(ctx, *otlpEndpoint, *otlpInsecure)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if !stringInArray(*keyType, sshKeyTypes) {
+		log.Fatalf("Invalid key type %s", *keyType)
+	}
+
+	if *tunnelPortMin < 1 || *tunnelPortMax > 65535 || *tunnelPortMin > *tunnelPortMax {
+		log.Fatalf("Invalid tunnel port range %d-%d", *tunnelPortMin, *tunnelPortMax)
+	}
+
+	err = validateForcedCommand(*forcedCommand)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *unmatchedSni != "" && *unmatchedSni != "reject" && *unmatchedSni != "admin-cert" {
+		log.Fatalf("Invalid -unmatched-sni %s", *unmatchedSni)
+	}
+
+	if !stringInArray(*keyFormat, sshKeyFormats) {
+		log.Fatalf("Invalid key format %s", *keyFormat)
+	}
+
+	if *rsaBits < minRsaBits {
+		log.Fatalf("Invalid -rsa-bits %d. Must be at least %d", *rsaBits, minRsaBits)
+	}
+
+	if *listenIp != "" {
+		err := checkLocalIp(*listenIp)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	if *certConcurrency < 1 {
+		log.Fatalf("Invalid -cert-concurrency %d. Must be at least 1", *certConcurrency)
+	}
+
+	if ip := net.ParseIP(*loopbackIp); ip == nil || !ip.IsLoopback() {
+		log.Fatalf("Invalid -loopback-ip %s. Must be a loopback address", *loopbackIp)
+	}
+
+	*baseDomain = strings.ToLower(strings.Trim(*baseDomain, "."))
+	if *baseDomain != "" && !strings.Contains(*baseDomain, ".") {
+		log.Fatalf("Invalid -base-domain %s", *baseDomain)
+	}
+
 	db, err := NewDatabase(*dbDir)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if *dbSaveInterval < 0 || *dbSaveBatch < 0 {
+		log.Fatal("-db-save-interval and -db-save-batch can't be negative")
+	}
+
+	if *dbSaveInterval > 0 {
+		db.SetBatching(*dbSaveBatch)
+		go db.AutoSave(ctx, *dbSaveInterval)
+	} else if *dbSaveBatch > 0 {
+		log.Fatal("-db-save-batch requires -db-save-interval")
+	}
+
+	if *routeCacheTtl < 0 {
+		log.Fatal("-route-cache-ttl can't be negative")
+	}
+
+	if *sshMaxChannels < 0 {
+		log.Fatal("-ssh-max-channels can't be negative")
+	}
+
+	if *sshKeepaliveInterval < 0 || *sshKeepaliveMaxMissed < 1 {
+		log.Fatal("-ssh-keepalive-interval can't be negative and -ssh-keepalive-max-missed must be at least 1")
+	}
+
+	if *secretsDir == "" {
+		*secretsDir = filepath.Join(*dbDir, "boringproxy_secrets")
+	}
+
+	if *sshHostKey == "" {
+		*sshHostKey = filepath.Join(*dbDir, "boringproxy_ssh_host_key")
+	}
+
+	tunnelPresets := make(map[string]map[string]string)
+	if *tunnelPresetsFile != "" {
+		tunnelPresets, err = LoadTunnelPresets(*tunnelPresetsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	var secretStore SecretStore
+	secretStore, err = NewFileSecretStore(*secretsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *secretsKeyFile != "" {
+		key, err := LoadSecretsKey(*secretsKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		secretStore, err = NewEncryptedSecretStore(secretStore, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
 	namedropClient := namedrop.NewClient(db, db.GetAdminDomain(), "takingnames.io/namedrop")
 
 	var ip string
@@ -100,10 +336,17 @@ func Listen() {
 	}
 
 	if *certDir != "" {
-		certmagic.Default.Storage = &certmagic.FileStorage{*certDir}
+		certmagic.Default.Storage = &certmagic.FileStorage{Path: *certDir}
 	}
-	//certmagic.DefaultACME.DisableHTTPChallenge = true
-	//certmagic.DefaultACME.DisableTLSALPNChallenge = true
+
+	challenges, err := parseAcmeChallenges(*acmeChallenges)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Owner ACME accounts inherit these from DefaultACME
+	certmagic.DefaultACME.DisableHTTPChallenge = !stringInArray("http-01", challenges)
+	certmagic.DefaultACME.DisableTLSALPNChallenge = !stringInArray("tls-alpn-01", challenges)
 
 	if *acmeEmail != "" {
 		certmagic.DefaultACME.Email = *acmeEmail
@@ -122,8 +365,21 @@ func Listen() {
 		certmagic.DefaultACME.CA = *acmeCa
 	}
 
+	// Challenges are normally answered through our own listeners (HTTP-01
+	// on the HTTP port, TLS-ALPN-01 via the acme-tls/1 protocol on the
+	// HTTPS port). If certmagic ever binds its own challenge listener
+	// (ie when it's not running on 80/443), it needs to use the same IP.
+	certmagic.DefaultACME.ListenHost = *listenIp
+
 	certConfig := certmagic.NewDefault()
 
+	// Also checked by NewTunnelManager, but the admin domain's cert is
+	// obtained first.
+	err = checkCertStorage(certConfig.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	if *newAdminDomain != "" {
 		db.SetAdminDomain(*newAdminDomain)
 	}
@@ -138,7 +394,7 @@ func Listen() {
 		}
 	} else {
 		if autoCerts {
-			err = certConfig.ManageSync(context.Background(), []string{adminDomain})
+			err = certConfig.ManageSync(ctx, []string{adminDomain})
 			if err != nil {
 				log.Fatal(err)
 			}
@@ -146,11 +402,13 @@ func Listen() {
 		}
 	}
 
+	aliases := splitList(*adminDomainAliases)
+
 	// Add admin user if it doesn't already exist
 	users := db.GetUsers()
 	if len(users) == 0 {
 		db.AddUser("admin", true)
-		_, err := db.AddToken("admin", "")
+		_, err := db.AddToken("admin", "", nil, "")
 		if err != nil {
 			log.Fatal("Failed to initialize admin user")
 		}
@@ -167,13 +425,71 @@ func Listen() {
 	}
 
 	config := &Config{
-		SshServerPort:  *sshServerPort,
-		PublicIp:       ip,
-		namedropClient: namedropClient,
-		autoCerts:      autoCerts,
+		SshServerPort:           *sshServerPort,
+		PublicIp:                ip,
+		RecoverAuthorizedKeys:   *recoverAuthorizedKeys,
+		HstsMaxAge:              *hstsMaxAge,
+		HstsIncludeSubdomains:   *hstsIncludeSubdomains,
+		HstsPreload:             *hstsPreload,
+		CertConcurrency:         *certConcurrency,
+		StartupCertTimeout:      *startupCertTimeout,
+		LazyCerts:               *lazyCerts,
+		ListenIp:                *listenIp,
+		LoopbackIp:              *loopbackIp,
+		KeyType:                 *keyType,
+		RsaBits:                 *rsaBits,
+		KeyFormat:               *keyFormat,
+		AutoRotateWeakKeys:      *autoRotateWeakKeys,
+		BackendMaxIdleConns:     *backendMaxIdleConns,
+		BackendIdleTimeout:      *backendIdleTimeout,
+		TunnelCreateRate:        *tunnelCreateRate,
+		TunnelCreateBurst:       *tunnelCreateBurst,
+		MaxTunnels:              *maxTunnels,
+		TunnelPortMin:           *tunnelPortMin,
+		TunnelPortMax:           *tunnelPortMax,
+		PortReuseGrace:          *portReuseGrace,
+		DefaultTunnel:           *defaultTunnel,
+		UnmatchedSni:            *unmatchedSni,
+		AuthorizedKeysTimeout:   *authorizedKeysTimeout,
+		IdleTimeout:             *idleTimeout,
+		IdleGracePeriod:         *idleGracePeriod,
+		IdleDryRun:              *idleDryRun,
+		IdleWebhook:             *idleWebhook,
+		IdleSkipConnected:       *idleSkipConnected,
+		PreflightDnsCheck:       *preflightDnsCheck,
+		PreflightDnsStrict:      *preflightDnsStrict,
+		AdmissionWebhook:        *admissionWebhook,
+		AdmissionFailOpen:       *admissionFailOpen,
+		BaseDomain:              *baseDomain,
+		DbSaveInterval:          *dbSaveInterval,
+		DbSaveBatch:             *dbSaveBatch,
+		RouteCacheTtl:           *routeCacheTtl,
+		SshMaxChannels:          *sshMaxChannels,
+		SshKeepaliveInterval:    *sshKeepaliveInterval,
+		SshKeepaliveMaxMissed:   *sshKeepaliveMaxMissed,
+		Http3:                   *http3,
+		AllowSelfSignedFallback: *allowSelfSignedFallback,
+		EmbeddedSsh:             *embeddedSsh,
+		ForcedCommand:           *forcedCommand,
+		TunnelPresets:           tunnelPresets,
+		AdminDomainAliases:      aliases,
+		SshHostKeyPath:          *sshHostKey,
+		namedropClient:          namedropClient,
+		secretStore:             secretStore,
+		autoCerts:               autoCerts,
+
+		ConnectionRequiresJoinToken: *connectionRequiresJoinToken,
+		SshHostKeyGrace:             *sshHostKeyGrace,
+		BehindProxy:                 *behindProxy,
 	}
 
-	tunMan := NewTunnelManager(config, db, certConfig)
+	tunMan := NewTunnelManager(ctx, config, db, certConfig)
+
+	// Lets out-of-band changes to the database take effect without a
+	// restart.
+	reloadSignals := make(chan os.Signal, 1)
+	notifyReload(reloadSignals)
+	go watchReloads(ctx, tunMan, reloadSignals)
 
 	auth := NewAuth(db)
 
@@ -181,21 +497,48 @@ func Listen() {
 
 	webUiHandler := NewWebUiHandler(config, db, api, auth)
 
-	httpClient := &http.Client{
-		// Don't follow redirects
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+	errorPages, err := LoadErrorPages(*errorPagesDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	landingPage, err := NewLandingPageHandler(*landingPageDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Used to answer HTTP-01 challenges. This needs to happen before any
+	// other handling of port 80 requests.
+	acmeManager, ok := certConfig.Issuers[0].(*certmagic.ACMEManager)
+	if !ok {
+		log.Fatal("Cert config has no ACME issuer, can't answer HTTP-01 challenges")
 	}
 
 	httpListener := NewPassthroughListener()
 
-	p := &Server{db, tunMan, httpClient, httpListener}
+	getCertificate := certConfig.GetCertificate
+	if *unmatchedSni == "admin-cert" {
+		getCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, err := certConfig.GetCertificate(hello)
+			if err != nil && !db.HasDomain(hello.ServerName) {
+				adminHello := *hello
+				adminHello.ServerName = db.GetAdminDomain()
+				return certConfig.GetCertificate(&adminHello)
+			}
+			return cert, err
+		}
+	}
 
 	tlsConfig := &tls.Config{
-		GetCertificate: certConfig.GetCertificate,
+		GetCertificate: getCertificate,
 		NextProtos:     []string{"h2", "acme-tls/1"},
+		MinVersion:     tls.VersionTLS12,
 	}
+
+	p := &Server{db, tunMan, httpListener, tlsConfig}
+
+	tlsConfig.GetConfigForClient = p.getTlsConfigForClient
+
 	tlsListener := tls.NewListener(httpListener, tlsConfig)
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
@@ -212,6 +555,13 @@ func Listen() {
 		hostParts := strings.Split(r.Host, ":")
 		hostDomain := hostParts[0]
 
+		// Load balancers usually check by IP, so this is answered for any
+		// host without a tunnel, as well as the admin domain.
+		if r.URL.Path == "/readyz" && (isAdminDomain(db, config, hostDomain) || !db.HasDomain(hostDomain)) {
+			handleReadyz(w, tunMan)
+			return
+		}
+
 		if r.URL.Path == "/namedrop/callback" {
 			r.ParseForm()
 
@@ -288,66 +638,217 @@ func Listen() {
 				http.Redirect(w, r, fmt.Sprintf("https://%s/edit-tunnel?domain=%s", adminDomain, fqdn), 303)
 			}
 
-		} else if hostDomain == db.GetAdminDomain() {
-			if strings.HasPrefix(r.URL.Path, "/api/") {
+		} else if isAdminDomain(db, config, hostDomain) {
+			if r.URL.Path == "/metrics" {
+				api.handleMetrics(w, r)
+			} else if strings.HasPrefix(r.URL.Path, "/api/") {
 				http.StripPrefix("/api", api).ServeHTTP(w, r)
 			} else {
 				webUiHandler.handleWebUiRequest(w, r)
 			}
 		} else {
 
-			tunnel, exists := db.GetTunnel(hostDomain)
+			tunnel, exists := tunMan.routeRequest(hostDomain, r.URL.Path)
 			if !exists {
-				errMessage := fmt.Sprintf("No tunnel attached to %s", hostDomain)
-				w.WriteHeader(500)
-				io.WriteString(w, errMessage)
+				landingPage.ServeHTTP(w, r)
+				return
+			}
+
+			tunMan.conns.CountRequest(tunnelKey(tunnel))
+
+			// The handshake only asks for a client cert when SNI
+			// exactly matches the tunnel, so check here too for
+			// requests that got to it some other way, ie wildcards,
+			// the default tunnel, or plain HTTP.
+			if tunnel.RequireClientCert && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+				w.WriteHeader(403)
+				io.WriteString(w, "Client certificate required")
+				return
+			}
+
+			if tunnel.RedirectTo != "" {
+				location, code := redirectLocation(tunnel, r, *behindProxy)
+				http.Redirect(w, r, location, code)
+				return
+			}
+
+			if !tunnelScheduleOpen(tunnel, time.Now()) {
+				w.WriteHeader(503)
+				io.WriteString(w, "Tunnel is outside its scheduled hours")
 				return
 			}
 
-			proxyRequest(w, r, tunnel, httpClient, "localhost", tunnel.TunnelPort, *behindProxy)
+			if tunnel.HstsMaxAge == 0 {
+				tunnel.HstsMaxAge = config.HstsMaxAge
+				tunnel.HstsIncludeSubdomains = config.HstsIncludeSubdomains
+				tunnel.HstsPreload = config.HstsPreload
+			}
+
+			done := tunMan.conns.Begin(tunnelKey(tunnel))
+			httpClient := tunMan.BackendClient(tunnel)
+			proxyRequest(w, r, tunnel, httpClient, tunnelLoopbackIp(tunnel), tunnel.TunnelPort, *behindProxy, errorPages)
+			done()
 		}
 	})
 
+	// Both listeners are bound before anything is served (with
+	// -allow-http the API is served on the plain one) and before any
+	// certs are obtained, so challenges are answered by them (see
+	// TunnelManager.StartCerts).
+	plainListener, err := net.Listen("tcp", net.JoinHostPort(*listenIp, strconv.Itoa(*httpPort)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort(*listenIp, strconv.Itoa(*httpsPort)))
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	go func() {
 
 		if *allowHttp {
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), nil); err != nil {
-				log.Fatalf("ListenAndServe error: %v", err)
+			if err := http.Serve(plainListener, wellKnownHandler(acmeManager, tunMan, http.DefaultServeMux)); err != nil {
+				log.Fatalf("HTTP server error: %v", err)
 			}
 		} else {
 			redirectTLS := func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path == "/readyz" {
+					handleReadyz(w, tunMan)
+					return
+				}
+
 				url := fmt.Sprintf("https://%s:%d%s", r.Host, *httpsPort, r.RequestURI)
 				http.Redirect(w, r, url, http.StatusMovedPermanently)
 			}
 
-			if err := http.ListenAndServe(fmt.Sprintf(":%d", *httpPort), http.HandlerFunc(redirectTLS)); err != nil {
-				log.Fatalf("ListenAndServe error: %v", err)
+			if err := http.Serve(plainListener, wellKnownHandler(acmeManager, tunMan, http.HandlerFunc(redirectTLS))); err != nil {
+				log.Fatalf("HTTP server error: %v", err)
 			}
 		}
 
 	}()
 
-	go http.Serve(tlsListener, nil)
+	tlsHandler := httpsHandler(config, *httpsPort, http.DefaultServeMux)
+	if *http3 {
+		go serveHttp3(ctx, net.JoinHostPort(*listenIp, strconv.Itoa(*httpsPort)), tlsConfig, http.DefaultServeMux)
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *httpsPort))
-	if err != nil {
-		log.Fatal(err)
+	go http.Serve(tlsListener, tlsHandler)
+
+	tunMan.StartCerts()
+
+	// Like the tunnels' certs, these are only obtained once the listeners
+	// are bound. The accept loop below has to be running to answer
+	// TLS-ALPN challenges, so this can't block.
+	if autoCerts && len(aliases) > 0 {
+		go manageAdminDomainAliases(ctx, certConfig, aliases)
 	}
 
 	log.Println("Ready")
 
+	go func() {
+		<-ctx.Done()
+		log.Println("Shutting down")
+		listener.Close()
+	}()
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
 			log.Print(err)
 			continue
 		}
 
-		go p.handleConnection(conn, certConfig)
+		go p.handleConnection(conn)
+	}
+
+	err = db.Flush()
+	if err != nil {
+		log.Println("Failed to save database:", err)
+	}
+
+	err = shutdownTracing(context.Background())
+	if err != nil {
+		log.Println("Failed to flush traces:", err)
+	}
+}
+
+// isAdminDomain reports whether domain is the admin domain or one of its
+// aliases.
+func isAdminDomain(db *Database, config *Config, domain string) bool {
+	return domain == db.GetAdminDomain() || stringInArray(domain, config.AdminDomainAliases)
+}
+
+// manageAdminDomainAliases gets certs for the admin domain aliases,
+// blocking until they're obtained.
+func manageAdminDomainAliases(ctx context.Context, certConfig *certmagic.Config, aliases []string) error {
+	err := certConfig.ManageSync(ctx, aliases)
+	if err != nil {
+		log.Printf("Failed to get certificates for admin domain aliases: %v", err)
+		return err
+	}
+	log.Printf("Successfully acquired certificates for admin domain aliases (%s)", strings.Join(aliases, ", "))
+	return nil
+}
+
+// handleReadyz reports 503 until the tunnel manager has finished getting
+// certs at startup.
+func handleReadyz(w http.ResponseWriter, tunMan *TunnelManager) {
+	if !tunMan.Ready() {
+		w.WriteHeader(503)
+		io.WriteString(w, "Not ready")
+		return
+	}
+
+	io.WriteString(w, "Ready")
+}
+
+// getTlsConfigForClient applies per-tunnel TLS policies based on SNI.
+func (p *Server) getTlsConfigForClient(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+	tunnel, exists := p.tunMan.routes.MatchDomain(hello.ServerName)
+	if !exists {
+		return nil, nil
+	}
+
+	// ACME TLS-ALPN challenges don't come with a client cert
+	if isAcmeChallengeHello(hello) {
+		tunnel.RequireClientCert = false
+	}
+
+	config, err := tunnelTlsConfig(p.tlsConfig, tunnel)
+	if err != nil {
+		return nil, err
+	}
+
+	// Certs from other ACME accounts live in their own cache. Self-signed
+	// certs are always in the default one.
+	certConfig, err := p.tunMan.certConfigForTunnel(tunnel)
+	if err != nil {
+		return nil, err
+	}
+	if tunnel.TlsTermination != "self-signed" && certConfig != p.tunMan.certConfig {
+		if config == nil {
+			config = p.tlsConfig.Clone()
+			config.GetConfigForClient = nil
+		}
+		config.GetCertificate = certConfig.GetCertificate
 	}
+
+	return config, nil
+}
+
+// isAcmeChallengeHello reports whether hello is from an ACME TLS-ALPN
+// challenge. The CA offers acme-tls/1 and nothing else. Anything that also
+// offers another protocol could go on to use it, so it's a regular client.
+func isAcmeChallengeHello(hello *tls.ClientHelloInfo) bool {
+	return len(hello.SupportedProtos) == 1 && hello.SupportedProtos[0] == "acme-tls/1"
 }
 
-func (p *Server) handleConnection(clientConn net.Conn, certConfig *certmagic.Config) {
+func (p *Server) handleConnection(clientConn net.Conn) {
 
 	clientHello, clientReader, err := peekClientHello(clientConn)
 	if err != nil {
@@ -357,33 +858,69 @@ func (p *Server) handleConnection(clientConn net.Conn, certConfig *certmagic.Con
 
 	passConn := NewProxyConn(clientConn, clientReader)
 
-	tunnel, exists := p.db.GetTunnel(clientHello.ServerName)
+	tunnel, exists := p.tunMan.routes.MatchDomain(clientHello.ServerName)
 
-	if exists && (tunnel.TlsTermination == "client" || tunnel.TlsTermination == "passthrough") || tunnel.TlsTermination == "client-tls" {
+	if exists {
+		passConn.counter = p.tunMan.conns.counter(tunnelKey(tunnel))
+	}
+
+	if exists && (tunnel.TlsTermination == "client" || tunnel.TlsTermination == "passthrough" || tunnel.TlsTermination == "client-tls") {
+		defer p.tunMan.conns.Begin(tunnelKey(tunnel))()
 		p.passthroughRequest(passConn, tunnel)
 	} else if exists && tunnel.TlsTermination == "server-tls" {
-		useTls := true
-		err := ProxyTcp(passConn, "127.0.0.1", tunnel.TunnelPort, useTls, certConfig)
+		defer p.tunMan.conns.Begin(tunnelKey(tunnel))()
+		err := ProxyTcp(passConn, tunnelLoopbackIp(tunnel), tunnel.TunnelPort, p.tlsConfig, nil)
 		if err != nil {
 			log.Println(err.Error())
 			return
 		}
+	} else if !exists && p.rejectUnmatchedSni(clientHello) {
+		log.Printf("Rejecting TLS connection for unknown domain %q", clientHello.ServerName)
+		clientConn.Close()
 	} else {
 		p.httpListener.PassConn(passConn)
 	}
 }
 
+// rejectUnmatchedSni reports whether a connection for a domain without a
+// tunnel should be closed rather than handed to the HTTPS server. ACME
+// TLS-ALPN challenges are always let through, since they happen before a new
+// tunnel is added.
+func (p *Server) rejectUnmatchedSni(hello *tls.ClientHelloInfo) bool {
+	if p.tunMan.config.UnmatchedSni != "reject" {
+		return false
+	}
+
+	if isAcmeChallengeHello(hello) {
+		return false
+	}
+
+	_, exists := p.tunMan.routes.MatchDomain(hello.ServerName)
+
+	return !exists && !isAdminDomain(p.db, p.tunMan.config, hello.ServerName)
+}
+
 func (p *Server) passthroughRequest(conn net.Conn, tunnel Tunnel) {
 
-	upstreamAddr := fmt.Sprintf("localhost:%d", tunnel.TunnelPort)
-	upstreamConn, err := net.Dial("tcp", upstreamAddr)
+	ctx, span := tracer.Start(context.Background(), "passthrough", trace.WithAttributes(
+		attribute.String("domain", tunnel.Domain),
+	))
+	defer span.End()
+
+	_, dialSpan := tracer.Start(ctx, "dial backend")
+	upstreamConn, err := net.Dial("tcp", backendAddr(tunnel))
+	dialSpan.End()
 
 	if err != nil {
 		log.Print(err)
+		span.RecordError(err)
 		return
 	}
 	defer upstreamConn.Close()
 
+	_, copySpan := tracer.Start(ctx, "copy")
+	defer copySpan.End()
+
 	var wg sync.WaitGroup
 	wg.Add(2)
 
@@ -401,6 +938,23 @@ func (p *Server) passthroughRequest(conn net.Conn, tunnel Tunnel) {
 	wg.Wait()
 }
 
+// watchReloads reloads the tunnels whenever a signal arrives on signals,
+// until ctx is done.
+func watchReloads(ctx context.Context, tunMan *TunnelManager, signals <-chan os.Signal) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-signals:
+			log.Println("Reloading tunnels")
+			err := tunMan.ReloadTunnels()
+			if err != nil {
+				log.Printf("Failed to reload tunnels: %v", err)
+			}
+		}
+	}
+}
+
 func setAdminDomain(certConfig *certmagic.Config, db *Database, namedropClient *namedrop.Client, autoCerts bool) error {
 	action := prompt("\nNo admin domain set. Select an option below:\nEnter '1' to input manually\nEnter '2' to configure through TakingNames.io\n")
 	switch action {
@@ -425,7 +979,7 @@ func setAdminDomain(certConfig *certmagic.Config, db *Database, namedropClient *
 		}
 
 		qrterminal.GenerateHalfBlock(namedropLink, qrterminal.L, os.Stdout)
-		fmt.Println("Use the link below or scan the QR code above to select an admin domain:\n")
+		fmt.Print("Use the link below or scan the QR code above to select an admin domain:\n\n")
 		fmt.Printf("%s\n\n", namedropLink)
 
 	default:
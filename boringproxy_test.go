@@ -0,0 +1,53 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+)
+
+func TestAdminDomainAliases(t *testing.T) {
+	m := newTestTunnelManager(t)
+	issuer := &testIssuer{issued: make(chan string, 2)}
+	newTestCertConfig(t, m, issuer)
+
+	aliases := []string{"ui.example.com", "admin.example.org"}
+
+	m.db.SetAdminDomain("admin.example.com")
+	m.config.AdminDomainAliases = aliases
+	m.config.UnmatchedSni = "reject"
+
+	err := manageAdminDomainAliases(context.Background(), m.certConfig, aliases)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: m.certConfig.GetCertificate}
+	p := &Server{db: m.db, tunMan: m, tlsConfig: tlsConfig}
+
+	for _, alias := range aliases {
+		if !hasCert(m.certConfig, alias) {
+			t.Errorf("Expected a cert for %s", alias)
+		}
+
+		err := clientHandshake(tlsConfig, alias)
+		if err != nil {
+			t.Errorf("Expected the handshake for %s to succeed: %v", alias, err)
+		}
+
+		if !isAdminDomain(m.db, m.config, alias) {
+			t.Errorf("Expected %s to be served the admin UI", alias)
+		}
+
+		if p.rejectUnmatchedSni(&tls.ClientHelloInfo{ServerName: alias}) {
+			t.Errorf("Expected connections for %s to be let through", alias)
+		}
+	}
+
+	if isAdminDomain(m.db, m.config, "other.example.com") {
+		t.Error("Expected other domains not to be served the admin UI")
+	}
+	if !p.rejectUnmatchedSni(&tls.ClientHelloInfo{ServerName: "other.example.com"}) {
+		t.Error("Expected connections for other domains to be rejected")
+	}
+}
@@ -0,0 +1,91 @@
+package boringproxy
+
+import (
+	"sync"
+)
+
+// Values of Tunnel.CertStatus
+const (
+	// The server has a cert for the tunnel from the CA
+	CertStatusManaged = "managed"
+	// The tunnel uses a cert that didn't come from the CA, currently only
+	// the self-signed fallback
+	CertStatusCustom = "custom"
+	// The server terminates TLS for the tunnel but hasn't obtained a cert
+	// yet, ie with lazy certs or while startup certs are in progress
+	CertStatusPending = "pending"
+	// The last attempt to obtain a cert failed
+	CertStatusFailed = "failed"
+	// The server doesn't need a cert for the tunnel
+	CertStatusNone = "none"
+)
+
+// certStatuses tracks the outcome of cert attempts by domain. Domains
+// without an entry are pending.
+type certStatuses struct {
+	statuses map[string]string
+	mutex    *sync.Mutex
+}
+
+func newCertStatuses() *certStatuses {
+	return &certStatuses{
+		statuses: make(map[string]string),
+		mutex:    &sync.Mutex{},
+	}
+}
+
+func (s *certStatuses) Set(domain, status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.statuses[domain] = status
+}
+
+func (s *certStatuses) Get(domain string) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	status, exists := s.statuses[domain]
+	return status, exists
+}
+
+func (s *certStatuses) Forget(domain string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.statuses, domain)
+}
+
+// onCertEvent is set as the OnEvent hook of the manager's certmagic
+// configs, so certs obtained on demand or renewed in the background are
+// reflected too. certmagic doesn't emit events for failures, so those are
+// only recorded where we call it ourselves.
+func (m *TunnelManager) onCertEvent(event string, data interface{}) {
+	switch event {
+	case "cert_obtained", "cert_renewed":
+		if domain, ok := data.(string); ok {
+			m.certStatuses.Set(domain, CertStatusManaged)
+		}
+	case "cached_managed_cert":
+		if names, ok := data.([]string); ok {
+			for _, name := range names {
+				m.certStatuses.Set(name, CertStatusManaged)
+			}
+		}
+	}
+}
+
+// tunnelCertStatus returns the CertStatus for tun.
+func (m *TunnelManager) tunnelCertStatus(tun Tunnel) string {
+	if tun.TlsTermination == "self-signed" {
+		return CertStatusCustom
+	}
+
+	if !m.config.autoCerts || (tun.TlsTermination != "server" && tun.TlsTermination != "server-tls") {
+		return CertStatusNone
+	}
+
+	status, exists := m.certStatuses.Get(tun.Domain)
+	if !exists {
+		return CertStatusPending
+	}
+
+	return status
+}
@@ -0,0 +1,58 @@
+package boringproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+)
+
+func TestCertStatusTransitions(t *testing.T) {
+	m := newTestTunnelManager(t)
+	newTestCertConfig(t, m, &testIssuer{err: errors.New("CA unreachable")})
+
+	domain := "app.example.com"
+	m.db.SetTunnel(domain, Tunnel{Domain: domain, TlsTermination: "server"})
+	m.db.SetTunnel("client.example.com", Tunnel{Domain: "client.example.com", TlsTermination: "client"})
+	m.db.SetTunnel("internal.example.com", Tunnel{Domain: "internal.example.com", TlsTermination: "self-signed"})
+
+	certStatus := func(key string) string {
+		t.Helper()
+		tun, exists := m.GetTunnelDetails(key)
+		if !exists {
+			t.Fatalf("Tunnel %s doesn't exist", key)
+		}
+		return tun.CertStatus
+	}
+
+	if status := certStatus(domain); status != CertStatusPending {
+		t.Errorf("Expected %s before startup certs, got %s", CertStatusPending, status)
+	}
+
+	errs := m.manageStartupCerts(context.Background(), m.db.GetTunnels())
+	if len(errs) != 1 || !errors.Is(errs[0], ErrCertFailed) {
+		t.Fatalf("Expected a cert error, got %v", errs)
+	}
+
+	if status := certStatus(domain); status != CertStatusFailed {
+		t.Errorf("Expected %s after the CA failed, got %s", CertStatusFailed, status)
+	}
+
+	// ie a later on-demand attempt or renewal succeeded
+	m.onCertEvent("cert_obtained", domain)
+
+	if status := certStatus(domain); status != CertStatusManaged {
+		t.Errorf("Expected %s after a cert was obtained, got %s", CertStatusManaged, status)
+	}
+
+	if m.GetTunnels()[domain].CertStatus != CertStatusManaged {
+		t.Errorf("Expected GetTunnels to report the same status")
+	}
+
+	if status := certStatus("client.example.com"); status != CertStatusNone {
+		t.Errorf("Expected %s for client termination, got %s", CertStatusNone, status)
+	}
+
+	if status := certStatus("internal.example.com"); status != CertStatusCustom {
+		t.Errorf("Expected %s for self-signed, got %s", CertStatusCustom, status)
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/boringproxy/boringproxy"
+)
+
+func TestJsonResultEnvelope(t *testing.T) {
+	cases := []struct {
+		data     interface{}
+		err      error
+		expected map[string]interface{}
+	}{
+		{
+			data:     pruneResult{Removed: []string{"line"}, Applied: true},
+			expected: map[string]interface{}{"ok": true, "data": map[string]interface{}{"removed": []interface{}{"line"}, "applied": true}},
+		},
+		{
+			data:     tunnelResult(boringproxy.Tunnel{Domain: "app.example.com"}, errors.New("Tunnel exists")),
+			err:      errors.New("Tunnel exists"),
+			expected: map[string]interface{}{"ok": false, "error": "Tunnel exists"},
+		},
+		{
+			expected: map[string]interface{}{"ok": true},
+		},
+	}
+
+	for _, c := range cases {
+		var buf bytes.Buffer
+		err := writeJsonResult(&buf, c.data, c.err)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var result map[string]interface{}
+		err = json.Unmarshal(buf.Bytes(), &result)
+		if err != nil {
+			t.Fatalf("Invalid JSON %q: %v", buf.String(), err)
+		}
+
+		expected, _ := json.Marshal(c.expected)
+		actual, _ := json.Marshal(result)
+		if !bytes.Equal(expected, actual) {
+			t.Errorf("Expected %s, got %s", expected, actual)
+		}
+	}
+}
+
+func TestApplyTunnelsFile(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("{}"))
+	}))
+	defer server.Close()
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	defer func() { http.DefaultClient = defaultClient }()
+
+	addr := strings.TrimPrefix(server.URL, "https://")
+	dir := t.TempDir()
+
+	// The example from the README
+	jsonPath := filepath.Join(dir, "tunnels.json")
+	err := os.WriteFile(jsonPath, []byte(`[
+  {
+    "domain": "demo.example.com",
+    "owner": "demo-user",
+    "clientName": "demo-client",
+    "clientPort": 8080,
+    "tlsTermination": "client"
+  }
+]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := applyTunnelsFile(addr, "token", jsonPath, true, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes.Create) != 1 || changes.Create[0] != "demo.example.com" || changes.Applied {
+		t.Errorf("Expected a dry run creating demo.example.com, got %+v", changes)
+	}
+
+	yamlPath := filepath.Join(dir, "tunnels.yaml")
+	err = os.WriteFile(yamlPath, []byte("- domain: demo.example.com\n  owner: demo-user\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = applyTunnelsFile(addr, "token", yamlPath, true, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "JSON") {
+		t.Errorf("Expected YAML to be rejected as not JSON, got %v", err)
+	}
+}
@@ -0,0 +1,374 @@
+package boringproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnTracker keeps track of which tunnel ports currently have a client
+// connected. Since the reverse tunnels are handled by the OS sshd, a port is
+// considered connected while something is listening on it, which is checked
+// by periodically reading /proc/net/tcp. On systems without procfs the
+// state is never updated unless SetConnected is called.
+//
+// It also keeps traffic counters for each tunnel domain.
+type ConnTracker struct {
+	ports    map[int]bool
+	counters map[string]*trafficCounter
+	mutex    *sync.Mutex
+	// Address of the SSH client serving each connected port, if it could
+	// be determined
+	remoteAddrs map[int]string
+}
+
+// trafficCounter is updated atomically, since it's hit on every read and
+// write.
+type trafficCounter struct {
+	active   int64
+	bytesIn  int64
+	bytesOut int64
+	// HTTP requests routed to the tunnel
+	requests int64
+	// Unix nanoseconds
+	lastActivity int64
+}
+
+func NewConnTracker() *ConnTracker {
+	return &ConnTracker{
+		ports:       make(map[int]bool),
+		counters:    make(map[string]*trafficCounter),
+		mutex:       &sync.Mutex{},
+		remoteAddrs: make(map[int]string),
+	}
+}
+
+func (t *ConnTracker) counter(domain string) *trafficCounter {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	counter, exists := t.counters[domain]
+	if !exists {
+		counter = &trafficCounter{}
+		t.counters[domain] = counter
+	}
+
+	return counter
+}
+
+// Begin records a new active connection or request for domain. The returned
+// function must be called when it's finished, which also counts as
+// activity so a long-lived connection isn't idle as soon as it closes.
+func (t *ConnTracker) Begin(domain string) func() {
+	counter := t.counter(domain)
+	atomic.AddInt64(&counter.active, 1)
+	atomic.StoreInt64(&counter.lastActivity, time.Now().UnixNano())
+	return func() {
+		atomic.AddInt64(&counter.active, -1)
+		atomic.StoreInt64(&counter.lastActivity, time.Now().UnixNano())
+	}
+}
+
+// CountRequest records that an HTTP request was routed to domain.
+func (t *ConnTracker) CountRequest(domain string) {
+	atomic.AddInt64(&t.counter(domain).requests, 1)
+}
+
+// Requests returns how many HTTP requests were routed to domain.
+func (t *ConnTracker) Requests(domain string) int64 {
+	return atomic.LoadInt64(&t.counter(domain).requests)
+}
+
+// Stats returns the current traffic stats for domain.
+func (t *ConnTracker) Stats(domain string) TunnelStats {
+	counter := t.counter(domain)
+	return TunnelStats{
+		ActiveConnections: int(atomic.LoadInt64(&counter.active)),
+		BytesIn:           atomic.LoadInt64(&counter.bytesIn),
+		BytesOut:          atomic.LoadInt64(&counter.bytesOut),
+	}
+}
+
+// LastActivity returns when a connection or request for domain last started
+// or finished, or the zero time if none has since startup.
+func (t *ConnTracker) LastActivity(domain string) time.Time {
+	nanos := atomic.LoadInt64(&t.counter(domain).lastActivity)
+	if nanos == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, nanos)
+}
+
+// Forget drops the stats for domain, ie when its tunnel is deleted.
+func (t *ConnTracker) Forget(domain string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	delete(t.counters, domain)
+}
+
+func (t *ConnTracker) IsConnected(port int) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.ports[port]
+}
+
+// SetConnected records a connect or disconnect event for port.
+func (t *ConnTracker) SetConnected(port int, connected bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.ports[port] == connected {
+		return
+	}
+
+	if connected {
+		log.Printf("Tunnel port %d connected", port)
+		t.ports[port] = true
+	} else {
+		log.Printf("Tunnel port %d disconnected", port)
+		delete(t.ports, port)
+		delete(t.remoteAddrs, port)
+	}
+}
+
+// SetRemoteAddr records the address of the SSH client serving port. It's
+// forgotten when the port disconnects.
+func (t *ConnTracker) SetRemoteAddr(port int, remoteAddr string) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	log.Printf("Tunnel port %d connected from %s", port, remoteAddr)
+	t.remoteAddrs[port] = remoteAddr
+}
+
+// RemoteAddr returns the address of the SSH client serving port, or "" if
+// it's not connected or the address is unknown.
+func (t *ConnTracker) RemoteAddr(port int) string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.remoteAddrs[port]
+}
+
+// Poll updates the state of ports every interval until ctx is done. sshPort
+// is the port sshd accepts client connections on.
+func (t *ConnTracker) Poll(ctx context.Context, interval time.Duration, sshPort int, ports func() []int) {
+
+	for {
+		entries, err := readProcNetTcp()
+		if err != nil {
+			log.Printf("Tunnel connection tracking disabled: %v", err)
+			return
+		}
+
+		listening := make(map[int]uint64)
+		for _, entry := range entries {
+			if entry.state == tcpListen {
+				listening[entry.localPort] = entry.inode
+			}
+		}
+
+		for _, port := range ports() {
+			inode, connected := listening[port]
+			wasConnected := t.IsConnected(port)
+
+			t.SetConnected(port, connected)
+
+			if connected && !wasConnected {
+				remoteAddr, err := sshRemoteAddr(entries, sshPort, inode)
+				if err == nil {
+					t.SetRemoteAddr(port, remoteAddr)
+				}
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+const (
+	tcpEstablished = "01"
+	tcpListen      = "0A"
+)
+
+type procTcpEntry struct {
+	localPort  int
+	remoteAddr string
+	state      string
+	inode      uint64
+}
+
+// readProcNetTcp parses the TCP sockets in /proc/net/tcp and /proc/net/tcp6.
+func readProcNetTcp() ([]procTcpEntry, error) {
+	entries := []procTcpEntry{}
+
+	for _, path := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(path)
+		if os.IsNotExist(err) && path == "/proc/net/tcp6" {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(f)
+
+		// Skip header
+		scanner.Scan()
+
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 10 {
+				continue
+			}
+
+			_, localPort, err := parseProcAddr(fields[1])
+			if err != nil {
+				continue
+			}
+
+			remoteIp, remotePort, err := parseProcAddr(fields[2])
+			if err != nil {
+				continue
+			}
+
+			inode, err := strconv.ParseUint(fields[9], 10, 64)
+			if err != nil {
+				continue
+			}
+
+			entries = append(entries, procTcpEntry{
+				localPort:  localPort,
+				remoteAddr: net.JoinHostPort(remoteIp.String(), strconv.Itoa(remotePort)),
+				state:      fields[3],
+				inode:      inode,
+			})
+		}
+
+		err = scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return entries, nil
+}
+
+// parseProcAddr parses an address like "0100007F:0016". The IP is stored as
+// native endian 32-bit words, which is little endian on all the platforms we
+// run on.
+func parseProcAddr(addr string) (net.IP, int, error) {
+	parts := strings.Split(addr, ":")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("Invalid address %s", addr)
+	}
+
+	ipBytes, err := hex.DecodeString(parts[0])
+	if err != nil || (len(ipBytes) != 4 && len(ipBytes) != 16) {
+		return nil, 0, fmt.Errorf("Invalid address %s", addr)
+	}
+
+	for i := 0; i < len(ipBytes); i += 4 {
+		ipBytes[i], ipBytes[i+1], ipBytes[i+2], ipBytes[i+3] = ipBytes[i+3], ipBytes[i+2], ipBytes[i+1], ipBytes[i]
+	}
+
+	port, err := strconv.ParseInt(parts[1], 16, 32)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return net.IP(ipBytes), int(port), nil
+}
+
+// sshRemoteAddr finds the address of the SSH client that opened the
+// listener with the given socket inode. The sshd process holding the
+// listener also holds the client's connection, which is its established
+// socket on sshPort. Only works for processes running as the same user as
+// us.
+func sshRemoteAddr(entries []procTcpEntry, sshPort int, inode uint64) (string, error) {
+	inodes, err := sshdSocketInodes(inode)
+	if err != nil {
+		return "", err
+	}
+
+	return sshConnRemoteAddr(entries, sshPort, inodes)
+}
+
+// sshConnRemoteAddr returns the remote address of the connection to sshPort
+// among the sockets in inodes.
+func sshConnRemoteAddr(entries []procTcpEntry, sshPort int, inodes map[uint64]bool) (string, error) {
+	for _, entry := range entries {
+		if entry.state == tcpEstablished && entry.localPort == sshPort && inodes[entry.inode] {
+			return entry.remoteAddr, nil
+		}
+	}
+
+	return "", fmt.Errorf("No SSH connection found on port %d", sshPort)
+}
+
+// sshdSocketInodes returns the inodes of all the sockets held by the sshd
+// process holding the socket with the given inode. Other processes aren't
+// looked at, so this doesn't read every fd on the system.
+func sshdSocketInodes(inode uint64) (map[uint64]bool, error) {
+	target := fmt.Sprintf("socket:[%d]", inode)
+
+	procDirs, err := filepath.Glob("/proc/[0-9]*")
+	if err != nil {
+		return nil, err
+	}
+
+	for _, procDir := range procDirs {
+		// The per-connection process is sshd, or sshd-session since
+		// OpenSSH 9.8
+		comm, err := ioutil.ReadFile(filepath.Join(procDir, "comm"))
+		if err != nil || !strings.HasPrefix(string(comm), "sshd") {
+			continue
+		}
+
+		fdDir := filepath.Join(procDir, "fd")
+
+		fds, err := ioutil.ReadDir(fdDir)
+		if err != nil {
+			continue
+		}
+
+		inodes := make(map[uint64]bool)
+		found := false
+
+		for _, fd := range fds {
+			link, err := os.Readlink(filepath.Join(fdDir, fd.Name()))
+			if err != nil || !strings.HasPrefix(link, "socket:[") {
+				continue
+			}
+
+			if link == target {
+				found = true
+			}
+
+			n, err := strconv.ParseUint(strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]"), 10, 64)
+			if err == nil {
+				inodes[n] = true
+			}
+		}
+
+		if found {
+			return inodes, nil
+		}
+	}
+
+	return nil, fmt.Errorf("No process found for socket %d", inode)
+}
@@ -0,0 +1,51 @@
+package boringproxy
+
+import "testing"
+
+func TestSshConnRemoteAddrMatchesSshPort(t *testing.T) {
+	entries := []procTcpEntry{
+		// A forwarded connection on the tunnel port
+		{localPort: 20001, remoteAddr: "127.0.0.1:50000", state: tcpEstablished, inode: 1},
+		// Something else the process has open
+		{localPort: 41000, remoteAddr: "10.0.0.5:443", state: tcpEstablished, inode: 2},
+		// Another client's connection, held by a different process
+		{localPort: 22, remoteAddr: "198.51.100.9:40000", state: tcpEstablished, inode: 3},
+		{localPort: 22, remoteAddr: "203.0.113.7:51234", state: tcpEstablished, inode: 4},
+	}
+
+	inodes := map[uint64]bool{1: true, 2: true, 4: true}
+
+	addr, err := sshConnRemoteAddr(entries, 22, inodes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if addr != "203.0.113.7:51234" {
+		t.Errorf("Expected the SSH connection's address, got %s", addr)
+	}
+}
+
+func TestClientRemoteAddrIsRuntimeState(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Owner: "admin", TunnelPort: 20001})
+
+	m.conns.SetConnected(20001, true)
+	m.conns.SetRemoteAddr(20001, "203.0.113.7:51234")
+
+	tun := m.GetTunnels()["app.example.com"]
+	if tun.ClientRemoteAddr != "203.0.113.7:51234" {
+		t.Errorf("Expected the client's address, got %q", tun.ClientRemoteAddr)
+	}
+
+	stored, _ := m.db.GetTunnel("app.example.com")
+	if stored.ClientRemoteAddr != "" {
+		t.Error("Expected the address not to be stored")
+	}
+
+	m.conns.SetConnected(20001, false)
+
+	tun, _ = m.GetTunnelDetails("app.example.com")
+	if tun.ClientRemoteAddr != "" {
+		t.Errorf("Expected the address to be forgotten on disconnect, got %q", tun.ClientRemoteAddr)
+	}
+}
@@ -0,0 +1,186 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+)
+
+// ConnectionDescriptor has everything needed to open a tunnel's SSH
+// connection and reverse forward, either with the boringproxy client or
+// plain ssh.
+type ConnectionDescriptor struct {
+	Domain     string `json:"domain"`
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// SSH server to connect to
+	ServerAddress string `json:"server_address"`
+	ServerPort    int    `json:"server_port"`
+	Username      string `json:"username"`
+	// The server's SSH host key, in authorized_keys format. Empty if the
+	// server didn't record one, in which case it can't be verified.
+	ServerPublicKey string `json:"server_public_key"`
+	// All host keys to accept, including ones the server recently replaced
+	ServerPublicKeys []string `json:"server_public_keys,omitempty"`
+	TunnelPrivateKey string   `json:"tunnel_private_key"`
+	// Address and port to request the reverse forward on
+	BindAddress string `json:"bind_address"`
+	TunnelPort  int    `json:"tunnel_port"`
+	// Where the client forwards connections to
+	ClientAddress  string `json:"client_address"`
+	ClientPort     int    `json:"client_port"`
+	TlsTermination string `json:"tls_termination"`
+	// The tunnel, which is what the boringproxy client works from. See
+	// clientTunnel for what's left out.
+	Tunnel Tunnel `json:"tunnel"`
+}
+
+func (a *Api) connectionDescriptor(tun Tunnel) ConnectionDescriptor {
+	if a.config.SshServerPort != 0 {
+		tun.ServerPort = a.config.SshServerPort
+	}
+
+	return ConnectionDescriptor{
+		Domain:           tun.Domain,
+		PathPrefix:       tun.PathPrefix,
+		ServerAddress:    tun.ServerAddress,
+		ServerPort:       tun.ServerPort,
+		Username:         tun.Username,
+		ServerPublicKey:  tun.ServerPublicKey,
+		ServerPublicKeys: tun.ServerPublicKeys,
+		TunnelPrivateKey: tun.TunnelPrivateKey,
+		BindAddress:      tunnelBindAddr(tun),
+		TunnelPort:       tun.TunnelPort,
+		ClientAddress:    tun.ClientAddress,
+		ClientPort:       tun.ClientPort,
+		TlsTermination:   tun.TlsTermination,
+		Tunnel:           clientTunnel(tun),
+	}
+}
+
+// clientTunnel returns tun without the settings only the server and the
+// tunnel's owner need, since whoever runs the client (ie with a join token)
+// may not be the owner. The auth credentials are only kept if the client
+// checks them itself, which is with client TLS termination.
+func clientTunnel(tun Tunnel) Tunnel {
+	tun.AcmeEmail = ""
+	tun.AcmeCa = ""
+	tun.AcmeAccountKey = ""
+	tun.AcmeAccountKeyRef = ""
+	tun.TunnelPrivateKeyRef = ""
+	tun.Description = ""
+	tun.Stats = nil
+
+	if tun.TlsTermination != "client" {
+		tun.AuthUsername = ""
+		tun.AuthPassword = ""
+	}
+
+	return tun
+}
+
+// GetConnectionDescriptor returns the connection details of the tunnel
+// identified by the domain and path-prefix parameters. It includes the
+// private key, so observer tokens can't use it.
+func (a *Api) GetConnectionDescriptor(tokenData TokenData, params url.Values) (ConnectionDescriptor, error) {
+	if !tokenData.CanModify() {
+		return ConnectionDescriptor{}, ErrReadOnly
+	}
+
+	if a.config.ConnectionRequiresJoinToken {
+		return ConnectionDescriptor{}, errors.New("Server requires a join token for connection details")
+	}
+
+	tun, err := a.GetTunnel(tokenData, params)
+	if err != nil {
+		return ConnectionDescriptor{}, err
+	}
+
+	if tokenData.Client != "" && tokenData.Client != tun.ClientName {
+		return ConnectionDescriptor{}, errors.New("Token is not valid for this client")
+	}
+
+	return a.connectionDescriptor(tun), nil
+}
+
+// RedeemConnectionDescriptor consumes a join token (see
+// CreateClientJoinToken) and returns the connection details of its tunnel.
+func (a *Api) RedeemConnectionDescriptor(joinToken string) (ConnectionDescriptor, error) {
+	tun, err := a.tunMan.RedeemClientJoinToken(joinToken)
+	if err != nil {
+		return ConnectionDescriptor{}, err
+	}
+
+	return a.connectionDescriptor(tun), nil
+}
+
+// handleConnectionDescriptor serves /api/connection. A POST with a join
+// token parameter redeems it; otherwise the access token must own the
+// tunnel given by the domain and path-prefix parameters. /api/join is the
+// same as a POST.
+func (a *Api) handleConnectionDescriptor(w http.ResponseWriter, r *http.Request) {
+
+	// The response contains the tunnel private key, so don't ever send it
+	// in the clear.
+	if !requestIsTls(r, a.config.BehindProxy) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Connection details can only be retrieved over TLS")
+		return
+	}
+
+	r.ParseForm()
+
+	var descriptor ConnectionDescriptor
+	var err error
+
+	switch r.Method {
+	case "POST":
+		joinToken := r.Form.Get("token")
+		if joinToken == "" {
+			w.WriteHeader(400)
+			io.WriteString(w, "Invalid token parameter")
+			return
+		}
+
+		descriptor, err = a.RedeemConnectionDescriptor(joinToken)
+		if err != nil {
+			w.WriteHeader(403)
+			io.WriteString(w, err.Error())
+			return
+		}
+	case "GET":
+		token, err := extractToken("access_token", r)
+		if err != nil {
+			w.WriteHeader(401)
+			io.WriteString(w, "No token provided")
+			return
+		}
+
+		tokenData, exists := a.db.GetTokenData(token)
+		if !exists {
+			w.WriteHeader(403)
+			io.WriteString(w, "Not authorized")
+			return
+		}
+
+		descriptor, err = a.GetConnectionDescriptor(tokenData, r.Form)
+		if err != nil {
+			status := tunnelErrorStatus(err)
+			if status == 500 {
+				status = 403
+			}
+			w.WriteHeader(status)
+			io.WriteString(w, err.Error())
+			return
+		}
+	default:
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/connection")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(descriptor)
+}
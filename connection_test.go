@@ -0,0 +1,121 @@
+package boringproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestConnectionDescriptorIsComplete(t *testing.T) {
+	a := newTestApi(t)
+	a.config.EmbeddedSsh = true
+	a.config.SshServerPort = 2222
+	a.db.SetAdminDomain("proxy.example.com")
+	a.db.SetTokenData("admin-token", TokenData{Owner: "admin"})
+
+	_, sshAddr := startTestSshServer(t, a.tunMan)
+
+	_, err := a.CreateTunnel(context.Background(), TokenData{Owner: "admin"}, url.Values{
+		"domain":          {"app.example.com"},
+		"owner":           {"admin"},
+		"client-addr":     {"10.0.0.5"},
+		"client-port":     {"3000"},
+		"tls-termination": {"client"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("access_token", "admin-token")
+		rec := httptest.NewRecorder()
+		a.handleConnectionDescriptor(rec, req)
+		return rec
+	}
+
+	if rec := get("http://proxy.example.com/connection?domain=app.example.com"); rec.Code != 403 {
+		t.Errorf("Expected the descriptor to be refused over plain HTTP, got %d", rec.Code)
+	}
+
+	rec := get("https://proxy.example.com/connection?domain=app.example.com")
+	if rec.Code != 200 {
+		t.Fatalf("Expected the descriptor, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var fields map[string]interface{}
+	err = json.Unmarshal(rec.Body.Bytes(), &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := []string{
+		"domain",
+		"server_address",
+		"server_port",
+		"username",
+		"server_public_key",
+		"tunnel_private_key",
+		"bind_address",
+		"tunnel_port",
+		"client_address",
+		"client_port",
+		"tls_termination",
+		"tunnel",
+	}
+	for _, field := range required {
+		value, exists := fields[field]
+		if !exists || value == "" || value == float64(0) || value == nil {
+			t.Errorf("Expected %s in the descriptor, got %v", field, value)
+		}
+	}
+
+	var descriptor ConnectionDescriptor
+	err = json.Unmarshal(rec.Body.Bytes(), &descriptor)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if descriptor.ServerAddress != "proxy.example.com" || descriptor.ServerPort != 2222 {
+		t.Errorf("Expected the SSH server at proxy.example.com:2222, got %s:%d", descriptor.ServerAddress, descriptor.ServerPort)
+	}
+	if descriptor.ClientAddress != "10.0.0.5" || descriptor.ClientPort != 3000 {
+		t.Errorf("Expected the backend at 10.0.0.5:3000, got %s:%d", descriptor.ClientAddress, descriptor.ClientPort)
+	}
+
+	// The descriptor alone is enough to connect and open the forward.
+	// The server address isn't resolvable here, so the test server's is
+	// used instead.
+	signer, err := ssh.ParsePrivateKey([]byte(descriptor.TunnelPrivateKey))
+	if err != nil {
+		t.Fatalf("Invalid private key: %v", err)
+	}
+	hostKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(descriptor.ServerPublicKey))
+	if err != nil {
+		t.Fatalf("Invalid server public key: %v", err)
+	}
+
+	client, err := ssh.Dial("tcp", sshAddr, &ssh.ClientConfig{
+		User:            descriptor.Username,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostKey),
+		Timeout:         5 * time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect with the descriptor: %v", err)
+	}
+	defer client.Close()
+
+	remote, err := client.Listen("tcp", net.JoinHostPort(descriptor.BindAddress, strconv.Itoa(descriptor.TunnelPort)))
+	if err != nil {
+		t.Fatalf("Failed to open the forward with the descriptor: %v", err)
+	}
+	remote.Close()
+}
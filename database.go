@@ -1,34 +1,87 @@
 package boringproxy
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"io/ioutil"
 	"log"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/takingnames/namedrop-go"
 )
 
 var DBFolderPath string
 
+// ErrPendingWrites is returned by Reload when batched changes haven't been
+// saved yet.
+var ErrPendingWrites = errors.New("Database has changes that haven't been saved yet. Reloading would lose them")
+
 type Database struct {
 	AdminDomain string                         `json:"admin_domain"`
 	Tokens      map[string]TokenData           `json:"tokens"`
 	Tunnels     map[string]Tunnel              `json:"tunnels"`
 	Users       map[string]User                `json:"users"`
-	dnsRequests map[string]namedrop.DNSRequest `json:"dns_requests"`
+	dnsRequests map[string]namedrop.DNSRequest `json:"-"`
 	mutex       *sync.Mutex
+	// With batching (see SetBatching), changes are only counted here and
+	// written by Flush.
+	batching bool
+	maxBatch int
+	pending  int
+	// Incremented whenever Tunnels changes, so RouteCache knows to reload
+	generation uint64
+
+	// One-time codes clients exchange for their own token, keyed by code
+	EnrollmentCodes map[string]EnrollmentCode `json:"enrollment_codes,omitempty"`
 }
 
 type TokenData struct {
 	Owner  string `json:"owner"`
 	Client string `json:"client,omitempty"`
+	// If set, the token can only be used to manage tunnels on these
+	// domains, and can't be used for anything else.
+	Domains []string `json:"domains,omitempty"`
+	// Empty for full access, or TokenRoleObserver for read-only access.
+	Role string `json:"role,omitempty"`
+}
+
+// TokenRoleObserver tokens can list and inspect tunnels, stats and health
+// but can't change anything.
+const TokenRoleObserver = "observer"
+
+// CanModify reports whether the token may be used to change state.
+func (t TokenData) CanModify() bool {
+	return t.Role != TokenRoleObserver
+}
+
+// AllowsDomain reports whether the token may manage tunnels on domain.
+func (t TokenData) AllowsDomain(domain string) bool {
+	return len(t.Domains) == 0 || stringInArray(domain, t.Domains)
+}
+
+// EnrollmentCode can be redeemed once, before Expires, for a token limited
+// to Client.
+type EnrollmentCode struct {
+	Owner   string    `json:"owner"`
+	Client  string    `json:"client"`
+	Expires time.Time `json:"expires"`
 }
 
 type User struct {
 	IsAdmin bool                `json:"is_admin"`
 	Clients map[string]DbClient `json:"clients"`
+
+	// Optional ACME account used for this user's certs instead of the
+	// server-wide one.
+	AcmeEmail string `json:"acme_email,omitempty"`
+	AcmeCa    string `json:"acme_ca,omitempty"`
+
+	// Default values for tunnel creation parameters (ie
+	// "tls-min-version"), used when the request doesn't include them.
+	TunnelDefaults map[string]string `json:"tunnel_defaults,omitempty"`
 }
 
 type DbClient struct {
@@ -54,6 +107,163 @@ type Tunnel struct {
 	AllowExternalTcp bool   `json:"allow_external_tcp"`
 	TlsTermination   string `json:"tls_termination"`
 
+	// Set instead of TunnelPrivateKey when the key is kept in the
+	// SecretStore. TunnelPrivateKey is still filled in when returning
+	// tunnels to clients.
+	TunnelPrivateKeyRef string `json:"tunnel_private_key_ref,omitempty"`
+
+	// Only requests under PathPrefix (ie "/v1") are routed to the tunnel,
+	// which lets several tunnels share a domain. The longest matching
+	// prefix wins. Only supported with server TLS termination.
+	PathPrefix string `json:"path_prefix,omitempty"`
+	// Remove PathPrefix from the path before forwarding
+	StripPrefix bool `json:"strip_prefix,omitempty"`
+
+	// Makes the tunnel an HTTP forward proxy into the client's network
+	// instead of a reverse proxy to one backend. CONNECT requests are only
+	// allowed to hosts in ForwardProxyAllowlist. Only supported with
+	// client TLS termination.
+	ForwardProxy          bool     `json:"forward_proxy,omitempty"`
+	ForwardProxyAllowlist []string `json:"forward_proxy_allowlist,omitempty"`
+
+	// Redirect tunnels don't connect to a client. The server answers every
+	// request with a redirect. If RedirectTo is a domain, it's to the same
+	// path on that domain, and if it's a full URL, it's to that URL.
+	// RedirectCode defaults to 301.
+	RedirectTo   string `json:"redirect_to,omitempty"`
+	RedirectCode int    `json:"redirect_code,omitempty"`
+
+	// Routes send requests to different ports on the client depending on
+	// their path. They're matched against the path the client receives
+	// (after StripPrefix), and only work for HTTP tunnels terminated by
+	// the server or client, since the client has to see each request.
+	Routes []Route `json:"routes,omitempty"`
+
+	// Recurring windows the tunnel is available in, ie
+	// "Mon-Fri 09:00-17:00", in ScheduleTimezone (UTC if empty). Outside
+	// them HTTP requests get a 503. Empty means always available.
+	Schedule         string `json:"schedule,omitempty"`
+	ScheduleTimezone string `json:"schedule_timezone,omitempty"`
+
+	// Find/replace rules applied to response bodies with one of
+	// BodyRewriteTypes (text/html if empty), ie to turn a legacy backend's
+	// http:// links into https://.
+	BodyRewrites     []BodyRewrite `json:"body_rewrites,omitempty"`
+	BodyRewriteTypes []string      `json:"body_rewrite_types,omitempty"`
+
+	// Host keys the client should accept, current first. Filled in by the
+	// embedded SSH server, which keeps advertising keys it replaced for a
+	// while.
+	ServerPublicKeys []string `json:"server_public_keys,omitempty"`
+
+	// Key of the redirect tunnel created alongside this one for the www or
+	// apex variant of the domain, if any.
+	Companion string `json:"companion,omitempty"`
+
+	// Server IP the tunnel port is exposed on when AllowExternalTcp is
+	// set. Defaults to all interfaces.
+	ListenIp string `json:"listen_ip,omitempty"`
+	// Loopback IP the tunnel port is bound to when external TCP isn't
+	// allowed. Empty means 127.0.0.1.
+	LoopbackIp string `json:"loopback_ip,omitempty"`
+
+	// TLS policy for server-terminated tunnels. An empty TlsMinVersion uses
+	// the server default (TLS 1.2).
+	TlsMinVersion   string   `json:"tls_min_version,omitempty"`
+	TlsCipherSuites []string `json:"tls_cipher_suites,omitempty"`
+
+	// If RequireClientCert is set, TLS handshakes for a server-terminated
+	// tunnel fail unless the client presents a cert signed by one of the
+	// CAs in the PEM file at ClientCertCaPath (on the server).
+	RequireClientCert bool   `json:"require_client_cert,omitempty"`
+	ClientCertCaPath  string `json:"client_cert_ca_path,omitempty"`
+
+	// Strict-Transport-Security settings. A HstsMaxAge of 0 uses the server
+	// defaults, and a negative value disables the header for the tunnel.
+	HstsMaxAge            int  `json:"hsts_max_age,omitempty"`
+	HstsIncludeSubdomains bool `json:"hsts_include_subdomains,omitempty"`
+	HstsPreload           bool `json:"hsts_preload,omitempty"`
+
+	// How the Host header sent to the backend is chosen. One of
+	// "preserve-original" (the default), "set-to-backend", or
+	// "custom-value", which uses HostHeader.
+	HostHeaderPolicy string `json:"host_header_policy,omitempty"`
+	HostHeader       string `json:"host_header,omitempty"`
+
+	// Makes the client talk TLS to the backend, for backends that only
+	// serve HTTPS. The backend's cert is verified against ClientCaFile (a
+	// path on the client machine) if set, otherwise the system roots,
+	// unless ClientTlsSkipVerify is set.
+	ClientUseTls        bool   `json:"client_use_tls,omitempty"`
+	ClientTlsSkipVerify bool   `json:"client_tls_skip_verify,omitempty"`
+	ClientCaFile        string `json:"client_ca_file,omitempty"`
+
+	// ACME account used for the tunnel's cert, overriding the owner's
+	// settings. The account key (PEM) is only passed inline when creating
+	// the tunnel, and is then moved to the SecretStore like
+	// TunnelPrivateKey.
+	AcmeEmail         string `json:"acme_email,omitempty"`
+	AcmeCa            string `json:"acme_ca,omitempty"`
+	AcmeAccountKey    string `json:"acme_account_key,omitempty"`
+	AcmeAccountKeyRef string `json:"acme_account_key_ref,omitempty"`
+
+	// Free text notes about the tunnel, shown in listings
+	Description string `json:"description,omitempty"`
+
+	// Number of times to retry dialing the backend for GET and HEAD
+	// requests before giving up with a 502.
+	RetryOnDialFailure int `json:"retry_on_dial_failure,omitempty"`
+
+	// Most connections the embedded SSH server forwards to the client at
+	// once, each over its own channel. Further connections are refused
+	// until some close. 0 uses the server's -ssh-max-channels.
+	MaxChannels int `json:"max_channels,omitempty"`
+
+	// What to do when the backend can't be reached: "fail" (the default)
+	// returns a 502, "wait" waits up to UnreachableWait seconds for the
+	// backend to come back, and "maintenance" serves the 503 page.
+	UnreachablePolicy string `json:"unreachable_policy,omitempty"`
+	UnreachableWait   int    `json:"unreachable_wait,omitempty"`
+
+	// Custom error page templates, keyed by status code (ie "502").
+	// Overrides the server-wide error pages.
+	ErrorPages map[string]string `json:"error_pages,omitempty"`
+
+	// Set for tunnels that were reconstructed from authorized_keys rather
+	// than created normally. They have no private key, and no owner since
+	// authorized_keys doesn't record it, so only admins can see them.
+	Recovered bool `json:"recovered,omitempty"`
+
+	// Whether a client currently has the tunnel open. This is runtime
+	// state filled in by the TunnelManager and never stored.
+	Connected bool `json:"connected,omitempty"`
+
+	// Pinned tunnels are exempt from automation. They're never deleted by
+	// the idle reaper or given new keys by -auto-rotate-weak-keys.
+	Pinned bool `json:"pinned,omitempty"`
+
+	// Exempts the tunnel from the idle reaper, for tunnels that mostly
+	// carry long-lived WebSockets and rarely see new requests.
+	NoIdleTimeout bool `json:"no_idle_timeout,omitempty"`
+
+	// When the tunnel last proxied a request or connection. Kept up to date
+	// in memory by the TunnelManager, and saved periodically.
+	LastActivity time.Time `json:"last_activity"`
+
+	// Address the client's SSH connection comes from, while it's
+	// connected. Runtime state like Connected, never stored.
+	ClientRemoteAddr string `json:"client_remote_addr,omitempty"`
+
+	// Only filled in by TunnelManager.GetTunnelDetails
+	Stats *TunnelStats `json:"stats,omitempty"`
+
+	// Number of HTTP requests routed to the tunnel since the server
+	// started. Runtime state like Connected.
+	MatchedRequests int64 `json:"matched_requests,omitempty"`
+
+	// One of the CertStatus constants. Runtime state like Connected.
+	CertStatus string `json:"cert_status,omitempty"`
+
 	// TODO: These are not used by clients and possibly shouldn't be
 	// returned in API calls.
 	Owner        string `json:"owner"`
@@ -62,6 +272,14 @@ type Tunnel struct {
 	AuthPassword string `json:"auth_password"`
 }
 
+type TunnelStats struct {
+	// Zero if the server doesn't manage a cert for the tunnel
+	CertExpiry        time.Time `json:"cert_expiry"`
+	ActiveConnections int       `json:"active_connections"`
+	BytesIn           int64     `json:"bytes_in"`
+	BytesOut          int64     `json:"bytes_out"`
+}
+
 func NewDatabase(path string) (*Database, error) {
 
 	DBFolderPath = path
@@ -96,6 +314,10 @@ func NewDatabase(path string) (*Database, error) {
 		db.dnsRequests = make(map[string]namedrop.DNSRequest)
 	}
 
+	if db.EnrollmentCodes == nil {
+		db.EnrollmentCodes = make(map[string]EnrollmentCode)
+	}
+
 	db.mutex = &sync.Mutex{}
 
 	db.mutex.Lock()
@@ -105,6 +327,90 @@ func NewDatabase(path string) (*Database, error) {
 	return db, nil
 }
 
+// Reload replaces the in-memory state with the contents of the database
+// file, ie after another process modified it. Since the file might be in the
+// middle of being written, parsing is retried a few times before giving up.
+// With batching, it fails with ErrPendingWrites rather than discarding
+// changes that haven't been saved. Saving them first isn't an option either,
+// since that would overwrite whatever the other process changed.
+func (d *Database) Reload() error {
+
+	var loaded *Database
+	var err error
+
+	for attempt := 0; attempt < 5; attempt++ {
+		if attempt > 0 {
+			time.Sleep(200 * time.Millisecond)
+		}
+
+		var dbJson []byte
+		dbJson, err = ioutil.ReadFile(DBFolderPath + "boringproxy_db.json")
+		if err != nil {
+			continue
+		}
+
+		loaded = nil
+		err = json.Unmarshal(dbJson, &loaded)
+		if err == nil && loaded != nil {
+			break
+		}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if loaded == nil {
+		return errors.New("Empty database file")
+	}
+
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.pending > 0 {
+		return ErrPendingWrites
+	}
+
+	d.AdminDomain = loaded.AdminDomain
+
+	if loaded.Tokens != nil {
+		d.Tokens = loaded.Tokens
+	} else {
+		d.Tokens = make(map[string]TokenData)
+	}
+
+	if loaded.Tunnels != nil {
+		d.Tunnels = loaded.Tunnels
+	} else {
+		d.Tunnels = make(map[string]Tunnel)
+	}
+
+	if loaded.Users != nil {
+		d.Users = loaded.Users
+	} else {
+		d.Users = make(map[string]User)
+	}
+
+	if loaded.EnrollmentCodes != nil {
+		d.EnrollmentCodes = loaded.EnrollmentCodes
+	} else {
+		d.EnrollmentCodes = make(map[string]EnrollmentCode)
+	}
+
+	d.generation++
+
+	return nil
+}
+
+// TunnelsGeneration returns a number that changes whenever tunnels are
+// added, changed or deleted.
+func (d *Database) TunnelsGeneration() uint64 {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return d.generation
+}
+
 func (d *Database) SetAdminDomain(adminDomain string) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -147,7 +453,9 @@ func (d *Database) DeleteDNSRequest(requestId string) {
 	delete(d.dnsRequests, requestId)
 }
 
-func (d *Database) AddToken(owner, client string) (string, error) {
+// AddToken creates a token for owner, optionally limited to client or to
+// managing tunnels on domains.
+func (d *Database) AddToken(owner, client string, domains []string, role string) (string, error) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
@@ -162,8 +470,10 @@ func (d *Database) AddToken(owner, client string) (string, error) {
 	}
 
 	d.Tokens[token] = TokenData{
-		Owner:  owner,
-		Client: client,
+		Owner:   owner,
+		Client:  client,
+		Domains: domains,
+		Role:    role,
 	}
 
 	d.persist()
@@ -214,6 +524,58 @@ func (d *Database) DeleteTokenData(token string) {
 	d.persist()
 }
 
+// AddEnrollmentCode stores a new one-time code for enrollment, dropping any
+// that have expired.
+func (d *Database) AddEnrollmentCode(enrollment EnrollmentCode) (string, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	code, err := genRandomCode(24)
+	if err != nil {
+		return "", errors.New("Could not generate enrollment code")
+	}
+
+	now := time.Now()
+	for c, e := range d.EnrollmentCodes {
+		if now.After(e.Expires) {
+			delete(d.EnrollmentCodes, c)
+		}
+	}
+
+	d.EnrollmentCodes[code] = enrollment
+
+	d.persist()
+
+	return code, nil
+}
+
+// RedeemEnrollmentCode consumes code, whether or not it has expired, and
+// returns what it was created for.
+func (d *Database) RedeemEnrollmentCode(code string) (EnrollmentCode, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	enrollment, exists := d.EnrollmentCodes[code]
+	if !exists {
+		return EnrollmentCode{}, errors.New("Invalid enrollment code")
+	}
+
+	delete(d.EnrollmentCodes, code)
+
+	// Written straight away even when batching, so a code can't be
+	// redeemed again after a crash.
+	err := d.write()
+	if err != nil {
+		return EnrollmentCode{}, err
+	}
+
+	if time.Now().After(enrollment.Expires) {
+		return EnrollmentCode{}, errors.New("Enrollment code expired")
+	}
+
+	return enrollment, nil
+}
+
 func (d *Database) GetTunnels() map[string]Tunnel {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
@@ -227,11 +589,124 @@ func (d *Database) GetTunnels() map[string]Tunnel {
 	return tunnels
 }
 
-func (d *Database) GetTunnel(domain string) (Tunnel, bool) {
+// tunnelKey is the key a tunnel is stored under. It's the domain plus the
+// path prefix, if any.
+func tunnelKey(tun Tunnel) string {
+	return tun.Domain + tun.PathPrefix
+}
+
+// pathHasPrefix reports whether path is prefix or under it. "/v1" matches
+// "/v1" and "/v1/users", but not "/v10".
+func pathHasPrefix(path, prefix string) bool {
+	if prefix == "" || path == prefix {
+		return true
+	}
+
+	return strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// wildcardMatches reports whether domain is matched by a wildcard tunnel
+// domain like "*.example.com". Only a single label is matched, so
+// "app.example.com" matches but "a.b.example.com" and "example.com" don't.
+func wildcardMatches(pattern, domain string) bool {
+	if !strings.HasPrefix(pattern, "*.") {
+		return false
+	}
+
+	label := strings.TrimSuffix(domain, pattern[1:])
+	return len(label) < len(domain) && label != "" && !strings.Contains(label, ".")
+}
+
+// MatchTunnel finds the tunnel for an HTTP request to domain and path, using
+// the longest matching path prefix. Tunnels for the exact domain take
+// precedence over wildcard tunnels, which only get requests none of them
+// match.
+func (d *Database) MatchTunnel(domain, path string) (Tunnel, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return matchTunnel(d.Tunnels, domain, path)
+}
+
+// MatchDomain finds the tunnel for domain regardless of path. See
+// matchDomain.
+func (d *Database) MatchDomain(domain string) (Tunnel, bool) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	return matchDomain(d.Tunnels, domain)
+}
+
+// matchDomain finds the tunnel for connections to domain when the path isn't
+// known, ie during the TLS handshake. As with matchTunnel, tunnels for the
+// exact domain take precedence over wildcard tunnels. When several tunnels
+// share the domain with different path prefixes, the one with the shortest
+// prefix decides.
+func matchDomain(tunnels map[string]Tunnel, domain string) (Tunnel, bool) {
+	var exact, wildcard Tunnel
+	var exactKey, wildcardKey string
+	foundExact, foundWildcard := false, false
+
+	better := func(tun Tunnel, key string, found bool, match Tunnel, matchKey string) bool {
+		return !found || len(tun.PathPrefix) < len(match.PathPrefix) ||
+			(len(tun.PathPrefix) == len(match.PathPrefix) && key < matchKey)
+	}
+
+	for key, tun := range tunnels {
+		if tun.Domain == domain {
+			if better(tun, key, foundExact, exact, exactKey) {
+				exact, exactKey, foundExact = tun, key, true
+			}
+		} else if wildcardMatches(tun.Domain, domain) {
+			if better(tun, key, foundWildcard, wildcard, wildcardKey) {
+				wildcard, wildcardKey, foundWildcard = tun, key, true
+			}
+		}
+	}
+
+	if foundExact {
+		return exact, true
+	}
+
+	return wildcard, foundWildcard
+}
+
+func matchTunnel(tunnels map[string]Tunnel, domain, path string) (Tunnel, bool) {
+	var exact, wildcard Tunnel
+	foundExact, foundWildcard := false, false
+
+	for _, tun := range tunnels {
+		if !pathHasPrefix(path, tun.PathPrefix) {
+			continue
+		}
+
+		if tun.Domain == domain {
+			if !foundExact || len(tun.PathPrefix) > len(exact.PathPrefix) {
+				exact = tun
+				foundExact = true
+			}
+		} else if wildcardMatches(tun.Domain, domain) {
+			if !foundWildcard || len(tun.PathPrefix) > len(wildcard.PathPrefix) {
+				wildcard = tun
+				foundWildcard = true
+			}
+		}
+	}
+
+	if foundExact {
+		return exact, true
+	}
+
+	return wildcard, foundWildcard
+}
+
+// GetTunnel returns the tunnel stored under key, which is its domain
+// followed by its path prefix, if any.
+func (d *Database) GetTunnel(key string) (Tunnel, bool) {
 	d.mutex.Lock()
 	defer d.mutex.Unlock()
 
-	tun, exists := d.Tunnels[domain]
+	tun, exists := d.Tunnels[key]
 
 	if !exists {
 		return Tunnel{}, false
@@ -245,6 +720,55 @@ func (d *Database) SetTunnel(domain string, tun Tunnel) {
 	defer d.mutex.Unlock()
 
 	d.Tunnels[domain] = tun
+	d.generation++
+	d.persist()
+}
+
+// HasDomain reports whether domain is the admin domain or is served by any
+// tunnel, including ones under a path prefix and wildcard tunnels.
+func (d *Database) HasDomain(domain string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if domain == d.AdminDomain {
+		return true
+	}
+
+	_, exists := matchDomain(d.Tunnels, domain)
+
+	return exists
+}
+
+// HasExactDomain reports whether a tunnel was created for exactly domain,
+// leaving out wildcard tunnels that match it.
+func (d *Database) HasExactDomain(domain string) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for _, tun := range d.Tunnels {
+		if tun.Domain == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// SetTunnelActivity updates LastActivity for the given tunnel keys, ignoring
+// any that no longer exist, and saves once.
+func (d *Database) SetTunnelActivity(activity map[string]time.Time) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	for key, t := range activity {
+		tun, exists := d.Tunnels[key]
+		if !exists {
+			continue
+		}
+		tun.LastActivity = t
+		d.Tunnels[key] = tun
+	}
+
 	d.persist()
 }
 
@@ -253,6 +777,7 @@ func (d *Database) DeleteTunnel(domain string) {
 	defer d.mutex.Unlock()
 
 	delete(d.Tunnels, domain)
+	d.generation++
 
 	d.persist()
 }
@@ -322,6 +847,65 @@ func (d *Database) DeleteUser(username string) {
 	d.persist()
 }
 
+// persist saves the database, or with batching records a pending change
+// and only saves once maxBatch changes are pending. Must be called with the
+// mutex held.
 func (d *Database) persist() {
-	saveJson(d, DBFolderPath+"boringproxy_db.json")
+	if d.batching {
+		d.pending++
+		if d.maxBatch == 0 || d.pending < d.maxBatch {
+			return
+		}
+	}
+
+	d.write()
+}
+
+func (d *Database) write() error {
+	err := saveJson(d, DBFolderPath+"boringproxy_db.json")
+	if err != nil {
+		log.Printf("Failed to save database: %v", err)
+		return err
+	}
+
+	d.pending = 0
+
+	return nil
+}
+
+// SetBatching makes changes only get saved once maxBatch of them are
+// pending (0 for no limit) or Flush is called, rather than on every change.
+// Use AutoSave to flush periodically.
+func (d *Database) SetBatching(maxBatch int) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.batching = true
+	d.maxBatch = maxBatch
+}
+
+// Flush saves any pending changes immediately.
+func (d *Database) Flush() error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	if d.pending == 0 {
+		return nil
+	}
+
+	return d.write()
+}
+
+// AutoSave flushes pending changes every interval, and once more when ctx
+// is done.
+func (d *Database) AutoSave(ctx context.Context, interval time.Duration) {
+	for {
+		select {
+		case <-ctx.Done():
+			d.Flush()
+			return
+		case <-time.After(interval):
+			d.Flush()
+		}
+	}
 }
@@ -0,0 +1,282 @@
+package boringproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestMatchDomainIgnoresPathPrefix(t *testing.T) {
+	tunnels := map[string]Tunnel{
+		"example.com/api": {Domain: "example.com", PathPrefix: "/api", TlsTermination: "passthrough"},
+		"example.com/app": {Domain: "example.com", PathPrefix: "/app", TlsTermination: "server"},
+		"other.com":       {Domain: "other.com", TlsTermination: "server"},
+	}
+
+	tun, exists := matchDomain(tunnels, "example.com")
+	if !exists {
+		t.Fatal("Domain served only by path-prefixed tunnels not found")
+	}
+
+	// Same length prefixes are broken by key, so this is stable
+	if tun.PathPrefix != "/api" {
+		t.Errorf("Expected /api tunnel, got %q", tun.PathPrefix)
+	}
+
+	tunnels["example.com"] = Tunnel{Domain: "example.com", TlsTermination: "server"}
+
+	tun, _ = matchDomain(tunnels, "example.com")
+	if tun.PathPrefix != "" {
+		t.Errorf("Tunnel without a prefix should win, got %q", tun.PathPrefix)
+	}
+
+	if _, exists := matchDomain(tunnels, "missing.com"); exists {
+		t.Error("Matched a domain without tunnels")
+	}
+}
+
+func TestPathPrefixRouting(t *testing.T) {
+	tunnels := map[string]Tunnel{
+		"api.example.com":        {Domain: "api.example.com", TunnelPort: 1},
+		"api.example.com/v1":     {Domain: "api.example.com", PathPrefix: "/v1", TunnelPort: 2},
+		"api.example.com/v1/old": {Domain: "api.example.com", PathPrefix: "/v1/old", TunnelPort: 3},
+	}
+
+	cases := []struct {
+		path string
+		port int
+	}{
+		{"/", 1},
+		{"/v2/users", 1},
+		{"/v1", 2},
+		{"/v1/users", 2},
+		// Longest prefix wins
+		{"/v1/old/users", 3},
+		// Prefixes match whole path segments
+		{"/v10", 1},
+	}
+
+	for _, c := range cases {
+		tun, exists := matchTunnel(tunnels, "api.example.com", c.path)
+		if !exists || tun.TunnelPort != c.port {
+			t.Errorf("%s: expected tunnel on port %d, got %d", c.path, c.port, tun.TunnelPort)
+		}
+	}
+
+	for _, strip := range []bool{true, false} {
+		tun := Tunnel{Domain: "api.example.com", PathPrefix: "/v1", StripPrefix: strip}
+		req := httptest.NewRequest("GET", "https://api.example.com/v1/users?page=2", nil)
+
+		uri := upstreamRequestURI(req, tun)
+
+		expected := "/v1/users?page=2"
+		if strip {
+			expected = "/users?page=2"
+		}
+		if uri != expected {
+			t.Errorf("StripPrefix %v: expected %s, got %s", strip, expected, uri)
+		}
+	}
+}
+
+func TestWildcardDomains(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	m.db.SetTunnel("*.example.com", Tunnel{Domain: "*.example.com", TunnelPort: 20001, TlsTermination: "server"})
+	m.db.SetTunnel("exact.example.com", Tunnel{Domain: "exact.example.com", TunnelPort: 20002, TlsTermination: "passthrough"})
+
+	tun, exists := m.routes.MatchDomain("app.example.com")
+	if !exists || tun.Domain != "*.example.com" {
+		t.Errorf("SNI for app.example.com should match the wildcard tunnel, got %q", tun.Domain)
+	}
+
+	tun, _ = m.routes.MatchDomain("exact.example.com")
+	if tun.Domain != "exact.example.com" {
+		t.Errorf("Exact tunnel should take precedence, got %q", tun.Domain)
+	}
+
+	// Only a single label is matched
+	if _, exists := m.routes.MatchDomain("a.b.example.com"); exists {
+		t.Error("Wildcard matched more than one label")
+	}
+
+	if !m.db.HasDomain("app.example.com") {
+		t.Error("HasDomain should include names matching a wildcard tunnel")
+	}
+
+	if m.db.HasExactDomain("app.example.com") {
+		t.Error("HasExactDomain shouldn't include wildcard matches")
+	}
+
+	// Any number of names match, so they're covered by a wildcard cert
+	// instead
+	if m.AllowCertForDomain("app.example.com") || m.AllowCertForDomain("other.example.com") {
+		t.Error("On-demand cert shouldn't be allowed for names under a wildcard tunnel")
+	}
+
+	if m.AllowCertForDomain("exact.example.com") {
+		t.Error("On-demand cert shouldn't be allowed for a passthrough tunnel, even with a wildcard")
+	}
+
+	if m.AllowCertForDomain("example.org") {
+		t.Error("On-demand cert allowed for an unknown domain")
+	}
+	m.config.LazyCerts = true
+	wildcard, _ := m.db.GetTunnel("*.example.com")
+	if m.lazyCert(wildcard) {
+		t.Error("Wildcard tunnel should get its wildcard cert up front, even with lazy certs")
+	}
+}
+
+func TestExactAndWildcardRequestCounts(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	m.db.SetTunnel("*.example.com", Tunnel{Domain: "*.example.com", TunnelPort: 20001, TlsTermination: "server"})
+	m.db.SetTunnel("exact.example.com", Tunnel{Domain: "exact.example.com", TunnelPort: 20002, TlsTermination: "server"})
+
+	requests := []string{"exact.example.com", "a.example.com", "b.example.com", "exact.example.com", "exact.example.com"}
+
+	for _, host := range requests {
+		tun, exists := m.routes.Match(host, "/")
+		if !exists {
+			t.Fatalf("No tunnel for %s", host)
+		}
+		m.conns.CountRequest(tunnelKey(tun))
+	}
+
+	tunnels := m.GetTunnels()
+
+	if n := tunnels["exact.example.com"].MatchedRequests; n != 3 {
+		t.Errorf("Expected 3 requests for the exact tunnel, got %d", n)
+	}
+
+	if n := tunnels["*.example.com"].MatchedRequests; n != 2 {
+		t.Errorf("Expected 2 requests for the wildcard tunnel, got %d", n)
+	}
+}
+
+func TestOnDemandCertForTunnelAddedAfterStartup(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.config.LazyCerts = true
+
+	if m.allowOnDemandCert("new.example.com") == nil {
+		t.Fatal("On-demand cert allowed before the tunnel exists")
+	}
+
+	tun := Tunnel{Domain: "new.example.com", Owner: "admin", TunnelPort: 20001, TlsTermination: "server"}
+	m.db.SetTunnel(tunnelKey(tun), tun)
+
+	if !m.lazyCert(tun) {
+		t.Error("Tunnel without its own ACME account should get its cert lazily")
+	}
+
+	if err := m.allowOnDemandCert("new.example.com"); err != nil {
+		t.Errorf("On-demand cert not allowed on first handshake: %v", err)
+	}
+	// The self-signed fallback happens when the tunnel is created
+	m.config.AllowSelfSignedFallback = true
+	if m.lazyCert(tun) {
+		t.Error("Tunnel that can fall back to a self-signed cert should get its cert up front")
+	}
+}
+
+// readDbFile returns what's saved in the database file. A missing or
+// partially written file reads as empty.
+func readDbFile(t *testing.T) Database {
+	t.Helper()
+
+	var saved Database
+	dbJson, err := ioutil.ReadFile(DBFolderPath + "boringproxy_db.json")
+	if err != nil {
+		return saved
+	}
+
+	json.Unmarshal(dbJson, &saved)
+
+	return saved
+}
+
+func TestBatchedWrites(t *testing.T) {
+	db, err := NewDatabase(t.TempDir() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.SetBatching(3)
+
+	db.SetTunnel("a.example.com", Tunnel{Domain: "a.example.com"})
+	db.SetTunnel("b.example.com", Tunnel{Domain: "b.example.com"})
+
+	if n := len(readDbFile(t).Tunnels); n != 0 {
+		t.Fatalf("Batched changes were saved early, found %d tunnels", n)
+	}
+
+	if err := db.Reload(); !errors.Is(err, ErrPendingWrites) {
+		t.Errorf("Reload with pending changes should fail, got %v", err)
+	}
+
+	if _, exists := db.GetTunnel("a.example.com"); !exists {
+		t.Fatal("Refused reload discarded pending changes")
+	}
+
+	err = db.Flush()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(readDbFile(t).Tunnels); n != 2 {
+		t.Errorf("Flush didn't save immediately, found %d tunnels", n)
+	}
+
+	if err := db.Reload(); err != nil {
+		t.Errorf("Reload after flushing failed: %v", err)
+	}
+
+	// The batch size is reached on the third change
+	db.SetTunnel("c.example.com", Tunnel{Domain: "c.example.com"})
+	db.SetTunnel("d.example.com", Tunnel{Domain: "d.example.com"})
+	db.SetTunnel("e.example.com", Tunnel{Domain: "e.example.com"})
+
+	if n := len(readDbFile(t).Tunnels); n != 5 {
+		t.Errorf("Full batch wasn't saved, found %d tunnels", n)
+	}
+}
+
+func TestAutoSaveEventuallyPersists(t *testing.T) {
+	db, err := NewDatabase(t.TempDir() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.SetBatching(0)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		db.AutoSave(ctx, 10*time.Millisecond)
+		close(done)
+	}()
+
+	db.SetTunnel("a.example.com", Tunnel{Domain: "a.example.com"})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for len(readDbFile(t).Tunnels) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("Batched change was never saved")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Pending changes are saved on shutdown too
+	db.SetTunnel("b.example.com", Tunnel{Domain: "b.example.com"})
+	cancel()
+	<-done
+
+	if n := len(readDbFile(t).Tunnels); n != 2 {
+		t.Errorf("Change wasn't saved on shutdown, found %d tunnels", n)
+	}
+}
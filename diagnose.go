@@ -0,0 +1,235 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Diagnose checks each step of connecting the tunnel for domain and writes
+// the outcome of each to out: fetching the tunnel from the server, the SSH
+// handshake and host key, the reverse forward, the local backend, and for
+// server-terminated tunnels, an HTTP request through the tunnel. It returns
+// the first error which prevents the later steps from running.
+//
+// The reverse forward can't be set up while another client has the tunnel
+// open, so the normal client should be stopped first.
+func (c *Client) Diagnose(ctx context.Context, domain string, out io.Writer) error {
+	return c.diagnose(ctx, domain, func(step, result string) {
+		fmt.Fprintf(out, "%-16s %s\n", step+":", result)
+	})
+}
+
+// DiagnoseStep is the outcome of one of the steps checked by Diagnose.
+type DiagnoseStep struct {
+	Step   string `json:"step"`
+	Result string `json:"result"`
+}
+
+// DiagnoseSteps is Diagnose for machine consumption. The steps that ran are
+// returned even if one failed.
+func (c *Client) DiagnoseSteps(ctx context.Context, domain string) ([]DiagnoseStep, error) {
+	steps := []DiagnoseStep{}
+	err := c.diagnose(ctx, domain, func(step, result string) {
+		steps = append(steps, DiagnoseStep{step, result})
+	})
+	return steps, err
+}
+
+func (c *Client) diagnose(ctx context.Context, domain string, report func(step, result string)) error {
+
+	tunnel, err := c.fetchTunnel(domain)
+	if err != nil {
+		report("Tunnel config", "FAILED: "+err.Error())
+		return err
+	}
+	report("Tunnel config", fmt.Sprintf("OK (%s termination, server %s:%d, port %d)", tunnel.TlsTermination, tunnel.ServerAddress, tunnel.ServerPort, tunnel.TunnelPort))
+
+	signer, err := ssh.ParsePrivateKey([]byte(tunnel.TunnelPrivateKey))
+	if err != nil {
+		report("Private key", "FAILED: "+err.Error())
+		return err
+	}
+	report("Private key", "OK ("+signer.PublicKey().Type()+")")
+
+	hostKeyCallback, hostKeyAlgos, err := tunnelHostKeyCallback(tunnel)
+	if err != nil {
+		report("Host key", "FAILED: "+err.Error())
+		return err
+	}
+
+	config := &ssh.ClientConfig{
+		User: tunnel.Username,
+		Auth: []ssh.AuthMethod{
+			ssh.PublicKeys(signer),
+		},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           10 * time.Second,
+	}
+
+	sshHost := net.JoinHostPort(tunnel.ServerAddress, fmt.Sprint(tunnel.ServerPort))
+	client, err := dialSsh(c.sshDialer, sshHost, config)
+	if err != nil {
+		err = classifyDialError(tunnel, sshHost, err)
+		if errors.Is(err, ErrSshHostKeyMismatch) {
+			report("Host key", "FAILED: "+err.Error())
+		} else {
+			report("SSH handshake", "FAILED: "+err.Error())
+		}
+		return err
+	}
+	defer client.Close()
+
+	if tunnel.ServerPublicKey == "" && len(tunnel.ServerPublicKeys) == 0 {
+		report("Host key", "NOT VERIFIED (the tunnel has no server public key)")
+	} else {
+		report("Host key", "OK (matches the tunnel's server public key)")
+	}
+	report("SSH handshake", "OK")
+
+	tunnelAddr := net.JoinHostPort(tunnelBindAddr(tunnel), fmt.Sprint(tunnel.TunnelPort))
+	listener, err := client.Listen("tcp", tunnelAddr)
+	if err != nil {
+		err = classifyListenError(tunnel, tunnelAddr, err)
+		report("Reverse forward", "FAILED: "+err.Error()+" (is another client already connected?)")
+		return err
+	}
+	defer listener.Close()
+	report("Reverse forward", "OK ("+tunnelAddr+")")
+
+	backendAddr := net.JoinHostPort(tunnel.ClientAddress, fmt.Sprint(tunnel.ClientPort))
+	backendConn, err := net.DialTimeout("tcp", backendAddr, 5*time.Second)
+	if err != nil {
+		report("Backend", "FAILED: "+err.Error())
+	} else {
+		backendConn.Close()
+		report("Backend", "OK ("+backendAddr+")")
+	}
+
+	if tunnel.TlsTermination != "server" && tunnel.TlsTermination != "self-signed" {
+		report("HTTP request", "SKIPPED (only supported for server TLS termination)")
+		return nil
+	}
+
+	// Answer the test request ourselves, so a response with the token
+	// proves it went through this tunnel rather than some other server.
+	token, err := genRandomCode(16)
+	if err != nil {
+		return err
+	}
+
+	server := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, token)
+		}),
+	}
+	go server.Serve(listener)
+	defer server.Close()
+
+	err = diagnoseRequest(ctx, tunnel, token)
+	if err != nil {
+		report("HTTP request", "FAILED: "+err.Error())
+		return err
+	}
+	report("HTTP request", "OK")
+
+	return nil
+}
+
+// fetchTunnel gets the tunnel for domain (or a tunnel key) from the server.
+func (c *Client) fetchTunnel(domain string) (Tunnel, error) {
+	url := fmt.Sprintf("https://%s/api/tunnels?client-name=%s", c.server, c.clientName)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	if len(c.token) > 0 {
+		req.Header.Add("Authorization", "bearer "+c.token)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return Tunnel{}, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	if resp.StatusCode != 200 {
+		return Tunnel{}, fmt.Errorf("HTTP status code %d: %s", resp.StatusCode, string(body))
+	}
+
+	tunnels := make(map[string]Tunnel)
+	err = json.Unmarshal(body, &tunnels)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	if tun, exists := tunnels[domain]; exists {
+		return tun, nil
+	}
+
+	for _, tun := range tunnels {
+		if tun.Domain == domain {
+			return tun, nil
+		}
+	}
+
+	return Tunnel{}, fmt.Errorf("No tunnel for %s on this client", domain)
+}
+
+func diagnoseRequest(ctx context.Context, tunnel Tunnel, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	url := fmt.Sprintf("https://%s%s/", tunnel.Domain, tunnel.PathPrefix)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	if tunnel.AuthUsername != "" || tunnel.AuthPassword != "" {
+		req.SetBasicAuth(tunnel.AuthUsername, tunnel.AuthPassword)
+	}
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: tunnel.TlsTermination == "self-signed",
+			},
+		},
+	}
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if string(body) != token {
+		return fmt.Errorf("Got HTTP status code %d, but the response didn't come through the tunnel", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,191 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const defaultEnrollmentTtl = time.Hour
+const maxEnrollmentTtl = 7 * 24 * time.Hour
+
+// Enrollment is what a client gets in exchange for an enrollment code: its
+// own token, limited to the client, and the tunnels it should open.
+type Enrollment struct {
+	Token   string            `json:"token"`
+	Owner   string            `json:"owner"`
+	Client  string            `json:"client"`
+	Tunnels map[string]Tunnel `json:"tunnels"`
+}
+
+// CreateEnrollmentCode mints a one-time code which a client can redeem at
+// /api/enroll, without having been given a long-lived token. The owner and
+// client-name parameters say who the client's token is for, and ttl how
+// long the code is valid. Only admins can create codes for other users.
+func (a *Api) CreateEnrollmentCode(tokenData TokenData, params url.Values) (string, error) {
+	if !tokenData.CanModify() {
+		return "", ErrReadOnly
+	}
+
+	ownerId := params.Get("owner")
+	if ownerId == "" {
+		ownerId = tokenData.Owner
+	}
+
+	if tokenData.Owner != ownerId {
+		user, _ := a.db.GetUser(tokenData.Owner)
+		if !user.IsAdmin {
+			return "", errors.New("Unauthorized")
+		}
+	}
+
+	if _, exists := a.db.GetUser(ownerId); !exists {
+		return "", errors.New("Owner doesn't exist")
+	}
+
+	client := params.Get("client-name")
+	if client == "" {
+		return "", errors.New("Invalid client-name parameter")
+	}
+
+	ttl := defaultEnrollmentTtl
+	if params.Get("ttl") != "" {
+		var err error
+		ttl, err = time.ParseDuration(params.Get("ttl"))
+		if err != nil || ttl <= 0 {
+			return "", errors.New("Invalid ttl parameter")
+		}
+	}
+
+	if ttl > maxEnrollmentTtl {
+		return "", fmt.Errorf("ttl can't be more than %s", maxEnrollmentTtl)
+	}
+
+	return a.db.AddEnrollmentCode(EnrollmentCode{
+		Owner:   ownerId,
+		Client:  client,
+		Expires: time.Now().Add(ttl),
+	})
+}
+
+// RedeemEnrollmentCode consumes code, creating its client if needed, and
+// returns a new token for the client along with its tunnels.
+func (a *Api) RedeemEnrollmentCode(code string) (Enrollment, error) {
+	enrollment, err := a.db.RedeemEnrollmentCode(code)
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	owner, exists := a.db.GetUser(enrollment.Owner)
+	if !exists {
+		return Enrollment{}, errors.New("Owner doesn't exist")
+	}
+
+	if _, exists := owner.Clients[enrollment.Client]; !exists {
+		if owner.Clients == nil {
+			owner.Clients = make(map[string]DbClient)
+		}
+		owner.Clients[enrollment.Client] = DbClient{}
+		a.db.SetUser(enrollment.Owner, owner)
+	}
+
+	token, err := a.db.AddToken(enrollment.Owner, enrollment.Client, nil, "")
+	if err != nil {
+		return Enrollment{}, err
+	}
+
+	// The code is already gone, so make sure the token isn't lost
+	a.db.Flush()
+
+	tunnels := a.GetTunnels(TokenData{Owner: enrollment.Owner, Client: enrollment.Client})
+	for k, tun := range tunnels {
+		if tun.ClientName != enrollment.Client {
+			delete(tunnels, k)
+		} else {
+			tun.ServerPort = a.config.SshServerPort
+			tunnels[k] = tun
+		}
+	}
+
+	return Enrollment{
+		Token:   token,
+		Owner:   enrollment.Owner,
+		Client:  enrollment.Client,
+		Tunnels: tunnels,
+	}, nil
+}
+
+// handleEnrollmentCodes serves /api/enrollment-codes, where a POST creates
+// a code.
+func (a *Api) handleEnrollmentCodes(w http.ResponseWriter, r *http.Request) {
+
+	r.ParseForm()
+
+	tokenData, ok := a.requireToken(w, r)
+	if !ok {
+		return
+	}
+
+	if tokenData.Client != "" || len(tokenData.Domains) > 0 || !tokenData.CanModify() {
+		w.WriteHeader(403)
+		io.WriteString(w, "Token cannot be used to create enrollment codes")
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/enrollment-codes")
+		return
+	}
+
+	code, err := a.CreateEnrollmentCode(tokenData, r.Form)
+	if err != nil {
+		w.WriteHeader(400)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	io.WriteString(w, code)
+}
+
+// handleEnroll serves /api/enroll, where a client POSTs its enrollment code
+// and gets back an Enrollment.
+func (a *Api) handleEnroll(w http.ResponseWriter, r *http.Request) {
+
+	if r.Method != "POST" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/enroll")
+		return
+	}
+
+	// The response contains a token and tunnel private keys, so don't
+	// ever send it in the clear.
+	if !requestIsTls(r, a.config.BehindProxy) {
+		w.WriteHeader(403)
+		io.WriteString(w, "Enrollment codes can only be redeemed over TLS")
+		return
+	}
+
+	r.ParseForm()
+
+	code := r.Form.Get("code")
+	if code == "" {
+		w.WriteHeader(400)
+		io.WriteString(w, "Invalid code parameter")
+		return
+	}
+
+	enrollment, err := a.RedeemEnrollmentCode(code)
+	if err != nil {
+		w.WriteHeader(403)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(enrollment)
+}
@@ -0,0 +1,102 @@
+package boringproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEnrollmentCodes(t *testing.T) {
+	a := newTestApi(t)
+
+	token, err := a.db.AddToken("admin", "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.db.SetTunnel("laptop.example.com", Tunnel{Domain: "laptop.example.com", Owner: "admin", ClientName: "laptop"})
+	a.db.SetTunnel("server.example.com", Tunnel{Domain: "server.example.com", Owner: "admin", ClientName: "server"})
+
+	req := httptest.NewRequest("POST", "/enrollment-codes", strings.NewReader(url.Values{"client-name": {"laptop"}}.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("access_token", token)
+	rec := httptest.NewRecorder()
+	a.handleEnrollmentCodes(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected a code, got %d: %s", rec.Code, rec.Body.String())
+	}
+	code := rec.Body.String()
+
+	redeem := func(code string, overTls bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/enroll", strings.NewReader(url.Values{"code": {code}}.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if overTls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		rec := httptest.NewRecorder()
+		a.handleEnroll(rec, req)
+		return rec
+	}
+
+	rec = redeem(code, false)
+	if rec.Code != 403 {
+		t.Errorf("Expected redeeming over plain HTTP to be refused, got %d", rec.Code)
+	}
+
+	rec = redeem(code, true)
+	if rec.Code != 200 {
+		t.Fatalf("Expected the code to be redeemed, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	var enrollment Enrollment
+	err = json.NewDecoder(rec.Body).Decode(&enrollment)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokenData, exists := a.db.GetTokenData(enrollment.Token)
+	if !exists || tokenData.Owner != "admin" || tokenData.Client != "laptop" {
+		t.Errorf("Expected a token for admin's laptop client, got %+v", tokenData)
+	}
+
+	user, _ := a.db.GetUser("admin")
+	if _, exists := user.Clients["laptop"]; !exists {
+		t.Error("Expected the client to be created")
+	}
+
+	if len(enrollment.Tunnels) != 1 {
+		t.Errorf("Expected only the laptop's tunnel, got %d", len(enrollment.Tunnels))
+	}
+	if _, exists := enrollment.Tunnels["laptop.example.com"]; !exists {
+		t.Error("Expected the laptop's tunnel to be included")
+	}
+
+	rec = redeem(code, true)
+	if rec.Code != 403 {
+		t.Errorf("Expected a code to be redeemable only once, got %d", rec.Code)
+	}
+
+	expired, err := a.db.AddEnrollmentCode(EnrollmentCode{
+		Owner:   "admin",
+		Client:  "laptop",
+		Expires: time.Now().Add(-time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec = redeem(expired, true)
+	if rec.Code != 403 || !strings.Contains(rec.Body.String(), "expired") {
+		t.Errorf("Expected an expired code to be refused, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Consumed anyway
+	if _, err := a.db.RedeemEnrollmentCode(expired); err == nil || strings.Contains(err.Error(), "expired") {
+		t.Errorf("Expected the expired code to be gone, got %v", err)
+	}
+}
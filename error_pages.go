@@ -0,0 +1,136 @@
+package boringproxy
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+var errorPageCodes = []int{502, 503, 504}
+
+const defaultErrorPage = `<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>{{.StatusCode}} {{.StatusText}}</title>
+  </head>
+  <body>
+    <h1>{{.StatusCode}} {{.StatusText}}</h1>
+    <p>{{.Domain}} is currently unavailable.</p>
+    <p>Request ID: {{.RequestId}}</p>
+  </body>
+</html>
+`
+
+var defaultErrorPageTmpl = template.Must(template.New("error").Parse(defaultErrorPage))
+
+// ErrorPageData is passed to error page templates.
+type ErrorPageData struct {
+	Domain     string
+	RequestId  string
+	StatusCode int
+	StatusText string
+}
+
+// ErrorPages holds the global error page templates used when a tunnel's
+// backend can't be reached. Tunnels can override them individually.
+type ErrorPages struct {
+	templates map[int]*template.Template
+}
+
+// LoadErrorPages loads 502.html, 503.html and 504.html from dir. Missing
+// files fall back to the built-in page. An empty dir uses only the built-in
+// pages.
+func LoadErrorPages(dir string) (*ErrorPages, error) {
+	templates := make(map[int]*template.Template)
+
+	if dir != "" {
+		for _, code := range errorPageCodes {
+			path := filepath.Join(dir, fmt.Sprintf("%d.html", code))
+
+			data, err := ioutil.ReadFile(path)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			} else if err != nil {
+				return nil, err
+			}
+
+			tmpl, err := template.New(path).Parse(string(data))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid error page %s: %w", path, err)
+			}
+
+			templates[code] = tmpl
+		}
+	}
+
+	return &ErrorPages{templates}, nil
+}
+
+// Render writes the error page for code, preferring the tunnel's own
+// template, then the global one, then the built-in one.
+func (e *ErrorPages) Render(w http.ResponseWriter, r *http.Request, tunnel Tunnel, code int) {
+
+	requestId := r.Header.Get("X-Request-Id")
+	if requestId == "" {
+		requestId, _ = genRandomCode(16)
+	}
+
+	tmpl := defaultErrorPageTmpl
+
+	if e != nil {
+		if t, exists := e.templates[code]; exists {
+			tmpl = t
+		}
+	}
+
+	if text, exists := tunnel.ErrorPages[strconv.Itoa(code)]; exists {
+		t, err := template.New("tunnel-error").Parse(text)
+		if err != nil {
+			log.Printf("Invalid %d error page for %s: %v", code, tunnel.Domain, err)
+		} else {
+			tmpl = t
+		}
+	}
+
+	data := ErrorPageData{
+		Domain:     tunnel.Domain,
+		RequestId:  requestId,
+		StatusCode: code,
+		StatusText: http.StatusText(code),
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Request-Id", requestId)
+	w.WriteHeader(code)
+
+	err := tmpl.Execute(w, data)
+	if err != nil {
+		log.Printf("Failed to render %d error page for %s: %v", code, tunnel.Domain, err)
+	}
+}
+
+// upstreamErrorCode picks the status code to return for a failed request
+// to a tunnel backend. Nothing listening on the port means the tunnel (or,
+// on the client, the backend) isn't up at all, which is reported as 503
+// rather than as a bad response.
+func upstreamErrorCode(err error) int {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return 504
+	}
+
+	if isDialError(err) && errors.Is(err, syscall.ECONNREFUSED) {
+		return 503
+	}
+
+	return 502
+}
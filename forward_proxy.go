@@ -0,0 +1,149 @@
+package boringproxy
+
+import (
+	"encoding/base64"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handleConnect handles a CONNECT request for a tunnel in forward proxy mode,
+// connecting the requester to r.Host if it's in the tunnel's allowlist.
+// Only the client calls it, so the destination is resolved from the
+// client's network. The server refuses CONNECT in proxyRequest.
+func handleConnect(w http.ResponseWriter, r *http.Request, tunnel Tunnel) {
+
+	if !tunnel.ForwardProxy {
+		w.WriteHeader(405)
+		io.WriteString(w, "CONNECT not allowed")
+		return
+	}
+
+	if tunnel.AuthUsername != "" || tunnel.AuthPassword != "" {
+		username, password, ok := parseProxyAuth(r.Header.Get("Proxy-Authorization"))
+		if !ok || username != tunnel.AuthUsername || password != tunnel.AuthPassword {
+			w.Header().Set("Proxy-Authenticate", "Basic")
+			w.WriteHeader(407)
+			return
+		}
+	}
+
+	if !forwardProxyAllowed(tunnel.ForwardProxyAllowlist, r.Host) {
+		log.Printf("Forward proxy for %s: destination %s not allowed", tunnel.Domain, r.Host)
+		w.WriteHeader(403)
+		io.WriteString(w, "Destination not allowed")
+		return
+	}
+
+	destConn, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		log.Printf("Forward proxy for %s: %v", tunnel.Domain, err)
+		w.WriteHeader(502)
+		return
+	}
+	defer destConn.Close()
+
+	// HTTP/1.x takes over the whole connection. HTTP/2 tunnels over the
+	// request and response bodies of the stream instead.
+	hijacker, ok := w.(http.Hijacker)
+	if ok && r.ProtoMajor == 1 {
+		clientConn, bufrw, err := hijacker.Hijack()
+		if err != nil {
+			log.Printf("Forward proxy for %s: %v", tunnel.Domain, err)
+			return
+		}
+		defer clientConn.Close()
+
+		_, err = io.WriteString(clientConn, "HTTP/1.1 200 Connection Established\r\n\r\n")
+		if err != nil {
+			return
+		}
+
+		pipeConns(destConn, bufrw, clientConn)
+		return
+	}
+
+	w.WriteHeader(200)
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+
+	pipeConns(destConn, r.Body, flushWriter{w})
+}
+
+// pipeConns copies from src to dest and dest to dst until both directions
+// are done.
+func pipeConns(dest net.Conn, src io.Reader, dst io.Writer) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		io.Copy(dest, src)
+		if tcpConn, ok := dest.(*net.TCPConn); ok {
+			tcpConn.CloseWrite()
+		}
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(dst, dest)
+		wg.Done()
+	}()
+
+	wg.Wait()
+}
+
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (f flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	if flusher, ok := f.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
+
+// forwardProxyAllowed reports whether hostPort matches an allowlist entry.
+// Entries can be a host ("example.com"), a host and port
+// ("example.com:443"), or a wildcard for subdomains ("*.example.com").
+func forwardProxyAllowed(allowlist []string, hostPort string) bool {
+	host, _, err := net.SplitHostPort(hostPort)
+	if err != nil {
+		return false
+	}
+
+	for _, entry := range allowlist {
+		switch {
+		case entry == hostPort || entry == host:
+			return true
+		case strings.HasPrefix(entry, "*.") && strings.HasSuffix(host, entry[1:]):
+			return true
+		}
+	}
+
+	return false
+}
+
+func parseProxyAuth(header string) (string, string, bool) {
+	const prefix = "Basic "
+	if !strings.HasPrefix(header, prefix) {
+		return "", "", false
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(header[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(string(decoded), ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+
+	return parts[0], parts[1], true
+}
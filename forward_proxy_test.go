@@ -0,0 +1,158 @@
+package boringproxy
+
+import (
+	"bufio"
+	"encoding/base64"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestForwardProxyAllowed(t *testing.T) {
+	allowlist := []string{"db.internal", "web.internal:443", "*.svc.internal"}
+
+	cases := []struct {
+		hostPort string
+		allowed  bool
+	}{
+		{"db.internal:5432", true},
+		{"web.internal:443", true},
+		{"web.internal:80", false},
+		{"api.svc.internal:8080", true},
+		{"svc.internal:8080", false},
+		{"evil.example.com:443", false},
+		{"db.internal", false},
+	}
+
+	for _, c := range cases {
+		if forwardProxyAllowed(allowlist, c.hostPort) != c.allowed {
+			t.Errorf("%s: expected allowed to be %v", c.hostPort, c.allowed)
+		}
+	}
+}
+
+// connectThroughProxy sends a CONNECT for dest to the proxy at proxyAddr and returns the
+// response along with the connection, which is the tunnel if it succeeded.
+func connectThroughProxy(t *testing.T, proxyAddr, dest, proxyAuth string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", proxyAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := "CONNECT " + dest + " HTTP/1.1\r\nHost: " + dest + "\r\n"
+	if proxyAuth != "" {
+		req += "Proxy-Authorization: " + proxyAuth + "\r\n"
+	}
+	io.WriteString(conn, req+"\r\n")
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, &http.Request{Method: "CONNECT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return res, conn, reader
+}
+
+func TestForwardProxyConnect(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go serveEcho(echo)
+
+	_, echoPort, _ := net.SplitHostPort(echo.Addr().String())
+
+	tunnel := Tunnel{
+		Domain:                "proxy.example.com",
+		ForwardProxy:          true,
+		ForwardProxyAllowlist: []string{"localhost:" + echoPort},
+		AuthUsername:          "user",
+		AuthPassword:          "secret",
+	}
+
+	// As served by the client
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handleConnect(w, r, tunnel)
+	}))
+	defer proxy.Close()
+
+	proxyAddr := proxy.Listener.Addr().String()
+	auth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:secret"))
+
+	res, _, _ := connectThroughProxy(t, proxyAddr, "localhost:"+echoPort, "")
+	if res.StatusCode != 407 || res.Header.Get("Proxy-Authenticate") == "" {
+		t.Errorf("Expected 407 with a challenge without credentials, got %d", res.StatusCode)
+	}
+
+	wrongAuth := "Basic " + base64.StdEncoding.EncodeToString([]byte("user:wrong"))
+	res, _, _ = connectThroughProxy(t, proxyAddr, "localhost:"+echoPort, wrongAuth)
+	if res.StatusCode != 407 {
+		t.Errorf("Expected 407 with the wrong password, got %d", res.StatusCode)
+	}
+
+	// Same port, but the allowlist only has localhost
+	res, _, _ = connectThroughProxy(t, proxyAddr, "127.0.0.1:"+echoPort, auth)
+	if res.StatusCode != 403 {
+		t.Errorf("Expected 403 for a destination not in the allowlist, got %d", res.StatusCode)
+	}
+
+	res, conn, reader := connectThroughProxy(t, proxyAddr, "localhost:"+echoPort, auth)
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected the CONNECT to be allowed, got %d", res.StatusCode)
+	}
+
+	io.WriteString(conn, "hello\n")
+	line, err := reader.ReadString('\n')
+	if err != nil || line != "hello\n" {
+		t.Errorf("Expected the tunnel to reach the destination, got %q, %v", line, err)
+	}
+}
+
+func TestServerRefusesConnect(t *testing.T) {
+	dialed := make(chan struct{}, 1)
+	dest, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dest.Close()
+	go func() {
+		conn, err := dest.Accept()
+		if err == nil {
+			dialed <- struct{}{}
+			conn.Close()
+		}
+	}()
+
+	tunnel := Tunnel{
+		Domain:                "proxy.example.com",
+		ForwardProxy:          true,
+		ForwardProxyAllowlist: []string{dest.Addr().String()},
+	}
+
+	// As served by the server, ie through the default or a wildcard
+	// tunnel
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyRequest(w, r, tunnel, &http.Client{}, "127.0.0.1", 1, false, nil)
+	}))
+	defer server.Close()
+
+	res, _, _ := connectThroughProxy(t, server.Listener.Addr().String(), dest.Addr().String(), "")
+	if res.StatusCode != 405 {
+		t.Errorf("Expected the server to refuse CONNECT, got %d", res.StatusCode)
+	}
+
+	select {
+	case <-dialed:
+		t.Error("Expected the server not to dial the destination")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
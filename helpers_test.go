@@ -0,0 +1,81 @@
+package boringproxy
+
+import (
+	"context"
+	"os/user"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// newTestTunnelManager returns a TunnelManager backed by a fresh database in
+// a temporary directory, without any of the certmagic, SSH or
+// authorized_keys setup NewTunnelManager does.
+func newTestTunnelManager(t *testing.T) *TunnelManager {
+	t.Helper()
+
+	db, err := NewDatabase(t.TempDir() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.AddUser("admin", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		TunnelPortMin: 20000,
+		TunnelPortMax: 20099,
+		LoopbackIp:    "127.0.0.1",
+	}
+
+	m := &TunnelManager{
+		ctx:           context.Background(),
+		config:        config,
+		db:            db,
+		mutex:         &sync.Mutex{},
+		conns:         NewConnTracker(),
+		createLimiter: newRateLimiter(0, 0),
+		backends:      NewBackendPool(defaultBackendMaxIdleConns, defaultBackendIdleConnTimeout),
+		user:          &user.User{Username: "boringproxy", HomeDir: t.TempDir()},
+		joinTokens:    make(map[string]joinToken),
+		joinMutex:     &sync.Mutex{},
+		started:       time.Now(),
+		akMutex:       &sync.Mutex{},
+		akMetrics:     newAuthorizedKeysMetrics(),
+		certStatuses:  newCertStatuses(),
+		verifications: newDomainVerifications(),
+		listening:     make(chan struct{}),
+	}
+
+	// Tests don't talk to a real CA
+	m.checkAcmeAccount = func(context.Context, *certmagic.ACMEManager, string) error {
+		return nil
+	}
+
+	// As if the listeners were already bound
+	close(m.listening)
+
+	m.routes = NewRouteCache(func() (map[string]Tunnel, error) {
+		return db.GetTunnels(), nil
+	}, db.TunnelsGeneration, config.RouteCacheTtl)
+
+	m.ports = NewPortAllocator(config.TunnelPortMin, config.TunnelPortMax, m.tunnelPorts(), config.PortReuseGrace)
+
+	return m
+}
+
+func newTestApi(t *testing.T) *Api {
+	t.Helper()
+
+	m := newTestTunnelManager(t)
+
+	return &Api{
+		config: m.config,
+		db:     m.db,
+		tunMan: m,
+	}
+}
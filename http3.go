@@ -0,0 +1,61 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// How long browsers can remember that HTTP/3 is available, in seconds.
+const altSvcMaxAge = 24 * 60 * 60
+
+// altSvcHandler advertises HTTP/3 on port for requests that came in over
+// TLS. Only requests the server terminates TLS for get here, so
+// passthrough and client terminated tunnels, which can't be served over
+// QUIC, are never advertised and clients keep using TCP for them.
+func altSvcHandler(port int, next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=%d`, port, altSvcMaxAge)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && r.ProtoMajor < 3 {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// httpsHandler returns the handler for the HTTPS listener on port, which
+// advertises HTTP/3 if config.Http3 is set.
+func httpsHandler(config *Config, port int, handler http.Handler) http.Handler {
+	if !config.Http3 {
+		return handler
+	}
+	return altSvcHandler(port, handler)
+}
+
+// serveHttp3 serves handler over HTTP/3 on the UDP address addr until ctx
+// is done. tlsConfig is the same config used for TCP, so certs are shared.
+func serveHttp3(ctx context.Context, addr string, tlsConfig *tls.Config, handler http.Handler) {
+	server := &http3.Server{
+		Addr:      addr,
+		TLSConfig: http3.ConfigureTLSConfig(tlsConfig),
+		Handler:   handler,
+	}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Printf("HTTP/3 listening on udp %s", addr)
+
+	err := server.ListenAndServe()
+	if err != nil && ctx.Err() == nil {
+		log.Printf("HTTP/3 server error: %v", err)
+	}
+}
@@ -0,0 +1,46 @@
+package boringproxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAltSvcAdvertisedWithHttp3(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})
+
+	altSvc := func(config *Config, tlsRequest bool) string {
+		req := httptest.NewRequest("GET", "https://app.example.com/", nil)
+		if !tlsRequest {
+			req.TLS = nil
+		} else if req.TLS == nil {
+			req.TLS = &tls.ConnectionState{}
+		}
+
+		rec := httptest.NewRecorder()
+		httpsHandler(config, 8443, handler).ServeHTTP(rec, req)
+
+		if rec.Body.String() != "ok" {
+			t.Errorf("Expected the request to be passed on, got %q", rec.Body.String())
+		}
+
+		return rec.Header().Get("Alt-Svc")
+	}
+
+	if header := altSvc(&Config{}, true); header != "" {
+		t.Errorf("Expected no Alt-Svc without -http3, got %q", header)
+	}
+
+	expected := `h3=":8443"; ma=86400`
+	if header := altSvc(&Config{Http3: true}, true); header != expected {
+		t.Errorf("Expected Alt-Svc %q with -http3, got %q", expected, header)
+	}
+
+	if header := altSvc(&Config{Http3: true}, false); header != "" {
+		t.Errorf("Expected no Alt-Svc over plain HTTP, got %q", header)
+	}
+}
@@ -1,14 +1,42 @@
 package boringproxy
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
+	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
-func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpClient *http.Client, address string, port int, behindProxy bool) {
+func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpClient *http.Client, address string, port int, behindProxy bool, errorPages *ErrorPages) {
+
+	ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+	ctx, span := tracer.Start(ctx, "proxy request", trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+		attribute.String("domain", tunnel.Domain),
+		attribute.String("http.method", r.Method),
+	))
+	defer span.End()
+
+	// CONNECT is only answered by the client, for forward proxy tunnels
+	// (see handleConnect). Handling it here would dial from the server's
+	// network.
+	if r.Method == "CONNECT" {
+		w.WriteHeader(405)
+		io.WriteString(w, "CONNECT not allowed")
+		return
+	}
 
 	if tunnel.AuthUsername != "" || tunnel.AuthPassword != "" {
 		username, password, ok := r.BasicAuth()
@@ -29,10 +57,18 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpCli
 
 	downstreamReqHeaders := r.Header.Clone()
 
-	upstreamAddr := fmt.Sprintf("%s:%d", address, port)
-	upstreamUrl := fmt.Sprintf("http://%s%s", upstreamAddr, r.URL.RequestURI())
+	// As with ProxyTcp, an https:// prefix on address means the backend
+	// speaks TLS. httpClient needs to be set up to verify it.
+	upstreamScheme := "http"
+	if strings.HasPrefix(address, "https://") {
+		upstreamScheme = "https"
+		address = strings.TrimPrefix(address, "https://")
+	}
+
+	upstreamAddr := net.JoinHostPort(address, strconv.Itoa(port))
+	upstreamUrl := fmt.Sprintf("%s://%s%s", upstreamScheme, upstreamAddr, upstreamRequestURI(r, tunnel))
 
-	upstreamReq, err := http.NewRequest(r.Method, upstreamUrl, r.Body)
+	upstreamReq, err := http.NewRequestWithContext(ctx, r.Method, upstreamUrl, r.Body)
 	if err != nil {
 		errMessage := fmt.Sprintf("%s", err)
 		w.WriteHeader(500)
@@ -75,16 +111,38 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpCli
 	upstreamReq.Header.Set("X-Forwarded-For", xForwardedFor)
 	upstreamReq.Header.Set("Forwarded", fmt.Sprintf("for=%s", remoteHost))
 
-	// TODO: This might need to be more generic, but using r.Host. However,
-	// I think that may have security implications for things like DNS
-	// rebinding attacks. Not sure.
-	upstreamReq.Host = tunnel.Domain
+	upstreamReq.Host = upstreamHost(r, tunnel)
+
+	// Compressed responses can't be rewritten, so ask for an uncompressed
+	// one. httpClient still negotiates gzip itself and decompresses it.
+	if len(tunnel.BodyRewrites) > 0 {
+		upstreamReq.Header.Del("Accept-Encoding")
+	}
+
+	// Pass our span on to the backend, in place of any incoming trace
+	// context.
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(upstreamReq.Header))
 
-	upstreamRes, err := httpClient.Do(upstreamReq)
+	_, dialSpan := tracer.Start(ctx, "dial backend")
+	upstreamRes, err := doUpstreamRequest(httpClient, upstreamReq, tunnel.RetryOnDialFailure)
+	if err != nil && tunnel.UnreachablePolicy == "wait" && isBackendDownError(err) && canRetryRequest(upstreamReq) {
+		upstreamRes, err = retryUntilReachable(httpClient, upstreamReq, unreachableWait(tunnel))
+	}
 	if err != nil {
-		errMessage := fmt.Sprintf("%s", err)
-		w.WriteHeader(502)
-		io.WriteString(w, errMessage)
+		dialSpan.RecordError(err)
+		dialSpan.SetStatus(codes.Error, "Upstream request failed")
+	}
+	dialSpan.End()
+
+	if err != nil {
+		log.Printf("Upstream request for %s failed: %v", tunnel.Domain, err)
+
+		code := upstreamErrorCode(err)
+		if tunnel.UnreachablePolicy == "maintenance" {
+			code = 503
+		}
+
+		errorPages.Render(w, r, tunnel, code)
 		return
 	}
 	defer upstreamRes.Body.Close()
@@ -103,8 +161,203 @@ func proxyRequest(w http.ResponseWriter, r *http.Request, tunnel Tunnel, httpCli
 		downstreamResHeaders[k] = v
 	}
 
+	if upstreamRes.StatusCode == http.StatusSwitchingProtocols && isUpgradeRequest(r) {
+		span.SetAttributes(attribute.Int("http.status_code", upstreamRes.StatusCode))
+		proxyUpgrade(w, r, tunnel, upstreamRes)
+		return
+	}
+
+	// Only send HSTS over HTTPS. See
+	// https://tools.ietf.org/html/rfc6797#section-7.2
+	if r.TLS != nil {
+		hsts := hstsHeader(tunnel)
+		if hsts != "" {
+			downstreamResHeaders.Set("Strict-Transport-Security", hsts)
+		}
+	}
+
+	var body io.Reader = upstreamRes.Body
+	if shouldRewriteBody(tunnel, upstreamRes) {
+		body, err = rewriteBody(downstreamResHeaders, upstreamRes.Body, tunnel.BodyRewrites)
+		if err != nil {
+			log.Printf("Reading response to rewrite for %s failed: %v", tunnel.Domain, err)
+			errorPages.Render(w, r, tunnel, 502)
+			return
+		}
+	}
+
+	span.SetAttributes(attribute.Int("http.status_code", upstreamRes.StatusCode))
+
 	w.WriteHeader(upstreamRes.StatusCode)
-	io.Copy(w, upstreamRes.Body)
+
+	_, copySpan := tracer.Start(ctx, "copy response")
+	io.Copy(w, body)
+	copySpan.End()
+}
+
+// upstreamRequestURI returns the request URI to send to the backend, with
+// the tunnel's path prefix removed if StripPrefix is set.
+func upstreamRequestURI(r *http.Request, tunnel Tunnel) string {
+	if !tunnel.StripPrefix || tunnel.PathPrefix == "" {
+		return r.URL.RequestURI()
+	}
+
+	u := *r.URL
+	u.Path = strings.TrimPrefix(u.Path, tunnel.PathPrefix)
+	u.RawPath = ""
+	if !strings.HasPrefix(u.Path, "/") {
+		u.Path = "/" + u.Path
+	}
+
+	return u.RequestURI()
+}
+
+// upstreamHost returns the Host header to send to the backend, according to
+// the tunnel's HostHeaderPolicy.
+func upstreamHost(r *http.Request, tunnel Tunnel) string {
+	switch tunnel.HostHeaderPolicy {
+	case "set-to-backend":
+		return fmt.Sprintf("%s:%d", tunnel.ClientAddress, tunnel.ClientPort)
+	case "custom-value":
+		return tunnel.HostHeader
+	default:
+		// r.Host has already been matched against the tunnel
+		// domain, so it's safe to pass on as is.
+		return r.Host
+	}
+}
+
+const maxDialRetries = 5
+const dialRetryDelay = 250 * time.Millisecond
+
+// doUpstreamRequest sends req, retrying up to retries times if the backend
+// couldn't be dialed. Only idempotent requests without a body are retried
+// (see canRetryRequest).
+func doUpstreamRequest(httpClient *http.Client, req *http.Request, retries int) (*http.Response, error) {
+
+	canRetry := canRetryRequest(req)
+
+	for i := 0; ; i++ {
+		res, err := httpClient.Do(req)
+		if err == nil || !canRetry || i >= retries || !isDialError(err) {
+			return res, err
+		}
+
+		log.Printf("Dialing backend for %s failed, retrying: %v", req.Host, err)
+
+		select {
+		case <-req.Context().Done():
+			return nil, err
+		case <-time.After(dialRetryDelay):
+		}
+	}
+}
+
+// redirectLocation returns where a redirect tunnel sends r, and with which
+// status code. Redirects to a domain keep r's scheme, so plain HTTP
+// requests (with -allow-http) aren't sent to HTTPS.
+func redirectLocation(tunnel Tunnel, r *http.Request, behindProxy bool) (string, int) {
+	code := tunnel.RedirectCode
+	if code == 0 {
+		code = http.StatusMovedPermanently
+	}
+
+	if strings.Contains(tunnel.RedirectTo, "://") {
+		return tunnel.RedirectTo, code
+	}
+
+	scheme := "https"
+	if !requestIsTls(r, behindProxy) {
+		scheme = "http"
+	}
+
+	return scheme + "://" + tunnel.RedirectTo + r.URL.RequestURI(), code
+}
+
+// canRetryRequest reports whether req can safely be sent again: it's
+// idempotent, and has no body that would already have been consumed.
+func canRetryRequest(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+
+	return req.Body == nil || req.Body == http.NoBody || req.ContentLength == 0
+}
+
+const defaultUnreachableWait = 10
+const maxUnreachableWait = 60
+
+// unreachableWait returns how long to wait for the tunnel's backend with
+// the "wait" unreachable policy.
+func unreachableWait(tunnel Tunnel) time.Duration {
+	if tunnel.UnreachableWait <= 0 {
+		return defaultUnreachableWait * time.Second
+	}
+	return time.Duration(tunnel.UnreachableWait) * time.Second
+}
+
+// retryUntilReachable sends req again until the backend answers, giving up
+// after timeout. This is used to ride out backend restarts. Dialing the
+// tunnel port succeeds even while the backend is down, since sshd is
+// listening on it, so the request itself is what's retried. req must pass
+// canRetryRequest.
+func retryUntilReachable(httpClient *http.Client, req *http.Request, timeout time.Duration) (*http.Response, error) {
+
+	ctx, cancel := context.WithTimeout(req.Context(), timeout)
+	defer cancel()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("Backend not reachable after %s", timeout)
+		case <-time.After(dialRetryDelay):
+		}
+
+		res, err := httpClient.Do(req)
+		if err == nil || !isBackendDownError(err) {
+			return res, err
+		}
+	}
+}
+
+func isDialError(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// isBackendDownError reports whether err is what a request gets when the
+// backend isn't running: either the tunnel port can't be dialed, or, since
+// the SSH server accepts the connection and closes it once the client
+// can't reach the backend, the connection is dropped before a response.
+// If it's dropped before the request was even written, net/http reports it
+// as a closed idle connection with an unexported error, so that's matched
+// by message.
+func isBackendDownError(err error) bool {
+	return isDialError(err) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		strings.Contains(err.Error(), "server closed idle connection")
+}
+
+func hstsHeader(tunnel Tunnel) string {
+	if tunnel.HstsMaxAge <= 0 {
+		return ""
+	}
+
+	hsts := fmt.Sprintf("max-age=%d", tunnel.HstsMaxAge)
+
+	if tunnel.HstsIncludeSubdomains {
+		hsts += "; includeSubDomains"
+	}
+
+	if tunnel.HstsPreload {
+		hsts += "; preload"
+	}
+
+	return hsts
 }
 
 // Need to strip out headers that shouldn't be forwarded from HTTP/1.1 to
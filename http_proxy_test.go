@@ -0,0 +1,547 @@
+package boringproxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// droppingListener closes the first drops connections it accepts, like the
+// SSH server does while the client can't reach the backend.
+type droppingListener struct {
+	net.Listener
+	mutex *sync.Mutex
+	drops int
+}
+
+func (l *droppingListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		l.mutex.Lock()
+		drop := l.drops > 0
+		if drop {
+			l.drops--
+		}
+		l.mutex.Unlock()
+
+		if !drop {
+			return conn, nil
+		}
+		conn.Close()
+	}
+}
+
+// startRestartingBackend returns the address and port of a backend that
+// drops its first drops connections, then answers "ok".
+func startRestartingBackend(t *testing.T, drops int) (string, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go http.Serve(&droppingListener{Listener: listener, mutex: &sync.Mutex{}, drops: drops}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	return host, port
+}
+
+func TestUnreachablePolicies(t *testing.T) {
+	cases := []struct {
+		policy string
+		method string
+		body   string
+		code   int
+	}{
+		{"", "GET", "", 502},
+		{"fail", "GET", "", 502},
+		{"maintenance", "GET", "", 503},
+		{"wait", "GET", "", 200},
+		{"wait", "DELETE", "", 200},
+		// Not safe to send twice
+		{"wait", "POST", "data", 502},
+		{"wait", "PUT", "data", 502},
+	}
+
+	for _, c := range cases {
+		host, port := startRestartingBackend(t, 2)
+
+		tunnel := Tunnel{Domain: "app.example.com", UnreachablePolicy: c.policy, UnreachableWait: 5}
+
+		var body io.Reader
+		if c.body != "" {
+			body = strings.NewReader(c.body)
+		}
+
+		req := httptest.NewRequest(c.method, "http://app.example.com/", body)
+		rec := httptest.NewRecorder()
+
+		client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+		proxyRequest(rec, req, tunnel, client, host, port, false, nil)
+
+		if rec.Code != c.code {
+			t.Errorf("%s %s with policy %q: expected %d, got %d", c.method, c.body, c.policy, c.code, rec.Code)
+		}
+	}
+}
+
+func TestWaitPolicyGivesUp(t *testing.T) {
+	host, port := startRestartingBackend(t, 1000)
+
+	tunnel := Tunnel{Domain: "app.example.com", UnreachablePolicy: "wait", UnreachableWait: 1}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	client := &http.Client{Transport: &http.Transport{DisableKeepAlives: true}}
+	proxyRequest(rec, req, tunnel, client, host, port, false, nil)
+
+	if rec.Code != 502 {
+		t.Errorf("Expected 502 once the wait is over, got %d", rec.Code)
+	}
+}
+
+// failingDialClient returns a client that fails its first fails dials with
+// "connection refused", and a count of all its dials.
+func failingDialClient(fails int32) (*http.Client, *int32) {
+	var dials int32
+	dialer := &net.Dialer{}
+
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				if atomic.AddInt32(&dials, 1) <= fails {
+					return nil, &net.OpError{Op: "dial", Net: network, Err: syscall.ECONNREFUSED}
+				}
+				return dialer.DialContext(ctx, network, addr)
+			},
+		},
+	}
+
+	return client, &dials
+}
+
+func TestRetryOnDialFailure(t *testing.T) {
+	var requests int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		io.WriteString(w, "ok")
+	}))
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+
+	tunnel := Tunnel{Domain: "app.example.com", RetryOnDialFailure: 1}
+
+	client, dials := failingDialClient(1)
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	proxyRequest(rec, req, tunnel, client, host, port, false, nil)
+
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Errorf("Expected the GET to succeed after one failed dial, got %d %q", rec.Code, rec.Body.String())
+	}
+	if *dials != 2 {
+		t.Errorf("Expected 2 dials, got %d", *dials)
+	}
+
+	// A POST with a body might not be safe to send twice
+	client, dials = failingDialClient(1)
+	req = httptest.NewRequest("POST", "http://app.example.com/", strings.NewReader("data"))
+	rec = httptest.NewRecorder()
+
+	proxyRequest(rec, req, tunnel, client, host, port, false, nil)
+
+	if rec.Code != 503 {
+		t.Errorf("Expected the failed POST to get 503, got %d", rec.Code)
+	}
+	if *dials != 1 {
+		t.Errorf("Expected the POST not to be retried, got %d dials", *dials)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Errorf("Expected only the GET to reach the backend, got %d requests", n)
+	}
+}
+
+func TestTunnelDownUsesCustom503Page(t *testing.T) {
+	// Nothing listening, like the tunnel port while the client is
+	// disconnected
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+	listener.Close()
+
+	dir := t.TempDir()
+	err = ioutil.WriteFile(filepath.Join(dir, "503.html"), []byte("{{.Domain}} is down"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorPages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{Domain: "app.example.com"}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	proxyRequest(rec, req, tunnel, &http.Client{}, host, port, false, errorPages)
+
+	if rec.Code != 503 {
+		t.Errorf("Expected 503, got %d", rec.Code)
+	}
+	if rec.Body.String() != "app.example.com is down" {
+		t.Errorf("Unexpected body %q", rec.Body.String())
+	}
+}
+
+// startResettingBackend starts a backend that reads each request and then
+// resets the connection without answering.
+func startResettingBackend(t *testing.T) (string, int) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.Read(make([]byte, 4096))
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}
+	}()
+
+	host, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	return host, port
+}
+
+func TestBackendResetUsesCustom502Page(t *testing.T) {
+	host, port := startResettingBackend(t)
+
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "502.html"), []byte("{{.Domain}} answered badly"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorPages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{Domain: "app.example.com"}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	proxyRequest(rec, req, tunnel, &http.Client{}, host, port, false, errorPages)
+
+	if rec.Code != 502 {
+		t.Errorf("Expected 502, got %d", rec.Code)
+	}
+	if rec.Body.String() != "app.example.com answered badly" {
+		t.Errorf("Unexpected body %q", rec.Body.String())
+	}
+}
+
+func TestTunnelErrorPageOverridesGlobal(t *testing.T) {
+	host, port := startResettingBackend(t)
+
+	dir := t.TempDir()
+	err := ioutil.WriteFile(filepath.Join(dir, "502.html"), []byte("global page"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	errorPages, err := LoadErrorPages(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{
+		Domain:     "app.example.com",
+		ErrorPages: map[string]string{"502": "{{.StatusCode}} from {{.Domain}}'s own page"},
+	}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+
+	proxyRequest(rec, req, tunnel, &http.Client{}, host, port, false, errorPages)
+
+	if rec.Code != 502 {
+		t.Errorf("Expected 502, got %d", rec.Code)
+	}
+	if rec.Body.String() != "502 from app.example.com's own page" {
+		t.Errorf("Expected the tunnel's page, got %q", rec.Body.String())
+	}
+}
+
+func TestHostHeaderPolicies(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" "+r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+
+	cases := []struct {
+		policy string
+		host   string
+	}{
+		{"", "app.example.com"},
+		{"preserve-original", "app.example.com"},
+		{"set-to-backend", "localhost:3000"},
+		{"custom-value", "internal.example.com"},
+	}
+
+	for _, c := range cases {
+		tunnel := Tunnel{
+			Domain:           "app.example.com",
+			ClientAddress:    "localhost",
+			ClientPort:       3000,
+			HostHeaderPolicy: c.policy,
+			HostHeader:       "internal.example.com",
+		}
+
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		rec := httptest.NewRecorder()
+
+		proxyRequest(rec, req, tunnel, &http.Client{}, host, port, false, nil)
+
+		// The original host is always passed on in X-Forwarded-Host
+		expected := c.host + " app.example.com"
+		if rec.Body.String() != expected {
+			t.Errorf("%q: Expected %q, got %q", c.policy, expected, rec.Body.String())
+		}
+	}
+}
+
+func TestUnknownHostUsesDefaultTunnel(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "default "+r.Header.Get("X-Forwarded-Host"))
+	}))
+	defer backend.Close()
+
+	_, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "http://"))
+	port, _ := strconv.Atoi(portStr)
+
+	m := newTestTunnelManager(t)
+	m.config.DefaultTunnel = "default.example.com"
+
+	m.db.SetTunnel("default.example.com", Tunnel{Domain: "default.example.com", TunnelPort: port, TlsTermination: "server"})
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", TunnelPort: 20001, TlsTermination: "server"})
+
+	tunnel, exists := m.routeRequest("unknown.example.com", "/")
+	if !exists {
+		t.Fatal("Expected an unknown host to be routed to the default tunnel")
+	}
+	if tunnel.Domain != "default.example.com" {
+		t.Fatalf("Expected the default tunnel, got %s", tunnel.Domain)
+	}
+
+	req := httptest.NewRequest("GET", "http://unknown.example.com/", nil)
+	rec := httptest.NewRecorder()
+	proxyRequest(rec, req, tunnel, &http.Client{}, tunnelLoopbackIp(tunnel), tunnel.TunnelPort, false, nil)
+
+	if rec.Body.String() != "default unknown.example.com" {
+		t.Errorf("Expected the default tunnel's backend to answer, got %q", rec.Body.String())
+	}
+
+	// Known hosts still go to their own tunnel
+	tunnel, _ = m.routeRequest("app.example.com", "/")
+	if tunnel.Domain != "app.example.com" {
+		t.Errorf("Expected app.example.com's own tunnel, got %s", tunnel.Domain)
+	}
+
+	// Only tunnels terminated by the server can serve other hosts
+	m.db.SetTunnel("default.example.com", Tunnel{Domain: "default.example.com", TunnelPort: port, TlsTermination: "passthrough"})
+	if _, exists := m.routeRequest("unknown.example.com", "/"); exists {
+		t.Error("Expected a passthrough default tunnel to be ignored")
+	}
+}
+
+func TestTlsBackendWithCustomCa(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "secure backend")
+	}))
+	defer backend.Close()
+
+	_, portStr, _ := net.SplitHostPort(strings.TrimPrefix(backend.URL, "https://"))
+	port, _ := strconv.Atoi(portStr)
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	caPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	err := ioutil.WriteFile(caFile, caPem, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		caFile string
+		code   int
+	}{
+		{caFile, 200},
+		// The backend's cert isn't signed by a public CA
+		{"", 502},
+	}
+
+	for _, c := range cases {
+		tunnel := Tunnel{
+			Domain:        "app.example.com",
+			ClientAddress: "127.0.0.1",
+			ClientPort:    port,
+			ClientUseTls:  true,
+			ClientCaFile:  c.caFile,
+		}
+
+		backendTls, err := backendTlsConfig(tunnel)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		client := newBackendClient(defaultBackendMaxIdleConns, defaultBackendIdleConnTimeout)
+		client.Transport.(*http.Transport).TLSClientConfig = backendTls
+
+		req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+		rec := httptest.NewRecorder()
+		proxyRequest(rec, req, tunnel, client, backendAddress(tunnel), tunnel.ClientPort, false, nil)
+
+		if rec.Code != c.code {
+			t.Errorf("CA file %q: Expected %d, got %d %s", c.caFile, c.code, rec.Code, rec.Body.String())
+		}
+		if c.code == 200 && rec.Body.String() != "secure backend" {
+			t.Errorf("Unexpected body %q", rec.Body.String())
+		}
+
+		client.CloseIdleConnections()
+	}
+}
+
+func TestHstsOnlyOverHttps(t *testing.T) {
+	host, port := startRestartingBackend(t, 0)
+
+	tunnel := Tunnel{Domain: "app.example.com", HstsMaxAge: 300, HstsIncludeSubdomains: true}
+
+	for _, scheme := range []string{"https", "http"} {
+		req := httptest.NewRequest("GET", scheme+"://app.example.com/", nil)
+		rec := httptest.NewRecorder()
+
+		proxyRequest(rec, req, tunnel, &http.Client{}, host, port, false, nil)
+
+		hsts := rec.Header().Get("Strict-Transport-Security")
+		if scheme == "https" && hsts != "max-age=300; includeSubDomains" {
+			t.Errorf("Unexpected HSTS header over HTTPS: %q", hsts)
+		}
+		if scheme == "http" && hsts != "" {
+			t.Errorf("Expected no HSTS header over HTTP, got %q", hsts)
+		}
+	}
+}
+
+func TestWebSocketUpgrade(t *testing.T) {
+	// Accepts an upgrade to "echo" and then echoes lines back
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(400)
+			return
+		}
+
+		conn, buf, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+		buf.Flush()
+
+		for {
+			line, err := buf.ReadString('\n')
+			if err != nil {
+				return
+			}
+			buf.WriteString(line)
+			buf.Flush()
+		}
+	}))
+	defer backend.Close()
+
+	host, portStr, _ := net.SplitHostPort(backend.Listener.Addr().String())
+	port, _ := strconv.Atoi(portStr)
+
+	tunnel := Tunnel{Domain: "app.example.com"}
+	frontend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxyRequest(w, r, tunnel, &http.Client{}, host, port, false, nil)
+	}))
+	defer frontend.Close()
+
+	conn, err := net.Dial("tcp", frontend.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /socket HTTP/1.1\r\nHost: app.example.com\r\nUpgrade: echo\r\nConnection: Upgrade\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.StatusCode != http.StatusSwitchingProtocols || res.Header.Get("Upgrade") != "echo" {
+		t.Fatalf("Expected the upgrade to be accepted, got %d (Upgrade: %q)", res.StatusCode, res.Header.Get("Upgrade"))
+	}
+
+	for _, msg := range []string{"hello\n", "again\n"} {
+		io.WriteString(conn, msg)
+
+		echoed, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if echoed != msg {
+			t.Errorf("Expected %q echoed back, got %q", msg, echoed)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package boringproxy
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const defaultKeepaliveInterval = 30 * time.Second
+const defaultKeepaliveMaxMissed = 3
+
+// ErrKeepaliveTimeout is returned by sshKeepalive when the peer stops
+// answering.
+var ErrKeepaliveTimeout = errors.New("SSH keepalive timed out")
+
+// sshKeepalive sends a keepalive request over conn every interval, same as
+// OpenSSH's ServerAliveInterval. Any reply counts, including a failure.
+// Once maxMissed intervals in a row pass without one, conn is closed so
+// whatever is waiting on it notices the peer is gone, rather than waiting
+// for TCP to give up, which can take many minutes after a NAT mapping is
+// dropped. It returns when conn is closed.
+func sshKeepalive(conn ssh.Conn, interval time.Duration, maxMissed int) error {
+	replies := make(chan error, 1)
+	pending := false
+	missed := 0
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-replies:
+			pending = false
+			if err != nil {
+				// Only happens once the connection is closed
+				return err
+			}
+			missed = 0
+		case <-ticker.C:
+			if pending {
+				missed++
+				if missed >= maxMissed {
+					conn.Close()
+					return ErrKeepaliveTimeout
+				}
+				continue
+			}
+
+			pending = true
+			go func() {
+				_, _, err := conn.SendRequest("keepalive@openssh.com", true, nil)
+				replies <- err
+			}()
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package boringproxy
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// keepaliveConn answers keepalive requests unless unresponsive is set, in
+// which case they hang until it's closed.
+type keepaliveConn struct {
+	ssh.Conn
+	unresponsive bool
+	closed       chan struct{}
+	closeOnce    sync.Once
+}
+
+func newKeepaliveConn(unresponsive bool) *keepaliveConn {
+	return &keepaliveConn{unresponsive: unresponsive, closed: make(chan struct{})}
+}
+
+func (c *keepaliveConn) SendRequest(name string, wantReply bool, payload []byte) (bool, []byte, error) {
+	select {
+	case <-c.closed:
+		return false, nil, io.EOF
+	default:
+	}
+
+	if c.unresponsive {
+		<-c.closed
+		return false, nil, io.EOF
+	}
+
+	return false, nil, nil
+}
+
+func (c *keepaliveConn) Close() error {
+	c.closeOnce.Do(func() { close(c.closed) })
+	return nil
+}
+
+func TestSshKeepalive(t *testing.T) {
+	run := func(conn *keepaliveConn) chan error {
+		done := make(chan error, 1)
+		go func() {
+			done <- sshKeepalive(conn, 10*time.Millisecond, 3)
+		}()
+		return done
+	}
+
+	// A peer that answers is left alone
+	conn := newKeepaliveConn(false)
+	done := run(conn)
+
+	select {
+	case err := <-done:
+		t.Fatalf("Expected a responsive peer to stay connected, got %v", err)
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if errors.Is(err, ErrKeepaliveTimeout) {
+			t.Error("Expected a closed connection not to be reported as a timeout")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected sshKeepalive to return once the connection closed")
+	}
+
+	// One that doesn't is disconnected
+	conn = newKeepaliveConn(true)
+	done = run(conn)
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrKeepaliveTimeout) {
+			t.Errorf("Expected ErrKeepaliveTimeout, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected an unresponsive peer to time out")
+	}
+
+	select {
+	case <-conn.closed:
+	default:
+		t.Error("Expected the connection to be closed after the timeout")
+	}
+}
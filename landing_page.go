@@ -0,0 +1,47 @@
+package boringproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+const defaultLandingPage = `<!doctype html>
+<html>
+  <head>
+    <meta charset="utf-8">
+    <title>Not Found</title>
+  </head>
+  <body>
+    <h1>Not Found</h1>
+    <p>There's nothing here. Check the address and try again.</p>
+  </body>
+</html>
+`
+
+// NewLandingPageHandler returns the handler used for requests that don't
+// match the admin domain or any tunnel. If dir is set, files are served from
+// it, otherwise a generic 404 page is returned. Nothing about the server or
+// its tunnels is revealed either way.
+func NewLandingPageHandler(dir string) (http.Handler, error) {
+
+	if dir == "" {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			w.WriteHeader(404)
+			io.WriteString(w, defaultLandingPage)
+		}), nil
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return nil, fmt.Errorf("Landing page path %s is not a directory", dir)
+	}
+
+	return http.FileServer(http.Dir(dir)), nil
+}
@@ -0,0 +1,96 @@
+package boringproxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestUnknownHostGetsLandingPage(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", TunnelPort: 20001, TlsTermination: "server"})
+
+	if _, exists := m.routeRequest("app.example.com", "/"); !exists {
+		t.Fatal("Expected the tunnel's domain to be routed")
+	}
+	if _, exists := m.routeRequest("unknown.example.com", "/"); exists {
+		t.Fatal("Expected an unknown host not to be routed to a tunnel")
+	}
+
+	landingPage, err := NewLandingPageHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := getWellKnown(landingPage, "unknown.example.com", "/")
+	if code != 404 || body != defaultLandingPage {
+		t.Errorf("Expected the default landing page, got %d %q", code, body)
+	}
+
+	dir := t.TempDir()
+	err = os.WriteFile(filepath.Join(dir, "index.html"), []byte("Example Inc"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	landingPage, err = NewLandingPageHandler(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body = getWellKnown(landingPage, "unknown.example.com", "/")
+	if code != 200 || body != "Example Inc" {
+		t.Errorf("Expected the branded landing page, got %d %q", code, body)
+	}
+}
+
+func TestChallengePathNotIntercepted(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	certConfig := certmagic.NewDefault()
+	certConfig.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+	acmeManager := certmagic.NewACMEManager(certConfig, certmagic.ACMEManager{})
+	certConfig.Issuers = []certmagic.Issuer{acmeManager}
+
+	// As stored by certmagic while solving a challenge for a domain
+	// without a tunnel, ie the admin domain during setup
+	domain := "unknown.example.com"
+	key := path.Join("acme", certmagic.StorageKeys.Safe(acmeManager.IssuerKey()), "challenge_tokens", certmagic.StorageKeys.Safe(domain)+".json")
+	err := certConfig.Storage.Store(key, []byte(`{
+		"type": "http-01",
+		"token": "challenge-token",
+		"keyAuthorization": "challenge-token.thumbprint",
+		"identifier": {"type": "dns", "value": "unknown.example.com"}
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	landingPage, err := NewLandingPageHandler("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := wellKnownHandler(acmeManager, m, landingPage)
+
+	req := httptest.NewRequest("GET", "http://"+domain+acmeChallengePath+"challenge-token", nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	body, _ := io.ReadAll(rec.Body)
+	if rec.Code != http.StatusOK || string(body) != "challenge-token.thumbprint" {
+		t.Errorf("Expected the challenge to be answered, got %d %q", rec.Code, body)
+	}
+
+	// Everything else still gets the landing page
+	code, page := getWellKnown(handler, domain, "/.well-known/other")
+	if code != 404 || !strings.Contains(page, "Not Found") {
+		t.Errorf("Expected the landing page, got %d %q", code, page)
+	}
+}
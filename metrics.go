@@ -0,0 +1,222 @@
+package boringproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// handleMetrics serves tunnel metrics in the Prometheus text format. Only
+// admin tokens are accepted.
+func (a *Api) handleMetrics(w http.ResponseWriter, r *http.Request) {
+
+	token, err := extractToken("access_token", r)
+	if err != nil {
+		w.WriteHeader(401)
+		io.WriteString(w, "No token provided")
+		return
+	}
+
+	tokenData, exists := a.db.GetTokenData(token)
+	if !exists {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return
+	}
+
+	user, _ := a.db.GetUser(tokenData.Owner)
+	if !user.IsAdmin || tokenData.Client != "" || len(tokenData.Domains) > 0 {
+		w.WriteHeader(403)
+		io.WriteString(w, "Not authorized")
+		return
+	}
+
+	tunnels := a.tunMan.GetTunnels()
+
+	stats, err := a.tunMan.Stats()
+	if err != nil {
+		w.WriteHeader(500)
+		io.WriteString(w, err.Error())
+		return
+	}
+
+	domains := []string{}
+	for domain := range tunnels {
+		domains = append(domains, domain)
+	}
+	sort.Strings(domains)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP boringproxy_tunnel_connected Whether a client currently has the tunnel open.")
+	fmt.Fprintln(w, "# TYPE boringproxy_tunnel_connected gauge")
+	for _, domain := range domains {
+		tun := tunnels[domain]
+
+		connected := 0
+		if tun.Connected {
+			connected = 1
+		}
+
+		fmt.Fprintf(w, "boringproxy_tunnel_connected{domain=%q,client=%q} %d\n", domain, tun.ClientName, connected)
+	}
+
+	fmt.Fprintln(w, "# HELP boringproxy_tunnel_matched_requests_total HTTP requests routed to the tunnel.")
+	fmt.Fprintln(w, "# TYPE boringproxy_tunnel_matched_requests_total counter")
+	for _, domain := range domains {
+		fmt.Fprintf(w, "boringproxy_tunnel_matched_requests_total{domain=%q} %d\n", domain, tunnels[domain].MatchedRequests)
+	}
+
+	fmt.Fprintln(w, "# HELP boringproxy_tunnels Number of tunnels.")
+	fmt.Fprintln(w, "# TYPE boringproxy_tunnels gauge")
+	fmt.Fprintf(w, "boringproxy_tunnels %d\n", stats.Tunnels)
+
+	fmt.Fprintln(w, "# HELP boringproxy_tunnels_connected Number of tunnels with a connected client.")
+	fmt.Fprintln(w, "# TYPE boringproxy_tunnels_connected gauge")
+	fmt.Fprintf(w, "boringproxy_tunnels_connected %d\n", stats.Healthy)
+
+	fmt.Fprintln(w, "# HELP boringproxy_received_bytes_total Bytes received from the public side of all tunnels.")
+	fmt.Fprintln(w, "# TYPE boringproxy_received_bytes_total counter")
+	fmt.Fprintf(w, "boringproxy_received_bytes_total %d\n", stats.BytesIn)
+
+	fmt.Fprintln(w, "# HELP boringproxy_sent_bytes_total Bytes sent to the public side of all tunnels.")
+	fmt.Fprintln(w, "# TYPE boringproxy_sent_bytes_total counter")
+	fmt.Fprintf(w, "boringproxy_sent_bytes_total %d\n", stats.BytesOut)
+
+	a.tunMan.akMetrics.write(w)
+}
+
+// Upper bounds, in seconds, of the buckets of durationHistogram
+var durationBuckets = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// durationHistogram is a Prometheus style histogram of durations. It must
+// be guarded by its owner.
+type durationHistogram struct {
+	// Cumulative, one per bucket
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func newDurationHistogram() *durationHistogram {
+	return &durationHistogram{
+		counts: make([]uint64, len(durationBuckets)),
+	}
+}
+
+func (h *durationHistogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range durationBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += seconds
+}
+
+// write prints the histogram's series. labels are added to each of them,
+// ie `op="add"`.
+func (h *durationHistogram) write(w io.Writer, name, labels string) {
+	prefix := labels
+	if prefix != "" {
+		prefix += ","
+	}
+
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%g\"} %d\n", name, prefix, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, prefix, h.count)
+	fmt.Fprintf(w, "%s_sum{%s} %g\n", name, labels, h.sum)
+	fmt.Fprintf(w, "%s_count{%s} %d\n", name, labels, h.count)
+}
+
+// authorizedKeysMetrics tracks the size of the authorized_keys files and how
+// long updating them takes, since they grow with the number of tunnels and
+// are rewritten on every change.
+type authorizedKeysMetrics struct {
+	// Keyed by path
+	lines map[string]int
+	bytes map[string]int
+	// Keyed by operation ("add" or "delete")
+	durations map[string]*durationHistogram
+	mutex     *sync.Mutex
+}
+
+func newAuthorizedKeysMetrics() *authorizedKeysMetrics {
+	return &authorizedKeysMetrics{
+		lines:     make(map[string]int),
+		bytes:     make(map[string]int),
+		durations: make(map[string]*durationHistogram),
+		mutex:     &sync.Mutex{},
+	}
+}
+
+// recordFile records the contents of the authorized_keys file at path.
+func (a *authorizedKeysMetrics) recordFile(path, contents string) {
+	lines := 0
+	for _, line := range strings.Split(contents, "\n") {
+		if strings.TrimSpace(line) != "" {
+			lines++
+		}
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.lines[path] = lines
+	a.bytes[path] = len(contents)
+}
+
+// recordOp records how long a read-modify-write of op took.
+func (a *authorizedKeysMetrics) recordOp(op string, d time.Duration) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	h, exists := a.durations[op]
+	if !exists {
+		h = newDurationHistogram()
+		a.durations[op] = h
+	}
+
+	h.observe(d)
+}
+
+func (a *authorizedKeysMetrics) write(w io.Writer) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	paths := []string{}
+	for path := range a.lines {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	fmt.Fprintln(w, "# HELP boringproxy_authorized_keys_lines Number of lines in authorized_keys.")
+	fmt.Fprintln(w, "# TYPE boringproxy_authorized_keys_lines gauge")
+	for _, path := range paths {
+		fmt.Fprintf(w, "boringproxy_authorized_keys_lines{path=%q} %d\n", path, a.lines[path])
+	}
+
+	fmt.Fprintln(w, "# HELP boringproxy_authorized_keys_size_bytes Size of authorized_keys.")
+	fmt.Fprintln(w, "# TYPE boringproxy_authorized_keys_size_bytes gauge")
+	for _, path := range paths {
+		fmt.Fprintf(w, "boringproxy_authorized_keys_size_bytes{path=%q} %d\n", path, a.bytes[path])
+	}
+
+	ops := []string{}
+	for op := range a.durations {
+		ops = append(ops, op)
+	}
+	sort.Strings(ops)
+
+	fmt.Fprintln(w, "# HELP boringproxy_authorized_keys_update_duration_seconds Time taken to read, modify, and write authorized_keys.")
+	fmt.Fprintln(w, "# TYPE boringproxy_authorized_keys_update_duration_seconds histogram")
+	for _, op := range ops {
+		a.durations[op].write(w, "boringproxy_authorized_keys_update_duration_seconds", fmt.Sprintf("op=%q", op))
+	}
+}
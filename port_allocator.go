@@ -0,0 +1,221 @@
+package boringproxy
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ErrNoFreePorts is returned when every port in the tunnel port range is
+// taken.
+var ErrNoFreePorts = errors.New("No free tunnel ports")
+
+// PortAllocator hands out tunnel ports from [min, max]. It keeps track of
+// the ports tunnels are using, so two tunnels created at the same time can't
+// be given the same port, and nothing has to be bound to find a free one.
+// Ports are picked at random from the free ones, so ports of deleted tunnels
+// aren't immediately reused. Released ports are also held back for a grace
+// period, since their sockets can linger in TIME_WAIT and make binding them
+// again fail. Allocate and Release are O(1) (amortized for Allocate).
+type PortAllocator struct {
+	min  int
+	max  int
+	free []int
+	// Position of each free port in free
+	freeIndex map[int]int
+	// Released ports in the order they were released, and when each one
+	// can be reused
+	quarantine  []quarantinedPort
+	quarantined map[int]time.Time
+	reuseGrace  time.Duration
+	rand        *rand.Rand
+	mutex       *sync.Mutex
+}
+
+type quarantinedPort struct {
+	port  int
+	until time.Time
+}
+
+// NewPortAllocator returns an allocator for [min, max] with ports, ie those
+// of existing tunnels, already allocated. Released ports aren't handed out
+// again until reuseGrace has passed.
+func NewPortAllocator(min, max int, ports []int, reuseGrace time.Duration) *PortAllocator {
+	a := &PortAllocator{
+		min:        min,
+		max:        max,
+		reuseGrace: reuseGrace,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+		mutex:      &sync.Mutex{},
+	}
+	a.Reset(ports)
+	return a
+}
+
+// Reset replaces the set of allocated ports, ie after reloading the
+// database.
+func (a *PortAllocator) Reset(ports []int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	allocated := make(map[int]bool)
+	for _, port := range ports {
+		allocated[port] = true
+	}
+
+	a.free = []int{}
+	a.freeIndex = make(map[int]int)
+	a.quarantine = []quarantinedPort{}
+	a.quarantined = make(map[int]time.Time)
+
+	for port := a.min; port <= a.max; port++ {
+		if !allocated[port] {
+			a.freeIndex[port] = len(a.free)
+			a.free = append(a.free, port)
+		}
+	}
+}
+
+// Allocate returns a free port and marks it allocated.
+func (a *PortAllocator) Allocate() (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine(time.Now())
+
+	if len(a.free) == 0 {
+		return 0, ErrNoFreePorts
+	}
+
+	port := a.free[a.rand.Intn(len(a.free))]
+	a.take(port)
+
+	return port, nil
+}
+
+// Peek returns a port Allocate could currently return, without allocating
+// it.
+func (a *PortAllocator) Peek() (int, error) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine(time.Now())
+
+	if len(a.free) == 0 {
+		return 0, ErrNoFreePorts
+	}
+
+	return a.free[a.rand.Intn(len(a.free))], nil
+}
+
+// Reserve marks port as allocated, ie when a tunnel requests a specific
+// port. That's allowed even if the port is quarantined, since whoever asked
+// for it presumably knows it's usable. Ports outside the range are ignored.
+func (a *PortAllocator) Reserve(port int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	delete(a.quarantined, port)
+	a.take(port)
+}
+
+// Release makes port available again once the reuse grace period has
+// passed. Ports outside the range are ignored.
+func (a *PortAllocator) Release(port int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if port < a.min || port > a.max {
+		return
+	}
+
+	if _, free := a.freeIndex[port]; free {
+		return
+	}
+
+	if _, quarantined := a.quarantined[port]; quarantined {
+		return
+	}
+
+	if a.reuseGrace <= 0 {
+		a.makeFree(port)
+		return
+	}
+
+	until := time.Now().Add(a.reuseGrace)
+	a.quarantine = append(a.quarantine, quarantinedPort{port, until})
+	a.quarantined[port] = until
+}
+
+// Cancel gives back a port from Allocate that was never handed out to a
+// tunnel, ie because creating it failed. Nothing can have bound it, so it's
+// free again immediately rather than after the grace period.
+func (a *PortAllocator) Cancel(port int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if port < a.min || port > a.max {
+		return
+	}
+
+	if _, free := a.freeIndex[port]; free {
+		return
+	}
+
+	if _, quarantined := a.quarantined[port]; quarantined {
+		return
+	}
+
+	a.makeFree(port)
+}
+
+// endQuarantine frees the quarantined ports whose grace period is over. The
+// grace period is the same for every port, so they expire in the order they
+// were released. Must be called with the mutex held.
+func (a *PortAllocator) endQuarantine(now time.Time) {
+	for len(a.quarantine) > 0 && !now.Before(a.quarantine[0].until) {
+		q := a.quarantine[0]
+		a.quarantine = a.quarantine[1:]
+
+		// Skip ports that were reserved, or released again, while
+		// quarantined
+		if until, exists := a.quarantined[q.port]; exists && until.Equal(q.until) {
+			delete(a.quarantined, q.port)
+			a.makeFree(q.port)
+		}
+	}
+}
+
+// makeFree adds port to the free list. Must be called with the mutex held.
+func (a *PortAllocator) makeFree(port int) {
+	a.freeIndex[port] = len(a.free)
+	a.free = append(a.free, port)
+}
+
+// Usage returns the number of ports in the range that aren't free, including
+// quarantined ones, and the size of the range.
+func (a *PortAllocator) Usage() (used, total int) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.endQuarantine(time.Now())
+
+	total = a.max - a.min + 1
+	return total - len(a.free), total
+}
+
+// take removes port from the free list by swapping in the last one. Must be
+// called with the mutex held.
+func (a *PortAllocator) take(port int) {
+	i, free := a.freeIndex[port]
+	if !free {
+		return
+	}
+
+	last := a.free[len(a.free)-1]
+	a.free[i] = last
+	a.freeIndex[last] = i
+
+	a.free = a.free[:len(a.free)-1]
+	delete(a.freeIndex, port)
+}
@@ -0,0 +1,134 @@
+package boringproxy
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPortAllocatorPeekAndCancelSkipQuarantine(t *testing.T) {
+	a := NewPortAllocator(20000, 20001, nil, time.Hour)
+
+	for i := 0; i < 10; i++ {
+		_, err := a.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if used, _ := a.Usage(); used != 0 {
+		t.Fatalf("Peek used %d ports", used)
+	}
+
+	port, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a.Cancel(port)
+
+	if used, _ := a.Usage(); used != 0 {
+		t.Fatalf("Cancelled port wasn't freed immediately")
+	}
+
+	port, _ = a.Allocate()
+	a.Release(port)
+
+	if used, _ := a.Usage(); used != 1 {
+		t.Fatalf("Released port wasn't quarantined")
+	}
+
+	other, err := a.Allocate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other == port {
+		t.Error("Quarantined port was reused")
+	}
+
+	if _, err := a.Allocate(); err != ErrNoFreePorts {
+		t.Errorf("Expected ErrNoFreePorts, got %v", err)
+	}
+}
+
+func TestPortAllocatorNeverDoubleIssues(t *testing.T) {
+	// 20003 is already used by an existing tunnel
+	a := NewPortAllocator(20000, 20099, []int{20003}, 0)
+
+	var mutex sync.Mutex
+	issued := make(map[int]bool)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				port, err := a.Allocate()
+				if err != nil {
+					return
+				}
+
+				mutex.Lock()
+				if issued[port] {
+					t.Errorf("Port %d issued twice", port)
+				}
+				issued[port] = true
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(issued) != 99 || issued[20003] {
+		t.Fatalf("Expected every free port to be issued once, got %d", len(issued))
+	}
+
+	// Without a grace period, released ports are free straight away
+	a.Release(20042)
+
+	port, err := a.Allocate()
+	if err != nil || port != 20042 {
+		t.Errorf("Expected the released port back, got %d, %v", port, err)
+	}
+}
+
+func TestPreflightDoesntQuarantinePorts(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.ports = NewPortAllocator(m.config.TunnelPortMin, m.config.TunnelPortMax, nil, time.Hour)
+
+	for i := 0; i < 5; i++ {
+		_, err := m.PreflightTunnel(context.Background(), Tunnel{Domain: "app.example.com", Owner: "admin", TlsTermination: "client"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if used, _ := m.ports.Usage(); used != 0 {
+		t.Errorf("Preflight left %d ports unavailable", used)
+	}
+}
+
+// The allocator replaced binding :0 for every new tunnel. Compare with
+// go test -bench Port.
+func BenchmarkRandomOpenPort(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		_, err := randomOpenPort("127.0.0.1")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkPortAllocator(b *testing.B) {
+	a := NewPortAllocator(20000, 29999, nil, 0)
+
+	for i := 0; i < b.N; i++ {
+		port, err := a.Allocate()
+		if err != nil {
+			b.Fatal(err)
+		}
+		a.Release(port)
+	}
+}
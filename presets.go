@@ -0,0 +1,74 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+)
+
+// Parameters a tunnel preset can set, in addition to tunnelDefaultParams.
+// Presets describe kinds of tunnels rather than a particular one, so domain,
+// ports and client name are left out.
+var tunnelPresetParams = []string{
+	"password-protect",
+	"username",
+	"password",
+	"strip-prefix",
+	"pinned",
+}
+
+// LoadTunnelPresets reads named tunnel presets from a JSON file mapping
+// preset names to tunnel creation parameters, ie
+//
+//	{"internal": {"password-protect": "on", "username": "me", "password": "..."}}
+func LoadTunnelPresets(path string) (map[string]map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	presets := make(map[string]map[string]string)
+	err = json.Unmarshal(data, &presets)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid tunnel presets file %s: %w", path, err)
+	}
+
+	for name, preset := range presets {
+		for param := range preset {
+			if !stringInArray(param, tunnelDefaultParams) && !stringInArray(param, tunnelPresetParams) {
+				return nil, fmt.Errorf("Tunnel preset %s: unsupported parameter %s", name, param)
+			}
+		}
+	}
+
+	return presets, nil
+}
+
+// withTunnelPreset fills in the parameters from the preset named by the
+// "preset" parameter, if any. Like withTunnelDefaults, explicit parameters
+// take precedence.
+func (a *Api) withTunnelPreset(params url.Values) (url.Values, error) {
+	name := params.Get("preset")
+	if name == "" {
+		return params, nil
+	}
+
+	preset, exists := a.config.TunnelPresets[name]
+	if !exists {
+		return nil, fmt.Errorf("Unknown tunnel preset %s", name)
+	}
+
+	return withTunnelDefaults(params, preset), nil
+}
+
+// presetNames returns the configured preset names, sorted.
+func presetNames(presets map[string]map[string]string) []string {
+	names := []string{}
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
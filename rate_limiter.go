@@ -0,0 +1,77 @@
+package boringproxy
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key. Buckets start full and
+// refill at rate tokens per second, up to burst. A rate of 0 disables
+// limiting.
+type rateLimiter struct {
+	rate    float64
+	burst   float64
+	buckets map[string]*tokenBucket
+	mutex   *sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		mutex:   &sync.Mutex{},
+	}
+}
+
+// Allow takes a token from key's bucket, returning false if it's empty.
+func (l *rateLimiter) Allow(key string) bool {
+	return l.take(key, true)
+}
+
+// Check reports whether Allow would succeed, without taking a token.
+func (l *rateLimiter) Check(key string) bool {
+	return l.take(key, false)
+}
+
+func (l *rateLimiter) take(key string, consume bool) bool {
+	if l.rate <= 0 {
+		return true
+	}
+
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	now := time.Now()
+
+	bucket, exists := l.buckets[key]
+	if !exists {
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	bucket.tokens += now.Sub(bucket.last).Seconds() * l.rate
+	if bucket.tokens > l.burst {
+		bucket.tokens = l.burst
+	}
+	bucket.last = now
+
+	if bucket.tokens < 1 {
+		return false
+	}
+
+	if consume {
+		bucket.tokens--
+	}
+
+	return true
+}
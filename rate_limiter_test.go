@@ -0,0 +1,29 @@
+package boringproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterBurstAndRefill(t *testing.T) {
+	l := newRateLimiter(20, 2)
+
+	if !l.Allow("alice") || !l.Allow("alice") {
+		t.Fatal("Expected the burst to be allowed")
+	}
+	if l.Allow("alice") {
+		t.Error("Expected requests beyond the burst to be rejected")
+	}
+	if !l.Allow("bob") {
+		t.Error("Expected each key to have its own bucket")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+
+	if !l.Check("alice") {
+		t.Fatal("Expected the bucket to refill")
+	}
+	if !l.Allow("alice") {
+		t.Error("Expected Check not to take a token")
+	}
+}
@@ -0,0 +1,166 @@
+package boringproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// How often the reaper looks for idle tunnels.
+const idleReapInterval = 10 * time.Minute
+
+// ReapEvent is POSTed as JSON to config.IdleWebhook when the reaper first
+// notices a tunnel is idle ("tunnel_idle"), and when it deletes it, or would
+// delete it in dry-run mode ("tunnel_reaped").
+type ReapEvent struct {
+	Event        string    `json:"event"`
+	Key          string    `json:"key"`
+	Domain       string    `json:"domain"`
+	Owner        string    `json:"owner"`
+	LastActivity time.Time `json:"last_activity"`
+	DryRun       bool      `json:"dry_run"`
+}
+
+// idleReaper deletes tunnels idle for longer than config.IdleTimeout. A
+// tunnel is first noticed as idle, and only deleted if it's still idle
+// config.IdleGracePeriod later, which gives owners time to react to the
+// warning. Pinned tunnels and ones with NoIdleTimeout are never deleted,
+// and with config.IdleSkipConnected neither are ones with a connected
+// client. In dry-run mode a tunnel that would have been deleted starts a new
+// grace period, so it's reported once per period rather than on every run.
+type idleReaper struct {
+	m *TunnelManager
+	// When each tunnel was first seen idle
+	idleSince map[string]time.Time
+}
+
+func (m *TunnelManager) runIdleReaper(ctx context.Context, interval time.Duration) {
+	r := &idleReaper{
+		m:         m,
+		idleSince: make(map[string]time.Time),
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+			r.reap(ctx, time.Now())
+		}
+	}
+}
+
+func (r *idleReaper) reap(ctx context.Context, now time.Time) {
+	m := r.m
+
+	idle := make(map[string]bool)
+
+	for _, key := range m.IdleTunnels(m.config.IdleTimeout, now) {
+		tun, exists := m.db.GetTunnel(key)
+		if !exists || tun.Pinned || tun.NoIdleTimeout {
+			continue
+		}
+
+		if m.config.IdleSkipConnected && m.IsConnected(tun.TunnelPort) {
+			continue
+		}
+
+		idle[key] = true
+
+		event := ReapEvent{
+			Event:        "tunnel_reaped",
+			Key:          key,
+			Domain:       tun.Domain,
+			Owner:        tun.Owner,
+			LastActivity: m.lastActivity(key, tun),
+			DryRun:       m.config.IdleDryRun,
+		}
+
+		since, seen := r.idleSince[key]
+		if !seen {
+			r.idleSince[key] = now
+			log.Printf("Tunnel %s (owner %s) is idle and will be deleted in %s unless it's used", key, tun.Owner, m.config.IdleGracePeriod)
+			event.Event = "tunnel_idle"
+			r.notify(ctx, event)
+			continue
+		}
+
+		if now.Sub(since) < m.config.IdleGracePeriod {
+			continue
+		}
+
+		if m.config.IdleDryRun {
+			log.Printf("Idle reaper (dry run): would delete %s (owner %s)", key, tun.Owner)
+			r.idleSince[key] = now
+		} else {
+			err := m.DeleteTunnel(ctx, key)
+			if err != nil {
+				log.Printf("Idle reaper: failed to delete %s: %v", key, err)
+				continue
+			}
+
+			if tun.Companion != "" {
+				err := m.DeleteTunnel(ctx, tun.Companion)
+				if err != nil {
+					log.Printf("Idle reaper: failed to delete companion %s: %v", tun.Companion, err)
+				}
+			}
+
+			log.Printf("Idle reaper: deleted %s (owner %s)", key, tun.Owner)
+			delete(r.idleSince, key)
+		}
+
+		r.notify(ctx, event)
+	}
+
+	// Tunnels that were used again start over
+	for key := range r.idleSince {
+		if !idle[key] {
+			delete(r.idleSince, key)
+		}
+	}
+}
+
+// notify sends event to config.IdleWebhook, if there is one.
+func (r *idleReaper) notify(ctx context.Context, event ReapEvent) {
+	if r.m.config.IdleWebhook == "" {
+		return
+	}
+
+	err := postReapEvent(ctx, r.m.config.IdleWebhook, event)
+	if err != nil {
+		log.Printf("Idle reaper: webhook failed for %s: %v", event.Key, err)
+	}
+}
+
+func postReapEvent(ctx context.Context, url string, event ReapEvent) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Second)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("HTTP status code %d", resp.StatusCode)
+	}
+
+	return nil
+}
@@ -0,0 +1,97 @@
+package boringproxy
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// startReapWebhook returns the URL of a webhook that records the events it
+// receives.
+func startReapWebhook(t *testing.T) (string, func() []ReapEvent) {
+	t.Helper()
+
+	var mutex sync.Mutex
+	events := []ReapEvent{}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event ReapEvent
+		json.NewDecoder(r.Body).Decode(&event)
+
+		mutex.Lock()
+		events = append(events, event)
+		mutex.Unlock()
+	}))
+	t.Cleanup(server.Close)
+
+	return server.URL, func() []ReapEvent {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]ReapEvent{}, events...)
+	}
+}
+
+func TestIdleTunnelsAtFixedTime(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	m.started = now.Add(-48 * time.Hour)
+
+	m.db.SetTunnel("old.example.com", Tunnel{Domain: "old.example.com", LastActivity: now.Add(-2 * time.Hour)})
+	m.db.SetTunnel("new.example.com", Tunnel{Domain: "new.example.com", LastActivity: now.Add(-30 * time.Minute)})
+	m.db.SetTunnel("untracked.example.com", Tunnel{Domain: "untracked.example.com"})
+	m.db.SetTunnel("www.old.example.com", Tunnel{Domain: "www.old.example.com", RedirectTo: "old.example.com"})
+
+	idle := m.IdleTunnels(time.Hour, now)
+	if len(idle) != 2 || idle[0] != "old.example.com" || idle[1] != "untracked.example.com" {
+		t.Errorf("Unexpected idle tunnels %v", idle)
+	}
+
+	if idle := m.IdleTunnels(time.Hour, now.Add(-90*time.Minute)); len(idle) != 1 || idle[0] != "untracked.example.com" {
+		t.Errorf("Unexpected idle tunnels earlier on %v", idle)
+	}
+}
+
+func TestIdleReaperDryRunReportsOncePerGracePeriod(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	webhook, events := startReapWebhook(t)
+
+	m.config.IdleTimeout = time.Hour
+	m.config.IdleGracePeriod = time.Hour
+	m.config.IdleDryRun = true
+	m.config.IdleWebhook = webhook
+
+	now := time.Date(2026, 10, 12, 12, 0, 0, 0, time.UTC)
+	m.started = now.Add(-48 * time.Hour)
+
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Owner: "admin", LastActivity: now.Add(-2 * time.Hour)})
+	m.db.SetTunnel("pinned.example.com", Tunnel{Domain: "pinned.example.com", Owner: "admin", Pinned: true})
+
+	r := &idleReaper{m: m, idleSince: make(map[string]time.Time)}
+
+	for _, offset := range []time.Duration{0, 30 * time.Minute, time.Hour, 70 * time.Minute, 110 * time.Minute, 2 * time.Hour} {
+		r.reap(context.Background(), now.Add(offset))
+	}
+
+	got := events()
+
+	expected := []string{"tunnel_idle", "tunnel_reaped", "tunnel_reaped"}
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %d events, got %+v", len(expected), got)
+	}
+
+	for i, event := range got {
+		if event.Event != expected[i] || event.Key != "app.example.com" || !event.DryRun {
+			t.Errorf("Unexpected event %d: %+v", i, event)
+		}
+	}
+
+	if _, exists := m.db.GetTunnel("app.example.com"); !exists {
+		t.Error("Dry run deleted the tunnel")
+	}
+}
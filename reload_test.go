@@ -0,0 +1,82 @@
+package boringproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// addTunnelExternally writes tun to the database file through a second
+// Database, the way another boringproxy process or a tool would.
+func addTunnelExternally(t *testing.T, tun Tunnel) {
+	t.Helper()
+
+	_, privKey, err := MakeSSHKeyPair("ed25519", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tun.TunnelPrivateKey = privKey
+
+	other, err := NewDatabase(DBFolderPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.SetTunnel(tunnelKey(tun), tun)
+}
+
+func TestReloadActivatesExternalTunnel(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addTunnelExternally(t, Tunnel{
+		Domain:         "external.example.com",
+		Owner:          "admin",
+		TunnelPort:     20005,
+		ClientAddress:  "127.0.0.1",
+		ClientPort:     8080,
+		TlsTermination: "server",
+	})
+
+	if _, ok := m.routeRequest("external.example.com", "/"); ok {
+		t.Fatal("Expected the tunnel to be unknown before reloading")
+	}
+
+	err = m.ReloadTunnels()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun, ok := m.routeRequest("external.example.com", "/")
+	if !ok {
+		t.Fatal("Expected the tunnel to be routed after reloading")
+	}
+	if tun.TunnelPort != 20005 {
+		t.Errorf("Expected tunnel port 20005, got %d", tun.TunnelPort)
+	}
+
+	akBytes, err := ioutil.ReadFile(filepath.Join(m.user.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(akBytes), tunnelKeyId("external.example.com", 20005)) {
+		t.Errorf("Expected an authorized_keys line for the tunnel, got %q", akBytes)
+	}
+
+	// The port is taken now, so it can't be handed out again
+	_, err = m.RequestCreateTunnel(m.ctx, Tunnel{
+		Domain:         "other.example.com",
+		Owner:          "admin",
+		TunnelPort:     20005,
+		TlsTermination: "client",
+	})
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("Expected the reloaded tunnel's port to be in use, got %v", err)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package boringproxy
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload relays SIGUSR1, which triggers a tunnel reload, to c.
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
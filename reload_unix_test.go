@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package boringproxy
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSignalReloadsTunnels(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	reloadSignals := make(chan os.Signal, 1)
+	notifyReload(reloadSignals)
+	defer signal.Stop(reloadSignals)
+	go watchReloads(ctx, m, reloadSignals)
+
+	addTunnelExternally(t, Tunnel{
+		Domain:         "signaled.example.com",
+		Owner:          "admin",
+		TunnelPort:     20006,
+		TlsTermination: "client",
+	})
+
+	err := syscall.Kill(os.Getpid(), syscall.SIGUSR1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, exists := m.db.GetTunnel("signaled.example.com"); exists {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected SIGUSR1 to reload the tunnel added to the database")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package boringproxy
+
+import (
+	"os"
+)
+
+// notifyReload does nothing, since there's no SIGUSR1 on Windows. Use the
+// /api/reload endpoint instead.
+func notifyReload(c chan<- os.Signal) {
+}
@@ -0,0 +1,97 @@
+package boringproxy
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const defaultRouteCacheTtl = 5 * time.Second
+
+// RouteCache keeps a copy of the tunnel map for routing requests, so that
+// if loading tunnels from the database fails, live traffic keeps flowing
+// from the last good copy. It's refreshed once it's older than ttl, or as
+// soon as the database reports a change. Writes always go straight to the
+// database.
+type RouteCache struct {
+	load       func() (map[string]Tunnel, error)
+	generation func() uint64
+	ttl        time.Duration
+	mutex      *sync.Mutex
+	tunnels    map[string]Tunnel
+	loadedGen  uint64
+	loadedAt   time.Time
+	// Set while the last load failed, so the error is only logged once
+	failing bool
+}
+
+// NewRouteCache caches the result of load. generation must change whenever
+// the tunnels do.
+func NewRouteCache(load func() (map[string]Tunnel, error), generation func() uint64, ttl time.Duration) *RouteCache {
+	return &RouteCache{
+		load:       load,
+		generation: generation,
+		ttl:        ttl,
+		mutex:      &sync.Mutex{},
+	}
+}
+
+// Tunnels returns the cached tunnel map, refreshing it first if needed. The
+// map is shared, so it must not be modified.
+func (c *RouteCache) Tunnels() map[string]Tunnel {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	gen := c.generation()
+
+	if c.tunnels != nil && gen == c.loadedGen && time.Since(c.loadedAt) < c.ttl {
+		return c.tunnels
+	}
+
+	tunnels, err := c.load()
+	if err != nil {
+		if !c.failing {
+			log.Printf("Failed to load tunnels, routing from cache: %v", err)
+			c.failing = true
+		}
+
+		if c.tunnels == nil {
+			return map[string]Tunnel{}
+		}
+
+		// Don't retry on every request while the database is down
+		c.loadedGen = gen
+		c.loadedAt = time.Now()
+
+		return c.tunnels
+	}
+
+	if c.failing {
+		log.Println("Loading tunnels succeeded again")
+		c.failing = false
+	}
+
+	c.tunnels = tunnels
+	c.loadedGen = gen
+	c.loadedAt = time.Now()
+
+	return c.tunnels
+}
+
+// Get returns the tunnel stored under key.
+func (c *RouteCache) Get(key string) (Tunnel, bool) {
+	tun, exists := c.Tunnels()[key]
+	return tun, exists
+}
+
+// MatchDomain finds the tunnel for a TLS connection, same as
+// Database.MatchDomain.
+func (c *RouteCache) MatchDomain(domain string) (Tunnel, bool) {
+	return matchDomain(c.Tunnels(), domain)
+}
+
+// Match finds the tunnel for an HTTP request, same as
+// Database.MatchTunnel.
+func (c *RouteCache) Match(domain, path string) (Tunnel, bool) {
+	return matchTunnel(c.Tunnels(), domain, path)
+}
@@ -0,0 +1,72 @@
+package boringproxy
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRouteCacheServesLastGoodCopy(t *testing.T) {
+	var tunnels map[string]Tunnel
+	var loadErr error
+	var gen uint64
+	loads := 0
+
+	cache := NewRouteCache(func() (map[string]Tunnel, error) {
+		loads++
+		return tunnels, loadErr
+	}, func() uint64 {
+		return gen
+	}, time.Hour)
+
+	loadErr = errors.New("database unavailable")
+
+	if len(cache.Tunnels()) != 0 {
+		t.Error("Expected no tunnels before the first successful load")
+	}
+
+	loadErr = nil
+	tunnels = map[string]Tunnel{
+		"app.example.com": {Domain: "app.example.com"},
+	}
+	gen++
+
+	if _, exists := cache.Match("app.example.com", "/"); !exists {
+		t.Fatal("Expected the tunnel to be routed")
+	}
+
+	loadsBefore := loads
+	cache.Get("app.example.com")
+	if loads != loadsBefore {
+		t.Error("Expected an unchanged generation to be served from the cache")
+	}
+
+	// A change that can't be loaded keeps the old routes
+	loadErr = errors.New("database unavailable")
+	tunnels = nil
+	gen++
+
+	if _, exists := cache.Match("app.example.com", "/"); !exists {
+		t.Error("Expected the tunnel to still be routed while loading fails")
+	}
+
+	loadsBefore = loads
+	cache.Tunnels()
+	if loads != loadsBefore {
+		t.Error("Expected a failed load not to be retried on every request")
+	}
+
+	// Recovered
+	loadErr = nil
+	tunnels = map[string]Tunnel{
+		"other.example.com": {Domain: "other.example.com"},
+	}
+	gen++
+
+	if _, exists := cache.Get("app.example.com"); exists {
+		t.Error("Expected the refreshed tunnels to replace the cached copy")
+	}
+	if _, exists := cache.MatchDomain("other.example.com"); !exists {
+		t.Error("Expected the new tunnel to be routed")
+	}
+}
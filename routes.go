@@ -0,0 +1,82 @@
+package boringproxy
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Route sends requests whose path starts with PathPrefix to ClientPort on
+// the client, instead of the tunnel's ClientPort.
+type Route struct {
+	PathPrefix string `json:"path_prefix"`
+	ClientPort int    `json:"client_port"`
+}
+
+// parseRoutes parses the routes parameter, a comma separated list of
+// prefix=port pairs, ie "/api=8080,/ws=8081,/=3000". A "/" route is required
+// as the default.
+func parseRoutes(routesParam string) ([]Route, error) {
+	routes := []Route{}
+	seen := make(map[string]bool)
+	hasDefault := false
+
+	for _, entry := range splitList(routesParam) {
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("Invalid route %s. Must be prefix=port", entry)
+		}
+
+		prefix := parts[0]
+		if prefix != "/" {
+			prefix = strings.TrimSuffix(prefix, "/")
+		}
+		if !strings.HasPrefix(prefix, "/") || strings.ContainsAny(prefix, "?#") {
+			return nil, fmt.Errorf("Invalid route prefix %s", parts[0])
+		}
+
+		if seen[prefix] {
+			return nil, fmt.Errorf("Duplicate route prefix %s", prefix)
+		}
+		seen[prefix] = true
+
+		port, err := strconv.Atoi(parts[1])
+		if err != nil || port < 1 || port > 65535 {
+			return nil, fmt.Errorf("Invalid route port %s", parts[1])
+		}
+
+		if prefix == "/" {
+			hasDefault = true
+		}
+
+		routes = append(routes, Route{PathPrefix: prefix, ClientPort: port})
+	}
+
+	if !hasDefault {
+		return nil, errors.New("Routes need a default \"/\" route")
+	}
+
+	return routes, nil
+}
+
+// routePort returns the client port for a request to path, using the route
+// with the longest matching prefix. Without routes it's the tunnel's
+// ClientPort.
+func routePort(tunnel Tunnel, path string) int {
+	port := tunnel.ClientPort
+	matchLen := -1
+
+	for _, route := range tunnel.Routes {
+		if route.PathPrefix != "/" && !pathHasPrefix(path, route.PathPrefix) {
+			continue
+		}
+
+		if len(route.PathPrefix) > matchLen {
+			port = route.ClientPort
+			matchLen = len(route.PathPrefix)
+		}
+	}
+
+	return port
+}
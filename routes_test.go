@@ -0,0 +1,58 @@
+package boringproxy
+
+import "testing"
+
+func TestRoutePort(t *testing.T) {
+	routes, err := parseRoutes("/api=8080, /api/ws/=8081, /=3000")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnel := Tunnel{ClientPort: 3000, Routes: routes}
+
+	cases := []struct {
+		path string
+		port int
+	}{
+		{"/", 3000},
+		{"/index.html", 3000},
+		{"/api", 8080},
+		{"/api/users", 8080},
+		// Longest prefix wins
+		{"/api/ws", 8081},
+		{"/api/ws/chat", 8081},
+		// Prefixes match whole path segments
+		{"/apidocs", 3000},
+		{"/api/wsx", 8080},
+	}
+
+	for _, c := range cases {
+		if port := routePort(tunnel, c.path); port != c.port {
+			t.Errorf("%s: Expected port %d, got %d", c.path, c.port, port)
+		}
+	}
+
+	// Without routes, everything goes to the tunnel's client port
+	if port := routePort(Tunnel{ClientPort: 4000}, "/api"); port != 4000 {
+		t.Errorf("Expected the client port without routes, got %d", port)
+	}
+}
+
+func TestParseRoutes(t *testing.T) {
+	invalid := []string{
+		// No default route
+		"/api=8080",
+		"/api=8080,/=3000,/api/=8081",
+		"api=8080,/=3000",
+		"/api=http,/=3000",
+		"/api=70000,/=3000",
+		"/api,/=3000",
+		"/api?x=8080,/=3000",
+	}
+
+	for _, routesParam := range invalid {
+		if _, err := parseRoutes(routesParam); err == nil {
+			t.Errorf("Expected %q to be rejected", routesParam)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+package boringproxy
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often the schedule sweeper checks for tunnels opening or closing.
+const scheduleSweepInterval = time.Minute
+
+var scheduleDays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// scheduleWindow is a daily time range on some days of the week. Times are
+// minutes since midnight. If end isn't after start the window runs past
+// midnight into the next day.
+type scheduleWindow struct {
+	days  [7]bool
+	start int
+	end   int
+}
+
+// tunnelSchedule is the parsed form of Tunnel.Schedule.
+type tunnelSchedule struct {
+	windows  []scheduleWindow
+	location *time.Location
+}
+
+// parseSchedule parses a schedule like "Mon-Fri 09:00-17:00; Sat 10:00-14:00"
+// in the given IANA timezone (UTC if empty). Days can be a range, a comma
+// separated list, or "*" for every day.
+func parseSchedule(schedule, timezone string) (*tunnelSchedule, error) {
+	location := time.UTC
+	if timezone != "" {
+		var err error
+		location, err = time.LoadLocation(timezone)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid schedule timezone %s", timezone)
+		}
+	}
+
+	s := &tunnelSchedule{location: location}
+
+	for _, entry := range strings.Split(schedule, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		fields := strings.Fields(entry)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("Invalid schedule window %s. Must be like \"Mon-Fri 09:00-17:00\"", entry)
+		}
+
+		days, err := parseScheduleDays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		times := strings.Split(fields[1], "-")
+		if len(times) != 2 {
+			return nil, fmt.Errorf("Invalid schedule times %s", fields[1])
+		}
+
+		start, err := parseScheduleTime(times[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseScheduleTime(times[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if start == end {
+			return nil, fmt.Errorf("Empty schedule window %s", entry)
+		}
+
+		s.windows = append(s.windows, scheduleWindow{days: days, start: start, end: end})
+	}
+
+	if len(s.windows) == 0 {
+		return nil, fmt.Errorf("Schedule has no windows")
+	}
+
+	return s, nil
+}
+
+func parseScheduleDays(value string) ([7]bool, error) {
+	var days [7]bool
+
+	if value == "*" {
+		for i := range days {
+			days[i] = true
+		}
+		return days, nil
+	}
+
+	for _, part := range strings.Split(strings.ToLower(value), ",") {
+		bounds := strings.Split(part, "-")
+		if len(bounds) > 2 {
+			return days, fmt.Errorf("Invalid schedule days %s", value)
+		}
+
+		first := scheduleDayIndex(bounds[0])
+		last := scheduleDayIndex(bounds[len(bounds)-1])
+		if first == -1 || last == -1 {
+			return days, fmt.Errorf("Invalid schedule days %s", value)
+		}
+
+		// Ranges can wrap around the week, ie Sat-Sun
+		for i := first; ; i = (i + 1) % 7 {
+			days[i] = true
+			if i == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+func scheduleDayIndex(day string) int {
+	for i, name := range scheduleDays {
+		if day == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// parseScheduleTime parses HH:MM, with 24:00 allowed as the end of the day.
+func parseScheduleTime(value string) (int, error) {
+	var hours, minutes int
+	_, err := fmt.Sscanf(value, "%d:%d", &hours, &minutes)
+	if err != nil || len(value) != 5 || hours < 0 || minutes < 0 || minutes > 59 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("Invalid schedule time %s. Must be HH:MM", value)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// Open reports whether now falls in one of the schedule's windows.
+func (s *tunnelSchedule) Open(now time.Time) bool {
+	now = now.In(s.location)
+	today := int(now.Weekday())
+	yesterday := (today + 6) % 7
+	minute := now.Hour()*60 + now.Minute()
+
+	for _, w := range s.windows {
+		if w.end > w.start {
+			if w.days[today] && minute >= w.start && minute < w.end {
+				return true
+			}
+			continue
+		}
+
+		// Overnight windows belong to the day they start on
+		if w.days[today] && minute >= w.start {
+			return true
+		}
+		if w.days[yesterday] && minute < w.end {
+			return true
+		}
+	}
+
+	return false
+}
+
+type scheduleKey struct {
+	schedule string
+	timezone string
+}
+
+// Parsed schedules by their text, since tunnelScheduleOpen runs on every
+// request. Ones that fail to parse are stored as nil.
+var scheduleCache sync.Map
+
+// cachedSchedule returns the parsed schedule, or nil if it doesn't parse.
+func cachedSchedule(schedule, timezone string) *tunnelSchedule {
+	key := scheduleKey{schedule, timezone}
+
+	if s, exists := scheduleCache.Load(key); exists {
+		return s.(*tunnelSchedule)
+	}
+
+	s, err := parseSchedule(schedule, timezone)
+	if err != nil {
+		s = nil
+	}
+
+	scheduleCache.Store(key, s)
+
+	return s
+}
+
+// tunnelScheduleOpen reports whether tun is available at now. Tunnels
+// without a schedule always are. Schedules are validated when they're set,
+// so one that doesn't parse is treated as always open rather than locking
+// the tunnel.
+func tunnelScheduleOpen(tun Tunnel, now time.Time) bool {
+	if tun.Schedule == "" {
+		return true
+	}
+
+	s := cachedSchedule(tun.Schedule, tun.ScheduleTimezone)
+	if s == nil {
+		return true
+	}
+
+	return s.Open(now)
+}
+
+// runScheduleSweeper logs whenever a scheduled tunnel opens or closes.
+func (m *TunnelManager) runScheduleSweeper(ctx context.Context, interval time.Duration) {
+	open := make(map[string]bool)
+
+	for {
+		m.sweepSchedules(open, time.Now())
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// sweepSchedules compares each scheduled tunnel's state at now with the
+// states in open, logging changes and updating open.
+func (m *TunnelManager) sweepSchedules(open map[string]bool, now time.Time) {
+	tunnels := m.db.GetTunnels()
+
+	for key, tun := range tunnels {
+		if tun.Schedule == "" {
+			delete(open, key)
+			continue
+		}
+
+		isOpen := tunnelScheduleOpen(tun, now)
+
+		wasOpen, seen := open[key]
+		if seen && wasOpen != isOpen {
+			if isOpen {
+				log.Printf("Tunnel %s is now within its schedule", key)
+			} else {
+				log.Printf("Tunnel %s is now outside its schedule", key)
+			}
+		}
+
+		open[key] = isOpen
+	}
+
+	for key := range open {
+		if _, exists := tunnels[key]; !exists {
+			delete(open, key)
+		}
+	}
+}
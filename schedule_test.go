@@ -0,0 +1,86 @@
+package boringproxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScheduleOpen(t *testing.T) {
+	// 2026-10-12 is a Monday
+	utc := func(day, hour, minute int) time.Time {
+		return time.Date(2026, 10, day, hour, minute, 0, 0, time.UTC)
+	}
+
+	cases := []struct {
+		schedule string
+		timezone string
+		now      time.Time
+		open     bool
+	}{
+		{"Mon-Fri 09:00-17:00", "", utc(12, 9, 0), true},
+		{"Mon-Fri 09:00-17:00", "", utc(12, 17, 0), false},
+		{"Mon-Fri 09:00-17:00", "", utc(17, 12, 0), false},
+		// Overnight windows belong to the day they start on
+		{"Fri 22:00-02:00", "", utc(16, 23, 0), true},
+		{"Fri 22:00-02:00", "", utc(17, 1, 59), true},
+		{"Fri 22:00-02:00", "", utc(12, 1, 0), false},
+		// Ranges wrap around the week
+		{"Sat-Sun 00:00-24:00", "", utc(18, 23, 59), true},
+		{"Sat-Sun 00:00-24:00", "", utc(19, 0, 0), false},
+		// 08:00 UTC is 10:00 in Berlin during summer time
+		{"Mon 09:00-12:00", "Europe/Berlin", utc(12, 8, 0), true},
+		{"Mon 09:00-12:00", "Europe/Berlin", utc(12, 10, 30), false},
+		{"mon,wed 09:00-10:00; * 20:00-21:00", "", utc(14, 9, 30), true},
+		{"mon,wed 09:00-10:00; * 20:00-21:00", "", utc(15, 20, 30), true},
+		{"mon,wed 09:00-10:00; * 20:00-21:00", "", utc(15, 9, 30), false},
+		// Invalid schedules don't lock the tunnel
+		{"Someday 09:00-10:00", "", utc(12, 0, 0), true},
+	}
+
+	for _, c := range cases {
+		tun := Tunnel{Schedule: c.schedule, ScheduleTimezone: c.timezone}
+		if open := tunnelScheduleOpen(tun, c.now); open != c.open {
+			t.Errorf("%q (%s) at %s: expected open=%v", c.schedule, c.timezone, c.now, c.open)
+		}
+	}
+}
+
+func TestScheduleIsParsedOnce(t *testing.T) {
+	first := cachedSchedule("Tue 10:00-11:00", "America/New_York")
+	if first == nil {
+		t.Fatal("Valid schedule didn't parse")
+	}
+
+	if cachedSchedule("Tue 10:00-11:00", "America/New_York") != first {
+		t.Error("Schedule was parsed again")
+	}
+
+	if cachedSchedule("Tue 10:00-11:00", "UTC") == first {
+		t.Error("Schedules in different timezones share a cache entry")
+	}
+}
+
+func TestSweepSchedulesAtFixedTimes(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Schedule: "Mon 09:00-17:00"})
+
+	open := make(map[string]bool)
+
+	monday := time.Date(2026, 10, 12, 8, 59, 0, 0, time.UTC)
+
+	m.sweepSchedules(open, monday)
+	if open["app.example.com"] {
+		t.Error("Open before the window starts")
+	}
+
+	m.sweepSchedules(open, monday.Add(time.Minute))
+	if !open["app.example.com"] {
+		t.Error("Closed once the window starts")
+	}
+
+	m.db.DeleteTunnel("app.example.com")
+	m.sweepSchedules(open, monday.Add(2*time.Minute))
+	if _, exists := open["app.example.com"]; exists {
+		t.Error("Deleted tunnel still tracked")
+	}
+}
@@ -0,0 +1,361 @@
+package boringproxy
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// SecretStore keeps secrets (currently tunnel private keys) out of the
+// database, which only stores a reference to each one.
+type SecretStore interface {
+	Put(ref string, secret []byte) error
+	Get(ref string) ([]byte, error)
+	Delete(ref string) error
+}
+
+// FileSecretStore stores each secret in its own 0600 file in a directory.
+type FileSecretStore struct {
+	dir string
+}
+
+func NewFileSecretStore(dir string) (*FileSecretStore, error) {
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileSecretStore{dir}, nil
+}
+
+func (s *FileSecretStore) path(ref string) (string, error) {
+	if ref == "" || strings.ContainsAny(ref, `/\`) || strings.HasPrefix(ref, ".") {
+		return "", errors.New("Invalid secret reference")
+	}
+	return filepath.Join(s.dir, ref), nil
+}
+
+func (s *FileSecretStore) Put(ref string, secret []byte) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, secret, 0600)
+}
+
+func (s *FileSecretStore) Get(ref string) ([]byte, error) {
+	path, err := s.path(ref)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (s *FileSecretStore) Delete(ref string) error {
+	path, err := s.path(ref)
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// storePrivateKey puts privKey in the secret store and returns its
+// reference. Without a store, an empty reference is returned and the key
+// has to be stored inline.
+func (m *TunnelManager) storePrivateKey(privKey string) (string, error) {
+	if m.config.secretStore == nil {
+		return "", nil
+	}
+
+	ref, err := genRandomCode(32)
+	if err != nil {
+		return "", err
+	}
+
+	err = m.config.secretStore.Put(ref, []byte(privKey))
+	if err != nil {
+		return "", err
+	}
+
+	return ref, nil
+}
+
+// setPrivateKey stores privKey for tun, either in the secret store or
+// inline, replacing any previous key.
+func (m *TunnelManager) setPrivateKey(tun *Tunnel, privKey string) error {
+	ref, err := m.storePrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	m.deletePrivateKey(*tun)
+
+	if ref == "" {
+		tun.TunnelPrivateKey = privKey
+	} else {
+		tun.TunnelPrivateKey = ""
+	}
+	tun.TunnelPrivateKeyRef = ref
+
+	return nil
+}
+
+// privateKey returns the private key of tun, from the secret store if it's
+// kept there.
+func (m *TunnelManager) privateKey(tun Tunnel) (string, error) {
+	if tun.TunnelPrivateKeyRef == "" {
+		return tun.TunnelPrivateKey, nil
+	}
+
+	if m.config.secretStore == nil {
+		return "", errors.New("No secret store configured")
+	}
+
+	privKey, err := m.config.secretStore.Get(tun.TunnelPrivateKeyRef)
+	if err != nil {
+		return "", err
+	}
+
+	return string(privKey), nil
+}
+
+// withPrivateKey fills in TunnelPrivateKey for tunnels whose key is in the
+// secret store, for returning to clients.
+func (m *TunnelManager) withPrivateKey(tun Tunnel) Tunnel {
+	if tun.TunnelPrivateKeyRef == "" {
+		return tun
+	}
+
+	privKey, err := m.privateKey(tun)
+	if err != nil {
+		log.Printf("Failed to get private key for %s: %v", tun.Domain, err)
+		return tun
+	}
+
+	tun.TunnelPrivateKey = privKey
+
+	return tun
+}
+
+func (m *TunnelManager) deletePrivateKey(tun Tunnel) {
+	if tun.TunnelPrivateKeyRef == "" || m.config.secretStore == nil {
+		return
+	}
+
+	err := m.config.secretStore.Delete(tun.TunnelPrivateKeyRef)
+	if err != nil {
+		log.Printf("Failed to delete private key for %s: %v", tun.Domain, err)
+	}
+}
+
+// storeAcmeAccountKey moves the ACME account key passed inline when creating
+// tun to the secret store, if there is one.
+func (m *TunnelManager) storeAcmeAccountKey(tun *Tunnel) error {
+	if tun.AcmeAccountKey == "" {
+		return nil
+	}
+
+	ref, err := m.storePrivateKey(tun.AcmeAccountKey)
+	if err != nil {
+		return err
+	}
+
+	if ref != "" {
+		tun.AcmeAccountKey = ""
+		tun.AcmeAccountKeyRef = ref
+	}
+
+	return nil
+}
+
+// acmeAccountKey returns the ACME account key of tun, if it has one.
+func (m *TunnelManager) acmeAccountKey(tun Tunnel) (string, error) {
+	if tun.AcmeAccountKeyRef == "" {
+		return tun.AcmeAccountKey, nil
+	}
+
+	if m.config.secretStore == nil {
+		return "", errors.New("No secret store configured")
+	}
+
+	key, err := m.config.secretStore.Get(tun.AcmeAccountKeyRef)
+	if err != nil {
+		return "", err
+	}
+
+	return string(key), nil
+}
+
+func (m *TunnelManager) deleteAcmeAccountKey(tun Tunnel) {
+	if tun.AcmeAccountKeyRef == "" || m.config.secretStore == nil {
+		return
+	}
+
+	err := m.config.secretStore.Delete(tun.AcmeAccountKeyRef)
+	if err != nil {
+		log.Printf("Failed to delete ACME account key for %s: %v", tun.Domain, err)
+	}
+}
+
+// migratePrivateKeys moves private keys stored inline in the database into
+// the secret store. It also reads every stored key once, so an
+// EncryptedSecretStore encrypts any left over from before encryption was
+// enabled.
+func (m *TunnelManager) migratePrivateKeys() {
+	if m.config.secretStore == nil {
+		return
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	count := 0
+
+	for key, tun := range m.db.GetTunnels() {
+		if tun.TunnelPrivateKeyRef != "" {
+			_, err := m.privateKey(tun)
+			if err != nil {
+				log.Printf("Failed to read private key for %s: %v", key, err)
+			}
+			continue
+		}
+
+		if tun.TunnelPrivateKey == "" {
+			continue
+		}
+
+		err := m.setPrivateKey(&tun, tun.TunnelPrivateKey)
+		if err != nil {
+			log.Printf("Failed to move private key for %s to the secret store: %v", key, err)
+			continue
+		}
+
+		m.db.SetTunnel(key, tun)
+		count++
+	}
+
+	if count > 0 {
+		log.Printf("Moved %d private key(s) from the database to the secret store", count)
+	}
+}
+
+// Prefix of secrets encrypted by EncryptedSecretStore. Anything without it
+// is a legacy plaintext secret.
+const encryptedSecretPrefix = "boringproxy-aes-gcm-v1:"
+
+// EncryptedSecretStore encrypts secrets with AES-GCM before passing them on
+// to another store. Plaintext secrets written before encryption was enabled
+// are still readable, and are encrypted the first time they're read.
+type EncryptedSecretStore struct {
+	store SecretStore
+	aead  cipher.AEAD
+}
+
+// NewEncryptedSecretStore wraps store, encrypting with key, which must be
+// 16, 24 or 32 bytes.
+func NewEncryptedSecretStore(store SecretStore, key []byte) (*EncryptedSecretStore, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EncryptedSecretStore{store, aead}, nil
+}
+
+// LoadSecretsKey reads a hex encoded AES key from path.
+func LoadSecretsKey(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.New("Secrets key must be hex encoded")
+	}
+
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errors.New("Secrets key must be 16, 24 or 32 bytes")
+	}
+
+	return key, nil
+}
+
+func (s *EncryptedSecretStore) encrypt(secret []byte) ([]byte, error) {
+	nonce := make([]byte, s.aead.NonceSize())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed := s.aead.Seal(nonce, nonce, secret, nil)
+
+	return []byte(encryptedSecretPrefix + base64.StdEncoding.EncodeToString(sealed)), nil
+}
+
+func (s *EncryptedSecretStore) decrypt(data []byte) ([]byte, error) {
+	sealed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(string(data), encryptedSecretPrefix))
+	if err != nil {
+		return nil, err
+	}
+
+	nonceSize := s.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return nil, errors.New("Encrypted secret too short")
+	}
+
+	secret, err := s.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return nil, errors.New("Failed to decrypt secret. Wrong secrets key?")
+	}
+
+	return secret, nil
+}
+
+func (s *EncryptedSecretStore) Put(ref string, secret []byte) error {
+	data, err := s.encrypt(secret)
+	if err != nil {
+		return err
+	}
+	return s.store.Put(ref, data)
+}
+
+func (s *EncryptedSecretStore) Get(ref string) ([]byte, error) {
+	data, err := s.store.Get(ref)
+	if err != nil {
+		return nil, err
+	}
+
+	if strings.HasPrefix(string(data), encryptedSecretPrefix) {
+		return s.decrypt(data)
+	}
+
+	err = s.Put(ref, data)
+	if err != nil {
+		log.Printf("Failed to encrypt plaintext secret: %v", err)
+	}
+
+	return data, nil
+}
+
+func (s *EncryptedSecretStore) Delete(ref string) error {
+	return s.store.Delete(ref)
+}
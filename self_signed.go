@@ -0,0 +1,157 @@
+package boringproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+const selfSignedCertValidity = 365 * 24 * time.Hour
+
+// Storage keys for self-signed certs, next to the ones certmagic manages.
+func selfSignedCertKey(domain string) string {
+	return "boringproxy/self-signed/" + domain + ".crt"
+}
+
+func selfSignedKeyKey(domain string) string {
+	return "boringproxy/self-signed/" + domain + ".key"
+}
+
+// makeSelfSignedCert generates a PEM encoded certificate and key for domain.
+func makeSelfSignedCert(domain string) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: domain},
+		DNSNames:              []string{domain},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(selfSignedCertValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	return certPem, keyPem, nil
+}
+
+// useSelfSignedCert loads the self-signed cert for domain from storage,
+// generating a new one if it's missing or expired, and adds it to the cert
+// cache so it's served for domain.
+func (m *TunnelManager) useSelfSignedCert(domain string) error {
+	storage := m.certConfig.Storage
+
+	cert, err := loadSelfSignedCert(storage, domain)
+	if err != nil {
+		certPem, keyPem, err := makeSelfSignedCert(domain)
+		if err != nil {
+			return err
+		}
+
+		err = storage.Store(selfSignedCertKey(domain), certPem)
+		if err != nil {
+			return err
+		}
+
+		err = storage.Store(selfSignedKeyKey(domain), keyPem)
+		if err != nil {
+			return err
+		}
+
+		cert, err = tls.X509KeyPair(certPem, keyPem)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.certConfig.CacheUnmanagedTLSCertificate(cert, []string{"self-signed"})
+}
+
+func loadSelfSignedCert(storage certmagic.Storage, domain string) (tls.Certificate, error) {
+	certPem, err := storage.Load(selfSignedCertKey(domain))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	keyPem, err := storage.Load(selfSignedKeyKey(domain))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	if time.Now().After(leaf.NotAfter) {
+		return tls.Certificate{}, errors.New("Self-signed cert expired")
+	}
+
+	return cert, nil
+}
+
+// canFallBackToSelfSigned reports whether tunReq can use a self-signed cert
+// if getting one from the CA fails. Path prefixes aren't supported since
+// tunnels sharing a domain all need "server" termination.
+func (m *TunnelManager) canFallBackToSelfSigned(tunReq Tunnel) bool {
+	return m.config.AllowSelfSignedFallback && tunReq.TlsTermination == "server" && tunReq.PathPrefix == ""
+}
+
+// loadSelfSignedCerts caches the certs of any self-signed tunnels.
+func (m *TunnelManager) loadSelfSignedCerts(tunnels map[string]Tunnel) {
+	for _, tun := range tunnels {
+		if tun.TlsTermination != "self-signed" {
+			continue
+		}
+
+		err := m.useSelfSignedCert(tun.Domain)
+		if err != nil {
+			log.Printf("Failed to load self-signed cert for %s: %v", tun.Domain, err)
+		}
+	}
+}
+
+// deleteSelfSignedCert removes the stored cert for domain.
+func (m *TunnelManager) deleteSelfSignedCert(domain string) {
+	storage := m.certConfig.Storage
+	storage.Delete(selfSignedCertKey(domain))
+	storage.Delete(selfSignedKeyKey(domain))
+}
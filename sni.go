@@ -8,6 +8,7 @@ import (
 	"crypto/tls"
 	"io"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
@@ -82,17 +83,33 @@ func (f *PassthroughListener) PassConn(conn net.Conn) {
 type ProxyConn struct {
 	conn   net.Conn
 	reader io.Reader
+	// Optional. Counts bytes read and written.
+	counter *trafficCounter
 }
 
 func NewProxyConn(conn net.Conn, reader io.Reader) *ProxyConn {
 	return &ProxyConn{
-		conn,
-		reader,
+		conn:   conn,
+		reader: reader,
 	}
 }
-func (c ProxyConn) CloseWrite() error           { return c.conn.(*net.TCPConn).CloseWrite() }
-func (c ProxyConn) Read(p []byte) (int, error)  { return c.reader.Read(p) }
-func (c ProxyConn) Write(p []byte) (int, error) { return c.conn.Write(p) }
+func (c ProxyConn) CloseWrite() error { return c.conn.(*net.TCPConn).CloseWrite() }
+
+func (c ProxyConn) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	if c.counter != nil {
+		atomic.AddInt64(&c.counter.bytesIn, int64(n))
+	}
+	return n, err
+}
+
+func (c ProxyConn) Write(p []byte) (int, error) {
+	n, err := c.conn.Write(p)
+	if c.counter != nil {
+		atomic.AddInt64(&c.counter.bytesOut, int64(n))
+	}
+	return n, err
+}
 
 // TODO: is this safe? Will it actually close properly, or does it need to be
 // connected to the reader somehow?
@@ -0,0 +1,195 @@
+package boringproxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startSocks5Server starts a minimal SOCKS5 server supporting CONNECT, with
+// user/password authentication if user isn't empty. It returns its address
+// and the channel the target of each CONNECT is sent on.
+func startSocks5Server(t *testing.T, user, password string) (string, chan string) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	targets := make(chan string, 10)
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go serveSocks5(conn, user, password, targets)
+		}
+	}()
+
+	return listener.Addr().String(), targets
+}
+
+func serveSocks5(conn net.Conn, user, password string, targets chan string) {
+	defer conn.Close()
+
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	if user == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+
+		readString := func() string {
+			length := make([]byte, 1)
+			io.ReadFull(conn, length)
+			value := make([]byte, length[0])
+			io.ReadFull(conn, value)
+			return string(value)
+		}
+
+		version := make([]byte, 1)
+		io.ReadFull(conn, version)
+		if readString() != user || readString() != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil || request[1] != 1 {
+		return
+	}
+
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		length := make([]byte, 1)
+		io.ReadFull(conn, length)
+		name := make([]byte, length[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	default:
+		return
+	}
+
+	portBytes := make([]byte, 2)
+	io.ReadFull(conn, portBytes)
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(portBytes))))
+	targets <- target
+
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	defer upstream.Close()
+
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		io.Copy(upstream, conn)
+		upstream.Close()
+		wg.Done()
+	}()
+	go func() {
+		io.Copy(conn, upstream)
+		conn.Close()
+		wg.Done()
+	}()
+	wg.Wait()
+}
+
+func TestDialSshThroughSocks5(t *testing.T) {
+	sshAddr, hostKey := startStubSshServer(t, true)
+	socksAddr, targets := startSocks5Server(t, "proxyuser", "proxypass")
+
+	hostPubKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(hostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, privKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ClientConfig{
+		User:            "boringproxy",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.FixedHostKey(hostPubKey),
+		Timeout:         5 * time.Second,
+	}
+
+	dialer, err := newSocks5Dialer("socks5://proxyuser:proxypass@" + socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := dialSsh(dialer, sshAddr, config)
+	if err != nil {
+		t.Fatalf("Expected to reach the SSH server through the proxy: %v", err)
+	}
+	client.Close()
+
+	select {
+	case target := <-targets:
+		if target != sshAddr {
+			t.Errorf("Expected the proxy to connect to %s, got %s", sshAddr, target)
+		}
+	default:
+		t.Error("Expected the connection to go through the proxy")
+	}
+
+	dialer, err = newSocks5Dialer("socks5://proxyuser:wrong@" + socksAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dialSsh(dialer, sshAddr, config)
+	if err == nil {
+		t.Error("Expected wrong proxy credentials to fail")
+	}
+}
+
+func TestNewSocks5DialerValidation(t *testing.T) {
+	invalid := []string{
+		"http://127.0.0.1:1080",
+		"127.0.0.1",
+		"socks5://user@127.0.0.1:1080",
+		"socks5://:password@127.0.0.1:1080",
+	}
+
+	for _, proxyAddr := range invalid {
+		if _, err := newSocks5Dialer(proxyAddr); err == nil {
+			t.Errorf("Expected %s to be rejected", proxyAddr)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package boringproxy
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Errors returned (wrapped) by the client when a tunnel's SSH connection
+// can't be established. The messages they're wrapped in say what to do
+// about it.
+var (
+	ErrSshAuthFailed      = errors.New("SSH authentication failed")
+	ErrSshHostKeyMismatch = errors.New("SSH host key mismatch")
+	ErrSshForwardDenied   = errors.New("SSH port forward denied")
+)
+
+// tunnelHostKeyCallback checks the server's host key against the tunnel's
+// ServerPublicKey and ServerPublicKeys, if it has any. Matching any of them
+// is enough, so the server can replace its host key without breaking
+// clients. It also returns the host key algorithms to ask for, so the
+// server presents one of those keys, or nil if any key is accepted.
+func tunnelHostKeyCallback(tunnel Tunnel) (ssh.HostKeyCallback, []string, error) {
+	pubKeys := tunnel.ServerPublicKeys
+	if tunnel.ServerPublicKey != "" {
+		pubKeys = append([]string{tunnel.ServerPublicKey}, pubKeys...)
+	}
+
+	if len(pubKeys) == 0 {
+		return ssh.InsecureIgnoreHostKey(), nil, nil
+	}
+
+	expected := [][]byte{}
+	parsedKeys := []ssh.PublicKey{}
+	for _, pubKey := range pubKeys {
+		parsed, _, _, _, err := ssh.ParseAuthorizedKey([]byte(pubKey))
+		if err != nil {
+			return nil, nil, fmt.Errorf("Invalid server public key for %s: %v", tunnel.Domain, err)
+		}
+		expected = append(expected, parsed.Marshal())
+		parsedKeys = append(parsedKeys, parsed)
+	}
+
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		for _, e := range expected {
+			if bytes.Equal(key.Marshal(), e) {
+				return nil
+			}
+		}
+		return ErrSshHostKeyMismatch
+	}, hostKeyAlgorithms(parsedKeys), nil
+}
+
+// classifyDialError turns an error from dialing the SSH server into one
+// that explains what went wrong.
+func classifyDialError(tunnel Tunnel, sshHost string, err error) error {
+	switch {
+	case errors.Is(err, ErrSshHostKeyMismatch):
+		return fmt.Errorf("%w: %s presented a different host key than expected for %s; check the server address, or recreate the tunnel if the server was reinstalled", ErrSshHostKeyMismatch, sshHost, tunnel.Domain)
+	case strings.Contains(err.Error(), "ssh: unable to authenticate"):
+		// x/crypto/ssh doesn't export a type for this
+		return fmt.Errorf("%w: server rejected key for %s; rotate the tunnel key: %v", ErrSshAuthFailed, tunnel.Domain, err)
+	default:
+		return fmt.Errorf("Failed to dial: %v", err)
+	}
+}
+
+// classifyListenError turns an error from requesting the reverse forward
+// into one that explains what went wrong.
+func classifyListenError(tunnel Tunnel, tunnelAddr string, err error) error {
+	// x/crypto/ssh doesn't export a type for this either
+	if strings.Contains(err.Error(), "tcpip-forward request denied") {
+		return fmt.Errorf("%w: server refused to listen on %s for %s; the tunnel key doesn't permit it, which usually means the tunnel was changed on the server. Recreate the tunnel or rotate its key", ErrSshForwardDenied, tunnelAddr, tunnel.Domain)
+	}
+
+	return fmt.Errorf("Unable to register tcp forward for %s %v", tunnelAddr, err)
+}
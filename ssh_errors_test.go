@@ -0,0 +1,147 @@
+package boringproxy
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startStubSshServer starts an SSH server that lets clients in only if
+// allowAuth is set, and denies any port forwards they ask for. It returns
+// the server's address and public key.
+func startStubSshServer(t *testing.T, allowAuth bool) (string, string) {
+	t.Helper()
+
+	_, hostKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.ParsePrivateKey([]byte(hostKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if !allowAuth {
+				return nil, errors.New("Unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				sshConn, chans, reqs, err := ssh.NewServerConn(conn, config)
+				if err != nil {
+					return
+				}
+				defer sshConn.Close()
+				go ssh.DiscardRequests(reqs)
+				for newChan := range chans {
+					newChan.Reject(ssh.Prohibited, "No channels")
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String(), string(ssh.MarshalAuthorizedKey(hostSigner.PublicKey()))
+}
+
+// dialStubSsh connects to addr as a client for tunnel would, and returns
+// the classified error, or the client.
+func dialStubSsh(t *testing.T, tunnel Tunnel, addr string) (*ssh.Client, error) {
+	t.Helper()
+
+	_, privKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hostKeyCallback, hostKeyAlgos, err := tunnelHostKeyCallback(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:              "boringproxy",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           5 * time.Second,
+	})
+	if err != nil {
+		return nil, classifyDialError(tunnel, addr, err)
+	}
+
+	return client, nil
+}
+
+func TestSshErrorsAreClassified(t *testing.T) {
+	tunnel := Tunnel{Domain: "app.example.com"}
+
+	addr, hostKey := startStubSshServer(t, false)
+
+	_, err := dialStubSsh(t, tunnel, addr)
+	if !errors.Is(err, ErrSshAuthFailed) {
+		t.Fatalf("Expected ErrSshAuthFailed, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "server rejected key for app.example.com; rotate the tunnel key") {
+		t.Errorf("Expected an actionable message, got %q", err)
+	}
+
+	// The host key is checked before authentication
+	_, otherKey, _ := MakeSSHKeyPair("ed25519", 0, "openssh")
+	otherPubKey, _ := publicKeyFromPrivate(otherKey)
+	_, err = dialStubSsh(t, Tunnel{Domain: "app.example.com", ServerPublicKey: otherPubKey}, addr)
+	if !errors.Is(err, ErrSshHostKeyMismatch) || errors.Is(err, ErrSshAuthFailed) {
+		t.Errorf("Expected ErrSshHostKeyMismatch, got %v", err)
+	}
+
+	_, err = dialStubSsh(t, Tunnel{Domain: "app.example.com", ServerPublicKey: hostKey}, addr)
+	if !errors.Is(err, ErrSshAuthFailed) {
+		t.Errorf("Expected the pinned host key to get as far as authentication, got %v", err)
+	}
+
+	// A key that's accepted but not permitted to listen
+	addr, _ = startStubSshServer(t, true)
+
+	client, err := dialStubSsh(t, tunnel, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tunnelAddr := "127.0.0.1:20001"
+	_, err = client.Listen("tcp", tunnelAddr)
+	if err == nil {
+		t.Fatal("Expected the forward to be denied")
+	}
+
+	err = classifyListenError(tunnel, tunnelAddr, err)
+	if !errors.Is(err, ErrSshForwardDenied) || !strings.Contains(err.Error(), tunnelAddr) {
+		t.Errorf("Expected ErrSshForwardDenied for %s, got %v", tunnelAddr, err)
+	}
+}
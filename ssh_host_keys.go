@@ -0,0 +1,184 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// hostKeyHistory is saved next to the embedded SSH server's host key. It
+// remembers keys the server used to have, so they can still be advertised
+// to clients and presented to them for a while after the host key is
+// replaced. It contains private keys, so it's only readable by us.
+//
+// An SSH server presents one host key per algorithm, so a retired key can
+// only be presented if the current key uses a different algorithm. To
+// replace a key with one of the same type without breaking clients, the new
+// key is first put at the path from nextHostKeyPath. It's advertised, but
+// not presented, until it's moved over the host key once clients have
+// picked it up.
+type hostKeyHistory struct {
+	Current           string           `json:"current"`
+	CurrentPrivateKey string           `json:"current_private_key,omitempty"`
+	Retired           []retiredHostKey `json:"retired"`
+}
+
+type retiredHostKey struct {
+	PublicKey string    `json:"public_key"`
+	RetiredAt time.Time `json:"retired_at"`
+	// Missing for keys retired before private keys were recorded, which
+	// are only advertised
+	PrivateKey string `json:"private_key,omitempty"`
+}
+
+func hostKeyHistoryPath(hostKeyPath string) string {
+	return hostKeyPath + ".history"
+}
+
+func nextHostKeyPath(hostKeyPath string) string {
+	return hostKeyPath + ".next"
+}
+
+// loadHostKeyHistory reads the history for the host key at hostKeyPath,
+// retiring the previously recorded key if it's no longer current, and
+// dropping keys retired more than grace ago.
+func loadHostKeyHistory(hostKeyPath string, current, currentPrivateKey string, grace time.Duration) (*hostKeyHistory, error) {
+	path := hostKeyHistoryPath(hostKeyPath)
+
+	history := &hostKeyHistory{}
+
+	historyBytes, err := ioutil.ReadFile(path)
+	if err == nil {
+		err = json.Unmarshal(historyBytes, history)
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	if history.Current != "" && history.Current != current {
+		log.Printf("SSH host key changed, advertising the old key to clients for another %s", grace)
+		history.Retired = append(history.Retired, retiredHostKey{
+			PublicKey:  history.Current,
+			RetiredAt:  time.Now(),
+			PrivateKey: history.CurrentPrivateKey,
+		})
+	}
+	history.Current = current
+	history.CurrentPrivateKey = currentPrivateKey
+
+	retired := []retiredHostKey{}
+	for _, key := range history.Retired {
+		if key.PublicKey != current && time.Since(key.RetiredAt) < grace {
+			retired = append(retired, key)
+		}
+	}
+	history.Retired = retired
+
+	historyBytes, err = json.MarshalIndent(history, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	err = ioutil.WriteFile(path, historyBytes, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// publicKeys returns the current key followed by retired keys still within
+// grace.
+func (h *hostKeyHistory) publicKeys(grace time.Duration) []string {
+	keys := []string{h.Current}
+	for _, key := range h.Retired {
+		if time.Since(key.RetiredAt) < grace {
+			keys = append(keys, key.PublicKey)
+		}
+	}
+	return keys
+}
+
+// retiredSigners returns the retired keys still within grace that can be
+// presented to clients, oldest first.
+func (h *hostKeyHistory) retiredSigners(grace time.Duration) []ssh.Signer {
+	signers := []ssh.Signer{}
+	for _, key := range h.Retired {
+		if key.PrivateKey == "" || time.Since(key.RetiredAt) >= grace {
+			continue
+		}
+
+		signer, err := ssh.ParsePrivateKey([]byte(key.PrivateKey))
+		if err != nil {
+			log.Printf("Ignoring invalid retired SSH host key: %v", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers
+}
+
+// loadNextHostKey returns the public key of the pre-announced host key at
+// nextHostKeyPath, or "" if there isn't one.
+func loadNextHostKey(hostKeyPath string) (string, error) {
+	keyBytes, err := ioutil.ReadFile(nextHostKeyPath(hostKeyPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return "", err
+	}
+
+	log.Printf("Advertising the next SSH host key from %s", nextHostKeyPath(hostKeyPath))
+
+	return string(ssh.MarshalAuthorizedKey(signer.PublicKey())), nil
+}
+
+// hostKeyAlgorithms returns the host key algorithms for the key types in
+// pubKeys, so a client asks the server for a key it will accept rather than
+// whichever the server prefers.
+func hostKeyAlgorithms(pubKeys []ssh.PublicKey) []string {
+	algos := []string{}
+	seen := make(map[string]bool)
+
+	for _, pubKey := range pubKeys {
+		keyAlgos := []string{pubKey.Type()}
+		if pubKey.Type() == ssh.KeyAlgoRSA {
+			keyAlgos = []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+		}
+
+		for _, algo := range keyAlgos {
+			if !seen[algo] {
+				seen[algo] = true
+				algos = append(algos, algo)
+			}
+		}
+	}
+
+	return algos
+}
+
+// withHostKeys fills in the host keys clients should accept for a tunnel on
+// the embedded SSH server. Tunnels created for the system sshd are left
+// alone.
+func (m *TunnelManager) withHostKeys(tun Tunnel) Tunnel {
+	if m.sshServer == nil || tun.ServerPublicKey == "" {
+		return tun
+	}
+
+	tun.ServerPublicKey = m.sshServer.PublicKey()
+	tun.ServerPublicKeys = m.sshServer.PublicKeys()
+
+	return tun
+}
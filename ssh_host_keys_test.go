@@ -0,0 +1,158 @@
+package boringproxy
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// sshHandshake connects a client for tunnel to server over loopback and
+// returns the client's error. Authentication fails, since the client's key
+// isn't a tunnel key, but the host key is checked before that.
+func sshHandshake(t *testing.T, server *SshServer, tunnel Tunnel) error {
+	t.Helper()
+
+	hostKeyCallback, hostKeyAlgos, err := tunnelHostKeyCallback(tunnel)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, privKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	go func() {
+		serverConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer serverConn.Close()
+		ssh.NewServerConn(serverConn, server.config)
+	}()
+
+	clientConn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+
+	_, _, _, err = ssh.NewClientConn(clientConn, "server", &ssh.ClientConfig{
+		User:              "boringproxy",
+		Auth:              []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgos,
+		Timeout:           5 * time.Second,
+	})
+	return err
+}
+
+func TestClientPinningRetiredHostKeyCanConnect(t *testing.T) {
+	m := newTestTunnelManager(t)
+	hostKeyPath := filepath.Join(t.TempDir(), "host_key")
+
+	_, oldKey, err := MakeSSHKeyPair("ecdsa", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(hostKeyPath, []byte(oldKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldServer, err := NewSshServer(m, hostKeyPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldPubKey := oldServer.PublicKey()
+
+	// Replace the host key with one of a different type
+	_, newKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(hostKeyPath, []byte(newKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := NewSshServer(m, hostKeyPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.PublicKey() == oldPubKey {
+		t.Fatal("Host key wasn't replaced")
+	}
+
+	advertised := server.PublicKeys()
+	if len(advertised) != 2 || advertised[1] != oldPubKey {
+		t.Fatalf("Retired key isn't advertised: %v", advertised)
+	}
+
+	// A client that hasn't picked up the new key yet
+	err = sshHandshake(t, server, Tunnel{Domain: "app.example.com", ServerPublicKey: oldPubKey})
+	if errors.Is(err, ErrSshHostKeyMismatch) || err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("Client pinning the retired key should get as far as authentication, got %v", err)
+	}
+
+	// And one that has
+	err = sshHandshake(t, server, Tunnel{Domain: "app.example.com", ServerPublicKey: server.PublicKey(), ServerPublicKeys: advertised})
+	if errors.Is(err, ErrSshHostKeyMismatch) || err == nil || !strings.Contains(err.Error(), "unable to authenticate") {
+		t.Errorf("Client with the current keys should get as far as authentication, got %v", err)
+	}
+
+	_, otherKey, _ := MakeSSHKeyPair("ecdsa", 0, "openssh")
+	otherPubKey, _ := publicKeyFromPrivate(otherKey)
+	err = sshHandshake(t, server, Tunnel{Domain: "app.example.com", ServerPublicKey: otherPubKey})
+	if !strings.Contains(err.Error(), ErrSshHostKeyMismatch.Error()) {
+		t.Errorf("Expected a host key mismatch for an unknown key, got %v", err)
+	}
+}
+
+func TestNextHostKeyIsAdvertisedBeforeUse(t *testing.T) {
+	m := newTestTunnelManager(t)
+	hostKeyPath := filepath.Join(t.TempDir(), "host_key")
+
+	_, nextKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(nextHostKeyPath(hostKeyPath), []byte(nextKey), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nextPubKey, _ := publicKeyFromPrivate(nextKey)
+
+	server, err := NewSshServer(m, hostKeyPath, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	advertised := server.PublicKeys()
+	if len(advertised) != 2 || advertised[0] != server.PublicKey() || advertised[1] != nextPubKey {
+		t.Fatalf("Expected the current and next keys, got %v", advertised)
+	}
+
+	// Only the current key is presented
+	err = sshHandshake(t, server, Tunnel{Domain: "app.example.com", ServerPublicKey: nextPubKey})
+	if !strings.Contains(err.Error(), ErrSshHostKeyMismatch.Error()) {
+		t.Errorf("Next key was presented before being moved into place: %v", err)
+	}
+}
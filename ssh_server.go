@@ -0,0 +1,499 @@
+package boringproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SshServer is an embedded replacement for the OS sshd. It authenticates
+// clients against the tunnel keys in the database and only lets each key
+// forward its own tunnel's port, which is what the permitlisten option does
+// in authorized_keys.
+type SshServer struct {
+	m         *TunnelManager
+	config    *ssh.ServerConfig
+	hostKey   ssh.Signer
+	history   *hostKeyHistory
+	grace     time.Duration
+	mutex     *sync.Mutex
+	conns     map[string][]*ssh.ServerConn
+	pubKeys   map[string]cachedPublicKey
+	keysMutex *sync.Mutex
+	// Open forwarded-tcpip channels for each tunnel, across all its
+	// connections. Guarded by mutex.
+	channels map[string]int
+	// Pre-announced replacement for hostKey, advertised but not presented
+	nextKey string
+}
+
+// cachedPublicKey saves parsing a tunnel's private key on every login. id
+// changes whenever the key does.
+type cachedPublicKey struct {
+	id     string
+	pubKey string
+}
+
+// Messages sent in a forwarded-tcpip channel open and a tcpip-forward
+// request, as described in RFC 4254 section 7.
+type forwardRequest struct {
+	BindAddr string
+	BindPort uint32
+}
+
+type forwardResponse struct {
+	BindPort uint32
+}
+
+type forwardedTcpip struct {
+	Addr       string
+	Port       uint32
+	OriginAddr string
+	OriginPort uint32
+}
+
+// NewSshServer loads the host key from hostKeyPath, generating it first if
+// it doesn't exist. Keys it replaced are still advertised to clients, and
+// presented to those that ask for them, for grace. See hostKeyHistory.
+func NewSshServer(m *TunnelManager, hostKeyPath string, grace time.Duration) (*SshServer, error) {
+	hostKey, hostKeyBytes, err := loadHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	current := string(ssh.MarshalAuthorizedKey(hostKey.PublicKey()))
+	history, err := loadHostKeyHistory(hostKeyPath, current, string(hostKeyBytes), grace)
+	if err != nil {
+		return nil, err
+	}
+
+	nextKey, err := loadNextHostKey(hostKeyPath)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &SshServer{
+		m:         m,
+		hostKey:   hostKey,
+		history:   history,
+		nextKey:   nextKey,
+		grace:     grace,
+		mutex:     &sync.Mutex{},
+		conns:     make(map[string][]*ssh.ServerConn),
+		channels:  make(map[string]int),
+		pubKeys:   make(map[string]cachedPublicKey),
+		keysMutex: &sync.Mutex{},
+	}
+
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: s.authenticate,
+	}
+
+	// AddHostKey replaces any key of the same type, so the current key
+	// is added last to take precedence.
+	for _, signer := range history.retiredSigners(grace) {
+		s.config.AddHostKey(signer)
+	}
+	s.config.AddHostKey(hostKey)
+
+	return s, nil
+}
+
+func loadHostKey(path string) (ssh.Signer, []byte, error) {
+	keyBytes, err := ioutil.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, privKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+		if err != nil {
+			return nil, nil, err
+		}
+
+		err = ioutil.WriteFile(path, []byte(privKey), 0600)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		log.Printf("Generated SSH host key %s", path)
+
+		keyBytes = []byte(privKey)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	signer, err := ssh.ParsePrivateKey(keyBytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return signer, keyBytes, nil
+}
+
+// PublicKey returns the host key in authorized_keys format, for clients to
+// verify the server with.
+func (s *SshServer) PublicKey() string {
+	return string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))
+}
+
+// PublicKeys returns the current host key, the next one if it's been
+// pre-announced, and any it recently replaced, which clients should all
+// accept while they catch up.
+func (s *SshServer) PublicKeys() []string {
+	keys := s.history.publicKeys(s.grace)
+	if s.nextKey != "" {
+		keys = append(keys[:1], append([]string{s.nextKey}, keys[1:]...)...)
+	}
+	return keys
+}
+
+// Serve accepts connections on listener until ctx is done.
+func (s *SshServer) Serve(ctx context.Context, listener net.Listener) {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("SSH server stopped: %v", err)
+			}
+			return
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// authenticate accepts key if it belongs to a tunnel, recording which one in
+// the connection's permissions.
+func (s *SshServer) authenticate(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	offered := string(ssh.MarshalAuthorizedKey(key))
+
+	for tunKey, tun := range s.m.db.GetTunnels() {
+		if tun.RedirectTo != "" {
+			continue
+		}
+
+		pubKey, err := s.tunnelPublicKey(tunKey, tun)
+		if err != nil {
+			continue
+		}
+
+		if pubKey == offered {
+			return &ssh.Permissions{
+				Extensions: map[string]string{
+					"tunnel":     tunKey,
+					"public-key": pubKey,
+				},
+			}, nil
+		}
+	}
+
+	return nil, fmt.Errorf("Unknown key for %s from %s", meta.User(), meta.RemoteAddr())
+}
+
+func (s *SshServer) tunnelPublicKey(key string, tun Tunnel) (string, error) {
+	id := tun.TunnelPrivateKeyRef
+	if id == "" {
+		id = tun.TunnelPrivateKey
+	}
+
+	s.keysMutex.Lock()
+	cached, exists := s.pubKeys[key]
+	s.keysMutex.Unlock()
+
+	if exists && cached.id == id {
+		return cached.pubKey, nil
+	}
+
+	privKey, err := s.m.privateKey(tun)
+	if err != nil {
+		return "", err
+	}
+
+	pubKey, err := publicKeyFromPrivate(privKey)
+	if err != nil {
+		return "", err
+	}
+
+	s.keysMutex.Lock()
+	s.pubKeys[key] = cachedPublicKey{id, pubKey}
+	s.keysMutex.Unlock()
+
+	return pubKey, nil
+}
+
+func (s *SshServer) handleConn(netConn net.Conn) {
+	conn, chans, reqs, err := ssh.NewServerConn(netConn, s.config)
+	if err != nil {
+		log.Printf("SSH handshake from %s failed: %v", netConn.RemoteAddr(), err)
+		netConn.Close()
+		return
+	}
+	defer conn.Close()
+
+	tunKey := conn.Permissions.Extensions["tunnel"]
+
+	s.mutex.Lock()
+	s.conns[tunKey] = append(s.conns[tunKey], conn)
+	s.mutex.Unlock()
+
+	defer s.removeConn(tunKey, conn)
+
+	if s.m.config.SshKeepaliveInterval > 0 {
+		go func() {
+			err := sshKeepalive(conn, s.m.config.SshKeepaliveInterval, s.m.config.SshKeepaliveMaxMissed)
+			if errors.Is(err, ErrKeepaliveTimeout) {
+				log.Printf("SSH client for %s at %s stopped responding", tunKey, conn.RemoteAddr())
+			}
+		}()
+	}
+
+	go func() {
+		for newChan := range chans {
+			newChan.Reject(ssh.Prohibited, "This key permits tunnels only")
+		}
+	}()
+
+	var listener net.Listener
+	defer func() {
+		if listener != nil {
+			listener.Close()
+		}
+	}()
+
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			if listener != nil {
+				req.Reply(false, nil)
+				continue
+			}
+
+			var err error
+			listener, err = s.listen(tunKey, conn, req.Payload)
+			if err != nil {
+				log.Printf("Refused forward for %s: %v", tunKey, err)
+				req.Reply(false, nil)
+				continue
+			}
+
+			port := listener.Addr().(*net.TCPAddr).Port
+			req.Reply(true, ssh.Marshal(forwardResponse{uint32(port)}))
+
+			go s.forward(tunKey, conn, listener)
+
+			s.m.conns.SetConnected(port, true)
+			s.m.conns.SetRemoteAddr(port, conn.RemoteAddr().String())
+			defer s.m.conns.SetConnected(port, false)
+
+		case "cancel-tcpip-forward":
+			if listener != nil {
+				listener.Close()
+				listener = nil
+			}
+			req.Reply(true, nil)
+
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+// listen opens the listener requested by payload, if the connection is
+// permitted to (see checkForward).
+func (s *SshServer) listen(tunKey string, conn *ssh.ServerConn, payload []byte) (net.Listener, error) {
+	var fwdReq forwardRequest
+	err := ssh.Unmarshal(payload, &fwdReq)
+	if err != nil {
+		return nil, err
+	}
+
+	tun, exists := s.m.db.GetTunnel(tunKey)
+	if !exists {
+		return nil, ErrTunnelNotFound
+	}
+
+	// The key may have been rotated since the connection was
+	// authenticated.
+	pubKey, err := s.tunnelPublicKey(tunKey, tun)
+	if err != nil {
+		return nil, err
+	}
+
+	if pubKey != conn.Permissions.Extensions["public-key"] {
+		return nil, fmt.Errorf("%w: tunnel key has changed", ErrForwardNotPermitted)
+	}
+
+	err = checkForward(tun, fwdReq)
+	if err != nil {
+		return nil, err
+	}
+
+	return net.Listen("tcp", net.JoinHostPort(fwdReq.BindAddr, strconv.Itoa(int(fwdReq.BindPort))))
+}
+
+// ErrForwardNotPermitted is returned for forward requests a tunnel's key
+// isn't allowed to make.
+var ErrForwardNotPermitted = errors.New("Forward not permitted")
+
+// checkForward is the equivalent of the permitlisten option written to
+// authorized_keys: a tunnel's key may only forward the tunnel's own port on
+// its bind address.
+func checkForward(tun Tunnel, fwdReq forwardRequest) error {
+	bindAddr := tunnelBindAddr(tun)
+
+	if fwdReq.BindAddr != bindAddr || int(fwdReq.BindPort) != tun.TunnelPort {
+		return fmt.Errorf("%w: %s:%d requested, only %s:%d allowed", ErrForwardNotPermitted, fwdReq.BindAddr, fwdReq.BindPort, bindAddr, tun.TunnelPort)
+	}
+
+	return nil
+}
+
+// forward passes each connection accepted by listener to the client through
+// a forwarded-tcpip channel. Connections beyond the tunnel's channel limit
+// are closed straight away.
+func (s *SshServer) forward(tunKey string, conn *ssh.ServerConn, listener net.Listener) {
+	listenAddr := listener.Addr().(*net.TCPAddr)
+
+	for {
+		tcpConn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		origin := tcpConn.RemoteAddr().(*net.TCPAddr)
+
+		limit := s.channelLimit(tunKey)
+		if !s.acquireChannel(tunKey, limit) {
+			log.Printf("Refused connection from %s for %s: %v (limit %d)", origin, tunKey, ErrTooManyChannels, limit)
+			tcpConn.Close()
+			continue
+		}
+
+		go func() {
+			defer s.releaseChannel(tunKey)
+			defer tcpConn.Close()
+
+			payload := ssh.Marshal(forwardedTcpip{
+				Addr:       listenAddr.IP.String(),
+				Port:       uint32(listenAddr.Port),
+				OriginAddr: origin.IP.String(),
+				OriginPort: uint32(origin.Port),
+			})
+
+			channel, reqs, err := conn.OpenChannel("forwarded-tcpip", payload)
+			if err != nil {
+				return
+			}
+			defer channel.Close()
+
+			go ssh.DiscardRequests(reqs)
+
+			done := make(chan struct{}, 2)
+
+			go func() {
+				io.Copy(channel, tcpConn)
+				channel.CloseWrite()
+				done <- struct{}{}
+			}()
+
+			go func() {
+				io.Copy(tcpConn, channel)
+				if c, ok := tcpConn.(*net.TCPConn); ok {
+					c.CloseWrite()
+				}
+				done <- struct{}{}
+			}()
+
+			<-done
+			<-done
+		}()
+	}
+}
+
+// ErrTooManyChannels is logged for connections refused because the tunnel
+// already has as many channels open as it's allowed.
+var ErrTooManyChannels = errors.New("Too many open channels")
+
+// channelLimit returns the most channels the tunnel stored under tunKey may
+// have open, or 0 for no limit.
+func (s *SshServer) channelLimit(tunKey string) int {
+	tun, exists := s.m.routes.Get(tunKey)
+	if exists && tun.MaxChannels > 0 {
+		return tun.MaxChannels
+	}
+	return s.m.config.SshMaxChannels
+}
+
+// acquireChannel counts a new channel for tunKey, unless it already has
+// limit open.
+func (s *SshServer) acquireChannel(tunKey string, limit int) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if limit > 0 && s.channels[tunKey] >= limit {
+		return false
+	}
+
+	s.channels[tunKey]++
+
+	return true
+}
+
+func (s *SshServer) releaseChannel(tunKey string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.channels[tunKey]--
+	if s.channels[tunKey] <= 0 {
+		delete(s.channels, tunKey)
+	}
+}
+
+func (s *SshServer) removeConn(tunKey string, conn *ssh.ServerConn) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	conns := []*ssh.ServerConn{}
+	for _, c := range s.conns[tunKey] {
+		if c != conn {
+			conns = append(conns, c)
+		}
+	}
+
+	if len(conns) == 0 {
+		delete(s.conns, tunKey)
+	} else {
+		s.conns[tunKey] = conns
+	}
+}
+
+// Disconnect closes any connections for the tunnel stored under tunKey, ie
+// after it's deleted or its key is replaced.
+func (s *SshServer) Disconnect(tunKey string) {
+	s.mutex.Lock()
+	conns := s.conns[tunKey]
+	delete(s.conns, tunKey)
+	s.mutex.Unlock()
+
+	for _, conn := range conns {
+		conn.Close()
+	}
+
+	s.keysMutex.Lock()
+	delete(s.pubKeys, tunKey)
+	s.keysMutex.Unlock()
+}
@@ -0,0 +1,255 @@
+package boringproxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// startTestSshServer runs an embedded SSH server for m on a loopback port
+// and returns its address.
+func startTestSshServer(t *testing.T, m *TunnelManager) (*SshServer, string) {
+	t.Helper()
+
+	server, err := NewSshServer(m, filepath.Join(t.TempDir(), "host_key"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.sshServer = server
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go server.Serve(ctx, listener)
+
+	return server, listener.Addr().String()
+}
+
+// addTestSshTunnel stores a tunnel with a fresh key on a free port and
+// returns it.
+func addTestSshTunnel(t *testing.T, m *TunnelManager, domain string) Tunnel {
+	t.Helper()
+
+	_, privKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+
+	tun := Tunnel{
+		Domain:           domain,
+		Owner:            "admin",
+		TunnelPort:       port,
+		TunnelPrivateKey: privKey,
+	}
+	m.db.SetTunnel(domain, tun)
+
+	return tun
+}
+
+func dialTestSsh(t *testing.T, addr, privKey string) (*ssh.Client, error) {
+	t.Helper()
+
+	signer, err := ssh.ParsePrivateKey([]byte(privKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            "boringproxy",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+		Timeout:         5 * time.Second,
+	})
+}
+
+// serveEcho answers each connection accepted by listener with what it's
+// sent.
+func serveEcho(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(conn, conn)
+			conn.Close()
+		}()
+	}
+}
+
+func TestEmbeddedSshReverseForward(t *testing.T) {
+	m := newTestTunnelManager(t)
+	_, addr := startTestSshServer(t, m)
+
+	tun := addTestSshTunnel(t, m, "app.example.com")
+
+	client, err := dialTestSsh(t, addr, tun.TunnelPrivateKey)
+	if err != nil {
+		t.Fatalf("Expected the tunnel's key to be accepted: %v", err)
+	}
+	defer client.Close()
+
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(tun.TunnelPort))
+
+	remote, err := client.Listen("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	go serveEcho(remote)
+
+	conn, err := net.Dial("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = io.WriteString(conn, "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(conn, buf)
+	if err != nil || string(buf) != "hello" {
+		t.Errorf("Expected the forward to echo, got %q, %v", buf, err)
+	}
+
+	if !m.IsConnected(tun.TunnelPort) {
+		t.Error("Expected the tunnel to be connected")
+	}
+
+	_, unknownKey, err := MakeSSHKeyPair("ed25519", 0, "openssh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = dialTestSsh(t, addr, unknownKey)
+	if err == nil {
+		t.Error("Expected an unknown key to be rejected")
+	}
+}
+
+func TestEmbeddedSshForwardOnlyOwnPort(t *testing.T) {
+	m := newTestTunnelManager(t)
+	_, addr := startTestSshServer(t, m)
+
+	tun := addTestSshTunnel(t, m, "app.example.com")
+	other := addTestSshTunnel(t, m, "other.example.com")
+
+	client, err := dialTestSsh(t, addr, tun.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	_, err = client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(other.TunnelPort)))
+	if err == nil {
+		t.Error("Expected forwarding another tunnel's port to be refused")
+	}
+
+	// Nor its own port on another address
+	_, err = client.Listen("tcp", net.JoinHostPort("0.0.0.0", strconv.Itoa(tun.TunnelPort)))
+	if err == nil {
+		t.Error("Expected forwarding on another bind address to be refused")
+	}
+
+	remote, err := client.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(tun.TunnelPort)))
+	if err != nil {
+		t.Fatalf("Expected the tunnel's own port to be allowed: %v", err)
+	}
+	remote.Close()
+
+	err = checkForward(tun, forwardRequest{BindAddr: "127.0.0.1", BindPort: uint32(other.TunnelPort)})
+	if !errors.Is(err, ErrForwardNotPermitted) {
+		t.Errorf("Expected ErrForwardNotPermitted, got %v", err)
+	}
+}
+
+func TestEmbeddedSshChannelLimit(t *testing.T) {
+	m := newTestTunnelManager(t)
+	_, addr := startTestSshServer(t, m)
+
+	tun := addTestSshTunnel(t, m, "app.example.com")
+	tun.MaxChannels = 1
+	m.db.SetTunnel(tun.Domain, tun)
+
+	client, err := dialTestSsh(t, addr, tun.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	tunnelAddr := net.JoinHostPort("127.0.0.1", strconv.Itoa(tun.TunnelPort))
+
+	remote, err := client.Listen("tcp", tunnelAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	go serveEcho(remote)
+
+	// echo dials the tunnel and reports whether msg came back
+	echo := func(msg string) (net.Conn, bool) {
+		conn, err := net.Dial("tcp", tunnelAddr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		io.WriteString(conn, msg)
+
+		buf := make([]byte, len(msg))
+		_, err = io.ReadFull(conn, buf)
+		return conn, err == nil && string(buf) == msg
+	}
+
+	first, ok := echo("first")
+	if !ok {
+		t.Fatal("Expected the first connection to be forwarded")
+	}
+
+	second, ok := echo("second")
+	second.Close()
+	if ok {
+		t.Error("Expected a connection over the limit to be refused")
+	}
+
+	first.Close()
+
+	// The channel is released once the forward notices the close
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		third, ok := echo("third")
+		third.Close()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected a connection to be forwarded again after the first closed")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
@@ -0,0 +1,84 @@
+package boringproxy
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// checkSshUsers looks for problems with the accounts tunnels log in as
+// through the OS sshd, which otherwise only show up as clients failing to
+// connect. It returns a warning for each problem found.
+func (m *TunnelManager) checkSshUsers() []string {
+	usernames := map[string]bool{m.user.Username: true}
+	for _, tun := range m.db.GetTunnels() {
+		if tun.Username != "" && tun.RedirectTo == "" {
+			usernames[tun.Username] = true
+		}
+	}
+
+	sorted := []string{}
+	for username := range usernames {
+		sorted = append(sorted, username)
+	}
+	sort.Strings(sorted)
+
+	warnings := []string{}
+
+	for _, username := range sorted {
+		homeDir := m.user.HomeDir
+		if username != m.user.Username {
+			sshUser, err := m.lookupUser(username)
+			if err != nil {
+				warnings = append(warnings, fmt.Sprintf("SSH user %s doesn't exist: %v", username, err))
+				continue
+			}
+			homeDir = sshUser.HomeDir
+		}
+
+		shell, err := loginShell("/etc/passwd", username)
+		if err == nil && (strings.HasSuffix(shell, "nologin") || strings.HasSuffix(shell, "false")) {
+			warnings = append(warnings, fmt.Sprintf("SSH user %s has login shell %s. Some sshd setups refuse tunnels for accounts that can't run the forced command", username, shell))
+		}
+
+		sshDir := filepath.Join(homeDir, ".ssh")
+		if _, err := os.Stat(sshDir); err != nil {
+			warnings = append(warnings, fmt.Sprintf("SSH user %s has no %s. Creating tunnels will fail until it exists", username, sshDir))
+		}
+	}
+
+	return warnings
+}
+
+// loginShell returns the shell for username from a passwd file. An empty
+// shell field means /bin/sh.
+func loginShell(passwdPath, username string) (string, error) {
+	f, err := os.Open(passwdPath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), ":")
+		if len(fields) < 7 || fields[0] != username {
+			continue
+		}
+
+		if fields[6] == "" {
+			return "/bin/sh", nil
+		}
+		return fields[6], nil
+	}
+
+	err = scanner.Err()
+	if err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("%s not found in %s", username, passwdPath)
+}
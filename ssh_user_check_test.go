@@ -0,0 +1,67 @@
+package boringproxy
+
+import (
+	"io/ioutil"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUnknownSshUserIsReported(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	aliceHome := t.TempDir()
+	m.lookupUser = func(username string) (*user.User, error) {
+		if username == "alice" {
+			return &user.User{Username: "alice", HomeDir: aliceHome}, nil
+		}
+		return nil, user.UnknownUserError(username)
+	}
+
+	m.db.SetTunnel("mine.example.com", Tunnel{Domain: "mine.example.com", Username: m.user.Username})
+	m.db.SetTunnel("ghost.example.com", Tunnel{Domain: "ghost.example.com", Username: "ghost"})
+	m.db.SetTunnel("alice.example.com", Tunnel{Domain: "alice.example.com", Username: "alice"})
+	// Redirects don't log in, so their user doesn't matter
+	m.db.SetTunnel("www.example.com", Tunnel{Domain: "www.example.com", Username: "nobody-here", RedirectTo: "example.com"})
+
+	warnings := m.checkSshUsers()
+
+	if len(warnings) != 2 {
+		t.Fatalf("Expected 2 warnings, got %q", warnings)
+	}
+	if !strings.Contains(warnings[0], "alice") || !strings.Contains(warnings[0], ".ssh") {
+		t.Errorf("Expected a warning about alice's missing .ssh, got %q", warnings[0])
+	}
+	if !strings.Contains(warnings[1], "SSH user ghost doesn't exist") {
+		t.Errorf("Expected a warning about the unknown user ghost, got %q", warnings[1])
+	}
+}
+
+func TestLoginShell(t *testing.T) {
+	passwd := filepath.Join(t.TempDir(), "passwd")
+	err := ioutil.WriteFile(passwd, []byte("root:x:0:0:root:/root:/bin/bash\ntunnels:x:1000:1000::/home/tunnels:/usr/sbin/nologin\nplain:x:1001:1001::/home/plain:\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for username, expected := range map[string]string{"tunnels": "/usr/sbin/nologin", "plain": "/bin/sh"} {
+		shell, err := loginShell(passwd, username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if shell != expected {
+			t.Errorf("%s: Expected %s, got %s", username, expected, shell)
+		}
+	}
+
+	if _, err := loginShell(passwd, "ghost"); err == nil {
+		t.Error("Expected an error for a user not in the file")
+	}
+}
@@ -0,0 +1,91 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+// Version of the server, set by the main package.
+var Version string
+
+// ServerStatus is returned by /api/status.
+type ServerStatus struct {
+	Version string `json:"version"`
+	// Seconds since the server started
+	Uptime            int64 `json:"uptime"`
+	Tunnels           int   `json:"tunnels"`
+	ActiveConnections int   `json:"active_connections"`
+	// Domains with a cert the server obtained and renews. Domains whose
+	// cert is pending or failed, ie not yet issued with on-demand TLS,
+	// aren't counted.
+	ManagedCerts int    `json:"managed_certs"`
+	OnDemandTls  bool   `json:"on_demand_tls"`
+	AcmeCa       string `json:"acme_ca"`
+	// Allocated ports in the tunnel port range, including ones held back
+	// after their tunnel was deleted
+	PortsUsed  int `json:"ports_used"`
+	PortsTotal int `json:"ports_total"`
+}
+
+// Status returns an overview of the server, for monitoring.
+func (m *TunnelManager) Status() ServerStatus {
+	status := ServerStatus{
+		Version:     Version,
+		Uptime:      int64(time.Since(m.started).Seconds()),
+		OnDemandTls: m.certConfig.OnDemand != nil,
+		AcmeCa:      certmagic.DefaultACME.CA,
+	}
+
+	status.PortsUsed, status.PortsTotal = m.ports.Usage()
+
+	certDomains := make(map[string]bool)
+
+	if m.config.autoCerts {
+		if adminDomain := m.db.GetAdminDomain(); adminDomain != "" {
+			certDomains[adminDomain] = true
+		}
+		for _, alias := range m.config.AdminDomainAliases {
+			certDomains[alias] = true
+		}
+	}
+
+	for key, tun := range m.db.GetTunnels() {
+		status.Tunnels++
+		status.ActiveConnections += m.conns.Stats(key).ActiveConnections
+
+		if m.config.autoCerts && (tun.TlsTermination == "server" || tun.TlsTermination == "server-tls") {
+			certDomains[tun.Domain] = true
+		}
+	}
+
+	for domain := range certDomains {
+		if certStatus, _ := m.certStatuses.Get(domain); certStatus == CertStatusManaged {
+			status.ManagedCerts++
+		}
+	}
+
+	return status
+}
+
+// handleStatus serves the server status as JSON. Only admin tokens are
+// accepted.
+func (a *Api) handleStatus(w http.ResponseWriter, r *http.Request) {
+
+	_, ok := a.requireAdminToken(w, r, false)
+	if !ok {
+		return
+	}
+
+	if r.Method != "GET" {
+		w.WriteHeader(405)
+		io.WriteString(w, "Invalid method for /api/status")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a.tunMan.Status())
+}
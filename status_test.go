@@ -0,0 +1,81 @@
+package boringproxy
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestStatusRequiresAdminToken(t *testing.T) {
+	a := newTestApi(t)
+	a.tunMan.certConfig = certmagic.NewDefault()
+
+	err := a.db.AddUser("bob", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tokens := map[string]TokenData{
+		"admin":    {Owner: "admin"},
+		"observer": {Owner: "admin", Role: TokenRoleObserver},
+		"scoped":   {Owner: "admin", Domains: []string{"app.example.com"}},
+		"client":   {Owner: "admin", Client: "laptop"},
+		"user":     {Owner: "bob"},
+	}
+	for token, tokenData := range tokens {
+		a.db.SetTokenData(token, tokenData)
+	}
+
+	expected := map[string]int{
+		"admin":    200,
+		"observer": 200,
+		"scoped":   403,
+		"client":   403,
+		"user":     403,
+	}
+
+	for token, code := range expected {
+		req := httptest.NewRequest("GET", "/status", nil)
+		req.Header.Set("access_token", token)
+		rec := httptest.NewRecorder()
+		a.handleStatus(rec, req)
+
+		if rec.Code != code {
+			t.Errorf("Expected %d for %s token, got %d", code, token, rec.Code)
+		}
+	}
+
+	// Reloading changes state, so observers can't
+	req := httptest.NewRequest("POST", "/reload", nil)
+	req.Header.Set("access_token", "observer")
+	rec := httptest.NewRecorder()
+	a.handleReload(rec, req)
+
+	if rec.Code != 403 {
+		t.Errorf("Expected observer reload to be refused, got %d", rec.Code)
+	}
+}
+
+func TestStatusCountsOnlyIssuedCerts(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.certConfig = certmagic.NewDefault()
+	m.config.autoCerts = true
+
+	m.db.SetTunnel("issued.example.com", Tunnel{Domain: "issued.example.com", TlsTermination: "server"})
+	m.db.SetTunnel("pending.example.com", Tunnel{Domain: "pending.example.com", TlsTermination: "server"})
+	m.db.SetTunnel("failed.example.com", Tunnel{Domain: "failed.example.com", TlsTermination: "server"})
+	m.db.SetTunnel("client.example.com", Tunnel{Domain: "client.example.com", TlsTermination: "client"})
+
+	m.onCertEvent("cert_obtained", "issued.example.com")
+	m.certStatuses.Set("failed.example.com", CertStatusFailed)
+
+	status := m.Status()
+
+	if status.Tunnels != 4 {
+		t.Errorf("Expected 4 tunnels, got %d", status.Tunnels)
+	}
+	if status.ManagedCerts != 1 {
+		t.Errorf("Expected 1 managed cert, got %d", status.ManagedCerts)
+	}
+}
@@ -3,26 +3,40 @@ package boringproxy
 import (
 	//"errors"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"sync"
-
-	"github.com/caddyserver/certmagic"
 )
 
-func ProxyTcp(conn net.Conn, addr string, port int, useTls bool, certConfig *certmagic.Config) error {
-
-	if useTls {
-		tlsConfig := &tls.Config{
-			GetCertificate: certConfig.GetCertificate,
+var rawTlsNextProtos = []string{"http/1.1", "h2", "acme-tls/1"}
+
+// ProxyTcp forwards conn to addr:port. If tlsConfig is not nil, TLS is
+// terminated first. If addr starts with https://, TLS is used to connect to
+// the backend, using backendTlsConfig if it's not nil.
+func ProxyTcp(conn net.Conn, addr string, port int, tlsConfig *tls.Config, backendTlsConfig *tls.Config) error {
+
+	if tlsConfig != nil {
+		config := tlsConfig.Clone()
+		config.NextProtos = rawTlsNextProtos
+
+		if getConfig := config.GetConfigForClient; getConfig != nil {
+			config.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				c, err := getConfig(hello)
+				if c != nil {
+					c = c.Clone()
+					c.NextProtos = rawTlsNextProtos
+				}
+				return c, err
+			}
 		}
 
-		tlsConfig.NextProtos = append([]string{"http/1.1", "h2", "acme-tls/1"}, tlsConfig.NextProtos...)
-
-		tlsConn := tls.Server(conn, tlsConfig)
+		tlsConn := tls.Server(conn, config)
 
 		tlsConn.Handshake()
 		if tlsConn.ConnectionState().NegotiatedProtocol == "acme-tls/1" {
@@ -30,15 +44,140 @@ func ProxyTcp(conn net.Conn, addr string, port int, useTls bool, certConfig *cer
 			return nil
 		}
 
-		go handleConnection(tlsConn, addr, port)
+		go handleConnection(tlsConn, addr, port, backendTlsConfig)
 	} else {
-		go handleConnection(conn, addr, port)
+		go handleConnection(conn, addr, port, backendTlsConfig)
 	}
 
 	return nil
 }
 
-func handleConnection(conn net.Conn, upstreamAddr string, port int) {
+// backendTlsConfig returns the TLS config for connecting to the tunnel's
+// backend on the client, or nil if the backend doesn't use TLS.
+func backendTlsConfig(tunnel Tunnel) (*tls.Config, error) {
+	if !tunnel.ClientUseTls {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		ServerName:         strings.TrimPrefix(tunnel.ClientAddress, "https://"),
+		InsecureSkipVerify: tunnel.ClientTlsSkipVerify,
+	}
+
+	if tunnel.ClientCaFile != "" {
+		pool, err := loadCertPool(tunnel.ClientCaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	return config, nil
+}
+
+// backendAddress returns the address the client passes to proxyRequest and
+// ProxyTcp for the tunnel's backend.
+func backendAddress(tunnel Tunnel) string {
+	if tunnel.ClientUseTls && !strings.HasPrefix(tunnel.ClientAddress, "https://") {
+		return "https://" + tunnel.ClientAddress
+	}
+	return tunnel.ClientAddress
+}
+
+// tunnelTlsConfig returns a copy of base with the tunnel's TLS policy
+// applied, or nil if the tunnel doesn't have one.
+func tunnelTlsConfig(base *tls.Config, tunnel Tunnel) (*tls.Config, error) {
+
+	if tunnel.TlsMinVersion == "" && len(tunnel.TlsCipherSuites) == 0 && !tunnel.RequireClientCert {
+		return nil, nil
+	}
+
+	config := base.Clone()
+	config.GetConfigForClient = nil
+
+	if tunnel.TlsMinVersion != "" {
+		version, err := parseTlsVersion(tunnel.TlsMinVersion)
+		if err != nil {
+			return nil, err
+		}
+		config.MinVersion = version
+	}
+
+	if len(tunnel.TlsCipherSuites) > 0 {
+		suites, err := parseCipherSuites(tunnel.TlsCipherSuites)
+		if err != nil {
+			return nil, err
+		}
+		config.CipherSuites = suites
+	}
+
+	if tunnel.RequireClientCert {
+		pool, err := loadCertPool(tunnel.ClientCertCaPath)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		config.ClientCAs = pool
+	}
+
+	return config, nil
+}
+
+// loadCertPool reads a pool of CA certs from a PEM file.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	caPem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPem) {
+		return nil, fmt.Errorf("No certificates found in %s", path)
+	}
+
+	return pool, nil
+}
+
+func parseTlsVersion(version string) (uint16, error) {
+	switch version {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("Invalid TLS version %s", version)
+	}
+}
+
+// parseCipherSuites converts cipher suite names (ie
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256) to IDs. Note that Go doesn't allow
+// configuring TLS 1.3 suites, so those only apply to TLS 1.2 and lower.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	ids := []uint16{}
+
+	for _, name := range names {
+		found := false
+		for _, suite := range tls.CipherSuites() {
+			if suite.Name == name {
+				ids = append(ids, suite.ID)
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("Invalid or insecure cipher suite %s", name)
+		}
+	}
+
+	return ids, nil
+}
+
+func handleConnection(conn net.Conn, upstreamAddr string, port int, tlsConfig *tls.Config) {
 
 	defer conn.Close()
 
@@ -54,12 +193,14 @@ func handleConnection(conn net.Conn, upstreamAddr string, port int) {
 	var err error
 
 	if useTls {
-		tlsConfig := &tls.Config{
-			InsecureSkipVerify: true,
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{
+				InsecureSkipVerify: true,
+			}
 		}
-		upstreamConn, err = tls.Dial("tcp", fmt.Sprintf("%s:%d", addr, port), tlsConfig)
+		upstreamConn, err = tls.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)), tlsConfig)
 	} else {
-		upstreamConn, err = net.Dial("tcp", fmt.Sprintf("%s:%d", addr, port))
+		upstreamConn, err = net.Dial("tcp", net.JoinHostPort(addr, strconv.Itoa(port)))
 	}
 
 	if err != nil {
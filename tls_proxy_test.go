@@ -0,0 +1,253 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestTunnelTlsMinVersion(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	m.db.SetTunnel("modern.example.com", Tunnel{Domain: "modern.example.com", TlsTermination: "server", TlsMinVersion: "1.3"})
+	m.db.SetTunnel("legacy.example.com", Tunnel{Domain: "legacy.example.com", TlsTermination: "server"})
+
+	certPem, keyPem, err := makeSelfSignedCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	p := &Server{db: m.db, tunMan: m, tlsConfig: tlsConfig}
+	tlsConfig.GetConfigForClient = p.getTlsConfigForClient
+
+	handshake := func(domain string, maxVersion uint16) error {
+		clientConn, serverConn := net.Pipe()
+		defer clientConn.Close()
+
+		go func() {
+			tls.Server(serverConn, tlsConfig).Handshake()
+			serverConn.Close()
+		}()
+
+		return tls.Client(clientConn, &tls.Config{
+			ServerName:         domain,
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS11,
+			MaxVersion:         maxVersion,
+		}).Handshake()
+	}
+
+	if err := handshake("modern.example.com", tls.VersionTLS12); err == nil {
+		t.Error("Expected a TLS 1.2 handshake to be refused for a 1.3-only tunnel")
+	}
+	if err := handshake("modern.example.com", tls.VersionTLS13); err != nil {
+		t.Errorf("Expected TLS 1.3 to be accepted: %v", err)
+	}
+
+	// The baseline
+	if err := handshake("legacy.example.com", tls.VersionTLS11); err == nil {
+		t.Error("Expected a TLS 1.1 handshake to be refused")
+	}
+	if err := handshake("legacy.example.com", tls.VersionTLS12); err != nil {
+		t.Errorf("Expected TLS 1.2 to be accepted: %v", err)
+	}
+}
+
+func TestClientCertOnlySkippedForAcmeChallenges(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	certPem, keyPem, err := makeSelfSignedCert("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caPath, certPem, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.db.SetTunnel("mtls.example.com", Tunnel{
+		Domain:            "mtls.example.com",
+		TlsTermination:    "server",
+		RequireClientCert: true,
+		ClientCertCaPath:  caPath,
+	})
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2", "http/1.1", "acme-tls/1"},
+	}
+	p := &Server{db: m.db, tunMan: m, tlsConfig: tlsConfig}
+	tlsConfig.GetConfigForClient = p.getTlsConfigForClient
+
+	// handshake returns the server's handshake error for a client
+	// offering protos without a cert
+	handshake := func(protos []string) error {
+		clientConn, serverConn := net.Pipe()
+
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- tls.Server(serverConn, tlsConfig).Handshake()
+			serverConn.Close()
+		}()
+
+		go func() {
+			client := tls.Client(clientConn, &tls.Config{
+				ServerName:         "mtls.example.com",
+				InsecureSkipVerify: true,
+				NextProtos:         protos,
+			})
+			// With TLS 1.3 the client is done before the server
+			// checks its cert, so read until the server closes.
+			if client.Handshake() == nil {
+				client.Read(make([]byte, 1))
+			}
+			clientConn.Close()
+		}()
+
+		return <-serverErr
+	}
+
+	if err := handshake([]string{"http/1.1"}); err == nil {
+		t.Error("Expected a handshake without a client cert to be rejected")
+	}
+
+	if err := handshake([]string{"http/1.1", "acme-tls/1"}); err == nil {
+		t.Error("Expected offering acme-tls/1 alongside http/1.1 not to skip the client cert")
+	}
+
+	if err := handshake([]string{"acme-tls/1"}); err != nil {
+		t.Errorf("Expected an ACME challenge handshake to be accepted: %v", err)
+	}
+}
+
+// clientHandshake does a TLS handshake for serverName against a server
+// using tlsConfig, and returns the client's error.
+func clientHandshake(tlsConfig *tls.Config, serverName string) error {
+	clientConn, serverConn := net.Pipe()
+	defer clientConn.Close()
+
+	go func() {
+		tls.Server(serverConn, tlsConfig).Handshake()
+		serverConn.Close()
+	}()
+
+	return tls.Client(clientConn, &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: true,
+	}).Handshake()
+}
+
+func TestCertObtainedOnFirstHandshake(t *testing.T) {
+	m := newTestTunnelManager(t)
+	issuer := &testIssuer{issued: make(chan string, 1)}
+	newTestCertConfig(t, m, issuer)
+	m.config.LazyCerts = true
+	m.certConfig.OnDemand = &certmagic.OnDemandConfig{DecisionFunc: m.allowOnDemandCert}
+
+	_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         "new.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case domain := <-issuer.issued:
+		t.Fatalf("Expected no cert before the first handshake, got one for %s", domain)
+	default:
+	}
+
+	tlsConfig := &tls.Config{GetCertificate: m.certConfig.GetCertificate}
+	p := &Server{db: m.db, tunMan: m, tlsConfig: tlsConfig}
+	tlsConfig.GetConfigForClient = p.getTlsConfigForClient
+
+	err = clientHandshake(tlsConfig, "new.example.com")
+	if err != nil {
+		t.Fatalf("Expected the first handshake to succeed: %v", err)
+	}
+
+	select {
+	case domain := <-issuer.issued:
+		if domain != "new.example.com" {
+			t.Errorf("Expected a cert for new.example.com, got %s", domain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a cert to be obtained on the first handshake")
+	}
+
+	// The second handshake uses the cached cert
+	err = clientHandshake(tlsConfig, "new.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-issuer.issued:
+		t.Error("Expected the cert to be obtained only once")
+	default:
+	}
+}
+
+func TestOnDemandHandshakes(t *testing.T) {
+	m := newTestTunnelManager(t)
+	issuer := &testIssuer{issued: make(chan string, 10)}
+	newTestCertConfig(t, m, issuer)
+	m.certConfig.OnDemand = &certmagic.OnDemandConfig{DecisionFunc: m.allowOnDemandCert}
+
+	m.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", TunnelPort: 20001, TlsTermination: "server"})
+	m.db.SetTunnel("*.example.org", Tunnel{Domain: "*.example.org", TunnelPort: 20002, TlsTermination: "server"})
+
+	tlsConfig := &tls.Config{GetCertificate: m.certConfig.GetCertificate}
+	p := &Server{db: m.db, tunMan: m, tlsConfig: tlsConfig}
+	tlsConfig.GetConfigForClient = p.getTlsConfigForClient
+
+	// Names without a tunnel of their own, including ones a wildcard
+	// tunnel routes, mustn't cost an ACME order
+	for _, name := range []string{"unknown.example.com", "anything.example.org"} {
+		if clientHandshake(tlsConfig, name) == nil {
+			t.Errorf("Expected the handshake for %s to be refused", name)
+		}
+	}
+
+	select {
+	case name := <-issuer.issued:
+		t.Fatalf("Expected no cert for names without a tunnel, got one for %s", name)
+	default:
+	}
+
+	err := clientHandshake(tlsConfig, "app.example.com")
+	if err != nil {
+		t.Fatalf("Expected the handshake for a tunnel's domain to proceed: %v", err)
+	}
+
+	select {
+	case name := <-issuer.issued:
+		if name != "app.example.com" {
+			t.Errorf("Expected a cert for app.example.com, got %s", name)
+		}
+	default:
+		t.Error("Expected a cert to be obtained for app.example.com")
+	}
+}
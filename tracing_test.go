@@ -0,0 +1,88 @@
+package boringproxy
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestCreateTunnelSpans(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	otel.SetTracerProvider(provider)
+	defer provider.Shutdown(context.Background())
+
+	m := newTestTunnelManager(t)
+	issuer := &testIssuer{}
+	newTestCertConfig(t, m, issuer)
+
+	_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         "traced.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+
+	create, exists := spans["CreateTunnel"]
+	if !exists {
+		t.Fatalf("No CreateTunnel span in %v", exporter.GetSpans())
+	}
+
+	attrs := make(map[attribute.Key]string)
+	for _, attr := range create.Attributes {
+		attrs[attr.Key] = attr.Value.AsString()
+	}
+	if attrs["domain"] != "traced.example.com" || attrs["owner"] != "admin" {
+		t.Errorf("Unexpected CreateTunnel attributes %v", create.Attributes)
+	}
+
+	for _, name := range []string{"ManageSync", "authorized_keys.write"} {
+		span, exists := spans[name]
+		if !exists {
+			t.Errorf("No %s span", name)
+			continue
+		}
+		if span.Parent.SpanID() != create.SpanContext.SpanID() {
+			t.Errorf("Expected %s to be a child of CreateTunnel", name)
+		}
+		if span.Status.Code == codes.Error {
+			t.Errorf("Unexpected error status on %s: %s", name, span.Status.Description)
+		}
+	}
+
+	// A failed cert is recorded on the ManageSync span
+	exporter.Reset()
+	issuer.err = errors.New("CA unreachable")
+
+	_, err = m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         "failed.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err == nil {
+		t.Fatal("Expected the cert to fail")
+	}
+
+	failed := false
+	for _, span := range exporter.GetSpans() {
+		if span.Name == "ManageSync" && span.Status.Code == codes.Error {
+			failed = true
+		}
+	}
+	if !failed {
+		t.Error("Expected the ManageSync span to have an error status")
+	}
+}
@@ -2,58 +2,1138 @@ package boringproxy
 
 import (
 	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/pem"
 	"errors"
 	"fmt"
 	"github.com/caddyserver/certmagic"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 	"golang.org/x/crypto/ssh"
 	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/user"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type TunnelManager struct {
+	// Canceled on shutdown
+	ctx        context.Context
 	config     *Config
 	db         *Database
 	mutex      *sync.Mutex
 	certConfig *certmagic.Config
 	user       *user.User
+	joinTokens map[string]joinToken
+	joinMutex  *sync.Mutex
+	// certmagic configs for owners and tunnels with their own ACME
+	// account, keyed by email, CA and account key
+	ownerCertConfigs map[string]*certmagic.Config
+	issuerMutex      *sync.Mutex
+	conns            *ConnTracker
+	createLimiter    *rateLimiter
+	backends         *BackendPool
+	started          time.Time
+	// Serializes access to authorized_keys. See authorizedKeysOp.
+	akMutex   *sync.Mutex
+	akMetrics *authorizedKeysMetrics
+	// Outcome of cert attempts, for Tunnel.CertStatus
+	certStatuses *certStatuses
+	// Pending domain verifications, served by wellKnownHandler
+	verifications *domainVerifications
+	// Only set with config.EmbeddedSsh
+	sshServer *SshServer
+	// Tunnels used for routing requests. See RouteCache.
+	routes *RouteCache
+	// Assigns ports to new tunnels. Must be kept in sync with the
+	// database.
+	ports *PortAllocator
+	// Resolves SSH users other than the one we're running as
+	lookupUser func(username string) (*user.User, error)
+	// Resolves tunnel domains for checkDomainPointsHere
+	lookupIp func(ctx context.Context, host string) ([]net.IPAddr, error)
+	// Checks an account key with the CA. See certConfigForTunnel.
+	checkAcmeAccount func(ctx context.Context, issuer *certmagic.ACMEManager, accountKey string) error
+	// Set to 1 once startup cert management is done. Accessed atomically.
+	ready int32
+	// Closed by StartCerts. See waitForListeners.
+	listening chan struct{}
 }
 
-func NewTunnelManager(config *Config, db *Database, certConfig *certmagic.Config) *TunnelManager {
+// Errors returned (possibly wrapped) by TunnelManager methods. Use errors.Is
+// to check for them.
+var (
+	ErrTunnelExists   = errors.New("Tunnel domain already in use")
+	ErrTunnelNotFound = errors.New("Tunnel doesn't exist")
+	ErrPortInUse      = errors.New("Tunnel port already in use")
+	ErrCertFailed     = errors.New("Failed to get cert")
+	// Returned when an owner creates tunnels faster than allowed
+	ErrRateLimited = errors.New("Too many tunnels created. Try again later")
+	// Returned when the server already has config.MaxTunnels tunnels
+	ErrMaxTunnels = errors.New("Maximum number of tunnels reached")
+	// Returned when a token limited to certain domains is used for
+	// another one
+	ErrTokenScope = errors.New("Token is not valid for this domain")
+	// Returned when an observer token is used to change something
+	ErrReadOnly = errors.New("Token is read-only")
+	// Returned when an update includes a field that can't be changed
+	ErrInvalidField = errors.New("Field can't be updated")
+	// Returned when an update has a value that doesn't parse or is out of
+	// range. See ParameterError.
+	ErrInvalidParameter = errors.New("Invalid parameter")
+	// Returned when a tunnel is assigned a client its owner doesn't have
+	ErrUnknownClient = errors.New("Unknown client")
+	// Returned when the admission webhook doesn't approve a new tunnel
+	ErrAdmissionDenied = errors.New("Tunnel creation denied")
+	// Returned with config.PreflightDnsStrict when a new tunnel's domain
+	// doesn't resolve to this server
+	ErrDnsMismatch = errors.New("Domain doesn't point at this server")
+	// Returned when a label is requested under the base domain but its
+	// subdomain already has a tunnel
+	ErrSubdomainTaken = errors.New("Subdomain already taken")
+	// Returned when authorized_keys can't be accessed within
+	// config.AuthorizedKeysTimeout
+	ErrAuthorizedKeysTimeout = errors.New("Timed out accessing authorized_keys")
+)
+
+// CertError is returned when a cert couldn't be obtained for a tunnel. It
+// wraps the underlying certmagic error (ie rate limiting or a failed
+// challenge).
+type CertError struct {
+	Domain string
+	Err    error
+}
+
+func (e *CertError) Error() string {
+	return fmt.Sprintf("failed to get cert for %s: %v", e.Domain, e.Err)
+}
+
+func (e *CertError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrCertFailed) true for any CertError.
+func (e *CertError) Is(target error) bool {
+	return target == ErrCertFailed
+}
+
+// ParameterError is returned when a tunnel update is rejected. It keeps the
+// message of the underlying error (ie which parameter was invalid).
+type ParameterError struct {
+	Err error
+}
+
+func (e *ParameterError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ParameterError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrInvalidParameter) true for any ParameterError.
+func (e *ParameterError) Is(target error) bool {
+	return target == ErrInvalidParameter
+}
+
+type joinToken struct {
+	domain  string
+	expires time.Time
+}
+
+// NewTunnelManager loads certs for existing tunnels before returning. ctx
+// should be canceled on shutdown, which aborts that and any other slow
+// operations in progress.
+func NewTunnelManager(ctx context.Context, config *Config, db *Database, certConfig *certmagic.Config) *TunnelManager {
+
+	currentUser, err := user.Current()
+	if err != nil {
+		log.Fatalf("Unable to get current user: %v", err)
+	}
+
+	err = checkCertStorage(certConfig.Storage)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	m := &TunnelManager{
+		ctx:        ctx,
+		config:     config,
+		db:         db,
+		mutex:      &sync.Mutex{},
+		certConfig: certConfig,
+		user:       currentUser,
+		joinTokens: make(map[string]joinToken),
+		joinMutex:  &sync.Mutex{},
+
+		ownerCertConfigs: make(map[string]*certmagic.Config),
+		issuerMutex:      &sync.Mutex{},
+		conns:            NewConnTracker(),
+		createLimiter:    newRateLimiter(config.TunnelCreateRate/60, config.TunnelCreateBurst),
+		backends:         NewBackendPool(config.BackendMaxIdleConns, config.BackendIdleTimeout),
+		started:          time.Now(),
+		akMutex:          &sync.Mutex{},
+		akMetrics:        newAuthorizedKeysMetrics(),
+		certStatuses:     newCertStatuses(),
+		verifications:    newDomainVerifications(),
+		lookupUser:       user.Lookup,
+		lookupIp:         net.DefaultResolver.LookupIPAddr,
+		checkAcmeAccount: checkAcmeAccountWithCa,
+		listening:        make(chan struct{}),
+	}
+
+	m.routes = NewRouteCache(func() (map[string]Tunnel, error) {
+		return db.GetTunnels(), nil
+	}, db.TunnelsGeneration, config.RouteCacheTtl)
+
+	m.ports = NewPortAllocator(config.TunnelPortMin, config.TunnelPortMax, m.tunnelPorts(), config.PortReuseGrace)
+
+	certConfig.OnEvent = m.onCertEvent
+
+	// The admin domain's cert was obtained before the hook was set, so
+	// record it by loading it again
+	if config.autoCerts && db.GetAdminDomain() != "" {
+		hasCert(certConfig, db.GetAdminDomain())
+	}
+
+	if config.LazyCerts && certConfig.OnDemand == nil {
+		certConfig.OnDemand = &certmagic.OnDemandConfig{}
+	}
+
+	// Without a decision function certmagic would try to get a cert for
+	// any SNI value it's sent.
+	if certConfig.OnDemand != nil && certConfig.OnDemand.DecisionFunc == nil {
+		certConfig.OnDemand.DecisionFunc = m.allowOnDemandCert
+	}
+
+	if config.EmbeddedSsh {
+		m.sshServer, err = NewSshServer(m, config.SshHostKeyPath, config.SshHostKeyGrace)
+		if err != nil {
+			log.Fatalf("Failed to start SSH server: %v", err)
+		}
+
+		sshAddr := net.JoinHostPort(config.ListenIp, strconv.Itoa(config.SshServerPort))
+		sshListener, err := net.Listen("tcp", sshAddr)
+		if err != nil {
+			log.Fatalf("Failed to start SSH server: %v", err)
+		}
+
+		log.Printf("SSH server listening on %s", sshAddr)
+
+		// The SSH server reports connections itself
+		go m.sshServer.Serve(ctx, sshListener)
+	} else {
+		go m.conns.Poll(ctx, 5*time.Second, config.SshServerPort, m.tunnelPorts)
+	}
+	go m.saveActivity(ctx, activitySaveInterval)
+	go m.runScheduleSweeper(ctx, scheduleSweepInterval)
+
+	if config.IdleTimeout > 0 {
+		go m.runIdleReaper(ctx, idleReapInterval)
+	}
+
+	m.migratePrivateKeys()
+
+	if !config.EmbeddedSsh {
+		for _, warning := range m.checkSshUsers() {
+			log.Printf("Warning: %s", warning)
+		}
+	}
+
+	if config.RecoverAuthorizedKeys && !config.EmbeddedSsh {
+		err := m.recoverAuthorizedKeys()
+		if err != nil {
+			log.Println("Failed to recover tunnels from authorized_keys:", err)
+		}
+	}
+
+	if !config.EmbeddedSsh {
+		m.loadAuthorizedKeysMetrics()
+	}
+
+	weak := m.weakKeyTunnels()
+	if len(weak) > 0 {
+		log.Printf("Warning: %d tunnel(s) have RSA keys smaller than %d bits: %s", len(weak), minRsaBits, strings.Join(weak, ", "))
+		if config.AutoRotateWeakKeys {
+			go m.rotateWeakKeys(ctx, weak, weakKeyRotateInterval)
+		} else {
+			log.Println("Run with -auto-rotate-weak-keys to replace them")
+		}
+	}
+
+	m.loadSelfSignedCerts(db.GetTunnels())
+
+	if !config.autoCerts {
+		atomic.StoreInt32(&m.ready, 1)
+	}
+
+	return m
+}
+
+// checkCertStorage makes sure certs can be saved to storage, so a
+// permission problem is reported clearly up front rather than as a failed
+// ACME order later. Only file storage is checked.
+func checkCertStorage(storage certmagic.Storage) error {
+	fileStorage, ok := storage.(*certmagic.FileStorage)
+	if !ok {
+		return nil
+	}
+
+	path := fileStorage.Path
+
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return fmt.Errorf("Cert storage directory %s can't be created: %v. Create it or use -cert-dir to choose another one", path, err)
+	}
+
+	testFile, err := ioutil.TempFile(path, ".boringproxy-write-check-")
+	if err != nil {
+		return fmt.Errorf("Cert storage directory %s isn't writable: %v. Fix its permissions or use -cert-dir to choose another one", path, err)
+	}
+	testFile.Close()
+	os.Remove(testFile.Name())
+
+	return nil
+}
+
+// StartCerts starts obtaining certs for the existing tunnels. It has to be
+// called after the HTTP and HTTPS listeners are bound and handling
+// challenges. Otherwise certmagic can't tell they're about to be, and either
+// binds the ports itself (so binding them later fails), or has its
+// challenges go unanswered.
+func (m *TunnelManager) StartCerts() {
+	close(m.listening)
+
+	// With lazy certs (the default), this only covers the tunnels
+	// lazyCert excludes. Everything else is obtained on first handshake.
+	if m.config.autoCerts {
+		go m.startupCerts(m.ctx)
+	}
+}
+
+// startupCerts runs manageStartupCerts and marks the manager ready when
+// it's done, or after config.StartupCertTimeout so a stuck domain can't keep
+// the server from ever becoming ready. In that case the remaining certs
+// are still obtained in the background.
+func (m *TunnelManager) startupCerts(ctx context.Context) {
+	done := make(chan struct{})
+
+	go func() {
+		errs := m.manageStartupCerts(ctx, m.db.GetTunnels())
+		if len(errs) > 0 {
+			log.Printf("CertMagic errors at startup for %d domain(s):", len(errs))
+			for _, err := range errs {
+				log.Println(err)
+			}
+		}
+		close(done)
+	}()
+
+	var timeout <-chan time.Time
+	if m.config.StartupCertTimeout > 0 {
+		timeout = time.After(m.config.StartupCertTimeout)
+	}
+
+	select {
+	case <-done:
+	case <-timeout:
+		log.Printf("Startup certificates not done after %s. Reporting ready anyway", m.config.StartupCertTimeout)
+	case <-ctx.Done():
+		return
+	}
+
+	atomic.StoreInt32(&m.ready, 1)
+}
+
+// waitForListeners blocks until StartCerts has been called, so certs for
+// tunnels created (or reloaded) at runtime aren't obtained while the
+// challenge listeners are still being bound. With -allow-http the API is
+// served before that.
+func (m *TunnelManager) waitForListeners(ctx context.Context) error {
+	select {
+	case <-m.listening:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Ready reports whether startup cert management has finished.
+func (m *TunnelManager) Ready() bool {
+	return atomic.LoadInt32(&m.ready) == 1
+}
+
+// manageStartupCerts obtains or loads certs for all tunnels terminated by
+// the server, using up to config.CertConcurrency workers. certmagic locks
+// each domain in storage, so parallel calls for different domains are safe.
+// Domains with a valid cert in storage are only loaded, which avoids an
+// ACME request per domain on every start. All errors are returned.
+func (m *TunnelManager) manageStartupCerts(ctx context.Context, tunnels map[string]Tunnel) []error {
+
+	certTunnels, duplicates := m.startupCertTunnels(tunnels)
+	if duplicates > 0 {
+		log.Printf("Skipping %d duplicate domain(s) at startup", duplicates)
+	}
+
+	var stored int32
+
+	concurrency := m.config.CertConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	jobs := make(chan Tunnel)
+	errChan := make(chan error)
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tun := range jobs {
+				if ctx.Err() != nil {
+					continue
+				}
+
+				certConfig, err := m.certConfigForTunnel(tun)
+				if err != nil {
+					m.certStatuses.Set(tun.Domain, CertStatusFailed)
+					errChan <- &CertError{Domain: tun.Domain, Err: err}
+					continue
+				}
+
+				// Loading the cert also puts it under
+				// certmagic's maintenance, so it's still
+				// renewed.
+				if hasCert(certConfig, tun.Domain) {
+					atomic.AddInt32(&stored, 1)
+					m.certStatuses.Set(tun.Domain, CertStatusManaged)
+					continue
+				}
+
+				err = certConfig.ManageSync(ctx, []string{tun.Domain})
+				if err != nil {
+					if !hasCert(certConfig, tun.Domain) {
+						m.certStatuses.Set(tun.Domain, CertStatusFailed)
+					}
+					errChan <- &CertError{Domain: tun.Domain, Err: err}
+				}
+			}
+		}()
+	}
+
+	go func() {
+		for _, tun := range certTunnels {
+			jobs <- tun
+		}
+		close(jobs)
+		wg.Wait()
+		close(errChan)
+	}()
+
+	errs := []error{}
+	for err := range errChan {
+		errs = append(errs, err)
+	}
+
+	if stored > 0 {
+		log.Printf("Loaded %d cert(s) from storage at startup without contacting the CA", stored)
+	}
+
+	return errs
+}
+
+// startupCertTunnels returns one tunnel for each domain that needs a cert
+// at startup, and how many duplicates were left out. Tunnels can share a
+// domain via path prefixes, and manual database edits can leave the same
+// domain with different case or a trailing dot, but each cert only needs to
+// be managed once.
+func (m *TunnelManager) startupCertTunnels(tunnels map[string]Tunnel) ([]Tunnel, int) {
+	certTunnels := []Tunnel{}
+	seen := make(map[string]bool)
+	duplicates := 0
+
+	for _, tun := range tunnels {
+		if tun.TlsTermination != "server" && tun.TlsTermination != "server-tls" {
+			continue
+		}
+
+		if m.lazyCert(tun) {
+			continue
+		}
+
+		domain := strings.TrimSuffix(strings.ToLower(tun.Domain), ".")
+		if seen[domain] {
+			duplicates++
+			continue
+		}
+		seen[domain] = true
+
+		tun.Domain = domain
+		certTunnels = append(certTunnels, tun)
+	}
+
+	return certTunnels, duplicates
+}
+
+// recoverAuthorizedKeys adds a minimal database entry for every boringproxy
+// key in authorized_keys that doesn't have a tunnel, ie after moving to a new
+// host without the database.
+func (m *TunnelManager) recoverAuthorizedKeys() error {
+
+	var akBytes []byte
+	err := m.authorizedKeysOp(func() error {
+		var err error
+		authKeysPath, err := m.authorizedKeysPath("")
+		if err != nil {
+			return err
+		}
+		akBytes, err = ioutil.ReadFile(authKeysPath)
+		return err
+	}, nil)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(string(akBytes), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		tunnelId := fields[len(fields)-1]
+		if !strings.HasPrefix(tunnelId, "boringproxy-") {
+			continue
+		}
+
+		idParts := strings.TrimPrefix(tunnelId, "boringproxy-")
+		sep := strings.LastIndex(idParts, "-")
+		if sep == -1 {
+			continue
+		}
+
+		domain := idParts[:sep]
+		port, err := strconv.Atoi(idParts[sep+1:])
+		if err != nil || domain == "" {
+			log.Printf("Skipping invalid authorized_keys entry %s", tunnelId)
+			continue
+		}
+
+		if _, exists := m.db.GetTunnel(domain); exists {
+			continue
+		}
+
+		log.Printf("Recovering tunnel %s (port %d) from authorized_keys", domain, port)
+
+		bindAddr := permitListenHost(line)
+		loopbackIp := ""
+		if ip := net.ParseIP(bindAddr); ip != nil && ip.IsLoopback() {
+			loopbackIp = bindAddr
+		}
+
+		m.db.SetTunnel(domain, Tunnel{
+			Domain:           domain,
+			ServerAddress:    m.db.GetAdminDomain(),
+			ServerPort:       m.config.SshServerPort,
+			Username:         m.user.Username,
+			TunnelPort:       port,
+			ClientAddress:    "127.0.0.1",
+			LoopbackIp:       loopbackIp,
+			AllowExternalTcp: bindAddr == "0.0.0.0" || bindAddr == "::",
+			TlsTermination:   "server",
+			Recovered:        true,
+		})
+
+		// The allocator was seeded from the database before this
+		m.ports.Reserve(port)
+	}
+
+	return nil
+}
+
+// GetTunnels returns all tunnels, with Connected, LastActivity,
+// MatchedRequests, CertStatus and ServerPublicKeys filled in.
+func (m *TunnelManager) GetTunnels() map[string]Tunnel {
+	tunnels := m.db.GetTunnels()
+
+	for key, tun := range tunnels {
+		tun = m.withPrivateKey(tun)
+		tun = m.withHostKeys(tun)
+		tun.Connected = m.IsConnected(tun.TunnelPort)
+		tun.ClientRemoteAddr = m.conns.RemoteAddr(tun.TunnelPort)
+		tun.LastActivity = m.lastActivity(key, tun)
+		tun.MatchedRequests = m.conns.Requests(key)
+		tun.CertStatus = m.tunnelCertStatus(tun)
+		tunnels[key] = tun
+	}
+
+	return tunnels
+}
+
+// GetTunnelDetails returns the tunnel stored under key along with its runtime
+// state. Unlike GetTunnels this includes Stats, which are gathered on demand.
+// No authorization is done here, so callers must check ownership.
+func (m *TunnelManager) GetTunnelDetails(key string) (Tunnel, bool) {
+	tun, exists := m.db.GetTunnel(key)
+	if !exists {
+		return Tunnel{}, false
+	}
+
+	tun = m.withPrivateKey(tun)
+	tun = m.withHostKeys(tun)
+	tun.Connected = m.IsConnected(tun.TunnelPort)
+	tun.ClientRemoteAddr = m.conns.RemoteAddr(tun.TunnelPort)
+	tun.LastActivity = m.lastActivity(key, tun)
+	tun.MatchedRequests = m.conns.Requests(key)
+	tun.CertStatus = m.tunnelCertStatus(tun)
+
+	stats := m.conns.Stats(key)
+
+	if m.config.autoCerts && (tun.TlsTermination == "server" || tun.TlsTermination == "server-tls") {
+		certConfig, err := m.certConfigForTunnel(tun)
+		if err == nil {
+			cert, err := certConfig.CacheManagedCertificate(tun.Domain)
+			if err == nil && cert.Leaf != nil {
+				stats.CertExpiry = cert.Leaf.NotAfter
+			}
+		}
+	}
+
+	tun.Stats = &stats
+
+	return tun, true
+}
+
+// routeRequest returns the tunnel that serves HTTP requests for host and
+// path. Hosts without a tunnel get the default tunnel, if one is configured
+// and it's server-terminated. Otherwise they get the landing page.
+func (m *TunnelManager) routeRequest(host, path string) (Tunnel, bool) {
+	tunnel, exists := m.routes.Match(host, path)
+	if !exists && m.config.DefaultTunnel != "" {
+		tunnel, exists = m.routes.Get(m.config.DefaultTunnel)
+		exists = exists && tunnel.TlsTermination == "server"
+	}
+
+	return tunnel, exists
+}
+
+// ManagerStats is an overview of all tunnels, returned by Stats.
+type ManagerStats struct {
+	Tunnels int `json:"tunnels"`
+	// Keyed by owner
+	TunnelsByOwner map[string]int `json:"tunnels_by_owner"`
+	// Keyed by TLS termination (ie "server", "passthrough")
+	TunnelsByProtocol map[string]int `json:"tunnels_by_protocol"`
+	// Tunnels whose certs come from their owner's own ACME account
+	CustomCerts int `json:"custom_certs"`
+	// Tunnels with a connected client
+	Healthy  int   `json:"healthy"`
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+}
+
+// Stats returns aggregate stats across all tunnels.
+func (m *TunnelManager) Stats() (ManagerStats, error) {
+	stats := ManagerStats{
+		TunnelsByOwner:    make(map[string]int),
+		TunnelsByProtocol: make(map[string]int),
+	}
+
+	users := m.db.GetUsers()
+
+	for key, tun := range m.db.GetTunnels() {
+		stats.Tunnels++
+		stats.TunnelsByOwner[tun.Owner]++
+		stats.TunnelsByProtocol[tun.TlsTermination]++
+
+		if tun.TlsTermination == "server" || tun.TlsTermination == "server-tls" {
+			if hasCustomAcmeAccount(tun, users[tun.Owner]) {
+				stats.CustomCerts++
+			}
+		}
+
+		if m.IsConnected(tun.TunnelPort) {
+			stats.Healthy++
+		}
+
+		traffic := m.conns.Stats(key)
+		stats.BytesIn += traffic.BytesIn
+		stats.BytesOut += traffic.BytesOut
+	}
+
+	return stats, nil
+}
+
+// withShutdown returns a context that's canceled when either ctx or the
+// manager's context is done.
+func (m *TunnelManager) withShutdown(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	go func() {
+		select {
+		case <-m.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, cancel
+}
+
+// BackendClient returns the HTTP client for requests to tunnel. Connections
+// are kept alive until the tunnel is deleted.
+func (m *TunnelManager) BackendClient(tunnel Tunnel) *http.Client {
+	return m.backends.Client(backendAddr(tunnel))
+}
+
+// backendAddr returns the address the server reaches tunnel's port at.
+func backendAddr(tunnel Tunnel) string {
+	return net.JoinHostPort(tunnelLoopbackIp(tunnel), strconv.Itoa(tunnel.TunnelPort))
+}
+
+// IsConnected reports whether a client currently has the tunnel on port
+// open.
+func (m *TunnelManager) IsConnected(port int) bool {
+	return m.conns.IsConnected(port)
+}
+
+func (m *TunnelManager) tunnelPorts() []int {
+	ports := []int{}
+	for _, tun := range m.db.GetTunnels() {
+		if tun.RedirectTo == "" {
+			ports = append(ports, tun.TunnelPort)
+		}
+	}
+	return ports
+}
+
+// SetPinned pins or unpins the tunnel stored under key.
+func (m *TunnelManager) SetPinned(key string, pinned bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tun, exists := m.db.GetTunnel(key)
+	if !exists {
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	tun.Pinned = pinned
+	m.db.SetTunnel(key, tun)
+
+	return nil
+}
+
+// SetRedirect changes where the redirect tunnel stored under key redirects
+// to. A code of 0 uses 301.
+func (m *TunnelManager) SetRedirect(key, target string, code int) error {
+	_, err := m.UpdateTunnel(key, func(tun *Tunnel) error {
+		return setRedirect(tun, target, code)
+	})
+	return err
+}
+
+func setRedirect(tun *Tunnel, target string, code int) error {
+	if tun.RedirectTo == "" {
+		return errors.New("Not a redirect tunnel")
+	}
+
+	err := validateRedirect(target, code)
+	if err != nil {
+		return err
+	}
+
+	tun.RedirectTo = target
+	tun.RedirectCode = code
+
+	return nil
+}
+
+// validateRedirect checks a redirect tunnel's target, which is either a
+// domain or an http(s) URL, and status code.
+func validateRedirect(target string, code int) error {
+	if strings.Contains(target, "://") {
+		u, err := url.Parse(target)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New("Invalid redirect target")
+		}
+	} else if target == "" || strings.ContainsAny(target, "/?#") {
+		return errors.New("Invalid redirect target")
+	}
+
+	switch code {
+	case 0, 301, 302, 303, 307, 308:
+	default:
+		return errors.New("Invalid redirect code. Must be 301, 302, 303, 307, or 308")
+	}
+
+	return nil
+}
+
+// UpdateTunnel applies update to the tunnel stored under key and saves it.
+// It's only for settings that don't affect the tunnel's key, port, or cert.
+// If update returns an error, nothing is saved.
+func (m *TunnelManager) UpdateTunnel(key string, update func(tun *Tunnel) error) (Tunnel, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tun, exists := m.db.GetTunnel(key)
+	if !exists {
+		return Tunnel{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	err := update(&tun)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	m.db.SetTunnel(key, tun)
+
+	return tun, nil
+}
+
+// RequestCreateTunnel creates a tunnel, obtaining a cert first if needed.
+// It's aborted if either ctx or the manager's context is canceled.
+func (m *TunnelManager) RequestCreateTunnel(ctx context.Context, tunReq Tunnel) (Tunnel, error) {
+	return m.createTunnel(ctx, tunReq, false)
+}
+
+// RequestCreateCompanion is RequestCreateTunnel for the redirect companion
+// of a tunnel that was just created. It's part of the same request, so it
+// isn't rate limited separately or counted towards config.MaxTunnels.
+func (m *TunnelManager) RequestCreateCompanion(ctx context.Context, tunReq Tunnel) (Tunnel, error) {
+	return m.createTunnel(ctx, tunReq, true)
+}
+
+func (m *TunnelManager) createTunnel(ctx context.Context, tunReq Tunnel, companion bool) (Tunnel, error) {
+
+	if tunReq.Domain == "" {
+		return Tunnel{}, errors.New("Domain required")
+	}
+
+	if tunReq.Owner == "" {
+		return Tunnel{}, errors.New("Owner required")
+	}
+
+	ctx, cancel := m.withShutdown(ctx)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "CreateTunnel", trace.WithAttributes(
+		attribute.String("domain", tunReq.Domain),
+		attribute.String("owner", tunReq.Owner),
+	))
+	defer span.End()
+
+	// Also checked below, but there's no point getting a cert if the
+	// server is already full or the domain is taken.
+	m.mutex.Lock()
+	var err error
+	if !companion {
+		err = m.checkMaxTunnels()
+	}
+	if err == nil {
+		err = m.checkConflicts(tunReq)
+	}
+	m.mutex.Unlock()
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	// Before any cert is requested, so denied domains don't cost an ACME
+	// order
+	err = m.admitTunnel(ctx, tunReq)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	err = m.preflightDns(ctx, tunReq)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	// Each new server-terminated tunnel costs an ACME order on a shared
+	// account, so this is checked before the cert is requested. Requests
+	// rejected above don't use up a token.
+	if !companion && !m.createLimiter.Allow(tunReq.Owner) {
+		return Tunnel{}, ErrRateLimited
+	}
+
+	// Set if a cert was obtained (or generated) for the tunnel below, so
+	// it can be dropped again if creating the tunnel fails
+	certObtained := false
+	created := false
+
+	if tunReq.TlsTermination == "server" || tunReq.TlsTermination == "server-tls" {
+		if m.config.autoCerts && !m.lazyCert(tunReq) {
+			certConfig, err := m.certConfigForTunnel(tunReq)
+			if err != nil {
+				return Tunnel{}, &CertError{Domain: tunReq.Domain, Err: err}
+			}
+			certObtained = true
+
+			// A valid cert in storage, ie from PrewarmCert, is only
+			// loaded, which also puts it back under maintenance.
+			if hasCert(certConfig, tunReq.Domain) {
+				m.certStatuses.Set(tunReq.Domain, CertStatusManaged)
+			} else if err = m.waitForListeners(ctx); err == nil {
+				certCtx, certSpan := tracer.Start(ctx, "ManageSync")
+				err = certConfig.ManageSync(certCtx, []string{tunReq.Domain})
+				if err != nil {
+					certSpan.RecordError(err)
+					certSpan.SetStatus(codes.Error, "ManageSync failed")
+				}
+				certSpan.End()
+			}
+
+			if err != nil {
+				// ManageSync can report an error even though the
+				// cert for this domain ended up in storage (ie when
+				// part of the batch failed). Only bail out (or fall
+				// back to self-signed) if the domain really doesn't
+				// have a cert.
+				if hasCert(certConfig, tunReq.Domain) {
+					log.Printf("CertMagic error for %s, but cert exists in storage: %v", tunReq.Domain, err)
+				} else {
+					m.certStatuses.Set(tunReq.Domain, CertStatusFailed)
+
+					certErr := &CertError{Domain: tunReq.Domain, Err: err}
+					log.Println(certErr)
+
+					if !m.canFallBackToSelfSigned(tunReq) {
+						return Tunnel{}, certErr
+					}
+
+					err := m.useSelfSignedCert(tunReq.Domain)
+					if err != nil {
+						log.Printf("Failed to create self-signed cert for %s: %v", tunReq.Domain, err)
+						return Tunnel{}, certErr
+					}
+
+					log.Printf("Using a self-signed cert for %s", tunReq.Domain)
+					tunReq.TlsTermination = "self-signed"
+				}
+			}
+		}
+	}
+
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	// Runs before the mutex is unlocked, so no other tunnel can start
+	// using the domain in between.
+	defer func() {
+		if certObtained && !created {
+			m.releaseCert(tunReq)
+		}
+	}()
+
+	// Don't leave a half-created tunnel behind if the cert request was
+	// interrupted.
+	if err := ctx.Err(); err != nil {
+		return Tunnel{}, err
+	}
+
+	if !companion {
+		err = m.checkMaxTunnels()
+		if err != nil {
+			return Tunnel{}, err
+		}
+	}
+
+	if tunReq.RedirectTo != "" {
+		// Redirects are served by the server itself, so there's no
+		// port or key to set up.
+		tunReq.TunnelPort = 0
+
+		err := m.checkConflicts(tunReq)
+		if err != nil {
+			return Tunnel{}, err
+		}
+
+		err = m.storeAcmeAccountKey(&tunReq)
+		if err != nil {
+			return Tunnel{}, err
+		}
+
+		tunReq.LastActivity = time.Now()
+		m.db.SetTunnel(tunnelKey(tunReq), tunReq)
+		created = true
+
+		return tunReq, nil
+	}
+
+	// Gives back the port if we allocated it and creation fails
+	release := func() {}
+
+	if tunReq.TunnelPort == 0 {
+		var err error
+		tunReq.TunnelPort, err = m.ports.Allocate()
+		if err != nil {
+			return Tunnel{}, err
+		}
+
+		port := tunReq.TunnelPort
+		release = func() {
+			m.ports.Cancel(port)
+		}
+	}
+
+	err = m.checkConflicts(tunReq)
+	if err != nil {
+		release()
+		return Tunnel{}, err
+	}
+
+	_, akSpan := tracer.Start(ctx, "authorized_keys.write")
+	if tunReq.Username == "" {
+		tunReq.Username = m.user.Username
+	}
 
-	user, err := user.Current()
+	privKey, err := m.addToAuthorizedKeys(tunReq.Username, tunReq.Domain, tunReq.TunnelPort, tunnelBindAddr(tunReq))
 	if err != nil {
-		log.Fatalf("Unable to get current user: %v", err)
+		akSpan.RecordError(err)
+		akSpan.SetStatus(codes.Error, "Failed to add authorized key")
+		akSpan.End()
+		release()
+		return Tunnel{}, err
 	}
+	akSpan.End()
 
-	if config.autoCerts {
-		for domainName, tun := range db.GetTunnels() {
-			if tun.TlsTermination == "server" || tun.TlsTermination == "server-tls" {
-				err = certConfig.ManageSync(context.Background(), []string{domainName})
-				if err != nil {
-					log.Println("CertMagic error at startup")
-					log.Println(err)
-				}
-			}
-		}
+	tunReq.ServerPublicKey = ""
+	if m.sshServer != nil {
+		tunReq.ServerPublicKey = m.sshServer.PublicKey()
+	}
+	tunReq.LastActivity = time.Now()
+
+	err = m.setPrivateKey(&tunReq, privKey)
+	if err != nil {
+		m.removeFromAuthorizedKeys(tunReq.Username, tunReq.Domain, tunReq.TunnelPort)
+		release()
+		return Tunnel{}, err
+	}
+
+	err = m.storeAcmeAccountKey(&tunReq)
+	if err != nil {
+		m.deletePrivateKey(tunReq)
+		m.removeFromAuthorizedKeys(tunReq.Username, tunReq.Domain, tunReq.TunnelPort)
+		release()
+		return Tunnel{}, err
 	}
 
-	mutex := &sync.Mutex{}
-	return &TunnelManager{config, db, mutex, certConfig, user}
+	m.ports.Reserve(tunReq.TunnelPort)
+	m.db.SetTunnel(tunnelKey(tunReq), tunReq)
+	created = true
+
+	// The key is already in authorized_keys, so don't leave the tunnel
+	// only in memory if writes are batched.
+	m.db.Flush()
+
+	tunReq.TunnelPrivateKey = privKey
+
+	return m.withHostKeys(tunReq), nil
 }
 
-func (m *TunnelManager) GetTunnels() map[string]Tunnel {
-	return m.db.GetTunnels()
+// PrewarmCert obtains a cert for domain ahead of creating a tunnel for it,
+// so the tunnel doesn't have to wait for the CA when it's created (or, with
+// lazy certs, on its first request). owner picks the ACME account, like for
+// the tunnel itself. The cert is left in storage but not managed, so it
+// isn't renewed unless a tunnel is created for the domain.
+func (m *TunnelManager) PrewarmCert(ctx context.Context, domain, owner string) error {
+	if !m.config.autoCerts {
+		return errors.New("Server doesn't manage certs")
+	}
+
+	if domain == "" {
+		return errors.New("Domain required")
+	}
+
+	tun := Tunnel{Domain: domain, Owner: owner}
+	certConfig, err := m.certConfigForTunnel(tun)
+	if err != nil {
+		return &CertError{Domain: domain, Err: err}
+	}
+
+	if hasCert(certConfig, domain) {
+		m.unmanagePrewarmed(certConfig, domain)
+		return nil
+	}
+
+	err = m.waitForListeners(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = certConfig.ManageSync(ctx, []string{domain})
+	if err != nil && !hasCert(certConfig, domain) {
+		return &CertError{Domain: domain, Err: err}
+	}
+
+	log.Printf("Prewarmed cert for %s", domain)
+
+	m.unmanagePrewarmed(certConfig, domain)
+
+	return nil
+}
+
+// unmanagePrewarmed stops maintenance of a prewarmed cert, unless a tunnel
+// already uses the domain.
+func (m *TunnelManager) unmanagePrewarmed(certConfig *certmagic.Config, domain string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.db.HasExactDomain(domain) || stringInArray(domain, m.config.AdminDomainAliases) {
+		return
+	}
+
+	certConfig.Unmanage([]string{domain})
 }
 
-func (m *TunnelManager) RequestCreateTunnel(tunReq Tunnel) (Tunnel, error) {
+// releaseCert drops the cert obtained for tun when creating it failed, so
+// it isn't renewed for a domain without a tunnel. The cert stays in storage,
+// but is no longer managed. Nothing happens if another tunnel uses the
+// domain. Must be called with the mutex held.
+func (m *TunnelManager) releaseCert(tun Tunnel) {
+	if m.db.HasExactDomain(tun.Domain) || stringInArray(tun.Domain, m.config.AdminDomainAliases) {
+		return
+	}
+
+	log.Printf("Dropping cert for %s, since the tunnel wasn't created", tun.Domain)
+
+	m.certStatuses.Forget(tun.Domain)
+
+	if tun.TlsTermination == "self-signed" {
+		m.deleteSelfSignedCert(tun.Domain)
+		return
+	}
+
+	// Without a config, the cert was never obtained
+	certConfig, err := m.certConfigForTunnel(tun)
+	if err == nil {
+		certConfig.Unmanage([]string{tun.Domain})
+	}
+}
+
+// PreflightTunnel runs the same checks as RequestCreateTunnel, returning the
+// same errors, but doesn't create anything. Rather than obtaining a cert, it
+// checks that the domain points at this server. The returned tunnel is what
+// would be created, minus the key. If no port was requested, the returned
+// port is currently free, but the real call may pick a different one.
+func (m *TunnelManager) PreflightTunnel(ctx context.Context, tunReq Tunnel) (Tunnel, error) {
 
 	if tunReq.Domain == "" {
 		return Tunnel{}, errors.New("Domain required")
@@ -65,9 +1145,16 @@ func (m *TunnelManager) RequestCreateTunnel(tunReq Tunnel) (Tunnel, error) {
 
 	if tunReq.TlsTermination == "server" || tunReq.TlsTermination == "server-tls" {
 		if m.config.autoCerts {
-			err := m.certConfig.ManageSync(context.Background(), []string{tunReq.Domain})
+			certConfig, err := m.certConfigForTunnel(tunReq)
 			if err != nil {
-				return Tunnel{}, errors.New("Failed to get cert")
+				return Tunnel{}, &CertError{Domain: tunReq.Domain, Err: err}
+			}
+
+			if !hasCert(certConfig, tunReq.Domain) {
+				err := m.checkDomainPointsHere(ctx, tunReq.Domain)
+				if err != nil {
+					return Tunnel{}, &CertError{Domain: tunReq.Domain, Err: err}
+				}
 			}
 		}
 	}
@@ -75,168 +1162,591 @@ func (m *TunnelManager) RequestCreateTunnel(tunReq Tunnel) (Tunnel, error) {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	if tunReq.TunnelPort == 0 {
-		var err error
-		tunReq.TunnelPort, err = randomOpenPort()
+	err := m.checkMaxTunnels()
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	if tunReq.RedirectTo != "" {
+		tunReq.TunnelPort = 0
+	} else if tunReq.TunnelPort == 0 {
+		tunReq.TunnelPort, err = m.ports.Peek()
 		if err != nil {
 			return Tunnel{}, err
 		}
 	}
 
+	err = m.checkConflicts(tunReq)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	// Last, like in RequestCreateTunnel
+	if !m.createLimiter.Check(tunReq.Owner) {
+		return Tunnel{}, ErrRateLimited
+	}
+
+	tunReq.ServerPublicKey = ""
+	if tunReq.Username == "" {
+		tunReq.Username = m.user.Username
+	}
+
+	return tunReq, nil
+}
+
+// checkMaxTunnels makes sure there's room for another tunnel. Redirect
+// companions come with their primary tunnel, so they aren't counted. Must be
+// called with the mutex held.
+func (m *TunnelManager) checkMaxTunnels() error {
+	if m.config.MaxTunnels <= 0 {
+		return nil
+	}
+
+	tunnels := m.db.GetTunnels()
+
+	count := len(tunnels)
+	for _, tun := range tunnels {
+		if _, exists := tunnels[tun.Companion]; exists && tun.Companion != "" {
+			count--
+		}
+	}
+
+	if count >= m.config.MaxTunnels {
+		return fmt.Errorf("%w (%d)", ErrMaxTunnels, m.config.MaxTunnels)
+	}
+	return nil
+}
+
+// checkConflicts makes sure tunReq doesn't clash with an existing tunnel.
+// Must be called with the mutex held.
+func (m *TunnelManager) checkConflicts(tunReq Tunnel) error {
 	for _, tun := range m.db.GetTunnels() {
-		if tunReq.Domain == tun.Domain {
-			return Tunnel{}, errors.New("Tunnel domain already in use")
+		if tunnelKey(tunReq) == tunnelKey(tun) {
+			return fmt.Errorf("%w: %s", ErrTunnelExists, tunReq.Domain)
+		}
+
+		// Path routing happens after TLS termination, so tunnels
+		// can only share a domain if the server terminates TLS for
+		// all of them.
+		if tunReq.Domain == tun.Domain && (tunReq.TlsTermination != "server" || tun.TlsTermination != "server") {
+			return fmt.Errorf("%w: %s", ErrTunnelExists, tunReq.Domain)
 		}
 
-		if tunReq.TunnelPort == tun.TunnelPort {
-			return Tunnel{}, errors.New("Tunnel port already in use")
+		if tunReq.TunnelPort != 0 && tunReq.TunnelPort == tun.TunnelPort {
+			return fmt.Errorf("%w: %d", ErrPortInUse, tunReq.TunnelPort)
 		}
 	}
 
-	privKey, err := m.addToAuthorizedKeys(tunReq.Domain, tunReq.TunnelPort, tunReq.AllowExternalTcp)
+	return nil
+}
+
+// checkDomainPointsHere checks that domain resolves, and if the public IP is
+// known, that it resolves to it. Otherwise the ACME challenges would fail.
+func (m *TunnelManager) checkDomainPointsHere(ctx context.Context, domain string) error {
+	addrs, err := m.lookupIp(ctx, domain)
 	if err != nil {
-		return Tunnel{}, err
+		return err
 	}
 
-	tunReq.ServerPublicKey = ""
-	tunReq.Username = m.user.Username
-	tunReq.TunnelPrivateKey = privKey
+	if m.config.PublicIp == "" {
+		return nil
+	}
 
-	m.db.SetTunnel(tunReq.Domain, tunReq)
+	publicIp := net.ParseIP(m.config.PublicIp)
 
-	return tunReq, nil
+	for _, addr := range addrs {
+		if addr.IP.Equal(publicIp) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("%s doesn't resolve to this server (%s)", domain, m.config.PublicIp)
+}
+
+// preflightDns runs checkDomainPointsHere for tunnels the server gets certs
+// for, if config.PreflightDnsCheck is set. A mismatch is only logged unless
+// config.PreflightDnsStrict is set, since the server's public IP isn't
+// always what clients see (ie behind a load balancer).
+func (m *TunnelManager) preflightDns(ctx context.Context, tunReq Tunnel) error {
+	if !m.config.PreflightDnsCheck || !m.config.autoCerts || strings.HasPrefix(tunReq.Domain, "*.") {
+		return nil
+	}
+
+	if tunReq.TlsTermination != "server" && tunReq.TlsTermination != "server-tls" {
+		return nil
+	}
+
+	certConfig, err := m.certConfigForTunnel(tunReq)
+	if err != nil {
+		return &CertError{Domain: tunReq.Domain, Err: err}
+	}
+
+	// Nothing to obtain, ie after PrewarmCert
+	if hasCert(certConfig, tunReq.Domain) {
+		return nil
+	}
+
+	err = m.checkDomainPointsHere(ctx, tunReq.Domain)
+	if err == nil {
+		return nil
+	}
+
+	if m.config.PreflightDnsStrict {
+		return fmt.Errorf("%w: %v", ErrDnsMismatch, err)
+	}
+
+	log.Printf("Warning: %v. Getting a cert will likely fail", err)
+
+	return nil
 }
 
-func (m *TunnelManager) DeleteTunnel(domain string) error {
+// DeleteTunnel deletes the tunnel stored under key (see tunnelKey).
+func (m *TunnelManager) DeleteTunnel(ctx context.Context, key string) error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 
-	tunnel, exists := m.db.GetTunnel(domain)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	tunnel, exists := m.db.GetTunnel(key)
 	if !exists {
-		return errors.New("Tunnel doesn't exist")
+		return fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	m.db.DeleteTunnel(key)
+	m.conns.Forget(key)
+
+	if m.sshServer != nil {
+		m.sshServer.Disconnect(key)
+	}
+
+	if tunnel.TlsTermination == "self-signed" {
+		m.deleteSelfSignedCert(tunnel.Domain)
 	}
 
-	m.db.DeleteTunnel(domain)
+	m.deletePrivateKey(tunnel)
+	m.deleteAcmeAccountKey(tunnel)
 
-	authKeysPath := fmt.Sprintf("%s/.ssh/authorized_keys", m.user.HomeDir)
+	if tunnel.RedirectTo != "" {
+		return nil
+	}
+
+	m.backends.Invalidate(backendAddr(tunnel))
+	m.ports.Release(tunnel.TunnelPort)
+
+	return m.removeFromAuthorizedKeys(tunnel.Username, tunnel.Domain, tunnel.TunnelPort)
+}
 
-	akBytes, err := ioutil.ReadFile(authKeysPath)
+// ReloadTunnels re-reads the database from disk to pick up tunnels that were
+// added or removed by other processes. Certs are obtained for new domains and
+// authorized_keys is updated to match.
+func (m *TunnelManager) ReloadTunnels() error {
+	m.mutex.Lock()
+
+	oldTunnels := m.db.GetTunnels()
+
+	err := m.db.Reload()
 	if err != nil {
+		m.mutex.Unlock()
 		return err
 	}
 
-	akStr := string(akBytes)
+	newTunnels := m.db.GetTunnels()
+
+	m.ports.Reset(m.tunnelPorts())
+
+	for key, old := range oldTunnels {
+		tun, exists := newTunnels[key]
+		if !exists || tun.TunnelPort != old.TunnelPort || tun.Username != old.Username || tun.TunnelPrivateKey != old.TunnelPrivateKey || tun.TunnelPrivateKeyRef != old.TunnelPrivateKeyRef || tun.AllowExternalTcp != old.AllowExternalTcp {
+			log.Printf("Reload: removing authorized key for %s", key)
+			m.backends.Invalidate(backendAddr(old))
+			if m.sshServer != nil {
+				m.sshServer.Disconnect(key)
+			}
+			err := m.removeFromAuthorizedKeys(old.Username, old.Domain, old.TunnelPort)
+			if err != nil {
+				log.Printf("Reload: failed to remove authorized key for %s: %v", key, err)
+			}
+		}
+	}
+
+	newKeys := []string{}
 
-	lines := strings.Split(akStr, "\n")
+	for key, tun := range newTunnels {
+		if _, existed := oldTunnels[key]; !existed {
+			newKeys = append(newKeys, key)
+		}
 
-	tunnelId := fmt.Sprintf("boringproxy-%s-%d", domain, tunnel.TunnelPort)
+		if tun.TunnelPrivateKey == "" && tun.TunnelPrivateKeyRef == "" {
+			continue
+		}
 
-	outLines := []string{}
+		privKey, err := m.privateKey(tun)
+		if err != nil {
+			log.Printf("Reload: failed to get private key for %s: %v", key, err)
+			continue
+		}
 
-	for _, line := range lines {
-		if strings.Contains(line, tunnelId) {
+		pubKey, err := publicKeyFromPrivate(privKey)
+		if err != nil {
+			log.Printf("Reload: invalid private key for %s: %v", key, err)
 			continue
 		}
 
-		outLines = append(outLines, line)
+		err = m.writeAuthorizedKey(tun.Username, tun.Domain, tun.TunnelPort, tunnelBindAddr(tun), pubKey)
+		if err != nil {
+			log.Printf("Reload: failed to add authorized key for %s: %v", key, err)
+		}
+	}
+
+	m.mutex.Unlock()
+
+	newSelfSigned := make(map[string]Tunnel)
+	for _, key := range newKeys {
+		newSelfSigned[key] = newTunnels[key]
 	}
+	m.loadSelfSignedCerts(newSelfSigned)
 
-	outStr := strings.Join(outLines, "\n")
+	if m.config.autoCerts && m.waitForListeners(m.ctx) == nil {
+		for _, key := range newKeys {
+			tun := newTunnels[key]
+			if !m.lazyCert(tun) && (tun.TlsTermination == "server" || tun.TlsTermination == "server-tls") {
+				certConfig, err := m.certConfigForTunnel(tun)
+				if err != nil {
+					log.Printf("Reload: failed to get cert for %s: %v", tun.Domain, err)
+					m.certStatuses.Set(tun.Domain, CertStatusFailed)
+					continue
+				}
 
-	err = ioutil.WriteFile(authKeysPath, []byte(outStr), 0600)
-	if err != nil {
-		return err
+				err = certConfig.ManageSync(m.ctx, []string{tun.Domain})
+				if err != nil {
+					log.Printf("Reload: failed to get cert for %s: %v", tun.Domain, err)
+					if !hasCert(certConfig, tun.Domain) {
+						m.certStatuses.Set(tun.Domain, CertStatusFailed)
+					}
+				}
+			}
+		}
 	}
 
+	log.Printf("Reloaded %d tunnels (%d new)", len(newTunnels), len(newKeys))
+
 	return nil
 }
 
+// CreateClientJoinToken mints a short-lived, single-use token which a client
+// can exchange at /api/join for the connection details of the tunnel for
+// domain. Tokens are only kept in memory.
+func (m *TunnelManager) CreateClientJoinToken(domain string, ttl time.Duration) (string, error) {
+
+	if _, exists := m.db.GetTunnel(domain); !exists {
+		return "", fmt.Errorf("%w: %s", ErrTunnelNotFound, domain)
+	}
+
+	if ttl <= 0 {
+		return "", errors.New("Invalid TTL")
+	}
+
+	token, err := genRandomCode(32)
+	if err != nil {
+		return "", err
+	}
+
+	m.joinMutex.Lock()
+	defer m.joinMutex.Unlock()
+
+	now := time.Now()
+
+	// Clean up expired tokens while we're here
+	for t, jt := range m.joinTokens {
+		if now.After(jt.expires) {
+			delete(m.joinTokens, t)
+		}
+	}
+
+	m.joinTokens[token] = joinToken{
+		domain:  domain,
+		expires: now.Add(ttl),
+	}
+
+	return token, nil
+}
+
+// RedeemClientJoinToken consumes a join token and returns the tunnel it was
+// created for.
+func (m *TunnelManager) RedeemClientJoinToken(token string) (Tunnel, error) {
+	m.joinMutex.Lock()
+	jt, exists := m.joinTokens[token]
+	delete(m.joinTokens, token)
+	m.joinMutex.Unlock()
+
+	if !exists {
+		return Tunnel{}, errors.New("Invalid join token")
+	}
+
+	if time.Now().After(jt.expires) {
+		return Tunnel{}, errors.New("Join token expired")
+	}
+
+	tunnel, exists := m.db.GetTunnel(jt.domain)
+	if !exists {
+		return Tunnel{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, jt.domain)
+	}
+
+	return m.withPrivateKey(tunnel), nil
+}
+
 func (m *TunnelManager) GetPort(domain string) (int, error) {
-	tunnel, exists := m.db.GetTunnel(domain)
+	tunnel, exists := m.routes.Get(domain)
 
 	if !exists {
-		return 0, errors.New("Doesn't exist")
+		return 0, fmt.Errorf("%w: %s", ErrTunnelNotFound, domain)
 	}
 
 	return tunnel.TunnelPort, nil
 }
 
-func (m *TunnelManager) addToAuthorizedKeys(domain string, port int, allowExternalTcp bool) (string, error) {
+// certConfigForTunnel returns the certmagic config used to obtain the cert
+// for tun. Tunnels with their own ACME account settings, or whose owner has
+// them, get a dedicated config per account. Everything else uses the global
+// config. Each account config has its own cert cache, so certmagic renews its
+// certs with the right account, and handshakes for those tunnels need to use
+// its GetCertificate. All configs share the same storage.
+//
+// A tunnel's account key is checked with the CA the first time its config
+// is created. If the key can't be read or the CA doesn't know it, an error
+// is returned and nothing is cached, rather than letting certmagic register
+// a new account under the same email.
+func (m *TunnelManager) certConfigForTunnel(tun Tunnel) (*certmagic.Config, error) {
 
-	authKeysPath := fmt.Sprintf("%s/.ssh/authorized_keys", m.user.HomeDir)
+	user, _ := m.db.GetUser(tun.Owner)
+	if !hasCustomAcmeAccount(tun, user) {
+		return m.certConfig, nil
+	}
 
-	akFile, err := os.OpenFile(authKeysPath, os.O_RDWR|os.O_CREATE, 0600)
-	if err != nil {
-		return "", err
+	email, ca, accountKey := user.AcmeEmail, user.AcmeCa, ""
+
+	if tunnelHasAcmeAccount(tun) {
+		email, ca = tun.AcmeEmail, tun.AcmeCa
+
+		var err error
+		accountKey, err = m.acmeAccountKey(tun)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get ACME account key: %w", err)
+		}
 	}
-	defer akFile.Close()
 
-	akBytes, err := ioutil.ReadAll(akFile)
-	if err != nil {
-		return "", err
+	keyHash := sha256.Sum256([]byte(accountKey))
+	key := fmt.Sprintf("%s|%s|%x", email, ca, keyHash)
+
+	m.issuerMutex.Lock()
+	defer m.issuerMutex.Unlock()
+
+	if certConfig, exists := m.ownerCertConfigs[key]; exists {
+		return certConfig, nil
 	}
 
-	akStr := string(akBytes)
+	var certConfig *certmagic.Config
+	cache := certmagic.NewCache(certmagic.CacheOptions{
+		GetConfigForCert: func(certmagic.Certificate) (*certmagic.Config, error) {
+			return certConfig, nil
+		},
+	})
+	certConfig = certmagic.New(cache, certmagic.Config{
+		Storage: m.certConfig.Storage,
+		OnEvent: m.onCertEvent,
+	})
+	issuer := certmagic.NewACMEManager(certConfig, certmagic.ACMEManager{
+		Email:         email,
+		CA:            ca,
+		AccountKeyPEM: accountKey,
+	})
+	certConfig.Issuers = []certmagic.Issuer{issuer}
 
-	var privKey string
-	var pubKey string
+	// Accounts given only by email are registered by certmagic as needed
+	if accountKey != "" {
+		ctx, cancel := context.WithTimeout(m.ctx, acmeAccountCheckTimeout)
+		defer cancel()
 
-	pubKey, privKey, err = MakeSSHKeyPair()
-	if err != nil {
-		return "", err
+		err := m.checkAcmeAccount(ctx, issuer, accountKey)
+		if err != nil {
+			cache.Stop()
+			return nil, fmt.Errorf("Invalid ACME account for %s: %w", email, err)
+		}
 	}
 
-	pubKey = strings.TrimSpace(pubKey)
+	m.ownerCertConfigs[key] = certConfig
+
+	return certConfig, nil
+}
+
+const acmeAccountCheckTimeout = 30 * time.Second
+
+// checkAcmeAccountWithCa is the default checkAcmeAccount. certmagic's
+// GetAccount finds the account in storage, or asks the CA for it. It never
+// creates one.
+func checkAcmeAccountWithCa(ctx context.Context, issuer *certmagic.ACMEManager, accountKey string) error {
+	_, err := issuer.GetAccount(ctx, []byte(accountKey))
+	return err
+}
+
+func tunnelHasAcmeAccount(tun Tunnel) bool {
+	return tun.AcmeEmail != "" || tun.AcmeCa != "" || tun.AcmeAccountKey != "" || tun.AcmeAccountKeyRef != ""
+}
+
+// hasCustomAcmeAccount reports whether tun's cert comes from an account
+// other than the server's, set either on the tunnel or its owner.
+func hasCustomAcmeAccount(tun Tunnel, owner User) bool {
+	return tunnelHasAcmeAccount(tun) || owner.AcmeEmail != "" || owner.AcmeCa != ""
+}
 
-	bindAddr := "127.0.0.1"
-	if allowExternalTcp {
-		bindAddr = "0.0.0.0"
+// lazyCert reports whether the cert for tun is obtained on demand rather
+// than up front. Tunnels with their own ACME account (or whose owner has
+// one) are excluded, since on-demand certs always come from the server's
+// account. So are wildcard tunnels, which need a managed wildcard cert
+// since AllowCertForDomain doesn't allow the names under them, and tunnels
+// that can fall back to a self-signed cert, since that happens when the
+// tunnel is created.
+func (m *TunnelManager) lazyCert(tun Tunnel) bool {
+	if !m.config.LazyCerts || strings.HasPrefix(tun.Domain, "*.") || m.canFallBackToSelfSigned(tun) {
+		return false
 	}
 
-	options := fmt.Sprintf(`command="echo This key permits tunnels only",permitopen="fakehost:1",permitlisten="%s:%d"`, bindAddr, port)
+	user, _ := m.db.GetUser(tun.Owner)
+	return !hasCustomAcmeAccount(tun, user)
+}
 
-	tunnelId := fmt.Sprintf("boringproxy-%s-%d", domain, port)
+// AllowCertForDomain reports whether a cert may be obtained on demand for
+// domain. Only the exact domains of server-terminated tunnels are allowed,
+// so arbitrary SNI values can't be used to make us request certs. Names
+// under a wildcard tunnel aren't either, since there's no limit to them.
+// Wildcard tunnels get a wildcard cert up front instead (see lazyCert).
+func (m *TunnelManager) AllowCertForDomain(domain string) bool {
+	isServerTerminated := func(tun Tunnel) bool {
+		return tun.TlsTermination == "server" || tun.TlsTermination == "server-tls"
+	}
 
-	newAk := fmt.Sprintf("%s%s %s %s\n", akStr, options, pubKey, tunnelId)
+	// This runs on every handshake for a name that isn't cached yet, so
+	// try the common case of a tunnel without a path prefix first.
+	if tun, exists := m.routes.Get(domain); exists {
+		return isServerTerminated(tun)
+	}
 
-	// Clear the file
-	err = akFile.Truncate(0)
-	if err != nil {
-		return "", err
+	for _, tun := range m.routes.Tunnels() {
+		if tun.Domain == domain && isServerTerminated(tun) {
+			return true
+		}
 	}
-	_, err = akFile.Seek(0, 0)
-	if err != nil {
-		return "", err
+
+	return false
+}
+
+// allowOnDemandCert adapts AllowCertForDomain to certmagic's
+// OnDemandConfig.DecisionFunc.
+func (m *TunnelManager) allowOnDemandCert(name string) error {
+	if !m.AllowCertForDomain(name) {
+		return fmt.Errorf("No tunnel for %s", name)
 	}
+	return nil
+}
 
-	_, err = akFile.Write([]byte(newAk))
+// hasCert checks whether a usable certificate for domain exists in the
+// certmagic storage, loading it into the cache if it does.
+func hasCert(certConfig *certmagic.Config, domain string) bool {
+	cert, err := certConfig.CacheManagedCertificate(domain)
 	if err != nil {
-		return "", err
+		return false
 	}
 
-	return privKey, nil
+	return !cert.Expired()
 }
 
+// Key types supported by MakeSSHKeyPair. "ecdsa" uses P-256.
+var sshKeyTypes = []string{"rsa", "ed25519", "ecdsa", "ecdsa-p384"}
+
+// Private key formats supported by MakeSSHKeyPair
+var sshKeyFormats = []string{"pem", "openssh"}
+
+// RSA keys smaller than this are considered weak. Older versions generated
+// 1024-bit keys.
+const minRsaBits = 2048
+
 // Adapted from https://stackoverflow.com/a/34347463/943814
 // MakeSSHKeyPair make a pair of public and private keys for SSH access.
 // Public key is encoded in the format for inclusion in an OpenSSH authorized_keys file.
-// Private Key generated is PEM encoded
-func MakeSSHKeyPair() (string, string, error) {
-	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
-	if err != nil {
-		return "", "", err
+// Private Key generated is PEM encoded. keyType is one of sshKeyTypes, and
+// defaults to RSA if empty. rsaBits is only used for RSA keys, and defaults
+// to minRsaBits if 0. format is one of sshKeyFormats: "pem" (the default)
+// uses the traditional PKCS#1/PKCS#8/SEC 1 encodings, and "openssh" the
+// format written by ssh-keygen.
+func MakeSSHKeyPair(keyType string, rsaBits int, format string) (string, string, error) {
+
+	var privateKey crypto.Signer
+	var privateKeyPEM *pem.Block
+
+	switch keyType {
+	case "", "rsa":
+		if rsaBits == 0 {
+			rsaBits = minRsaBits
+		}
+		rsaKey, err := rsa.GenerateKey(rand.Reader, rsaBits)
+		if err != nil {
+			return "", "", err
+		}
+		privateKey = rsaKey
+		privateKeyPEM = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}
+	case "ed25519":
+		_, edKey, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(edKey)
+		if err != nil {
+			return "", "", err
+		}
+		privateKey = edKey
+		privateKeyPEM = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	case "ecdsa", "ecdsa-p384":
+		curve := elliptic.P256()
+		if keyType == "ecdsa-p384" {
+			curve = elliptic.P384()
+		}
+		ecKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return "", "", err
+		}
+		der, err := x509.MarshalECPrivateKey(ecKey)
+		if err != nil {
+			return "", "", err
+		}
+		privateKey = ecKey
+		privateKeyPEM = &pem.Block{Type: "EC PRIVATE KEY", Bytes: der}
+	default:
+		return "", "", fmt.Errorf("Unsupported key type %s", keyType)
+	}
+
+	switch format {
+	case "", "pem":
+	case "openssh":
+		var err error
+		privateKeyPEM, err = ssh.MarshalPrivateKey(privateKey, "")
+		if err != nil {
+			return "", "", err
+		}
+	default:
+		return "", "", fmt.Errorf("Unsupported key format %s", format)
 	}
 
 	// generate and write private key as PEM
 	var privKeyBuf strings.Builder
 
-	privateKeyPEM := &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)}
 	if err := pem.Encode(&privKeyBuf, privateKeyPEM); err != nil {
 		return "", "", err
 	}
 
 	// generate and write public key
-	pub, err := ssh.NewPublicKey(&privateKey.PublicKey)
+	pub, err := ssh.NewPublicKey(privateKey.Public())
 	if err != nil {
 		return "", "", err
 	}
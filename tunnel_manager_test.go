@@ -0,0 +1,1057 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func TestAccountCertConfigsHaveTheirOwnCache(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.ownerCertConfigs = make(map[string]*certmagic.Config)
+	m.issuerMutex = &sync.Mutex{}
+
+	m.certConfig = certmagic.NewDefault()
+	m.certConfig.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+
+	err := m.db.SetUser("alice", User{AcmeEmail: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tun := Tunnel{Domain: "alice.example.com", Owner: "alice", TlsTermination: "server"}
+	m.db.SetTunnel(tun.Domain, tun)
+
+	accountConfig, err := m.certConfigForTunnel(tun)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if accountConfig == m.certConfig {
+		t.Fatal("Expected a separate config for the owner's ACME account")
+	}
+	if again, _ := m.certConfigForTunnel(tun); again != accountConfig {
+		t.Error("Expected the account config to be reused")
+	}
+	if accountConfig.Storage != m.certConfig.Storage {
+		t.Error("Expected the account config to share storage")
+	}
+
+	certPem, keyPem, err := makeSelfSignedCert(tun.Domain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := tls.X509KeyPair(certPem, keyPem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = accountConfig.CacheUnmanagedTLSCertificate(cert, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hello := &tls.ClientHelloInfo{ServerName: tun.Domain}
+
+	_, err = m.certConfig.GetCertificate(hello)
+	if err == nil {
+		t.Error("Expected the account's cert not to be in the default cache")
+	}
+
+	p := &Server{db: m.db, tunMan: m, tlsConfig: &tls.Config{GetCertificate: m.certConfig.GetCertificate}}
+
+	tlsConfig, err := p.getTlsConfigForClient(hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig == nil {
+		t.Fatal("Expected a TLS config using the account's cache")
+	}
+
+	_, err = tlsConfig.GetCertificate(hello)
+	if err != nil {
+		t.Errorf("Expected the handshake to find the account's cert: %v", err)
+	}
+}
+
+func TestAccountCertConfigIssuers(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.ownerCertConfigs = make(map[string]*certmagic.Config)
+	m.issuerMutex = &sync.Mutex{}
+
+	m.certConfig = certmagic.NewDefault()
+	m.certConfig.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+
+	err := m.db.SetUser("alice", User{AcmeEmail: "alice@example.com", AcmeCa: "https://alice-ca.example.com/dir"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.db.SetUser("bob", User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		tun   Tunnel
+		email string
+		ca    string
+	}{
+		{
+			name:  "owner's account",
+			tun:   Tunnel{Domain: "alice.example.com", Owner: "alice"},
+			email: "alice@example.com",
+			ca:    "https://alice-ca.example.com/dir",
+		},
+		{
+			name: "tunnel overrides owner",
+			tun: Tunnel{
+				Domain:    "team.example.com",
+				Owner:     "alice",
+				AcmeEmail: "team@example.com",
+				AcmeCa:    "https://team-ca.example.com/dir",
+			},
+			email: "team@example.com",
+			ca:    "https://team-ca.example.com/dir",
+		},
+		{
+			name: "global fallback",
+			tun:  Tunnel{Domain: "bob.example.com", Owner: "bob"},
+		},
+	}
+
+	for _, test := range tests {
+		test.tun.TlsTermination = "server"
+
+		certConfig, err := m.certConfigForTunnel(test.tun)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.email == "" {
+			if certConfig != m.certConfig {
+				t.Errorf("%s: Expected the global config", test.name)
+			}
+			continue
+		}
+
+		if certConfig == m.certConfig {
+			t.Errorf("%s: Expected a separate config", test.name)
+			continue
+		}
+		if len(certConfig.Issuers) != 1 {
+			t.Fatalf("%s: Expected one issuer, got %d", test.name, len(certConfig.Issuers))
+		}
+
+		issuer, ok := certConfig.Issuers[0].(*certmagic.ACMEManager)
+		if !ok {
+			t.Fatalf("%s: Expected an ACME issuer, got %T", test.name, certConfig.Issuers[0])
+		}
+		if issuer.Email != test.email || issuer.CA != test.ca {
+			t.Errorf("%s: Expected account %s at %s, got %s at %s", test.name, test.email, test.ca, issuer.Email, issuer.CA)
+		}
+	}
+}
+
+// testIssuer stands in for the ACME issuer. It signs whatever it's asked
+// to and records when it was, or fails with err if set.
+type testIssuer struct {
+	issued chan string
+	err    error
+}
+
+func (i *testIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	if i.issued != nil {
+		i.issued <- csr.DNSNames[0]
+	}
+
+	if i.err != nil {
+		// Otherwise certmagic keeps retrying
+		return nil, certmagic.ErrNoRetry{Err: i.err}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: csr.DNSNames[0]},
+		DNSNames:     csr.DNSNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, csr.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &certmagic.IssuedCertificate{
+		Certificate: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}, nil
+}
+
+func (i *testIssuer) IssuerKey() string {
+	return "test"
+}
+
+func TestRequestCreateTunnelWaitsForListeners(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.listening = make(chan struct{})
+
+	issuer := &testIssuer{issued: make(chan string, 1)}
+	newTestCertConfig(t, m, issuer)
+
+	type result struct {
+		tun Tunnel
+		err error
+	}
+	created := make(chan result, 1)
+
+	go func() {
+		tun, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+			Domain:         "new.example.com",
+			Owner:          "admin",
+			TlsTermination: "server",
+		})
+		created <- result{tun, err}
+	}()
+
+	select {
+	case domain := <-issuer.issued:
+		t.Fatalf("Cert for %s requested before the listeners were bound", domain)
+	case res := <-created:
+		t.Fatalf("Tunnel created before the listeners were bound: %+v", res)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	m.StartCerts()
+
+	select {
+	case domain := <-issuer.issued:
+		if domain != "new.example.com" {
+			t.Errorf("Unexpected cert requested for %s", domain)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Cert wasn't requested after StartCerts")
+	}
+
+	res := <-created
+	if res.err != nil {
+		t.Fatal(res.err)
+	}
+	if !hasCert(m.certConfig, "new.example.com") {
+		t.Error("Expected the tunnel's cert to be in storage")
+	}
+}
+
+func TestMaxTunnels(t *testing.T) {
+	m := newTestTunnelManager(t)
+	m.config.MaxTunnels = 2
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	create := func(domain string) error {
+		_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+			Domain:         domain,
+			Owner:          "admin",
+			TlsTermination: "client",
+		})
+		return err
+	}
+
+	for _, domain := range []string{"a.example.com", "b.example.com"} {
+		err := create(domain)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = create("c.example.com")
+	if !errors.Is(err, ErrMaxTunnels) {
+		t.Fatalf("Expected ErrMaxTunnels, got %v", err)
+	}
+
+	// Deleting still works, and makes room
+	err = m.DeleteTunnel(context.Background(), "a.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = create("c.example.com")
+	if err != nil {
+		t.Errorf("Expected room for another tunnel after deleting one: %v", err)
+	}
+}
+
+// newTestCertConfig gives m a cert config using issuer, with storage in a
+// temporary directory.
+func TestAcmeAccountErrorsAreNotCached(t *testing.T) {
+	m := newTestTunnelManager(t)
+	newTestCertConfig(t, m, &testIssuer{issued: make(chan string, 1)})
+	m.ownerCertConfigs = make(map[string]*certmagic.Config)
+	m.issuerMutex = &sync.Mutex{}
+
+	// The key is in a secret store that isn't configured
+	tun := Tunnel{
+		Domain:            "ref.example.com",
+		Owner:             "admin",
+		TlsTermination:    "server",
+		AcmeEmail:         "ref@example.com",
+		AcmeAccountKeyRef: "missing",
+	}
+
+	certConfig, err := m.certConfigForTunnel(tun)
+	if err == nil || certConfig != nil {
+		t.Fatal("Expected an error for an unreadable account key")
+	}
+
+	checkErr := errors.New("Account does not exist")
+	checks := 0
+	m.checkAcmeAccount = func(ctx context.Context, issuer *certmagic.ACMEManager, accountKey string) error {
+		checks++
+		if accountKey != "account key" || issuer.Email != "key@example.com" {
+			t.Errorf("Unexpected account %s, %s", issuer.Email, accountKey)
+		}
+		return checkErr
+	}
+
+	tunReq := Tunnel{
+		Domain:         "key.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+		AcmeEmail:      "key@example.com",
+		AcmeAccountKey: "account key",
+	}
+
+	_, err = m.RequestCreateTunnel(context.Background(), tunReq)
+	var certErr *CertError
+	if !errors.As(err, &certErr) || !errors.Is(err, checkErr) {
+		t.Fatalf("Expected a CertError for the rejected account, got %v", err)
+	}
+	if _, exists := m.db.GetTunnel(tunReq.Domain); exists {
+		t.Error("Expected the tunnel not to be created")
+	}
+
+	if len(m.ownerCertConfigs) != 0 {
+		t.Fatalf("Expected nothing cached, got %d configs", len(m.ownerCertConfigs))
+	}
+
+	// Once the CA knows the account, the config is created and cached
+	checkErr = nil
+
+	certConfig, err = m.certConfigForTunnel(tunReq)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again, _ := m.certConfigForTunnel(tunReq); again != certConfig {
+		t.Error("Expected the account config to be cached")
+	}
+	if checks != 2 {
+		t.Errorf("Expected the account to be checked only until it's valid, got %d checks", checks)
+	}
+}
+
+func newTestCertConfig(t *testing.T, m *TunnelManager, issuer certmagic.Issuer) {
+	t.Helper()
+
+	m.config.autoCerts = true
+	m.certConfig = certmagic.NewDefault()
+	m.certConfig.Storage = &certmagic.FileStorage{Path: t.TempDir()}
+	m.certConfig.Issuers = []certmagic.Issuer{issuer}
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSelfSignedFallback(t *testing.T) {
+	for _, allowed := range []bool{false, true} {
+		m := newTestTunnelManager(t)
+		newTestCertConfig(t, m, &testIssuer{err: errors.New("CA unreachable")})
+		m.config.AllowSelfSignedFallback = allowed
+
+		domain := "internal.example.com"
+
+		tun, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+			Domain:         domain,
+			Owner:          "admin",
+			TlsTermination: "server",
+		})
+
+		if !allowed {
+			var certErr *CertError
+			if !errors.As(err, &certErr) {
+				t.Errorf("Expected a CertError without the fallback, got %v", err)
+			}
+			if _, exists := m.db.GetTunnel(domain); exists {
+				t.Error("Tunnel was created without a cert")
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Fatal(err)
+		}
+		if tun.TlsTermination != "self-signed" {
+			t.Errorf("Expected self-signed termination, got %q", tun.TlsTermination)
+		}
+
+		cert, err := m.certConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: domain})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.VerifyHostname(domain) != nil {
+			t.Errorf("Self-signed cert isn't valid for %s", domain)
+		}
+	}
+}
+
+func TestCheckCertStorage(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "certs")
+
+	err := checkCertStorage(&certmagic.FileStorage{Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("Write check left %d files behind", len(entries))
+	}
+
+	// A file where the directory should be can't be fixed by MkdirAll, even
+	// when running as root.
+	blocked := filepath.Join(t.TempDir(), "certs")
+	os.WriteFile(blocked, nil, 0600)
+
+	err = checkCertStorage(&certmagic.FileStorage{Path: filepath.Join(blocked, "acme")})
+	if err == nil || !strings.Contains(err.Error(), blocked) {
+		t.Errorf("Expected an error naming %s, got %v", blocked, err)
+	}
+
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions aren't enforced for root")
+	}
+
+	readOnly := t.TempDir()
+	os.Chmod(readOnly, 0500)
+	defer os.Chmod(readOnly, 0700)
+
+	err = checkCertStorage(&certmagic.FileStorage{Path: readOnly})
+	if err == nil || !strings.Contains(err.Error(), "isn't writable") {
+		t.Errorf("Expected a read-only directory to be rejected, got %v", err)
+	}
+}
+
+func TestStartupCertsOncePerDomain(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	issuer := &testIssuer{issued: make(chan string, 10)}
+	newTestCertConfig(t, m, issuer)
+	m.config.CertConcurrency = 4
+
+	tunnels := map[string]Tunnel{
+		"app.example.com":         {Domain: "app.example.com", TlsTermination: "server"},
+		"app.example.com/api":     {Domain: "app.example.com", PathPrefix: "/api", TlsTermination: "server"},
+		"App.example.com.":        {Domain: "App.example.com.", TlsTermination: "server-tls"},
+		"other.example.com":       {Domain: "other.example.com", TlsTermination: "server"},
+		"passthrough.example.com": {Domain: "passthrough.example.com", TlsTermination: "client"},
+	}
+
+	certTunnels, duplicates := m.startupCertTunnels(tunnels)
+	if len(certTunnels) != 2 || duplicates != 2 {
+		t.Fatalf("Expected 2 domains and 2 duplicates, got %d and %d", len(certTunnels), duplicates)
+	}
+
+	errs := m.manageStartupCerts(context.Background(), tunnels)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+	close(issuer.issued)
+
+	issued := make(map[string]int)
+	for domain := range issuer.issued {
+		issued[domain]++
+	}
+	if len(issued) != 2 || issued["app.example.com"] != 1 || issued["other.example.com"] != 1 {
+		t.Errorf("Expected one cert per domain, got %v", issued)
+	}
+
+	// The certs are in storage now, so they're only loaded on the next
+	// start. The closed channel makes any further Issue call panic.
+	errs = m.manageStartupCerts(context.Background(), tunnels)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	for _, domain := range []string{"app.example.com", "other.example.com"} {
+		if status, _ := m.certStatuses.Get(domain); status != CertStatusManaged {
+			t.Errorf("Expected %s to be managed, got %q", domain, status)
+		}
+	}
+}
+
+// countingIssuer records the most Issue calls that were in flight at once.
+type countingIssuer struct {
+	testIssuer
+	mutex       sync.Mutex
+	inFlight    int
+	maxInFlight int
+}
+
+func (i *countingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	i.mutex.Lock()
+	i.inFlight++
+	if i.inFlight > i.maxInFlight {
+		i.maxInFlight = i.inFlight
+	}
+	i.mutex.Unlock()
+
+	time.Sleep(50 * time.Millisecond)
+
+	i.mutex.Lock()
+	i.inFlight--
+	i.mutex.Unlock()
+
+	return i.testIssuer.Issue(ctx, csr)
+}
+
+func TestStartupCertConcurrency(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	issuer := &countingIssuer{}
+	newTestCertConfig(t, m, issuer)
+	m.config.CertConcurrency = 2
+
+	tunnels := make(map[string]Tunnel)
+	for i := 0; i < 6; i++ {
+		domain := fmt.Sprintf("app%d.example.com", i)
+		tunnels[domain] = Tunnel{Domain: domain, TlsTermination: "server"}
+	}
+
+	errs := m.manageStartupCerts(context.Background(), tunnels)
+	if len(errs) != 0 {
+		t.Fatal(errs)
+	}
+
+	if issuer.maxInFlight != 2 {
+		t.Errorf("Expected 2 certs to be obtained at a time, got %d", issuer.maxInFlight)
+	}
+}
+
+func TestStartupCertErrorsAreAllReported(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	issuer := &countingIssuer{testIssuer: testIssuer{err: errors.New("CA unreachable")}}
+	newTestCertConfig(t, m, issuer)
+	m.config.CertConcurrency = 2
+
+	tunnels := make(map[string]Tunnel)
+	for i := 0; i < 6; i++ {
+		domain := fmt.Sprintf("app%d.example.com", i)
+		tunnels[domain] = Tunnel{Domain: domain, TlsTermination: "server"}
+	}
+
+	errs := m.manageStartupCerts(context.Background(), tunnels)
+
+	failed := make(map[string]bool)
+	for _, err := range errs {
+		var certErr *CertError
+		if !errors.As(err, &certErr) {
+			t.Fatalf("Expected a CertError, got %v", err)
+		}
+		failed[certErr.Domain] = true
+	}
+
+	if len(errs) != len(tunnels) || len(failed) != len(tunnels) {
+		t.Fatalf("Expected an error for each of %d domains, got %v", len(tunnels), errs)
+	}
+
+	for domain := range tunnels {
+		if !failed[domain] {
+			t.Errorf("No error for %s", domain)
+		}
+		if status, _ := m.certStatuses.Get(domain); status != CertStatusFailed {
+			t.Errorf("Expected %s to be marked failed, got %q", domain, status)
+		}
+	}
+}
+
+// blockingIssuer stands in for a CA that never answers. It signals started
+// and waits for the order to be canceled.
+type blockingIssuer struct {
+	testIssuer
+	started chan struct{}
+}
+
+func (i *blockingIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	i.started <- struct{}{}
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestCancelDuringCertReturnsPromptly(t *testing.T) {
+	m := newTestTunnelManager(t)
+	issuer := &blockingIssuer{started: make(chan struct{}, 1)}
+	newTestCertConfig(t, m, issuer)
+
+	// By the caller
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-issuer.started
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := m.RequestCreateTunnel(ctx, Tunnel{
+		Domain:         "slow.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err == nil {
+		t.Fatal("Expected creating the tunnel to fail once canceled")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a prompt return, took %s", elapsed)
+	}
+	if _, exists := m.db.GetTunnel("slow.example.com"); exists {
+		t.Error("Expected the canceled tunnel not to be created")
+	}
+
+	// By shutting down the manager
+	shutdownCtx, shutdown := context.WithCancel(context.Background())
+	m.ctx = shutdownCtx
+	go func() {
+		<-issuer.started
+		shutdown()
+	}()
+
+	start = time.Now()
+	errs := m.manageStartupCerts(m.ctx, map[string]Tunnel{
+		"startup.example.com": {Domain: "startup.example.com", TlsTermination: "server"},
+	})
+	if len(errs) != 1 {
+		t.Errorf("Expected the canceled cert to be reported, got %v", errs)
+	}
+
+	_, err = m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         "after.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err == nil {
+		t.Error("Expected creating a tunnel after shutdown to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected a prompt return after shutdown, took %s", elapsed)
+	}
+}
+
+func TestGetTunnelDetails(t *testing.T) {
+	m := newTestTunnelManager(t)
+	newTestCertConfig(t, m, &testIssuer{})
+	m.certConfig.OnEvent = m.onCertEvent
+
+	created, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         "app.example.com",
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.conns.CountRequest("app.example.com")
+	m.conns.CountRequest("app.example.com")
+
+	tun, exists := m.GetTunnelDetails("app.example.com")
+	if !exists {
+		t.Fatal("Expected details for an existing tunnel")
+	}
+
+	if tun.Domain != "app.example.com" || tun.TunnelPort != created.TunnelPort {
+		t.Errorf("Unexpected tunnel %s on port %d", tun.Domain, tun.TunnelPort)
+	}
+	if tun.TunnelPrivateKey == "" || tun.TunnelPrivateKey != created.TunnelPrivateKey {
+		t.Error("Expected the tunnel's private key")
+	}
+	if tun.Connected {
+		t.Error("Expected the tunnel not to be connected")
+	}
+	if tun.MatchedRequests != 2 {
+		t.Errorf("Expected 2 matched requests, got %d", tun.MatchedRequests)
+	}
+	if tun.CertStatus != CertStatusManaged {
+		t.Errorf("Expected a managed cert, got %q", tun.CertStatus)
+	}
+	if tun.Stats == nil || tun.Stats.CertExpiry.Before(time.Now()) {
+		t.Errorf("Expected stats with the cert's expiry, got %+v", tun.Stats)
+	}
+
+	tun, exists = m.GetTunnelDetails("missing.example.com")
+	if exists {
+		t.Error("Expected no details for a missing tunnel")
+	}
+	if tun.Domain != "" || tun.Stats != nil {
+		t.Errorf("Expected an empty tunnel, got %+v", tun)
+	}
+}
+
+func TestTunnelManagerErrors(t *testing.T) {
+	m := newTestTunnelManager(t)
+	newTestCertConfig(t, m, &testIssuer{err: errors.New("CA unreachable")})
+
+	ctx := context.Background()
+
+	created, err := m.RequestCreateTunnel(ctx, Tunnel{Domain: "app.example.com", Owner: "admin", TlsTermination: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = m.RequestCreateTunnel(ctx, Tunnel{Domain: "app.example.com", Owner: "admin", TlsTermination: "client"})
+	if !errors.Is(err, ErrTunnelExists) {
+		t.Errorf("Expected ErrTunnelExists, got %v", err)
+	}
+
+	_, err = m.RequestCreateTunnel(ctx, Tunnel{
+		Domain:         "other.example.com",
+		Owner:          "admin",
+		TlsTermination: "client",
+		TunnelPort:     created.TunnelPort,
+	})
+	if !errors.Is(err, ErrPortInUse) {
+		t.Errorf("Expected ErrPortInUse, got %v", err)
+	}
+
+	err = m.DeleteTunnel(ctx, "missing.example.com")
+	if !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("Expected ErrTunnelNotFound from DeleteTunnel, got %v", err)
+	}
+
+	_, err = m.UpdateTunnel("missing.example.com", func(tun *Tunnel) error { return nil })
+	if !errors.Is(err, ErrTunnelNotFound) {
+		t.Errorf("Expected ErrTunnelNotFound from UpdateTunnel, got %v", err)
+	}
+
+	_, err = m.RequestCreateTunnel(ctx, Tunnel{Domain: "cert.example.com", Owner: "admin", TlsTermination: "server"})
+	var certErr *CertError
+	if !errors.Is(err, ErrCertFailed) || !errors.As(err, &certErr) || certErr.Domain != "cert.example.com" {
+		t.Errorf("Expected a CertError for cert.example.com, got %v", err)
+	}
+}
+
+func TestManagerStats(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	err := m.db.SetUser("alice", User{AcmeEmail: "alice@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.db.SetUser("bob", User{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tunnels := []Tunnel{
+		{Domain: "a.example.com", Owner: "alice", TunnelPort: 20001, TlsTermination: "server"},
+		{Domain: "b.example.com", Owner: "alice", TunnelPort: 20002, TlsTermination: "passthrough"},
+		{Domain: "c.example.com", Owner: "bob", TunnelPort: 20003, TlsTermination: "server"},
+		{Domain: "d.example.com", Owner: "bob", TunnelPort: 20004, TlsTermination: "server-tls", AcmeEmail: "d@example.com"},
+	}
+	for _, tun := range tunnels {
+		m.db.SetTunnel(tunnelKey(tun), tun)
+	}
+
+	m.conns.SetConnected(20001, true)
+	m.conns.SetConnected(20003, true)
+
+	atomic.AddInt64(&m.conns.counter("a.example.com").bytesIn, 100)
+	atomic.AddInt64(&m.conns.counter("a.example.com").bytesOut, 1000)
+	atomic.AddInt64(&m.conns.counter("c.example.com").bytesIn, 50)
+
+	stats, err := m.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if stats.Tunnels != 4 {
+		t.Errorf("Expected 4 tunnels, got %d", stats.Tunnels)
+	}
+	if stats.TunnelsByOwner["alice"] != 2 || stats.TunnelsByOwner["bob"] != 2 {
+		t.Errorf("Unexpected tunnels by owner %v", stats.TunnelsByOwner)
+	}
+	if p := stats.TunnelsByProtocol; p["server"] != 2 || p["passthrough"] != 1 || p["server-tls"] != 1 {
+		t.Errorf("Unexpected tunnels by protocol %v", p)
+	}
+	// alice's server tunnel, and d's own account. Passthrough tunnels
+	// don't get a cert at all.
+	if stats.CustomCerts != 2 {
+		t.Errorf("Expected 2 custom certs, got %d", stats.CustomCerts)
+	}
+	if stats.Healthy != 2 {
+		t.Errorf("Expected 2 healthy tunnels, got %d", stats.Healthy)
+	}
+	if stats.BytesIn != 150 || stats.BytesOut != 1000 {
+		t.Errorf("Expected 150 bytes in and 1000 out, got %d and %d", stats.BytesIn, stats.BytesOut)
+	}
+}
+
+func TestOnDemandDecider(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	tunnels := []Tunnel{
+		{Domain: "app.example.com", TunnelPort: 20001, TlsTermination: "server"},
+		{Domain: "tls.example.com", TunnelPort: 20002, TlsTermination: "server-tls"},
+		{Domain: "paths.example.com", PathPrefix: "/api", TunnelPort: 20003, TlsTermination: "server"},
+		{Domain: "passthrough.example.com", TunnelPort: 20004, TlsTermination: "passthrough"},
+		{Domain: "client.example.com", TunnelPort: 20005, TlsTermination: "client"},
+	}
+	for _, tun := range tunnels {
+		m.db.SetTunnel(tunnelKey(tun), tun)
+	}
+
+	cases := []struct {
+		name    string
+		allowed bool
+	}{
+		{"app.example.com", true},
+		{"tls.example.com", true},
+		// Only has a tunnel under a path prefix
+		{"paths.example.com", true},
+		// The client or backend has the cert
+		{"passthrough.example.com", false},
+		{"client.example.com", false},
+		{"unknown.example.com", false},
+		{"sub.app.example.com", false},
+		{"", false},
+	}
+
+	for _, c := range cases {
+		err := m.allowOnDemandCert(c.name)
+		if c.allowed && err != nil {
+			t.Errorf("Expected %q to be allowed, got %v", c.name, err)
+		}
+		if !c.allowed && err == nil {
+			t.Errorf("Expected %q to be rejected", c.name)
+		}
+	}
+
+	// Deleted tunnels stop being allowed
+	m.db.DeleteTunnel("app.example.com")
+	if m.allowOnDemandCert("app.example.com") == nil {
+		t.Error("Expected a deleted tunnel's domain to be rejected")
+	}
+}
+
+func TestPrewarmedCertIsReused(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	issuer := &testIssuer{issued: make(chan string, 2)}
+	newTestCertConfig(t, m, issuer)
+
+	domain := "new.example.com"
+
+	for i := 0; i < 2; i++ {
+		err := m.PrewarmCert(context.Background(), domain, "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(issuer.issued) != 1 {
+		t.Fatalf("Expected prewarming twice to obtain 1 cert, got %d", len(issuer.issued))
+	}
+
+	_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         domain,
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(issuer.issued) != 1 {
+		t.Errorf("Expected the tunnel to use the prewarmed cert, but another was obtained")
+	}
+
+	if status, _ := m.certStatuses.Get(domain); status != CertStatusManaged {
+		t.Errorf("Expected the prewarmed cert to be managed once the tunnel exists, got %q", status)
+	}
+}
+
+func TestPrewarmCertWithoutAutoCerts(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	err := m.PrewarmCert(context.Background(), "new.example.com", "admin")
+	if err == nil {
+		t.Error("Expected prewarming to fail when the server doesn't manage certs")
+	}
+}
+
+func TestPreflightDns(t *testing.T) {
+	newManager := func(strict bool) (*TunnelManager, *testIssuer) {
+		m := newTestTunnelManager(t)
+
+		issuer := &testIssuer{issued: make(chan string, 10)}
+		newTestCertConfig(t, m, issuer)
+
+		m.config.PreflightDnsCheck = true
+		m.config.PreflightDnsStrict = strict
+		m.config.PublicIp = "203.0.113.10"
+		m.lookupIp = func(ctx context.Context, host string) ([]net.IPAddr, error) {
+			switch host {
+			case "right.example.com":
+				return []net.IPAddr{{IP: net.ParseIP("203.0.113.10")}}, nil
+			case "wrong.example.com":
+				return []net.IPAddr{{IP: net.ParseIP("198.51.100.1")}}, nil
+			}
+			t.Errorf("Unexpected lookup for %s", host)
+			return nil, errors.New("no such host")
+		}
+
+		return m, issuer
+	}
+
+	create := func(m *TunnelManager, domain, tlsTermination string) error {
+		_, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+			Domain:         domain,
+			Owner:          "admin",
+			TlsTermination: tlsTermination,
+		})
+		return err
+	}
+
+	m, issuer := newManager(true)
+
+	err := create(m, "wrong.example.com", "server")
+	if !errors.Is(err, ErrDnsMismatch) {
+		t.Fatalf("Expected ErrDnsMismatch, got %v", err)
+	}
+	if len(issuer.issued) != 0 {
+		t.Error("Expected no cert to be requested for a mismatched domain")
+	}
+	if _, exists := m.db.GetTunnel("wrong.example.com"); exists {
+		t.Error("Expected the tunnel not to be created")
+	}
+
+	err = create(m, "right.example.com", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No cert, so no lookup
+	err = create(m, "passthrough.example.com", "client")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without strict mode the mismatch is only logged
+	m, issuer = newManager(false)
+
+	err = create(m, "wrong.example.com", "server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issuer.issued) != 1 {
+		t.Error("Expected a cert to be requested anyway")
+	}
+}
+
+// partialIssuer stores a cert for the domain it's asked for but reports a
+// failure anyway, like ManageSync does when only part of a batch succeeds.
+type partialIssuer struct {
+	storage certmagic.Storage
+}
+
+func (i *partialIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*certmagic.IssuedCertificate, error) {
+	domain := csr.DNSNames[0]
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: domain},
+		DNSNames:     []string{domain},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(90 * 24 * time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	i.storage.Store(certmagic.StorageKeys.SiteCert(i.IssuerKey(), domain), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+	i.storage.Store(certmagic.StorageKeys.SitePrivateKey(i.IssuerKey(), domain), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}))
+	i.storage.Store(certmagic.StorageKeys.SiteMeta(i.IssuerKey(), domain), []byte("{}"))
+
+	return nil, certmagic.ErrNoRetry{Err: errors.New("order for another domain failed")}
+}
+
+func (i *partialIssuer) IssuerKey() string {
+	return "test"
+}
+
+func TestCreateTunnelAfterPartialCertSuccess(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	issuer := &partialIssuer{}
+	newTestCertConfig(t, m, issuer)
+	issuer.storage = m.certConfig.Storage
+
+	domain := "new.example.com"
+
+	tun, err := m.RequestCreateTunnel(context.Background(), Tunnel{
+		Domain:         domain,
+		Owner:          "admin",
+		TlsTermination: "server",
+	})
+	if err != nil {
+		t.Fatalf("Expected the tunnel to be created since its cert is in storage: %v", err)
+	}
+
+	if tun.TlsTermination != "server" {
+		t.Errorf("Expected the stored cert to be used rather than a fallback, got %s", tun.TlsTermination)
+	}
+
+	if status, _ := m.certStatuses.Get(domain); status == CertStatusFailed {
+		t.Error("Expected the cert not to be reported as failed")
+	}
+}
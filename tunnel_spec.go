@@ -0,0 +1,408 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// TunnelSpec is the declarative description of a tunnel used by the
+// "tunnels export" and "tunnels apply" commands. It intentionally leaves out
+// anything secret (keys, passwords) or assigned by the server (ports), so
+// specs can be committed to version control.
+type TunnelSpec struct {
+	Domain           string `json:"domain"`
+	PathPrefix       string `json:"pathPrefix,omitempty"`
+	StripPrefix      bool   `json:"stripPrefix,omitempty"`
+	Owner            string `json:"owner"`
+	ClientName       string `json:"clientName,omitempty"`
+	ClientAddress    string `json:"clientAddr,omitempty"`
+	ClientPort       int    `json:"clientPort,omitempty"`
+	TlsTermination   string `json:"tlsTermination"`
+	AllowExternalTcp bool   `json:"allowExternalTcp,omitempty"`
+	Pinned           bool   `json:"pinned,omitempty"`
+}
+
+func tunnelToSpec(tun Tunnel) TunnelSpec {
+	return TunnelSpec{
+		Domain:           tun.Domain,
+		PathPrefix:       tun.PathPrefix,
+		StripPrefix:      tun.StripPrefix,
+		Owner:            tun.Owner,
+		ClientName:       tun.ClientName,
+		ClientAddress:    tun.ClientAddress,
+		ClientPort:       tun.ClientPort,
+		TlsTermination:   tun.TlsTermination,
+		AllowExternalTcp: tun.AllowExternalTcp,
+		Pinned:           tun.Pinned,
+	}
+}
+
+// specKey identifies the tunnel a spec describes, matching the server's
+// tunnel keys.
+func specKey(spec TunnelSpec) string {
+	return spec.Domain + spec.PathPrefix
+}
+
+// ExportTunnels retrieves all the tunnels visible to token from the server
+// and returns them as specs, sorted by domain and path prefix.
+func ExportTunnels(server, token string) ([]TunnelSpec, error) {
+	url := fmt.Sprintf("https://%s/api/tunnels", server)
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Failed to get tunnels. HTTP Status code: %d. Message: %s", resp.StatusCode, string(body))
+	}
+
+	tunnels := make(map[string]Tunnel)
+	err = json.Unmarshal(body, &tunnels)
+	if err != nil {
+		return nil, err
+	}
+
+	specs := []TunnelSpec{}
+	for _, tun := range tunnels {
+		specs = append(specs, tunnelToSpec(tun))
+	}
+
+	sort.Slice(specs, func(i, j int) bool {
+		return specKey(specs[i]) < specKey(specs[j])
+	})
+
+	return specs, nil
+}
+
+// TunnelChanges lists the tunnels, by key, that ApplyTunnels creates,
+// updates, and deletes. Applied is false for dry runs and when
+// there's nothing to change.
+type TunnelChanges struct {
+	Create  []string       `json:"create"`
+	Update  []TunnelUpdate `json:"update"`
+	Delete  []string       `json:"delete"`
+	Applied bool           `json:"applied"`
+}
+
+// TunnelUpdate describes the changes to an existing tunnel. Recreate is set
+// when a changed field can't be modified in place, in which case the tunnel
+// is deleted and created again, and gets a new key and port.
+type TunnelUpdate struct {
+	Key      string   `json:"key"`
+	Changes  []string `json:"changes"`
+	Recreate bool     `json:"recreate"`
+}
+
+// ApplyTunnels makes the tunnels visible to token match specs, creating,
+// updating, and deleting tunnels as needed. The planned changes are
+// written to out before anything is modified, and returned. If dryRun is
+// set, nothing is modified. If applying fails partway, the returned changes
+// are the ones that were planned.
+func ApplyTunnels(server, token string, specs []TunnelSpec, dryRun bool, out io.Writer) (*TunnelChanges, error) {
+
+	desired := make(map[string]TunnelSpec)
+	for _, spec := range specs {
+		if spec.Domain == "" {
+			return nil, fmt.Errorf("Tunnel spec missing domain")
+		}
+
+		if _, exists := desired[specKey(spec)]; exists {
+			return nil, fmt.Errorf("Duplicate tunnel spec for %s", specKey(spec))
+		}
+
+		desired[specKey(spec)] = spec
+	}
+
+	currentSpecs, err := ExportTunnels(server, token)
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]TunnelSpec)
+	for _, spec := range currentSpecs {
+		current[specKey(spec)] = spec
+	}
+
+	var creates, updates, deletes []string
+
+	for key, spec := range desired {
+		cur, exists := current[key]
+		if !exists {
+			creates = append(creates, key)
+		} else if cur != spec {
+			updates = append(updates, key)
+		}
+	}
+
+	for key := range current {
+		if _, exists := desired[key]; !exists {
+			deletes = append(deletes, key)
+		}
+	}
+
+	sort.Strings(creates)
+	sort.Strings(updates)
+	sort.Strings(deletes)
+
+	changes := &TunnelChanges{
+		Create: []string{},
+		Update: []TunnelUpdate{},
+		Delete: []string{},
+	}
+
+	for _, key := range creates {
+		fmt.Fprintf(out, "+ %s\n", key)
+		changes.Create = append(changes.Create, key)
+	}
+	for _, key := range updates {
+		diff := specDiff(current[key], desired[key])
+		recreate := specNeedsRecreate(current[key], desired[key])
+		if recreate {
+			fmt.Fprintf(out, "-/+ %s (%s)\n", key, strings.Join(diff, ", "))
+		} else {
+			fmt.Fprintf(out, "~ %s (%s)\n", key, strings.Join(diff, ", "))
+		}
+		changes.Update = append(changes.Update, TunnelUpdate{key, diff, recreate})
+	}
+	for _, key := range deletes {
+		fmt.Fprintf(out, "- %s\n", key)
+		changes.Delete = append(changes.Delete, key)
+	}
+
+	if len(creates) == 0 && len(updates) == 0 && len(deletes) == 0 {
+		fmt.Fprintln(out, "No changes")
+		return changes, nil
+	}
+
+	if dryRun {
+		return changes, nil
+	}
+
+	for _, key := range deletes {
+		err := apiDeleteTunnel(server, token, key)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	for _, update := range changes.Update {
+		key := update.Key
+
+		if !update.Recreate {
+			err := apiUpdateTunnel(server, token, key, current[key], desired[key])
+			if err != nil {
+				return changes, err
+			}
+			continue
+		}
+
+		err := apiDeleteTunnel(server, token, key)
+		if err != nil {
+			return changes, err
+		}
+
+		err = apiCreateTunnel(server, token, desired[key])
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	for _, key := range creates {
+		err := apiCreateTunnel(server, token, desired[key])
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	changes.Applied = true
+
+	return changes, nil
+}
+
+func specDiff(a, b TunnelSpec) []string {
+	diffs := []string{}
+
+	if a.Owner != b.Owner {
+		diffs = append(diffs, fmt.Sprintf("owner: %s -> %s", a.Owner, b.Owner))
+	}
+	if a.ClientName != b.ClientName {
+		diffs = append(diffs, fmt.Sprintf("clientName: %s -> %s", a.ClientName, b.ClientName))
+	}
+	if a.ClientAddress != b.ClientAddress {
+		diffs = append(diffs, fmt.Sprintf("clientAddr: %s -> %s", a.ClientAddress, b.ClientAddress))
+	}
+	if a.ClientPort != b.ClientPort {
+		diffs = append(diffs, fmt.Sprintf("clientPort: %d -> %d", a.ClientPort, b.ClientPort))
+	}
+	if a.TlsTermination != b.TlsTermination {
+		diffs = append(diffs, fmt.Sprintf("tlsTermination: %s -> %s", a.TlsTermination, b.TlsTermination))
+	}
+	if a.StripPrefix != b.StripPrefix {
+		diffs = append(diffs, fmt.Sprintf("stripPrefix: %t -> %t", a.StripPrefix, b.StripPrefix))
+	}
+	if a.AllowExternalTcp != b.AllowExternalTcp {
+		diffs = append(diffs, fmt.Sprintf("allowExternalTcp: %t -> %t", a.AllowExternalTcp, b.AllowExternalTcp))
+	}
+	if a.Pinned != b.Pinned {
+		diffs = append(diffs, fmt.Sprintf("pinned: %t -> %t", a.Pinned, b.Pinned))
+	}
+
+	return diffs
+}
+
+// specNeedsRecreate reports whether changing a tunnel from a to b requires
+// deleting and recreating it. The owner, TLS termination and external TCP
+// settings are fixed when a tunnel is created. Clearing the client address or
+// port is also done by recreating, so the owner's tunnel defaults apply.
+func specNeedsRecreate(a, b TunnelSpec) bool {
+	return a.Owner != b.Owner ||
+		a.TlsTermination != b.TlsTermination ||
+		a.AllowExternalTcp != b.AllowExternalTcp ||
+		(a.ClientAddress != b.ClientAddress && b.ClientAddress == "") ||
+		(a.ClientPort != b.ClientPort && b.ClientPort == 0)
+}
+
+// apiUpdateTunnel changes the fields that differ between cur and spec with a
+// PATCH, which keeps the tunnel's key and port.
+func apiUpdateTunnel(server, token, key string, cur, spec TunnelSpec) error {
+	params := url.Values{}
+	params.Set("domain", key)
+	if cur.ClientName != spec.ClientName {
+		params.Set("client-name", spec.ClientName)
+	}
+	if cur.ClientAddress != spec.ClientAddress {
+		params.Set("client-addr", spec.ClientAddress)
+	}
+	if cur.ClientPort != spec.ClientPort {
+		params.Set("client-port", strconv.Itoa(spec.ClientPort))
+	}
+	if cur.StripPrefix != spec.StripPrefix {
+		params.Set("strip-prefix", strconv.FormatBool(spec.StripPrefix))
+	}
+	if cur.Pinned != spec.Pinned {
+		params.Set("pinned", strconv.FormatBool(spec.Pinned))
+	}
+
+	return apiTunnelRequest("PATCH", server, token, params)
+}
+
+func apiCreateTunnel(server, token string, spec TunnelSpec) error {
+	params := url.Values{}
+	params.Set("domain", spec.Domain)
+	params.Set("owner", spec.Owner)
+	params.Set("client-port", strconv.Itoa(spec.ClientPort))
+	// Leave out unset fields, so the owner's tunnel defaults apply
+	setIfNotEmpty(params, "client-name", spec.ClientName)
+	setIfNotEmpty(params, "client-addr", spec.ClientAddress)
+	setIfNotEmpty(params, "tls-termination", spec.TlsTermination)
+	setIfNotEmpty(params, "path-prefix", spec.PathPrefix)
+	if spec.StripPrefix {
+		params.Set("strip-prefix", "on")
+	}
+	if spec.AllowExternalTcp {
+		params.Set("allow-external-tcp", "on")
+	}
+	if spec.Pinned {
+		params.Set("pinned", "on")
+	}
+
+	return apiTunnelRequest("POST", server, token, params)
+}
+
+func setIfNotEmpty(params url.Values, name, value string) {
+	if value != "" {
+		params.Set(name, value)
+	}
+}
+
+func apiDeleteTunnel(server, token, key string) error {
+	params := url.Values{}
+	params.Set("domain", key)
+	return apiTunnelRequest("DELETE", server, token, params)
+}
+
+// CreateRemoteTunnel creates a tunnel on server, taking the same parameters
+// as the /api/tunnels POST, and returns it.
+func CreateRemoteTunnel(server, token string, params url.Values) (Tunnel, error) {
+	return apiTunnelResult("POST", server, token, "tunnels", params)
+}
+
+// DeleteRemoteTunnel deletes the tunnel stored under key on server.
+func DeleteRemoteTunnel(server, token, key string) error {
+	return apiDeleteTunnel(server, token, key)
+}
+
+// RotateRemoteTunnelKey replaces the private key of the tunnel stored under
+// key on server, and returns the updated tunnel.
+func RotateRemoteTunnelKey(server, token, key string) (Tunnel, error) {
+	params := url.Values{}
+	params.Set("domain", key)
+	return apiTunnelResult("POST", server, token, "rotate-key", params)
+}
+
+func apiTunnelResult(method, server, token, path string, params url.Values) (Tunnel, error) {
+	body, err := apiRequest(method, server, token, path, params)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	var tunnel Tunnel
+	err = json.Unmarshal(body, &tunnel)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	return tunnel, nil
+}
+
+func apiTunnelRequest(method, server, token string, params url.Values) error {
+	_, err := apiRequest(method, server, token, "tunnels", params)
+	return err
+}
+
+func apiRequest(method, server, token, path string, params url.Values) ([]byte, error) {
+	url := fmt.Sprintf("https://%s/api/%s?%s", server, path, params.Encode())
+
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Authorization", "bearer "+token)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("%s %s failed. HTTP Status code: %d. Message: %s", method, params.Get("domain"), resp.StatusCode, string(body))
+	}
+
+	return body, nil
+}
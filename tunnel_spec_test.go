@@ -0,0 +1,101 @@
+package boringproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestApplyTunnelsUpdatesInPlace(t *testing.T) {
+	current := map[string]Tunnel{
+		"a.example.com": {
+			Domain:         "a.example.com",
+			Owner:          "admin",
+			ClientName:     "laptop",
+			ClientAddress:  "127.0.0.1",
+			ClientPort:     8080,
+			TlsTermination: "server",
+		},
+		"b.example.com": {
+			Domain:         "b.example.com",
+			Owner:          "admin",
+			ClientAddress:  "127.0.0.1",
+			ClientPort:     9090,
+			TlsTermination: "server",
+		},
+	}
+
+	var mutex sync.Mutex
+	var requests []string
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(current)
+			return
+		}
+
+		r.ParseForm()
+		mutex.Lock()
+		requests = append(requests, r.Method+" "+r.Form.Encode())
+		mutex.Unlock()
+	}))
+	defer server.Close()
+
+	defaultClient := http.DefaultClient
+	http.DefaultClient = server.Client()
+	defer func() { http.DefaultClient = defaultClient }()
+
+	specs := []TunnelSpec{
+		// Client port and pinned can be changed in place
+		{
+			Domain:         "a.example.com",
+			Owner:          "admin",
+			ClientName:     "laptop",
+			ClientAddress:  "127.0.0.1",
+			ClientPort:     8081,
+			TlsTermination: "server",
+			Pinned:         true,
+		},
+		// TLS termination can't
+		{
+			Domain:         "b.example.com",
+			Owner:          "admin",
+			ClientAddress:  "127.0.0.1",
+			ClientPort:     9090,
+			TlsTermination: "client",
+		},
+	}
+
+	addr := strings.TrimPrefix(server.URL, "https://")
+
+	changes, err := ApplyTunnels(addr, "token", specs, false, ioutil.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !changes.Applied || len(changes.Update) != 2 {
+		t.Fatalf("Unexpected changes: %+v", changes)
+	}
+	if changes.Update[0].Recreate || !changes.Update[1].Recreate {
+		t.Errorf("Expected only b.example.com to be recreated, got %+v", changes.Update)
+	}
+
+	expected := []string{
+		"PATCH client-port=8081&domain=a.example.com&pinned=true",
+		"DELETE domain=b.example.com",
+		"POST client-addr=127.0.0.1&client-port=9090&domain=b.example.com&owner=admin&tls-termination=client",
+	}
+
+	if len(requests) != len(expected) {
+		t.Fatalf("Expected requests %v, got %v", expected, requests)
+	}
+	for i := range expected {
+		if requests[i] != expected[i] {
+			t.Errorf("Request %d: expected %q, got %q", i, expected[i], requests[i])
+		}
+	}
+}
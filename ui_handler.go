@@ -1,15 +1,17 @@
 package boringproxy
 
 import (
+	"context"
 	"embed"
 	"encoding/base64"
+	"errors"
 	//"encoding/json"
 	"fmt"
 	qrcode "github.com/skip2/go-qrcode"
 	"html/template"
 	"io"
 	"net/http"
-	//"net/url"
+	"net/url"
 	//"os"
 	"strings"
 	"sync"
@@ -40,6 +42,9 @@ type ConfirmData struct {
 	Message    string
 	ConfirmUrl string
 	CancelUrl  string
+	// Optional second confirm button
+	AltConfirmUrl   string
+	AltConfirmLabel string
 }
 
 type LoadingData struct {
@@ -95,6 +100,12 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 		return
 	}
 
+	if len(tokenData.Domains) > 0 {
+		w.WriteHeader(403)
+		h.alertDialog(w, r, "This token is limited to specific tunnels and cannot be used for the web UI", "/")
+		return
+	}
+
 	user, _ := h.db.GetUser(tokenData.Owner)
 
 	tunnels := h.api.GetTunnels(tokenData)
@@ -149,6 +160,14 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 			CancelUrl:  "/tunnels",
 		}
 
+		if tun, exists := h.db.GetTunnel(domain); exists && tun.Companion != "" {
+			if _, exists := h.db.GetTunnel(tun.Companion); exists {
+				data.Message = fmt.Sprintf("Are you sure you want to delete %s? %s redirects to it.", domain, tun.Companion)
+				data.AltConfirmUrl = fmt.Sprintf("/delete-tunnel?domain=%s&delete-companion=true", domain)
+				data.AltConfirmLabel = "Delete Both"
+			}
+		}
+
 		h.tmpl.ExecuteTemplate(w, "confirm.tmpl", data)
 
 	case "/edit-tunnel":
@@ -167,15 +186,17 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 		}
 
 		templateData := struct {
-			Domain string
-			UserId string
-			User   User
-			Users  map[string]User
+			Domain  string
+			UserId  string
+			User    User
+			Users   map[string]User
+			Presets []string
 		}{
-			Domain: domain,
-			UserId: tokenData.Owner,
-			User:   user,
-			Users:  users,
+			Domain:  domain,
+			UserId:  tokenData.Owner,
+			User:    user,
+			Users:   users,
+			Presets: presetNames(h.config.TunnelPresets),
 		}
 
 		err = h.tmpl.ExecuteTemplate(w, "edit_tunnel.tmpl", templateData)
@@ -189,7 +210,7 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		r.ParseForm()
 
-		err := h.api.DeleteTunnel(tokenData, r.Form)
+		err := h.api.DeleteTunnel(r.Context(), tokenData, r.Form)
 		if err != nil {
 			w.WriteHeader(400)
 			h.alertDialog(w, r, err.Error(), "/tunnels")
@@ -198,8 +219,46 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 		http.Redirect(w, r, "/tunnels", 303)
 
+	case "/edit-tunnel-description", "/edit-tunnel-backend":
+
+		r.ParseForm()
+
+		_, err := h.api.UpdateTunnel(tokenData, r.Form)
+		if err != nil {
+			w.WriteHeader(400)
+			h.alertDialog(w, r, err.Error(), "/tunnels")
+			return
+		}
+
+		http.Redirect(w, r, "/tunnels/"+tunnelKeyParam(r.Form), 303)
+
+	case "/pin-tunnel":
+
+		if r.Method != "POST" {
+			w.WriteHeader(405)
+			h.alertDialog(w, r, "Invalid method for pin-tunnel", "/tunnels")
+			return
+		}
+
+		r.ParseForm()
+
+		err := h.api.SetTunnelPinned(tokenData, r.Form)
+		if err != nil {
+			w.WriteHeader(400)
+			h.alertDialog(w, r, err.Error(), "/tunnels")
+			return
+		}
+
+		http.Redirect(w, r, "/tunnels/"+tunnelKeyParam(r.Form), 303)
+
 	case "/tunnel-private-key":
 
+		if !tokenData.CanModify() {
+			w.WriteHeader(403)
+			h.alertDialog(w, r, "Read-only tokens can't download private keys", "/tunnels")
+			return
+		}
+
 		r.ParseForm()
 
 		tun, err := h.api.GetTunnel(tokenData, r.Form)
@@ -234,6 +293,11 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 			return
 		}
 	case "/tokens":
+		if !tokenData.CanModify() {
+			w.WriteHeader(403)
+			h.alertDialog(w, r, "Read-only tokens can't manage tokens", "/tunnels")
+			return
+		}
 		h.handleTokens(w, r, user, tokenData)
 	case "/clients":
 		h.handleClients(w, r, user, tokenData)
@@ -289,17 +353,16 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 
 			r.ParseForm()
 
-			parts := strings.Split(r.URL.Path, "/")
+			// Includes the path prefix, if any
+			key := strings.TrimPrefix(r.URL.Path, "/tunnels/")
 
-			if len(parts) != 3 {
+			if key == "" {
 				w.WriteHeader(400)
 				h.alertDialog(w, r, "Invalid path", "/tunnels")
 				return
 			}
 
-			domain := parts[2]
-
-			r.Form.Set("domain", domain)
+			r.Form.Set("domain", key)
 
 			tunnel, err := h.api.GetTunnel(tokenData, r.Form)
 			if err != nil {
@@ -308,11 +371,15 @@ func (h *WebUiHandler) handleWebUiRequest(w http.ResponseWriter, r *http.Request
 				return
 			}
 
+			owner, _ := h.db.GetUser(tunnel.Owner)
+
 			templateData := struct {
 				User   User
+				Owner  User
 				Tunnel Tunnel
 			}{
 				User:   user,
+				Owner:  owner,
 				Tunnel: tunnel,
 			}
 
@@ -532,6 +599,20 @@ func (h *WebUiHandler) handleTunnels(w http.ResponseWriter, r *http.Request, tok
 	}
 }
 
+// nonEmptyParams returns params without the empty fields the web UI sends
+// for inputs left blank, so they don't override tunnel defaults.
+func nonEmptyParams(params url.Values) url.Values {
+	out := url.Values{}
+	for name, values := range params {
+		for _, value := range values {
+			if value != "" {
+				out.Add(name, value)
+			}
+		}
+	}
+	return out
+}
+
 func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request, tokenData TokenData) {
 
 	pendingId, err := genRandomCode(16)
@@ -549,7 +630,17 @@ func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request
 
 		r.ParseForm()
 
-		_, err := h.api.CreateTunnel(tokenData, r.Form)
+		// This outlives the request, so it's only canceled on
+		// shutdown.
+		_, err := h.api.CreateTunnel(context.Background(), tokenData, nonEmptyParams(r.Form))
+
+		// The full certmagic error is logged by the tunnel manager
+		// and tends to be long and confusing, so only show a
+		// summary here.
+		var certErr *CertError
+		if errors.As(err, &certErr) {
+			err = fmt.Errorf("Failed to get a certificate for %s. See the server logs for details.", certErr.Domain)
+		}
 
 		doneSignal <- ReqResult{err, "/tunnels"}
 	}()
@@ -578,7 +669,7 @@ func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request
 
 	case result := <-doneSignal:
 		if result.err != nil {
-			w.WriteHeader(400)
+			w.WriteHeader(createErrorStatus(result.err))
 			h.alertDialog(w, r, result.err.Error(), result.redirectUrl)
 			return
 		}
@@ -587,6 +678,15 @@ func (h *WebUiHandler) handleCreateTunnel(w http.ResponseWriter, r *http.Request
 	}
 }
 
+// createErrorStatus returns the status for a failed tunnel creation. Rate
+// limiting gets its own, so scripts driving the UI know to back off.
+func createErrorStatus(err error) int {
+	if errors.Is(err, ErrRateLimited) {
+		return 429
+	}
+	return 400
+}
+
 func (h *WebUiHandler) sendLoginPage(w http.ResponseWriter, r *http.Request, code int) {
 
 	loginData := LoginData{
@@ -796,7 +896,7 @@ func (h *WebUiHandler) handleLoading(w http.ResponseWriter, r *http.Request) {
 	result := <-doneSignal
 
 	if result.err != nil {
-		w.WriteHeader(400)
+		w.WriteHeader(createErrorStatus(result.err))
 		h.alertDialog(w, r, result.err.Error(), result.redirectUrl)
 		return
 	}
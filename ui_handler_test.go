@@ -0,0 +1,174 @@
+package boringproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestPinTunnelWithPathPrefix(t *testing.T) {
+	api := newTestApi(t)
+	h := NewWebUiHandler(api.config, api.db, api, nil)
+
+	token, err := api.db.AddToken("admin", "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.db.SetTunnel("example.com/app", Tunnel{Domain: "example.com", PathPrefix: "/app", Owner: "admin"})
+
+	form := url.Values{}
+	form.Set("domain", "example.com")
+	form.Set("path-prefix", "/app")
+	form.Set("pinned", "true")
+
+	// Pinning changes state, so links (GETs) mustn't do it
+	req := httptest.NewRequest("GET", "/pin-tunnel?"+form.Encode(), nil)
+	req.Header.Set("access_token", token)
+	rec := httptest.NewRecorder()
+	h.handleWebUiRequest(rec, req)
+
+	if rec.Code != 405 {
+		t.Errorf("Expected GET to be rejected, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest("POST", "/pin-tunnel", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("access_token", token)
+	rec = httptest.NewRecorder()
+	h.handleWebUiRequest(rec, req)
+
+	if rec.Code != http.StatusSeeOther {
+		t.Fatalf("Expected redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get("Location") != "/tunnels/example.com/app" {
+		t.Errorf("Unexpected redirect to %s", rec.Header().Get("Location"))
+	}
+
+	tun, _ := api.db.GetTunnel("example.com/app")
+	if !tun.Pinned {
+		t.Error("Tunnel wasn't pinned")
+	}
+}
+
+var loadingUrl = regexp.MustCompile(`/loading\?id=[^']+`)
+
+func TestCreateTunnelRateLimit(t *testing.T) {
+	api := newTestApi(t)
+	api.tunMan.createLimiter = newRateLimiter(0.001, 1)
+	h := NewWebUiHandler(api.config, api.db, api, nil)
+
+	token, err := api.db.AddToken("admin", "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = os.MkdirAll(filepath.Join(api.tunMan.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.db.SetTunnel("taken.example.com", Tunnel{Domain: "taken.example.com", Owner: "admin", TunnelPort: 20050})
+
+	create := func(domain string) int {
+		form := url.Values{}
+		form.Set("domain", domain)
+		form.Set("owner", "admin")
+		form.Set("tls-termination", "client")
+
+		req := httptest.NewRequest("POST", "/tunnels", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("access_token", token)
+		rec := httptest.NewRecorder()
+		h.handleWebUiRequest(rec, req)
+
+		// Slow creations are finished on the loading page
+		loading := loadingUrl.FindString(rec.Body.String())
+		if rec.Code == 200 && loading != "" {
+			req = httptest.NewRequest("GET", loading, nil)
+			req.Header.Set("access_token", token)
+			rec = httptest.NewRecorder()
+			h.handleWebUiRequest(rec, req)
+		}
+
+		return rec.Code
+	}
+
+	// Rejected requests don't use up the owner's token
+	if code := create("taken.example.com"); code != 400 {
+		t.Fatalf("Expected a conflict to be rejected, got %d", code)
+	}
+
+	if code := create("first.example.com"); code != http.StatusSeeOther {
+		t.Fatalf("Expected the first tunnel to be created, got %d", code)
+	}
+
+	if code := create("second.example.com"); code != http.StatusTooManyRequests {
+		t.Errorf("Expected 429, got %d", code)
+	}
+}
+
+func TestTunnelDescriptionRoundTrip(t *testing.T) {
+	api := newTestApi(t)
+	h := NewWebUiHandler(api.config, api.db, api, nil)
+
+	token, err := api.db.AddToken("admin", "", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api.db.SetTunnel("app.example.com", Tunnel{Domain: "app.example.com", Owner: "admin", TunnelPort: 20050})
+
+	description := `Staging <script>alert("hi")</script>`
+
+	req := httptest.NewRequest("PATCH", "/app.example.com", strings.NewReader(url.Values{"description": {description}}.Encode()))
+	// The API mux strips the prefix before handleTunnel sees the path.
+	req.URL.Path = "app.example.com"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("access_token", token)
+	rec := httptest.NewRecorder()
+	api.handleTunnel(rec, req)
+
+	if rec.Code != 200 {
+		t.Fatalf("Expected the description to be updated, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	tun, _ := api.db.GetTunnel("app.example.com")
+	if tun.Description != description {
+		t.Errorf("Description wasn't stored, got %q", tun.Description)
+	}
+
+	tooLong := url.Values{"description": {strings.Repeat("a", maxDescriptionLength+1)}}
+	req = httptest.NewRequest("PATCH", "/app.example.com", strings.NewReader(tooLong.Encode()))
+	req.URL.Path = "app.example.com"
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("access_token", token)
+	rec = httptest.NewRecorder()
+	api.handleTunnel(rec, req)
+
+	if rec.Code != 400 {
+		t.Errorf("Expected an over-long description to be rejected, got %d", rec.Code)
+	}
+
+	listed := api.GetTunnels(TokenData{Owner: "admin"})
+	if listed["app.example.com"].Description != description {
+		t.Errorf("Description isn't returned by the API")
+	}
+
+	for _, path := range []string{"/tunnels", "/tunnels/app.example.com"} {
+		req = httptest.NewRequest("GET", path, nil)
+		req.Header.Set("access_token", token)
+		rec = httptest.NewRecorder()
+		h.handleWebUiRequest(rec, req)
+
+		body := rec.Body.String()
+		if strings.Contains(body, "<script>alert") || !strings.Contains(body, "&lt;script&gt;") {
+			t.Errorf("%s: expected the description to be escaped", path)
+		}
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"math/big"
 	"net"
 	"net/http"
-	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func saveJson(data interface{}, filePath string) error {
@@ -25,6 +27,13 @@ func saveJson(data interface{}, filePath string) error {
 	return nil
 }
 
+// requestIsTls reports whether r was made over TLS. X-Forwarded-Proto is set
+// by clients as easily as by proxies, so it's only trusted when running
+// behind another reverse proxy.
+func requestIsTls(r *http.Request, behindProxy bool) bool {
+	return r.TLS != nil || (behindProxy && r.Header.Get("X-Forwarded-Proto") == "https")
+}
+
 // Looks for auth token in query string, then headers, then cookies
 func extractToken(tokenName string, r *http.Request) (string, error) {
 
@@ -68,21 +77,104 @@ func genRandomCode(length int) (string, error) {
 	return id, nil
 }
 
-func randomOpenPort() (int, error) {
-	listener, err := net.Listen("tcp", "127.0.0.1:0")
-	if err != nil {
-		return 0, err
+// Bounds on retrying randomOpenPort. The delay doubles after each attempt.
+const openPortRetryDelay = 50 * time.Millisecond
+const openPortTimeout = 2 * time.Second
+
+// randomOpenPort returns a free port on host, which can be an IPv4 or IPv6
+// address. An empty host checks all interfaces.
+func randomOpenPort(host string) (int, error) {
+	return openPortWith(net.Listen, host, openPortRetryDelay, openPortTimeout)
+}
+
+// openPortWith finds a free port by binding port 0 on host with listen.
+// Running out of ports or file descriptors is often momentary on a busy
+// host, so those errors are retried until timeout has passed. Other errors
+// are returned immediately.
+func openPortWith(listen func(network, address string) (net.Listener, error), host string, delay, timeout time.Duration) (int, error) {
+	deadline := time.Now().Add(timeout)
+
+	for {
+		listener, err := listen("tcp", net.JoinHostPort(host, "0"))
+		if err == nil {
+			port := listener.Addr().(*net.TCPAddr).Port
+			listener.Close()
+			return port, nil
+		}
+
+		if !isTransientListenError(err) {
+			return 0, err
+		}
+
+		if time.Now().Add(delay).After(deadline) {
+			return 0, fmt.Errorf("No open port after %s: %w", timeout, err)
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+func isTransientListenError(err error) bool {
+	for _, errno := range []syscall.Errno{syscall.EADDRINUSE, syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// tunnelBindAddr returns the address the tunnel's port is bound to on the
+// server.
+func tunnelBindAddr(tunnel Tunnel) string {
+	loopbackIp := tunnelLoopbackIp(tunnel)
+
+	if !tunnel.AllowExternalTcp {
+		return loopbackIp
+	}
+
+	if tunnel.ListenIp != "" {
+		return tunnel.ListenIp
+	}
+
+	// On IPv6 hosts, bind all interfaces for both stacks
+	if net.ParseIP(loopbackIp).To4() == nil {
+		return "::"
 	}
 
-	addrParts := strings.Split(listener.Addr().String(), ":")
-	port, err := strconv.Atoi(addrParts[len(addrParts)-1])
+	return "0.0.0.0"
+}
+
+// tunnelLoopbackIp returns the loopback IP for reaching the tunnel's port on
+// the server.
+func tunnelLoopbackIp(tunnel Tunnel) string {
+	if tunnel.LoopbackIp == "" {
+		return "127.0.0.1"
+	}
+	return tunnel.LoopbackIp
+}
+
+// checkLocalIp returns an error if ip isn't assigned to any of this host's
+// interfaces.
+func checkLocalIp(ip string) error {
+	parsedIp := net.ParseIP(ip)
+	if parsedIp == nil {
+		return fmt.Errorf("Invalid IP address %s", ip)
+	}
+
+	addrs, err := net.InterfaceAddrs()
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	listener.Close()
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.Equal(parsedIp) {
+			return nil
+		}
+	}
 
-	return port, nil
+	return fmt.Errorf("IP address %s isn't assigned to any interface on this host", ip)
 }
 
 func stringInArray(value string, array []string) bool {
@@ -93,3 +185,44 @@ func stringInArray(value string, array []string) bool {
 	}
 	return false
 }
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+var acmeChallengeTypes = []string{"http-01", "tls-alpn-01"}
+
+// parseAcmeChallenges parses a comma separated list of ACME challenge types,
+// making sure at least one is enabled.
+func parseAcmeChallenges(value string) ([]string, error) {
+	challenges := []string{}
+
+	for _, challenge := range strings.Split(value, ",") {
+		challenge = strings.TrimSpace(challenge)
+		if challenge == "" {
+			continue
+		}
+
+		if !stringInArray(challenge, acmeChallengeTypes) {
+			return nil, fmt.Errorf("Unsupported ACME challenge type %s. Must be one of %s", challenge, strings.Join(acmeChallengeTypes, ", "))
+		}
+
+		if !stringInArray(challenge, challenges) {
+			challenges = append(challenges, challenge)
+		}
+	}
+
+	if len(challenges) == 0 {
+		return nil, errors.New("At least one ACME challenge type must be enabled")
+	}
+
+	return challenges, nil
+}
@@ -0,0 +1,153 @@
+package boringproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// skipWithoutIpv6 skips the test on hosts without IPv6 loopback.
+func skipWithoutIpv6(t *testing.T) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("No IPv6 loopback: %v", err)
+	}
+	listener.Close()
+}
+
+func TestAllocatePortOnIpv6Loopback(t *testing.T) {
+	skipWithoutIpv6(t)
+
+	port, err := randomOpenPort("::1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatalf("Allocated port %d can't be bound on ::1: %v", port, err)
+	}
+	listener.Close()
+}
+
+// failingListen fails with errs in turn, then listens on loopback.
+func failingListen(calls *int, errs ...error) func(network, address string) (net.Listener, error) {
+	return func(network, address string) (net.Listener, error) {
+		*calls++
+		if *calls <= len(errs) {
+			return nil, &net.OpError{Op: "listen", Net: network, Err: errs[*calls-1]}
+		}
+		return net.Listen(network, "127.0.0.1:0")
+	}
+}
+
+func TestOpenPortRetries(t *testing.T) {
+	calls := 0
+	port, err := openPortWith(failingListen(&calls, syscall.EMFILE), "", time.Millisecond, time.Second)
+	if err != nil {
+		t.Fatalf("Expected a port after one transient failure: %v", err)
+	}
+	if port == 0 || calls != 2 {
+		t.Errorf("Expected a port on the second attempt, got %d after %d", port, calls)
+	}
+
+	// Still failing once the time is up
+	calls = 0
+	errs := make([]error, 100)
+	for i := range errs {
+		errs[i] = syscall.EADDRINUSE
+	}
+	_, err = openPortWith(failingListen(&calls, errs...), "", time.Millisecond, 20*time.Millisecond)
+	if !errors.Is(err, syscall.EADDRINUSE) {
+		t.Errorf("Expected the last error once out of time, got %v", err)
+	}
+	if calls < 2 || calls == len(errs)+1 {
+		t.Errorf("Expected a bounded number of retries, got %d", calls)
+	}
+
+	// Other errors aren't retried
+	calls = 0
+	_, err = openPortWith(failingListen(&calls, syscall.EACCES), "", time.Millisecond, time.Second)
+	if !errors.Is(err, syscall.EACCES) || calls != 1 {
+		t.Errorf("Expected EACCES without retrying, got %v after %d attempts", err, calls)
+	}
+}
+
+func TestIpv6LoopbackAddresses(t *testing.T) {
+	tunnel := Tunnel{Domain: "app.example.com", TunnelPort: 20001, LoopbackIp: "::1"}
+
+	if addr := backendAddr(tunnel); addr != "[::1]:20001" {
+		t.Errorf("Unexpected backend address %s", addr)
+	}
+
+	if addr := tunnelBindAddr(tunnel); addr != "::1" {
+		t.Errorf("Unexpected bind address %s", addr)
+	}
+
+	tunnel.AllowExternalTcp = true
+	if addr := tunnelBindAddr(tunnel); addr != "::" {
+		t.Errorf("External TCP tunnel should listen on both stacks, got %s", addr)
+	}
+
+	if addr := backendAddr(Tunnel{TunnelPort: 20001}); addr != "127.0.0.1:20001" {
+		t.Errorf("Tunnels without a loopback IP should use IPv4, got %s", addr)
+	}
+}
+
+func TestProxyToIpv6Loopback(t *testing.T) {
+	skipWithoutIpv6(t)
+
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	}))
+	backend.Listener = listener
+	backend.Start()
+	defer backend.Close()
+
+	m := newTestTunnelManager(t)
+	tunnel := Tunnel{Domain: "app.example.com", TunnelPort: listener.Addr().(*net.TCPAddr).Port, LoopbackIp: "::1"}
+
+	req := httptest.NewRequest("GET", "http://app.example.com/", nil)
+	rec := httptest.NewRecorder()
+	proxyRequest(rec, req, tunnel, m.BackendClient(tunnel), tunnelLoopbackIp(tunnel), tunnel.TunnelPort, false, nil)
+
+	if rec.Code != 200 || rec.Body.String() != "ok" {
+		t.Errorf("Proxying to [::1] failed: %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestForwardedProtoOnlyTrustedBehindProxy(t *testing.T) {
+	api := newTestApi(t)
+
+	// Without a code, the request fails after the TLS check
+	enroll := func() string {
+		req := httptest.NewRequest("POST", "/enroll", nil)
+		req.Header.Set("X-Forwarded-Proto", "https")
+		rec := httptest.NewRecorder()
+		api.handleEnroll(rec, req)
+		return rec.Body.String()
+	}
+
+	if body := enroll(); !strings.Contains(body, "over TLS") {
+		t.Errorf("Expected a spoofed X-Forwarded-Proto to be refused, got %q", body)
+	}
+
+	api.config.BehindProxy = true
+
+	if body := enroll(); body != "Invalid code parameter" {
+		t.Errorf("Expected X-Forwarded-Proto to be trusted behind a proxy, got %q", body)
+	}
+}
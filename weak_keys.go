@@ -0,0 +1,125 @@
+package boringproxy
+
+import (
+	"context"
+	"crypto/rsa"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Delay between rotations by rotateWeakKeys, so the affected clients don't
+// all reconnect at once.
+const weakKeyRotateInterval = 10 * time.Second
+
+// rsaKeyBits returns the size of privKey if it's an RSA key, or 0 for other
+// key types.
+func rsaKeyBits(privKey string) (int, error) {
+	key, err := ssh.ParseRawPrivateKey([]byte(privKey))
+	if err != nil {
+		return 0, err
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return 0, nil
+	}
+
+	return rsaKey.N.BitLen(), nil
+}
+
+// isWeakKey reports whether privKey is an RSA key smaller than minRsaBits.
+func isWeakKey(privKey string) bool {
+	bits, err := rsaKeyBits(privKey)
+	return err == nil && bits != 0 && bits < minRsaBits
+}
+
+// weakKeyTunnels returns the keys of tunnels with weak private keys, sorted.
+func (m *TunnelManager) weakKeyTunnels() []string {
+	weak := []string{}
+
+	for key, tun := range m.db.GetTunnels() {
+		privKey, err := m.privateKey(tun)
+		if err == nil && privKey != "" && isWeakKey(privKey) {
+			weak = append(weak, key)
+		}
+	}
+
+	sort.Strings(weak)
+
+	return weak
+}
+
+// rotateWeakKeys calls RotateTunnelKey for each of keys that isn't pinned,
+// waiting interval between them, until done or ctx is canceled.
+func (m *TunnelManager) rotateWeakKeys(ctx context.Context, keys []string, interval time.Duration) {
+	for i, key := range keys {
+		if tun, exists := m.db.GetTunnel(key); exists && tun.Pinned {
+			log.Printf("Not rotating weak key for pinned tunnel %s", key)
+			continue
+		}
+
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(interval):
+			}
+		}
+
+		_, err := m.RotateTunnelKey(key)
+		if err != nil {
+			log.Printf("Failed to rotate weak key for %s: %v", key, err)
+			continue
+		}
+
+		log.Printf("Rotated weak key for %s (%d of %d)", key, i+1, len(keys))
+	}
+}
+
+// RotateTunnelKey replaces the private key of the tunnel stored under key,
+// using the configured key type. The old key stops working immediately, and
+// the client picks up the new one from the API on its next poll.
+func (m *TunnelManager) RotateTunnelKey(key string) (Tunnel, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	tun, exists := m.db.GetTunnel(key)
+	if !exists {
+		return Tunnel{}, fmt.Errorf("%w: %s", ErrTunnelNotFound, key)
+	}
+
+	if tun.RedirectTo != "" {
+		return Tunnel{}, errors.New("Redirect tunnels don't have keys")
+	}
+
+	err := m.removeFromAuthorizedKeys(tun.Username, tun.Domain, tun.TunnelPort)
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	privKey, err := m.addToAuthorizedKeys(tun.Username, tun.Domain, tun.TunnelPort, tunnelBindAddr(tun))
+	if err != nil {
+		return Tunnel{}, err
+	}
+
+	err = m.setPrivateKey(&tun, privKey)
+	if err != nil {
+		return Tunnel{}, err
+	}
+	tun.Recovered = false
+
+	m.db.SetTunnel(key, tun)
+
+	if m.sshServer != nil {
+		m.sshServer.Disconnect(key)
+	}
+
+	tun.TunnelPrivateKey = privKey
+
+	return tun, nil
+}
@@ -0,0 +1,94 @@
+package boringproxy
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWeakKeysAreDetectedAndRotated(t *testing.T) {
+	m := newTestTunnelManager(t)
+
+	err := os.MkdirAll(filepath.Join(m.user.HomeDir, ".ssh"), 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// As created by older versions
+	m.config.RsaBits = 1024
+
+	keys := []string{}
+	for _, domain := range []string{"weak.example.com", "pinned.example.com"} {
+		tun, err := m.RequestCreateTunnel(context.Background(), Tunnel{Domain: domain, Owner: "admin", TlsTermination: "client"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isWeakKey(tun.TunnelPrivateKey) {
+			t.Fatal("Expected a 1024 bit key to be weak")
+		}
+		keys = append(keys, tunnelKey(tun))
+	}
+
+	err = m.SetPinned("pinned.example.com", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.config.RsaBits = 3072
+
+	_, err = m.RequestCreateTunnel(context.Background(), Tunnel{Domain: "strong.example.com", Owner: "admin", TlsTermination: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config.KeyType = "ed25519"
+	_, err = m.RequestCreateTunnel(context.Background(), Tunnel{Domain: "ed.example.com", Owner: "admin", TlsTermination: "client"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.config.KeyType = "rsa"
+
+	weak := m.weakKeyTunnels()
+	if strings.Join(weak, ",") != "pinned.example.com,weak.example.com" {
+		t.Fatalf("Expected the two 1024 bit keys to be detected, got %v", weak)
+	}
+
+	oldTun, _ := m.db.GetTunnel("weak.example.com")
+	oldPubKey, err := publicKeyFromPrivate(m.withPrivateKey(oldTun).TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m.rotateWeakKeys(context.Background(), weak, 0)
+
+	tun, _ := m.GetTunnelDetails("weak.example.com")
+	bits, err := rsaKeyBits(tun.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bits != 3072 {
+		t.Errorf("Expected the key to be rotated to the configured 3072 bits, got %d", bits)
+	}
+
+	newPubKey, err := publicKeyFromPrivate(tun.TunnelPrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(m.user.HomeDir, ".ssh", "authorized_keys"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorizedKeys := string(data)
+	if !strings.Contains(authorizedKeys, strings.TrimSpace(newPubKey)) || strings.Contains(authorizedKeys, strings.TrimSpace(oldPubKey)) {
+		t.Error("Expected authorized_keys to have the new key in place of the old one")
+	}
+
+	// Pinned tunnels are left for their owner to rotate
+	weak = m.weakKeyTunnels()
+	if strings.Join(weak, ",") != "pinned.example.com" {
+		t.Errorf("Expected only the pinned tunnel's key to still be weak, got %v", weak)
+	}
+}
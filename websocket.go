@@ -0,0 +1,78 @@
+package boringproxy
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// isUpgradeRequest reports whether r asks to switch protocols, ie to a
+// WebSocket.
+func isUpgradeRequest(r *http.Request) bool {
+	if r.ProtoMajor != 1 || r.Header.Get("Upgrade") == "" {
+		return false
+	}
+
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// proxyUpgrade finishes a protocol switch the backend accepted with res,
+// by taking over the client connection and copying raw bytes in both
+// directions until either side closes.
+func proxyUpgrade(w http.ResponseWriter, r *http.Request, tunnel Tunnel, res *http.Response) {
+	backendConn, ok := res.Body.(io.ReadWriteCloser)
+	if !ok {
+		log.Printf("Upgrade for %s failed: backend connection isn't writable", tunnel.Domain)
+		w.WriteHeader(502)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("Upgrade for %s failed: client connection can't be taken over", tunnel.Domain)
+		w.WriteHeader(502)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Upgrade for %s failed: %v", tunnel.Domain, err)
+		return
+	}
+	defer clientConn.Close()
+
+	// Everything the backend sent goes back, including the Connection and
+	// Upgrade headers.
+	fmt.Fprintf(clientBuf, "HTTP/1.1 %s\r\n", res.Status)
+	w.Header().Write(clientBuf)
+	clientBuf.WriteString("\r\n")
+	err = clientBuf.Flush()
+	if err != nil {
+		return
+	}
+
+	done := make(chan struct{}, 2)
+
+	go func() {
+		// Includes anything the client sent right after its request
+		io.Copy(backendConn, clientBuf.Reader)
+		done <- struct{}{}
+	}()
+
+	go func() {
+		io.Copy(clientConn, backendConn)
+		done <- struct{}{}
+	}()
+
+	<-done
+}
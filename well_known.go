@@ -0,0 +1,158 @@
+package boringproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/certmagic"
+)
+
+const (
+	acmeChallengePath = "/.well-known/acme-challenge/"
+	verifyPath        = "/.well-known/boringproxy-verify/"
+)
+
+// domainVerifications holds the pending HTTP verification token for each
+// domain. They're only kept in memory, since a verification is expected to
+// be checked within minutes of starting it.
+type domainVerifications struct {
+	tokens map[string]string
+	mutex  *sync.Mutex
+}
+
+func newDomainVerifications() *domainVerifications {
+	return &domainVerifications{
+		tokens: make(map[string]string),
+		mutex:  &sync.Mutex{},
+	}
+}
+
+// StartDomainVerification creates a token that will be served at
+// /.well-known/boringproxy-verify/<token> on port 80 for domain, replacing
+// any previous one. Fetching it through the domain shows that the domain
+// points at this server.
+func (m *TunnelManager) StartDomainVerification(domain string) (string, error) {
+	token, err := genRandomCode(32)
+	if err != nil {
+		return "", err
+	}
+
+	v := m.verifications
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	v.tokens[strings.ToLower(domain)] = token
+
+	return token, nil
+}
+
+// StopDomainVerification stops serving the token for domain.
+func (m *TunnelManager) StopDomainVerification(domain string) {
+	v := m.verifications
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	delete(v.tokens, strings.ToLower(domain))
+}
+
+// Used by VerifyDomain. Redirects aren't followed, so only a response from
+// whatever the domain points at counts.
+var domainVerificationClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// VerifyDomain checks that HTTP requests for domain reach this server, by
+// serving a new verification token and fetching it through the domain.
+func (m *TunnelManager) VerifyDomain(ctx context.Context, domain string) error {
+	token, err := m.StartDomainVerification(domain)
+	if err != nil {
+		return err
+	}
+	defer m.StopDomainVerification(domain)
+
+	url := fmt.Sprintf("http://%s%s%s", domain, verifyPath, token)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+
+	res, err := domainVerificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1024))
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != 200 || string(body) != token {
+		return errors.New("Verification token wasn't returned. Make sure the domain points at this server")
+	}
+
+	return nil
+}
+
+func (m *TunnelManager) verificationToken(domain string) (string, bool) {
+	v := m.verifications
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	token, exists := v.tokens[strings.ToLower(domain)]
+	return token, exists
+}
+
+// wellKnownHandler answers ACME HTTP-01 challenges and domain verification
+// requests on port 80 for any host, before next does any routing. Only
+// content we generated is served: challenges certmagic started, and
+// verification tokens, which are only returned for the host they were
+// created for. Unknown verification requests get a 404 rather than being
+// passed on, so nothing behind the server can answer for them. Unknown
+// ACME challenges are passed on as before, since a passthrough tunnel's
+// backend may be solving its own.
+func wellKnownHandler(acmeManager *certmagic.ACMEManager, tunMan *TunnelManager, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, acmeChallengePath) {
+			if acmeManager.HandleHTTPChallenge(w, r) {
+				return
+			}
+		} else if strings.HasPrefix(r.URL.Path, verifyPath) {
+			serveVerification(w, r, tunMan)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func serveVerification(w http.ResponseWriter, r *http.Request, tunMan *TunnelManager) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		w.WriteHeader(405)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+
+	token, exists := tunMan.verificationToken(host)
+	if !exists || strings.TrimPrefix(r.URL.Path, verifyPath) != token {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write([]byte(token))
+}
@@ -0,0 +1,124 @@
+package boringproxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/certmagic"
+)
+
+func newTestWellKnownHandler(t *testing.T) (*TunnelManager, http.Handler) {
+	t.Helper()
+
+	m := newTestTunnelManager(t)
+	acmeManager := certmagic.NewACMEManager(certmagic.NewDefault(), certmagic.ACMEManager{})
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "routed")
+	})
+
+	return m, wellKnownHandler(acmeManager, m, next)
+}
+
+func getWellKnown(handler http.Handler, host, path string) (int, string) {
+	req := httptest.NewRequest("GET", "http://"+host+path, nil)
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	body, _ := io.ReadAll(rec.Body)
+	return rec.Code, string(body)
+}
+
+func TestWellKnownVerificationIsServedOnlyForItsDomain(t *testing.T) {
+	m, handler := newTestWellKnownHandler(t)
+
+	token, err := m.StartDomainVerification("App.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, body := getWellKnown(handler, "app.example.com", verifyPath+token)
+	if code != 200 || body != token {
+		t.Errorf("Token wasn't served: %d %q", code, body)
+	}
+
+	code, body = getWellKnown(handler, "app.example.com:80", verifyPath+token)
+	if code != 200 || body != token {
+		t.Errorf("Token wasn't served with a port in the host: %d %q", code, body)
+	}
+
+	// Unknown tokens and other hosts get a 404 rather than being routed
+	for _, c := range []struct{ host, path string }{
+		{"app.example.com", verifyPath + "other"},
+		{"other.example.com", verifyPath + token},
+		{"app.example.com", verifyPath},
+	} {
+		code, body = getWellKnown(handler, c.host, c.path)
+		if code != 404 || body == "routed" {
+			t.Errorf("%s%s: expected 404, got %d %q", c.host, c.path, code, body)
+		}
+	}
+
+	m.StopDomainVerification("app.example.com")
+
+	if code, _ := getWellKnown(handler, "app.example.com", verifyPath+token); code != 404 {
+		t.Errorf("Token still served after stopping, got %d", code)
+	}
+}
+
+func TestWellKnownOtherPathsFallThrough(t *testing.T) {
+	_, handler := newTestWellKnownHandler(t)
+
+	for _, path := range []string{"/", "/index.html", "/.well-known/security.txt", acmeChallengePath + "unknown"} {
+		code, body := getWellKnown(handler, "app.example.com", path)
+		if code != 200 || body != "routed" {
+			t.Errorf("%s wasn't passed on for routing: %d %q", path, code, body)
+		}
+	}
+}
+
+func TestVerifyDomain(t *testing.T) {
+	m, handler := newTestWellKnownHandler(t)
+
+	server := httptest.NewServer(handler)
+	defer server.Close()
+
+	// Send requests for any domain to the test server, as DNS pointing at
+	// this server would
+	transport := &http.Transport{
+		DisableKeepAlives: true,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("tcp", server.Listener.Addr().String())
+		},
+	}
+	origClient := domainVerificationClient
+	domainVerificationClient = &http.Client{Transport: transport, CheckRedirect: origClient.CheckRedirect}
+	defer func() { domainVerificationClient = origClient }()
+
+	err := m.VerifyDomain(context.Background(), "app.example.com")
+	if err != nil {
+		t.Errorf("Verification failed: %v", err)
+	}
+
+	if _, exists := m.verificationToken("app.example.com"); exists {
+		t.Error("Token still served after verifying")
+	}
+
+	// Something else answering for the domain
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	defer other.Close()
+
+	transport.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial("tcp", other.Listener.Addr().String())
+	}
+
+	err = m.VerifyDomain(context.Background(), "app.example.com")
+	if err == nil {
+		t.Error("Verification passed for a domain pointing elsewhere")
+	}
+}